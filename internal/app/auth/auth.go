@@ -0,0 +1,262 @@
+// Package auth authenticates API clients by API keys or JWT bearer tokens and
+// describes the roles they are granted.
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+)
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Role grants access to a set of routes. Every role includes the permissions of
+// the roles below it: reader < analyst < admin.
+type Role string
+
+const (
+	// RoleReader evaluates segments and reads user data.
+	RoleReader Role = "reader"
+	// RoleAnalyst also manages memberships, attributes and overrides and builds reports.
+	RoleAnalyst Role = "analyst"
+	// RoleAdmin also manages segments and API keys.
+	RoleAdmin Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleReader:  1,
+	RoleAnalyst: 2,
+	RoleAdmin:   3,
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// Allows reports whether r grants the permissions of required.
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[required]
+}
+
+// Principal is the authenticated client of a request. An empty Namespace grants
+// access to all namespaces.
+type Principal struct {
+	Subject   string
+	Role      Role
+	Namespace string
+}
+
+// CanAccess reports whether the principal may work in the namespace.
+func (p *Principal) CanAccess(namespace string) bool {
+	return p.Namespace == "" || p.Namespace == namespace
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal of the request or nil if it isn't authenticated.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// KeyPrefix tells API keys apart from JWTs in the Authorization header.
+const KeyPrefix = "sk_"
+
+// keyDisplayLength is the number of leading key characters stored in plain text
+// so administrators can tell keys apart.
+const keyDisplayLength = 8
+
+// GenerateKey returns a new random API key and the prefix of it that is safe to display.
+func GenerateKey() (key, prefix string, err error) {
+	buf := make([]byte, 32) //nolint:gomnd
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+
+	key = KeyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	return key, key[:keyDisplayLength], nil
+}
+
+// HashKey returns the hash under which an API key is stored.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyStore looks up a not revoked API key.
+type KeyStore interface {
+	AuthenticateAPIKey(ctx context.Context, key string) (*api.APIKey, error)
+}
+
+type Authenticator struct {
+	keys          KeyStore
+	bootstrapHash string
+	jwtKeys       []crypto.PublicKey
+	jwtParser     *jwt.Parser
+}
+
+type Option func(*Authenticator)
+
+// WithBootstrapKey accepts key as an admin key, so the first keys can be issued
+// before any are stored.
+func WithBootstrapKey(key string) Option {
+	return func(a *Authenticator) {
+		if key != "" {
+			a.bootstrapHash = HashKey(key)
+		}
+	}
+}
+
+// WithJWT accepts bearer tokens signed by one of keys. The subject is taken from
+// the sub claim, the role from the role claim and the namespace from the optional
+// namespace claim. Empty issuer or audience aren't checked.
+func WithJWT(keys []crypto.PublicKey, issuer, audience string) Option {
+	return func(a *Authenticator) {
+		opts := []jwt.ParserOption{
+			jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}),
+			jwt.WithExpirationRequired(),
+		}
+		if issuer != "" {
+			opts = append(opts, jwt.WithIssuer(issuer))
+		}
+		if audience != "" {
+			opts = append(opts, jwt.WithAudience(audience))
+		}
+
+		a.jwtKeys = keys
+		a.jwtParser = jwt.NewParser(opts...)
+	}
+}
+
+func New(keys KeyStore, opts ...Option) *Authenticator {
+	a := &Authenticator{keys: keys}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	return a
+}
+
+// Authenticate reads credentials from the X-API-Key header or the Authorization
+// bearer token, which holds either an API key or a JWT.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := r.Header.Get("X-API-Key")
+	if token == "" {
+		scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(credentials)
+		}
+	}
+
+	return a.AuthenticateToken(r.Context(), token)
+}
+
+// AuthenticateToken authenticates an API key or a JWT taken from elsewhere than
+// HTTP headers, e.g. gRPC metadata.
+func (a *Authenticator) AuthenticateToken(ctx context.Context, token string) (*Principal, error) {
+	switch {
+	case token == "":
+		return nil, ErrMissingCredentials
+	case strings.HasPrefix(token, KeyPrefix):
+		return a.authenticateKey(ctx, token)
+	case a.jwtParser != nil:
+		return a.authenticateJWT(token)
+	default:
+		return nil, ErrInvalidCredentials
+	}
+}
+
+func (a *Authenticator) authenticateKey(ctx context.Context, key string) (*Principal, error) {
+	if a.bootstrapHash != "" && subtle.ConstantTimeCompare([]byte(HashKey(key)), []byte(a.bootstrapHash)) == 1 {
+		return &Principal{Subject: "bootstrap", Role: RoleAdmin}, nil
+	}
+
+	apiKey, err := a.keys.AuthenticateAPIKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{Subject: "key:" + apiKey.Name, Role: Role(apiKey.Role), Namespace: apiKey.Namespace}, nil
+}
+
+type claims struct {
+	Role      string `json:"role"`
+	Namespace string `json:"namespace"`
+	jwt.RegisteredClaims
+}
+
+func (a *Authenticator) authenticateJWT(token string) (*Principal, error) {
+	var c claims
+	_, err := a.jwtParser.ParseWithClaims(token, &c, func(*jwt.Token) (any, error) {
+		keys := make([]jwt.VerificationKey, 0, len(a.jwtKeys))
+		for _, key := range a.jwtKeys {
+			keys = append(keys, key)
+		}
+		return jwt.VerificationKeySet{Keys: keys}, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	role := Role(c.Role)
+	if c.Subject == "" || !role.Valid() {
+		return nil, fmt.Errorf("%w: token has no subject or valid role", ErrInvalidCredentials)
+	}
+
+	return &Principal{Subject: c.Subject, Role: role, Namespace: c.Namespace}, nil
+}
+
+// LoadPublicKeys reads PEM encoded PKIX public keys from files.
+func LoadPublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys found")
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,142 @@
+package auth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/auth"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type keyStore map[string]*api.APIKey
+
+func (s keyStore) AuthenticateAPIKey(_ context.Context, key string) (*api.APIKey, error) {
+	if k, ok := s[key]; ok {
+		return k, nil
+	}
+
+	return nil, auth.ErrInvalidCredentials
+}
+
+func request(header, value string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/list", nil)
+	if header != "" {
+		r.Header.Set(header, value)
+	}
+
+	return r
+}
+
+func TestRoles(t *testing.T) {
+	assert.True(t, auth.RoleAdmin.Allows(auth.RoleAnalyst))
+	assert.True(t, auth.RoleAnalyst.Allows(auth.RoleReader))
+	assert.True(t, auth.RoleReader.Allows(auth.RoleReader))
+	assert.False(t, auth.RoleReader.Allows(auth.RoleAnalyst))
+	assert.False(t, auth.RoleAnalyst.Allows(auth.RoleAdmin))
+	assert.False(t, auth.Role("root").Allows(auth.RoleReader))
+}
+
+func TestNamespaceAccess(t *testing.T) {
+	assert.True(t, (&auth.Principal{}).CanAccess("team-a"))
+	assert.True(t, (&auth.Principal{Namespace: "team-a"}).CanAccess("team-a"))
+	assert.False(t, (&auth.Principal{Namespace: "team-a"}).CanAccess("team-b"))
+}
+
+func TestAPIKeys(t *testing.T) {
+	key, prefix, err := auth.GenerateKey()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, prefix))
+	assert.NotEqual(t, key, auth.HashKey(key))
+	assert.Equal(t, auth.HashKey(key), auth.HashKey(key))
+
+	authn := auth.New(keyStore{key: {Name: "ci", Role: "analyst", Namespace: "team-a"}}, auth.WithBootstrapKey("sk_bootstrap"))
+
+	t.Run("x-api-key header", func(t *testing.T) {
+		p, err := authn.Authenticate(request("X-API-Key", key))
+		require.NoError(t, err)
+		assert.Equal(t, &auth.Principal{Subject: "key:ci", Role: auth.RoleAnalyst, Namespace: "team-a"}, p)
+	})
+
+	t.Run("bearer key", func(t *testing.T) {
+		p, err := authn.Authenticate(request("Authorization", "Bearer "+key))
+		require.NoError(t, err)
+		assert.Equal(t, auth.RoleAnalyst, p.Role)
+	})
+
+	t.Run("bootstrap key", func(t *testing.T) {
+		p, err := authn.Authenticate(request("X-API-Key", "sk_bootstrap"))
+		require.NoError(t, err)
+		assert.Equal(t, auth.RoleAdmin, p.Role)
+	})
+
+	t.Run("rejects unknown and missing credentials", func(t *testing.T) {
+		_, err := authn.Authenticate(request("X-API-Key", "sk_unknown"))
+		assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+		_, err = authn.Authenticate(request("Authorization", "Bearer a.b.c"))
+		assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+		_, err = authn.Authenticate(request("", ""))
+		assert.ErrorIs(t, err, auth.ErrMissingCredentials)
+	})
+}
+
+func TestJWT(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(public)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	keys, err := auth.LoadPublicKeys([]string{path})
+	require.NoError(t, err)
+
+	authn := auth.New(keyStore{}, auth.WithJWT(keys, "issuer", ""))
+
+	sign := func(key crypto.Signer, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(key)
+		require.NoError(t, err)
+		return token
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	t.Run("accepts signed token", func(t *testing.T) {
+		token := sign(private, jwt.MapClaims{"sub": "analytics", "role": "reader", "iss": "issuer", "exp": exp})
+
+		p, err := authn.Authenticate(request("Authorization", "Bearer "+token))
+		require.NoError(t, err)
+		assert.Equal(t, &auth.Principal{Subject: "analytics", Role: auth.RoleReader}, p)
+	})
+
+	t.Run("rejects invalid tokens", func(t *testing.T) {
+		_, other, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		for name, token := range map[string]string{
+			"foreign key": sign(other, jwt.MapClaims{"sub": "a", "role": "reader", "iss": "issuer", "exp": exp}),
+			"expired":     sign(private, jwt.MapClaims{"sub": "a", "role": "reader", "iss": "issuer", "exp": time.Now().Add(-time.Hour).Unix()}),
+			"no expiry":   sign(private, jwt.MapClaims{"sub": "a", "role": "reader", "iss": "issuer"}),
+			"issuer":      sign(private, jwt.MapClaims{"sub": "a", "role": "reader", "iss": "other", "exp": exp}),
+			"role":        sign(private, jwt.MapClaims{"sub": "a", "role": "root", "iss": "issuer", "exp": exp}),
+		} {
+			_, err := authn.Authenticate(request("Authorization", "Bearer "+token))
+			assert.ErrorIs(t, err, auth.ErrInvalidCredentials, name)
+		}
+	})
+}
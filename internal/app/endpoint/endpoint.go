@@ -2,35 +2,93 @@ package endpoint
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"log/slog"
 	"net/http"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
-	"github.com/psxzz/backend-trainee-assignment/internal/app/model"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/auth"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/events"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/rule"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
 	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
 )
 
 type Service interface {
-	CreateSegment(context.Context, string) (*model.Segment, error)
-	DeleteSegment(context.Context, string) (*model.Segment, error)
-	AddUserExperiments(context.Context, int64, []*model.UserExperimentItem) ([]*model.UserExperiment, error)
-	RemoveUserExperiments(context.Context, int64, []string) ([]*model.UserExperiment, error)
-	ListUserSegments(context.Context, int64) (*model.UserExperimentList, error)
-	CreateLog(context.Context, int64, string) (*model.LogInfo, error)
+	CreateSegment(context.Context, string) (*api.Segment, error)
+	CreateSegmentWithSettings(context.Context, string, api.SegmentSettings) (*api.Segment, error)
+	UpdateSegment(context.Context, string, api.SegmentSettings, int64) (*api.Segment, error)
+	DeleteSegment(context.Context, string) (*api.Segment, error)
+	DeleteSegmentWithVersion(context.Context, string, int64) (*api.Segment, error)
+	SegmentInfo(context.Context, string) (*api.Segment, error)
+	AddUserExperiments(context.Context, int64, []*api.UserExperimentItem) ([]*api.UserExperiment, []*api.RejectedExperiment, error)
+	RemoveUserExperiments(context.Context, int64, []string) ([]*api.UserExperiment, error)
+	ListUserSegments(context.Context, int64) (*api.UserExperimentList, error)
+	ListUsersSegments(context.Context, []int64, func(*api.UserExperimentList) error) error
+	Snapshot(context.Context) (*api.Snapshot, error)
+	UsersSnapshot(context.Context, []int64) (*api.UserSnapshotList, error)
+	UserVersion(context.Context, int64) (int64, error)
+	CheckUserVersion(context.Context, int64, int64) error
+	HoldoutStatus(context.Context, int64) *api.HoldoutStatus
+	CreateLog(context.Context, int64, string) (*api.LogInfo, error)
+	SetUserAttributes(context.Context, int64, map[string]string) (*api.UserAttributes, error)
+	UserAttributes(context.Context, int64) (*api.UserAttributes, error)
+	SetOverride(context.Context, *api.Override) (*api.Override, error)
+	DeleteOverride(context.Context, int64, string, string) (*api.Override, error)
+	UserOverrides(context.Context, int64) (*api.UserOverrideList, error)
+	CreateAPIKey(context.Context, string, string) (*api.APIKey, error)
+	RevokeAPIKey(context.Context, int64) (*api.APIKey, error)
+	APIKeys(context.Context) (*api.APIKeyList, error)
+	Namespaces(context.Context) (*api.NamespaceList, error)
+	CreateWebhook(context.Context, string, []string, []string) (*api.Webhook, error)
+	DeleteWebhook(context.Context, int64) (*api.Webhook, error)
+	Webhooks(context.Context) (*api.WebhookList, error)
+	WebhookDeliveries(context.Context, string, int) (*api.WebhookDeliveryList, error)
+	ReplayWebhookDelivery(context.Context, int64) (*api.WebhookDelivery, error)
+	Events(context.Context, int64, service.EventFilter, int) ([]*api.Event, int64, error)
+	LastEventID(context.Context) (int64, error)
 }
 
 type Endpoint struct {
-	svc Service
+	svc    Service
+	events *events.Broker
+	logger *slog.Logger
 }
 
-func New(svc Service) *Endpoint {
-	return &Endpoint{
-		svc: svc,
+type Option func(*Endpoint)
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(e *Endpoint) {
+		e.logger = logger
+	}
+}
+
+// WithEvents wakes event streams with the broker. Without it streams only check for
+// changes on keep-alives.
+func WithEvents(b *events.Broker) Option {
+	return func(e *Endpoint) {
+		e.events = b
+	}
+}
+
+func New(svc Service, opts ...Option) *Endpoint {
+	e := &Endpoint{
+		svc:    svc,
+		logger: slog.Default(),
+	}
+
+	for _, opt := range opts {
+		opt(e)
 	}
+
+	return e
 }
 
 func (e *Endpoint) HandleCreate(ctx echo.Context) error {
-	var req segmentRequest
+	var req createSegmentRequest
 	if err := ctx.Bind(&req); err != nil {
 		return err
 	}
@@ -41,17 +99,22 @@ func (e *Endpoint) HandleCreate(ctx echo.Context) error {
 		})
 	}
 
-	segment, err := e.svc.CreateSegment(ctx.Request().Context(), req.Name)
+	segment, err := e.svc.CreateSegmentWithSettings(ctx.Request().Context(), req.Name, req.SegmentSettings)
 	if err != nil {
-		if errors.Is(err, storage.ErrSegmentExists) {
+		if errors.Is(err, storage.ErrSegmentExists) || errors.Is(err, storage.ErrSegmentNotFound) {
 			return ctx.JSON(http.StatusBadRequest, errorResponse{
 				Message: errors.Unwrap(err).Error(),
 			})
 		}
 
-		return ctx.JSON(http.StatusInternalServerError, errorResponse{
-			Message: "Internal error",
-		})
+		if errors.Is(err, rule.ErrSyntax) || errors.Is(err, service.ErrInvalidWindow) ||
+			errors.Is(err, service.ErrInvalidCapacity) {
+			return ctx.JSON(http.StatusBadRequest, errorResponse{
+				Message: err.Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
 	}
 
 	return ctx.JSON(http.StatusOK, segment)
@@ -60,9 +123,7 @@ func (e *Endpoint) HandleCreate(ctx echo.Context) error {
 func (e *Endpoint) HandleDelete(ctx echo.Context) error {
 	var req segmentRequest
 	if err := ctx.Bind(&req); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, errorResponse{
-			Message: "Internal error",
-		})
+		return e.internalError(ctx, err)
 	}
 
 	if err := ctx.Validate(req); err != nil {
@@ -79,20 +140,42 @@ func (e *Endpoint) HandleDelete(ctx echo.Context) error {
 			})
 		}
 
-		return ctx.JSON(http.StatusInternalServerError, errorResponse{
-			Message: "Internal error",
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, segment)
+}
+
+func (e *Endpoint) HandleSegmentInfo(ctx echo.Context) error {
+	var req segmentRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: field 'name' not found",
 		})
 	}
 
+	segment, err := e.svc.SegmentInfo(ctx.Request().Context(), req.Name)
+	if err != nil {
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			return ctx.JSON(http.StatusNotFound, errorResponse{
+				Message: errors.Unwrap(err).Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
 	return ctx.JSON(http.StatusOK, segment)
 }
 
 func (e *Endpoint) HandleExperiments(ctx echo.Context) error {
 	var req userExperimentRequest
 	if err := ctx.Bind(&req); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, errorResponse{
-			Message: "Internal error",
-		})
+		return e.internalError(ctx, err)
 	}
 
 	if err := ctx.Validate(req); err != nil {
@@ -101,33 +184,28 @@ func (e *Endpoint) HandleExperiments(ctx echo.Context) error {
 		})
 	}
 
-	added, err := e.svc.AddUserExperiments(ctx.Request().Context(), req.UserID, req.ToAdd)
+	added, rejected, err := e.svc.AddUserExperiments(ctx.Request().Context(), req.UserID, req.ToAdd)
 	if err != nil {
-		return ctx.JSON(http.StatusInternalServerError, errorResponse{
-			Message: "Internal error",
-		})
+		return e.internalError(ctx, err)
 	}
 
 	removed, err := e.svc.RemoveUserExperiments(ctx.Request().Context(), req.UserID, req.ToRemove)
 	if err != nil {
-		return ctx.JSON(http.StatusInternalServerError, errorResponse{
-			Message: "Internal error",
-		})
+		return e.internalError(ctx, err)
 	}
 
 	return ctx.JSON(http.StatusOK, userExperimentResponse{
-		UserID:  req.UserID,
-		Added:   added,
-		Removed: removed,
+		UserID:   req.UserID,
+		Added:    added,
+		Removed:  removed,
+		Rejected: rejected,
 	})
 }
 
 func (e *Endpoint) HandleUserExperimentList(ctx echo.Context) error {
 	var req experimentListRequest
 	if err := ctx.Bind(&req); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, errorResponse{
-			Message: "Internal error",
-		})
+		return e.internalError(ctx, err)
 	}
 
 	if err := ctx.Validate(req); err != nil {
@@ -138,20 +216,95 @@ func (e *Endpoint) HandleUserExperimentList(ctx echo.Context) error {
 
 	list, err := e.svc.ListUserSegments(ctx.Request().Context(), req.UserID)
 	if err != nil {
-		return ctx.JSON(http.StatusInternalServerError, errorResponse{
-			Message: "Internal error",
-		})
+		return e.internalError(ctx, err)
 	}
 
 	return ctx.JSON(http.StatusOK, list)
 }
 
+// HandleUsersExperimentList streams segments of a batch of users as a JSON object
+// keyed by user id, flushing the response every batchFlushSize users.
+func (e *Endpoint) HandleUsersExperimentList(ctx echo.Context) error {
+	var req batchListRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: invalid request body",
+		})
+	}
+
+	var (
+		resp    = ctx.Response()
+		enc     = json.NewEncoder(resp)
+		written int
+	)
+
+	err := e.svc.ListUsersSegments(ctx.Request().Context(), req.UserIDs, func(list *api.UserExperimentList) error {
+		prefix := ","
+		if written == 0 {
+			resp.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+			resp.WriteHeader(http.StatusOK)
+			prefix = `{"users":{`
+		}
+
+		if _, err := resp.Write([]byte(prefix + strconv.Quote(strconv.FormatInt(list.UserID, 10)) + ":")); err != nil {
+			return err
+		}
+
+		if err := enc.Encode(list.Segments); err != nil {
+			return err
+		}
+
+		written++
+		if written%batchFlushSize == 0 {
+			resp.Flush()
+		}
+
+		return nil
+	})
+	if err != nil {
+		// Once streaming has started the status is already sent, so the
+		// truncated body is the only signal left to the client.
+		if written > 0 {
+			e.logger.ErrorContext(ctx.Request().Context(), "batch list interrupted",
+				"written", written, "error", err)
+			return err
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	if written == 0 {
+		return ctx.JSON(http.StatusOK, map[string]any{"users": struct{}{}})
+	}
+
+	_, err = resp.Write([]byte("}}"))
+
+	return err
+}
+
+func (e *Endpoint) HandleHoldout(ctx echo.Context) error {
+	var req experimentListRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: invalid request body",
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, e.svc.HoldoutStatus(ctx.Request().Context(), req.UserID))
+}
+
 func (e *Endpoint) HandleCreateLog(ctx echo.Context) error {
 	var req userLogRequest
 	if err := ctx.Bind(&req); err != nil {
-		return ctx.JSON(http.StatusInternalServerError, errorResponse{
-			Message: "Internal error",
-		})
+		return e.internalError(ctx, err)
 	}
 
 	if err := ctx.Validate(req); err != nil {
@@ -162,14 +315,233 @@ func (e *Endpoint) HandleCreateLog(ctx echo.Context) error {
 
 	info, err := e.svc.CreateLog(ctx.Request().Context(), req.UserID, req.From)
 	if err != nil {
-		return ctx.JSON(http.StatusInternalServerError, errorResponse{
-			Message: "Internal error",
-		})
+		return e.internalError(ctx, err)
 	}
 
 	return ctx.JSON(http.StatusOK, info)
 }
 
+func (e *Endpoint) HandleSetAttributes(ctx echo.Context) error {
+	var req userAttributesRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: invalid request body",
+		})
+	}
+
+	attributes, err := e.svc.SetUserAttributes(ctx.Request().Context(), req.UserID, req.Attributes)
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, attributes)
+}
+
+func (e *Endpoint) HandleGetAttributes(ctx echo.Context) error {
+	var req experimentListRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: invalid request body",
+		})
+	}
+
+	attributes, err := e.svc.UserAttributes(ctx.Request().Context(), req.UserID)
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, attributes)
+}
+
+func (e *Endpoint) HandleSetOverride(ctx echo.Context) error {
+	var req overrideRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: invalid request body",
+		})
+	}
+
+	override, err := e.svc.SetOverride(ctx.Request().Context(), &api.Override{
+		UserID:    req.UserID,
+		Segment:   req.Segment,
+		Mode:      req.Mode,
+		Variant:   req.Variant,
+		ExpiresAt: req.ExpiresAt,
+		Actor:     actor(ctx),
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			return ctx.JSON(http.StatusNotFound, errorResponse{
+				Message: errors.Unwrap(err).Error(),
+			})
+		}
+
+		if errors.Is(err, service.ErrInvalidOverride) {
+			return ctx.JSON(http.StatusBadRequest, errorResponse{
+				Message: err.Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, override)
+}
+
+func (e *Endpoint) HandleDeleteOverride(ctx echo.Context) error {
+	var req deleteOverrideRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: invalid request body",
+		})
+	}
+
+	override, err := e.svc.DeleteOverride(ctx.Request().Context(), req.UserID, req.Segment, actor(ctx))
+	if err != nil {
+		if errors.Is(err, storage.ErrSegmentNotFound) || errors.Is(err, storage.ErrOverrideNotFound) {
+			return ctx.JSON(http.StatusNotFound, errorResponse{
+				Message: errors.Unwrap(err).Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, override)
+}
+
+func (e *Endpoint) HandleListOverrides(ctx echo.Context) error {
+	var req experimentListRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: invalid request body",
+		})
+	}
+
+	list, err := e.svc.UserOverrides(ctx.Request().Context(), req.UserID)
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, list)
+}
+
+func (e *Endpoint) HandleCreateAPIKey(ctx echo.Context) error {
+	var req apiKeyRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: invalid request body",
+		})
+	}
+
+	key, err := e.svc.CreateAPIKey(ctx.Request().Context(), req.Name, req.Role)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidRole) {
+			return ctx.JSON(http.StatusBadRequest, errorResponse{
+				Message: err.Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, key)
+}
+
+func (e *Endpoint) HandleRevokeAPIKey(ctx echo.Context) error {
+	var req revokeAPIKeyRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: field 'id' not found",
+		})
+	}
+
+	key, err := e.svc.RevokeAPIKey(ctx.Request().Context(), req.ID)
+	if err != nil {
+		if errors.Is(err, storage.ErrAPIKeyNotFound) {
+			return ctx.JSON(http.StatusNotFound, errorResponse{
+				Message: errors.Unwrap(err).Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, key)
+}
+
+func (e *Endpoint) HandleListAPIKeys(ctx echo.Context) error {
+	list, err := e.svc.APIKeys(ctx.Request().Context())
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, list)
+}
+
+// HandleListNamespaces lists namespaces in use, or only the client's own one if
+// its credentials are bound to a namespace.
+func (e *Endpoint) HandleListNamespaces(ctx echo.Context) error {
+	if principal := auth.FromContext(ctx.Request().Context()); principal != nil && principal.Namespace != "" {
+		return ctx.JSON(http.StatusOK, &api.NamespaceList{Namespaces: []string{principal.Namespace}})
+	}
+
+	list, err := e.svc.Namespaces(ctx.Request().Context())
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, list)
+}
+
+// internalError logs err and hides it from the client behind a generic 500 response.
+func (e *Endpoint) internalError(ctx echo.Context, err error) error {
+	e.logger.ErrorContext(ctx.Request().Context(), "request failed",
+		"method", ctx.Request().Method, "path", ctx.Path(), "error", err)
+
+	return ctx.JSON(http.StatusInternalServerError, errorResponse{
+		Message: "Internal error",
+	})
+}
+
+// actor names the authenticated client in audit logs, so clients can't record
+// changes under someone else's name.
+func actor(ctx echo.Context) string {
+	if principal := auth.FromContext(ctx.Request().Context()); principal != nil {
+		return principal.Subject
+	}
+
+	return ""
+}
+
 type errorResponse struct {
 	Message string `json:"message"`
 }
@@ -178,23 +550,62 @@ type segmentRequest struct {
 	Name string `json:"name" validate:"required"`
 }
 
+type createSegmentRequest struct {
+	Name string `json:"name" validate:"required"`
+	api.SegmentSettings
+}
+
 type userExperimentRequest struct {
-	UserID   int64                       `json:"user_id" validate:"required"`
-	ToAdd    []*model.UserExperimentItem `json:"to_add" validate:"required"`
-	ToRemove []string                    `json:"to_remove" validate:"required"`
+	UserID   int64                     `json:"user_id" validate:"required"`
+	ToAdd    []*api.UserExperimentItem `json:"to_add" validate:"required"`
+	ToRemove []string                  `json:"to_remove" validate:"required"`
 }
 
 type userExperimentResponse struct {
-	UserID  int64                   `json:"user_id"`
-	Added   []*model.UserExperiment `json:"added"`
-	Removed []*model.UserExperiment `json:"removed"`
+	UserID   int64                     `json:"user_id"`
+	Added    []*api.UserExperiment     `json:"added"`
+	Removed  []*api.UserExperiment     `json:"removed"`
+	Rejected []*api.RejectedExperiment `json:"rejected"`
 }
 
 type experimentListRequest struct {
 	UserID int64 `json:"user_id" validate:"required"`
 }
 
+const batchFlushSize = 500
+
+type batchListRequest struct {
+	UserIDs []int64 `json:"user_ids" validate:"required,min=1,max=5000"`
+}
+
 type userLogRequest struct {
 	UserID int64  `json:"user_id" validate:"required"`
 	From   string `json:"from" validate:"required"`
 }
+
+type userAttributesRequest struct {
+	UserID     int64             `json:"user_id" validate:"required"`
+	Attributes map[string]string `json:"attributes" validate:"required"`
+}
+
+type overrideRequest struct {
+	UserID    int64  `json:"user_id" validate:"required"`
+	Segment   string `json:"segment" validate:"required"`
+	Mode      string `json:"mode" validate:"required,oneof=include exclude"`
+	Variant   string `json:"variant"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type apiKeyRequest struct {
+	Name string `json:"name" validate:"required"`
+	Role string `json:"role" validate:"required,oneof=reader analyst admin"`
+}
+
+type revokeAPIKeyRequest struct {
+	ID int64 `json:"id" validate:"required"`
+}
+
+type deleteOverrideRequest struct {
+	UserID  int64  `json:"user_id" validate:"required"`
+	Segment string `json:"segment" validate:"required"`
+}
@@ -0,0 +1,185 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+)
+
+const (
+	headerLastEventID = "Last-Event-ID"
+	mimeEventStream   = "text/event-stream"
+
+	eventsBatchSize = 100
+	// keepAliveInterval keeps proxies from closing idle streams. Events are read on
+	// every keep-alive too, in case a notification was lost.
+	keepAliveInterval = 15 * time.Second
+	// eventsRetry is how long clients wait before reconnecting.
+	eventsRetry = 3 * time.Second
+)
+
+// HandleEvents streams segment and membership changes as Server-Sent Events. The
+// stream starts after the event in Last-Event-ID (or the last_event_id parameter,
+// since browsers can't set headers on the first connection), or with the next change.
+func (e *Endpoint) HandleEvents(ctx echo.Context) error {
+	filter, err := eventFilter(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, errorResponse{
+			Message: err.Error(),
+		})
+	}
+
+	reqCtx := ctx.Request().Context()
+
+	var wake, done <-chan struct{}
+	if e.events != nil {
+		// subscribe before reading, so changes made in between aren't waited for
+		var cancel func()
+		wake, cancel = e.events.Subscribe(namespace.FromContext(reqCtx))
+		defer cancel()
+		done = e.events.Done()
+	}
+
+	cursor, err := lastEventID(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, errorResponse{
+			Message: err.Error(),
+		})
+	}
+
+	if cursor < 0 {
+		if cursor, err = e.svc.LastEventID(reqCtx); err != nil {
+			return e.internalError(ctx, err)
+		}
+	}
+
+	// the first batch is read before the stream starts, so errors get a status code
+	batch, next, err := e.svc.Events(reqCtx, cursor, filter, eventsBatchSize)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidEventFilter) {
+			return ctx.JSON(http.StatusBadRequest, errorResponse{
+				Message: err.Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	res := ctx.Response()
+	res.Header().Set(echo.HeaderContentType, mimeEventStream)
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	// nginx buffers responses otherwise
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprintf(res, "retry: %d\n\n", eventsRetry.Milliseconds())
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		for next != cursor {
+			for _, event := range batch {
+				if err := writeEvent(res, event); err != nil {
+					return nil
+				}
+			}
+			cursor = next
+
+			if batch, next, err = e.svc.Events(reqCtx, cursor, filter, eventsBatchSize); err != nil {
+				// the client resumes from the last event it got
+				e.logger.ErrorContext(reqCtx, "couldn't read events", "error", err)
+				return nil
+			}
+		}
+		res.Flush()
+
+		select {
+		case <-reqCtx.Done():
+			return nil
+		case <-done:
+			return nil
+		case <-wake:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		}
+
+		if batch, next, err = e.svc.Events(reqCtx, cursor, filter, eventsBatchSize); err != nil {
+			e.logger.ErrorContext(reqCtx, "couldn't read events", "error", err)
+			return nil
+		}
+	}
+}
+
+func writeEvent(res *echo.Response, event *api.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+
+	return err
+}
+
+// lastEventID returns the position to resume from, or -1 to start with the next event.
+func lastEventID(ctx echo.Context) (int64, error) {
+	value := ctx.Request().Header.Get(headerLastEventID)
+	if value == "" {
+		value = ctx.QueryParam("last_event_id")
+	}
+	if value == "" {
+		return -1, nil
+	}
+
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("%w: invalid last event id", service.ErrInvalidEventFilter)
+	}
+
+	return id, nil
+}
+
+// eventFilter reads the segment, type and user_id parameters. Segments and types may
+// be repeated or separated by commas.
+func eventFilter(ctx echo.Context) (service.EventFilter, error) {
+	params := ctx.QueryParams()
+	filter := service.EventFilter{
+		Segments: splitParams(params["segment"]),
+		Types:    splitParams(params["type"]),
+	}
+
+	if value := ctx.QueryParam("user_id"); value != "" {
+		userID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || userID <= 0 {
+			return filter, fmt.Errorf("%w: invalid user id", service.ErrInvalidEventFilter)
+		}
+		filter.UserID = userID
+	}
+
+	return filter, nil
+}
+
+func splitParams(values []string) []string {
+	var split []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				split = append(split, part)
+			}
+		}
+	}
+
+	return split
+}
@@ -0,0 +1,80 @@
+package endpoint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Snapshots let clients evaluate segments locally. Their ETag is a hash of the
+// content, so a client that sends it back in If-None-Match gets 304 until the
+// snapshot changes and downloads only the parts that did.
+
+const headerIfNoneMatch = "If-None-Match"
+
+// HandleSnapshot returns segment definitions, overrides and the holdout.
+func (e *Endpoint) HandleSnapshot(ctx echo.Context) error {
+	snapshot, err := e.svc.Snapshot(ctx.Request().Context())
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	return e.conditionalJSON(ctx, snapshot)
+}
+
+// HandleUsersSnapshot returns stored memberships and attributes of a batch of users.
+func (e *Endpoint) HandleUsersSnapshot(ctx echo.Context) error {
+	var req batchListRequest
+	if err := ctx.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, errorResponse{
+			Message: "Validation error: invalid request body",
+		})
+	}
+
+	list, err := e.svc.UsersSnapshot(ctx.Request().Context(), req.UserIDs)
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	return e.conditionalJSON(ctx, list)
+}
+
+// conditionalJSON writes v with an ETag of its content, or only the ETag with 304
+// if the client already has it.
+func (e *Endpoint) conditionalJSON(ctx echo.Context, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	ctx.Response().Header().Set(headerETag, etag)
+
+	if noneMatch(ctx.Request().Header.Get(headerIfNoneMatch), etag) {
+		return ctx.NoContent(http.StatusNotModified)
+	}
+
+	return ctx.JSONBlob(http.StatusOK, body)
+}
+
+// noneMatch reports whether an If-None-Match header lists the ETag. Weak ETags
+// match too, as the comparison of If-None-Match is weak.
+func noneMatch(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == anyVersion {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,307 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/rule"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+)
+
+// The v2 API addresses segments and users by path and uses versions for optimistic
+// concurrency: reads return the version in ETag, and changes must send it back in
+// If-Match. A change made against a stale version fails with 412.
+
+// errPreconditionRequired is returned when a change is sent without If-Match.
+var errPreconditionRequired = errors.New("If-Match header is required")
+
+const (
+	headerETag    = "ETag"
+	headerIfMatch = "If-Match"
+
+	// anyVersion is the If-Match value that matches every version.
+	anyVersion = "*"
+)
+
+// HandleCreateSegmentV2 creates a segment and returns its first version.
+func (e *Endpoint) HandleCreateSegmentV2(ctx echo.Context) error {
+	var req createSegmentRequest
+	if err := ctx.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, errorResponse{
+			Message: "Validation error: field 'name' not found",
+		})
+	}
+
+	segment, err := e.svc.CreateSegmentWithSettings(ctx.Request().Context(), req.Name, req.SegmentSettings)
+	if err != nil {
+		if errors.Is(err, storage.ErrSegmentExists) {
+			return ctx.JSON(http.StatusConflict, errorResponse{
+				Message: errors.Unwrap(err).Error(),
+			})
+		}
+
+		if resp, ok := segmentSettingsError(err); ok {
+			return ctx.JSON(http.StatusBadRequest, resp)
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	ctx.Response().Header().Set(echo.HeaderLocation, "/v2/segments/"+url.PathEscape(segment.Name))
+	setETag(ctx, segment.Version)
+
+	return ctx.JSON(http.StatusCreated, segment)
+}
+
+func (e *Endpoint) HandleSegmentV2(ctx echo.Context) error {
+	segment, err := e.svc.SegmentInfo(ctx.Request().Context(), ctx.Param("name"))
+	if err != nil {
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			return ctx.JSON(http.StatusNotFound, errorResponse{
+				Message: errors.Unwrap(err).Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	setETag(ctx, segment.Version)
+
+	return ctx.JSON(http.StatusOK, segment)
+}
+
+// HandleUpdateSegmentV2 replaces the segment settings.
+func (e *Endpoint) HandleUpdateSegmentV2(ctx echo.Context) error {
+	version, err := segmentIfMatch(ctx)
+	if err != nil {
+		return err
+	}
+
+	var settings api.SegmentSettings
+	if err := ctx.Bind(&settings); err != nil {
+		return err
+	}
+
+	segment, err := e.svc.UpdateSegment(ctx.Request().Context(), ctx.Param("name"), settings, version)
+	if err != nil {
+		if errors.Is(err, storage.ErrVersionMismatch) {
+			return preconditionFailed(ctx)
+		}
+
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			return ctx.JSON(http.StatusNotFound, errorResponse{
+				Message: errors.Unwrap(err).Error(),
+			})
+		}
+
+		if resp, ok := segmentSettingsError(err); ok {
+			return ctx.JSON(http.StatusBadRequest, resp)
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	setETag(ctx, segment.Version)
+
+	return ctx.JSON(http.StatusOK, segment)
+}
+
+func (e *Endpoint) HandleDeleteSegmentV2(ctx echo.Context) error {
+	version, err := segmentIfMatch(ctx)
+	if err != nil {
+		return err
+	}
+
+	segment, err := e.svc.DeleteSegmentWithVersion(ctx.Request().Context(), ctx.Param("name"), version)
+	if err != nil {
+		if errors.Is(err, storage.ErrVersionMismatch) {
+			return preconditionFailed(ctx)
+		}
+
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			return ctx.JSON(http.StatusNotFound, errorResponse{
+				Message: errors.Unwrap(err).Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, segment)
+}
+
+// HandleUserSegmentsV2 returns the user's segments with the version of their memberships.
+func (e *Endpoint) HandleUserSegmentsV2(ctx echo.Context) error {
+	userID, err := userIDParam(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the version is read first, so a concurrent change makes it stale rather than
+	// letting the client overwrite what it hasn't seen
+	version, err := e.svc.UserVersion(ctx.Request().Context(), userID)
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	list, err := e.svc.ListUserSegments(ctx.Request().Context(), userID)
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	list.Version = version
+	setETag(ctx, version)
+
+	return ctx.JSON(http.StatusOK, list)
+}
+
+// HandleUpdateUserSegmentsV2 adds the user to and removes them from segments.
+func (e *Endpoint) HandleUpdateUserSegmentsV2(ctx echo.Context) error {
+	userID, err := userIDParam(ctx)
+	if err != nil {
+		return err
+	}
+
+	version, matchAny, err := ifMatch(ctx)
+	if err != nil {
+		return err
+	}
+
+	var req userSegmentsPatchRequest
+	if err := ctx.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, errorResponse{
+			Message: "Validation error: invalid request body",
+		})
+	}
+
+	reqCtx := ctx.Request().Context()
+
+	if !matchAny {
+		if err := e.svc.CheckUserVersion(reqCtx, userID, version); err != nil {
+			if errors.Is(err, storage.ErrVersionMismatch) {
+				return preconditionFailed(ctx)
+			}
+
+			return e.internalError(ctx, err)
+		}
+	}
+
+	added, rejected, err := e.svc.AddUserExperiments(reqCtx, userID, req.ToAdd)
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	removed, err := e.svc.RemoveUserExperiments(reqCtx, userID, req.ToRemove)
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	version, err = e.svc.UserVersion(reqCtx, userID)
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	setETag(ctx, version)
+
+	return ctx.JSON(http.StatusOK, userSegmentsPatchResponse{
+		userExperimentResponse: userExperimentResponse{
+			UserID:   userID,
+			Added:    added,
+			Removed:  removed,
+			Rejected: rejected,
+		},
+		Version: version,
+	})
+}
+
+// ifMatch returns the version the client expects from If-Match, or matchAny for "*".
+// Weak and multiple ETags aren't accepted, since versions are compared exactly.
+func ifMatch(ctx echo.Context) (version int64, matchAny bool, err error) {
+	header := strings.TrimSpace(ctx.Request().Header.Get(headerIfMatch))
+	if header == "" {
+		return 0, false, echo.NewHTTPError(http.StatusPreconditionRequired, errPreconditionRequired.Error())
+	}
+
+	if header == anyVersion {
+		return 0, true, nil
+	}
+
+	quoted := len(header) > 2 && header[0] == '"' && header[len(header)-1] == '"'
+
+	version, err = strconv.ParseInt(strings.Trim(header, `"`), 10, 64)
+	if !quoted || err != nil || version < 0 {
+		return 0, false, echo.NewHTTPError(http.StatusPreconditionFailed, storage.ErrVersionMismatch.Error())
+	}
+
+	return version, false, nil
+}
+
+// segmentIfMatch returns the segment version from If-Match in the form the storage
+// expects it, where 0 matches every version.
+func segmentIfMatch(ctx echo.Context) (int64, error) {
+	version, matchAny, err := ifMatch(ctx)
+	if err != nil || matchAny {
+		return 0, err
+	}
+
+	// segment versions start at 1
+	if version == 0 {
+		return 0, echo.NewHTTPError(http.StatusPreconditionFailed, storage.ErrVersionMismatch.Error())
+	}
+
+	return version, nil
+}
+
+func preconditionFailed(ctx echo.Context) error {
+	return ctx.JSON(http.StatusPreconditionFailed, errorResponse{
+		Message: storage.ErrVersionMismatch.Error(),
+	})
+}
+
+func setETag(ctx echo.Context, version int64) {
+	ctx.Response().Header().Set(headerETag, fmt.Sprintf(`"%d"`, version))
+}
+
+func userIDParam(ctx echo.Context) (int64, error) {
+	userID, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil || userID <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Validation error: invalid user id")
+	}
+
+	return userID, nil
+}
+
+// segmentSettingsError describes an error caused by invalid segment settings.
+func segmentSettingsError(err error) (errorResponse, bool) {
+	if errors.Is(err, rule.ErrSyntax) || errors.Is(err, service.ErrInvalidWindow) ||
+		errors.Is(err, service.ErrInvalidCapacity) || errors.Is(err, service.ErrInvalidPrerequisite) {
+		return errorResponse{Message: err.Error()}, true
+	}
+
+	return errorResponse{}, false
+}
+
+type userSegmentsPatchRequest struct {
+	ToAdd    []*api.UserExperimentItem `json:"to_add" validate:"dive"`
+	ToRemove []string                  `json:"to_remove"`
+}
+
+type userSegmentsPatchResponse struct {
+	userExperimentResponse
+	Version int64 `json:"version"`
+}
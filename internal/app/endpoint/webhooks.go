@@ -0,0 +1,136 @@
+package endpoint
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+)
+
+// HandleCreateWebhook subscribes a URL to segment and membership events. The
+// signing secret is returned only in this response.
+func (e *Endpoint) HandleCreateWebhook(ctx echo.Context) error {
+	var req createWebhookRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: field 'url' not found",
+		})
+	}
+
+	webhook, err := e.svc.CreateWebhook(ctx.Request().Context(), req.URL, req.Segments, req.Events)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidWebhook) {
+			return ctx.JSON(http.StatusBadRequest, errorResponse{
+				Message: err.Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, webhook)
+}
+
+func (e *Endpoint) HandleDeleteWebhook(ctx echo.Context) error {
+	var req webhookIDRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: field 'id' not found",
+		})
+	}
+
+	webhook, err := e.svc.DeleteWebhook(ctx.Request().Context(), req.ID)
+	if err != nil {
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			return ctx.JSON(http.StatusNotFound, errorResponse{
+				Message: errors.Unwrap(err).Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, webhook)
+}
+
+func (e *Endpoint) HandleListWebhooks(ctx echo.Context) error {
+	list, err := e.svc.Webhooks(ctx.Request().Context())
+	if err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, list)
+}
+
+// HandleListWebhookDeliveries lists deliveries with the status, the dead letters by default.
+func (e *Endpoint) HandleListWebhookDeliveries(ctx echo.Context) error {
+	var req webhookDeliveriesRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	list, err := e.svc.WebhookDeliveries(ctx.Request().Context(), req.Status, req.Limit)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidWebhook) {
+			return ctx.JSON(http.StatusBadRequest, errorResponse{
+				Message: err.Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, list)
+}
+
+// HandleReplayWebhookDelivery schedules a dead or delivered delivery to be sent again.
+func (e *Endpoint) HandleReplayWebhookDelivery(ctx echo.Context) error {
+	var req webhookIDRequest
+	if err := ctx.Bind(&req); err != nil {
+		return e.internalError(ctx, err)
+	}
+
+	if err := ctx.Validate(req); err != nil {
+		return ctx.JSON(http.StatusMethodNotAllowed, errorResponse{
+			Message: "Validation error: field 'id' not found",
+		})
+	}
+
+	delivery, err := e.svc.ReplayWebhookDelivery(ctx.Request().Context(), req.ID)
+	if err != nil {
+		if errors.Is(err, storage.ErrDeliveryNotFound) {
+			return ctx.JSON(http.StatusNotFound, errorResponse{
+				Message: errors.Unwrap(err).Error(),
+			})
+		}
+
+		return e.internalError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, delivery)
+}
+
+type createWebhookRequest struct {
+	URL      string   `json:"url" validate:"required"`
+	Segments []string `json:"segments"`
+	Events   []string `json:"events"`
+}
+
+type webhookIDRequest struct {
+	ID int64 `json:"id" validate:"required"`
+}
+
+type webhookDeliveriesRequest struct {
+	Status string `json:"status"`
+	Limit  int    `json:"limit"`
+}
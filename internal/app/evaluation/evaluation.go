@@ -0,0 +1,239 @@
+// Package evaluation decides which segments a user is in. The service and the
+// local-evaluation SDK share it, so segments evaluated in process match the ones
+// the API returns.
+package evaluation
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/rule"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+)
+
+const (
+	OverrideModeInclude = "include"
+	OverrideModeExclude = "exclude"
+)
+
+// Location is the timezone of timestamps in requests and responses.
+var Location = time.FixedZone("MSK", 3*60*60) //nolint:gomnd
+
+type Evaluator struct {
+	logger *slog.Logger
+	rules  sync.Map
+}
+
+func New(logger *slog.Logger) *Evaluator {
+	return &Evaluator{logger: logger}
+}
+
+// Evaluate combines a user's overrides, stored memberships and rule candidates into
+// the final list of segments: overrides take precedence over stored memberships,
+// which in turn take precedence over rule-based matches.
+func (e *Evaluator) Evaluate(ctx context.Context, stored []storage.SegmentDTO, overrides []storage.OverrideDTO,
+	candidates []storage.SegmentDTO, attributes map[string]string, now time.Time) []api.Segment {
+	var (
+		members  = make([]storage.SegmentDTO, 0, len(stored)+len(overrides))
+		excluded = make(map[string]struct{})
+		variants = make(map[string]string)
+	)
+
+	for _, override := range overrides {
+		if override.Mode == OverrideModeExclude {
+			excluded[override.Segment.Name] = struct{}{}
+			continue
+		}
+
+		members = append(members, override.Segment)
+		variants[override.Segment.Name] = override.Variant
+	}
+
+	for _, segment := range Active(stored, now) {
+		if _, ok := excluded[segment.Name]; ok {
+			continue
+		}
+		if _, ok := variants[segment.Name]; ok {
+			continue
+		}
+		members = append(members, segment)
+	}
+
+	matched := e.matchRuleSegments(ctx, members, excluded, candidates, attributes)
+	segments := make([]api.Segment, 0, len(members)+len(matched))
+
+	for i := range members {
+		segment := SegmentFromDTO(&members[i])
+		segment.Variant = variants[segment.Name]
+		segments = append(segments, *segment)
+	}
+
+	for i := range matched {
+		segments = append(segments, *SegmentFromDTO(&matched[i]))
+	}
+
+	return segments
+}
+
+// matchRuleSegments returns segments whose rules match the user's attributes.
+// Like manual assignment, matches respect exclusion groups and prerequisites.
+func (e *Evaluator) matchRuleSegments(ctx context.Context, members []storage.SegmentDTO, excluded map[string]struct{},
+	candidates []storage.SegmentDTO, attributes map[string]string) []storage.SegmentDTO {
+	var (
+		names   = make(map[string]struct{}, len(members))
+		groups  = make(map[string]struct{})
+		matched []storage.SegmentDTO
+	)
+
+	for _, member := range members {
+		names[member.Name] = struct{}{}
+		if member.Group != "" {
+			groups[member.Group] = struct{}{}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if _, ok := names[candidate.Name]; ok {
+			continue
+		}
+
+		if _, ok := excluded[candidate.Name]; ok {
+			continue
+		}
+
+		if _, ok := groups[candidate.Group]; ok && candidate.Group != "" {
+			continue
+		}
+
+		if !containsAll(names, candidate.Requires) {
+			continue
+		}
+
+		r, err := e.Compile(candidate.Rule)
+		if err != nil {
+			e.logger.WarnContext(ctx, "skipping segment with invalid rule", "segment", candidate.Name, "error", err)
+			continue
+		}
+
+		if !r.Match(attributes) {
+			continue
+		}
+
+		names[candidate.Name] = struct{}{}
+		if candidate.Group != "" {
+			groups[candidate.Group] = struct{}{}
+		}
+		matched = append(matched, candidate)
+	}
+
+	return matched
+}
+
+// Compile parses the expression once and reuses it for later evaluations.
+func (e *Evaluator) Compile(expr string) (*rule.Rule, error) {
+	if r, ok := e.rules.Load(expr); ok {
+		return r.(*rule.Rule), nil
+	}
+
+	r, err := rule.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	e.rules.Store(expr, r)
+
+	return r, nil
+}
+
+// Active filters out segments whose activation window does not contain now.
+func Active(segments []storage.SegmentDTO, now time.Time) []storage.SegmentDTO {
+	active := make([]storage.SegmentDTO, 0, len(segments))
+
+	for _, segment := range segments {
+		if segment.StartsAt != nil && segment.StartsAt.After(now) {
+			continue
+		}
+		if segment.EndsAt != nil && !segment.EndsAt.After(now) {
+			continue
+		}
+		active = append(active, segment)
+	}
+
+	return active
+}
+
+func containsAll(set map[string]struct{}, names []string) bool {
+	for _, name := range names {
+		if _, ok := set[name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ParseTime parses a timestamp in the format of requests and responses.
+func ParseTime(value string) (time.Time, error) {
+	return time.ParseInLocation(time.DateTime, value, Location)
+}
+
+// FormatTime formats t for responses, or returns an empty string for nil.
+func FormatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.In(Location).Format(time.DateTime)
+}
+
+func SegmentFromDTO(dto *storage.SegmentDTO) *api.Segment {
+	return &api.Segment{
+		ID:      dto.ID,
+		Name:    dto.Name,
+		Version: dto.Version,
+		SegmentSettings: api.SegmentSettings{
+			Group:      dto.Group,
+			Requires:   dto.Requires,
+			Rule:       dto.Rule,
+			StartsAt:   FormatTime(dto.StartsAt),
+			EndsAt:     FormatTime(dto.EndsAt),
+			MaxMembers: dto.MaxMembers,
+		},
+	}
+}
+
+// SegmentToDTO converts a segment received from the API back into the form
+// segments are evaluated in.
+func SegmentToDTO(segment *api.Segment) (storage.SegmentDTO, error) {
+	dto := storage.SegmentDTO{
+		ID:      segment.ID,
+		Name:    segment.Name,
+		Version: segment.Version,
+		SegmentSettingsDTO: storage.SegmentSettingsDTO{
+			Group:      segment.Group,
+			Requires:   segment.Requires,
+			Rule:       segment.Rule,
+			MaxMembers: segment.MaxMembers,
+		},
+	}
+
+	if segment.StartsAt != "" {
+		startsAt, err := ParseTime(segment.StartsAt)
+		if err != nil {
+			return storage.SegmentDTO{}, err
+		}
+		dto.StartsAt = &startsAt
+	}
+
+	if segment.EndsAt != "" {
+		endsAt, err := ParseTime(segment.EndsAt)
+		if err != nil {
+			return storage.SegmentDTO{}, err
+		}
+		dto.EndsAt = &endsAt
+	}
+
+	return dto, nil
+}
@@ -0,0 +1,84 @@
+// Package events wakes event stream subscribers when changes are written. It only
+// signals that there's something new: subscribers read the events themselves from
+// their own position, so a missed or coalesced signal never loses an event.
+package events
+
+import "sync"
+
+// Broker fans notifications out to subscribers of a namespace.
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[*subscription]struct{}
+	done   chan struct{}
+	closed bool
+}
+
+type subscription struct {
+	namespace string
+	wake      chan struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		subs: make(map[*subscription]struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Subscribe returns a channel that receives a value after events are written to the
+// namespace. Notifications that arrive before the previous one is received are
+// coalesced. Cancel must be called once the subscriber is done.
+func (b *Broker) Subscribe(namespace string) (wake <-chan struct{}, cancel func()) {
+	sub := &subscription{namespace: namespace, wake: make(chan struct{}, 1)}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub.wake, func() {
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+	}
+}
+
+// Notify wakes subscribers of the namespace, or all of them if it's empty.
+func (b *Broker) Notify(namespace string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		if namespace != "" && sub.namespace != namespace {
+			continue
+		}
+
+		select {
+		case sub.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Subscribers returns the number of subscribers.
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subs)
+}
+
+// Close tells subscribers to stop, e.g. before the server shuts down.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+}
+
+// Done is closed by Close.
+func (b *Broker) Done() <-chan struct{} {
+	return b.done
+}
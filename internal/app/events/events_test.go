@@ -0,0 +1,72 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func woken(wake <-chan struct{}) bool {
+	select {
+	case <-wake:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestBroker(t *testing.T) {
+	t.Run("wakes subscribers of the namespace", func(t *testing.T) {
+		b := events.NewBroker()
+
+		teamA, cancelA := b.Subscribe("team-a")
+		defer cancelA()
+		teamB, cancelB := b.Subscribe("team-b")
+		defer cancelB()
+
+		b.Notify("team-a")
+		assert.True(t, woken(teamA))
+		assert.False(t, woken(teamB))
+
+		b.Notify("")
+		assert.True(t, woken(teamA))
+		assert.True(t, woken(teamB))
+	})
+
+	t.Run("coalesces notifications", func(t *testing.T) {
+		b := events.NewBroker()
+
+		wake, cancel := b.Subscribe("default")
+		defer cancel()
+
+		b.Notify("default")
+		b.Notify("default")
+		assert.True(t, woken(wake))
+		assert.False(t, woken(wake))
+	})
+
+	t.Run("forgets canceled subscribers", func(t *testing.T) {
+		b := events.NewBroker()
+
+		_, cancel := b.Subscribe("default")
+		assert.Equal(t, 1, b.Subscribers())
+
+		cancel()
+		assert.Equal(t, 0, b.Subscribers())
+		b.Notify("default")
+	})
+
+	t.Run("closes", func(t *testing.T) {
+		b := events.NewBroker()
+
+		b.Close()
+		b.Close()
+
+		select {
+		case <-b.Done():
+		default:
+			t.Fatal("broker isn't done")
+		}
+	})
+}
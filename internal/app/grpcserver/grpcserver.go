@@ -0,0 +1,455 @@
+// Package grpcserver serves the segment API over gRPC. It shares the service with the
+// HTTP endpoints and applies the same authentication, roles and namespaces: clients
+// pass credentials in the x-api-key or authorization metadata and the namespace in
+// the x-namespace metadata.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/auth"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/rule"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+	segmentsv1 "github.com/psxzz/backend-trainee-assignment/pkg/pb/segments/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// maxBatchUsers matches the limit of the HTTP batch lookup.
+const maxBatchUsers = 5000
+
+type Service interface {
+	CreateSegmentWithSettings(context.Context, string, api.SegmentSettings) (*api.Segment, error)
+	DeleteSegment(context.Context, string) (*api.Segment, error)
+	SegmentInfo(context.Context, string) (*api.Segment, error)
+	AddUserExperiments(context.Context, int64, []*api.UserExperimentItem) ([]*api.UserExperiment, []*api.RejectedExperiment, error)
+	RemoveUserExperiments(context.Context, int64, []string) ([]*api.UserExperiment, error)
+	ListUserSegments(context.Context, int64) (*api.UserExperimentList, error)
+	ListUsersSegments(context.Context, []int64, func(*api.UserExperimentList) error) error
+	CreateLog(context.Context, int64, string) (*api.LogInfo, error)
+}
+
+// Authenticator checks the credentials of a call.
+type Authenticator interface {
+	AuthenticateToken(ctx context.Context, token string) (*auth.Principal, error)
+}
+
+// methodRoles lists the role every method requires. Methods of other services, i.e.
+// health checks and reflection, stay open like the HTTP probes.
+var methodRoles = map[string]auth.Role{
+	segmentsv1.SegmentService_CreateSegment_FullMethodName:        auth.RoleAdmin,
+	segmentsv1.SegmentService_DeleteSegment_FullMethodName:        auth.RoleAdmin,
+	segmentsv1.SegmentService_GetSegment_FullMethodName:           auth.RoleReader,
+	segmentsv1.SegmentService_UpdateUserSegments_FullMethodName:   auth.RoleAnalyst,
+	segmentsv1.SegmentService_GetUserSegments_FullMethodName:      auth.RoleReader,
+	segmentsv1.SegmentService_BatchGetUserSegments_FullMethodName: auth.RoleReader,
+	segmentsv1.SegmentService_CreateReport_FullMethodName:         auth.RoleAnalyst,
+}
+
+type Server struct {
+	segmentsv1.UnimplementedSegmentServiceServer
+
+	svc    Service
+	authn  Authenticator
+	logger *slog.Logger
+	grpc   *grpc.Server
+	health *health.Server
+}
+
+type Option func(*Server)
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+func New(svc Service, authn Authenticator, opts ...Option) *Server {
+	s := &Server{
+		svc:    svc,
+		authn:  authn,
+		logger: slog.Default(),
+		health: health.NewServer(),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.grpc = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(s.logUnary, s.authUnary),
+		grpc.ChainStreamInterceptor(s.logStream, s.authStream),
+	)
+	segmentsv1.RegisterSegmentServiceServer(s.grpc, s)
+	healthpb.RegisterHealthServer(s.grpc, s.health)
+	reflection.Register(s.grpc)
+
+	return s
+}
+
+// Serve accepts connections on lis until Stop is called.
+func (s *Server) Serve(lis net.Listener) error {
+	return s.grpc.Serve(lis)
+}
+
+// Stop reports the server as not serving and waits for calls in flight to finish
+// until ctx is done, then closes the remaining ones.
+func (s *Server) Stop(ctx context.Context) {
+	s.health.Shutdown()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpc.Stop()
+	}
+}
+
+func (s *Server) CreateSegment(ctx context.Context, req *segmentsv1.CreateSegmentRequest) (*segmentsv1.Segment, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+
+	segment, err := s.svc.CreateSegmentWithSettings(ctx, req.GetName(), settingsFromProto(req.GetSettings()))
+	if err != nil {
+		return nil, s.statusError(ctx, err)
+	}
+
+	return segmentToProto(segment), nil
+}
+
+func (s *Server) DeleteSegment(ctx context.Context, req *segmentsv1.DeleteSegmentRequest) (*segmentsv1.Segment, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+
+	segment, err := s.svc.DeleteSegment(ctx, req.GetName())
+	if err != nil {
+		return nil, s.statusError(ctx, err)
+	}
+
+	return segmentToProto(segment), nil
+}
+
+func (s *Server) GetSegment(ctx context.Context, req *segmentsv1.GetSegmentRequest) (*segmentsv1.Segment, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+
+	segment, err := s.svc.SegmentInfo(ctx, req.GetName())
+	if err != nil {
+		return nil, s.statusError(ctx, err)
+	}
+
+	return segmentToProto(segment), nil
+}
+
+func (s *Server) UpdateUserSegments(ctx context.Context, req *segmentsv1.UpdateUserSegmentsRequest) (*segmentsv1.UpdateUserSegmentsResponse, error) {
+	if req.GetUserId() == 0 {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+
+	items := make([]*api.UserExperimentItem, 0, len(req.GetAdd()))
+	for _, item := range req.GetAdd() {
+		if item.GetName() == "" {
+			return nil, status.Error(codes.InvalidArgument, "segment name is required")
+		}
+
+		items = append(items, &api.UserExperimentItem{
+			Name:      item.GetName(),
+			ExpiresAt: item.GetExpiresAt(),
+			Force:     item.GetForce(),
+		})
+	}
+
+	added, rejected, err := s.svc.AddUserExperiments(ctx, req.GetUserId(), items)
+	if err != nil {
+		return nil, s.statusError(ctx, err)
+	}
+
+	removed, err := s.svc.RemoveUserExperiments(ctx, req.GetUserId(), req.GetRemove())
+	if err != nil {
+		return nil, s.statusError(ctx, err)
+	}
+
+	resp := &segmentsv1.UpdateUserSegmentsResponse{
+		UserId:  req.GetUserId(),
+		Added:   membershipsToProto(added),
+		Removed: membershipsToProto(removed),
+	}
+	for _, r := range rejected {
+		resp.Rejected = append(resp.Rejected, &segmentsv1.Rejection{Name: r.Name, Reason: r.Reason})
+	}
+
+	return resp, nil
+}
+
+func (s *Server) GetUserSegments(ctx context.Context, req *segmentsv1.GetUserSegmentsRequest) (*segmentsv1.UserSegments, error) {
+	if req.GetUserId() == 0 {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+
+	list, err := s.svc.ListUserSegments(ctx, req.GetUserId())
+	if err != nil {
+		return nil, s.statusError(ctx, err)
+	}
+
+	return userSegmentsToProto(list), nil
+}
+
+// BatchGetUserSegments sends segments of every user as soon as they're read, so
+// large batches aren't buffered.
+func (s *Server) BatchGetUserSegments(req *segmentsv1.BatchGetUserSegmentsRequest, stream segmentsv1.SegmentService_BatchGetUserSegmentsServer) error {
+	if n := len(req.GetUserIds()); n == 0 || n > maxBatchUsers {
+		return status.Errorf(codes.InvalidArgument, "user_ids must hold from 1 to %d users", maxBatchUsers)
+	}
+
+	ctx := stream.Context()
+
+	err := s.svc.ListUsersSegments(ctx, req.GetUserIds(), func(list *api.UserExperimentList) error {
+		return stream.Send(userSegmentsToProto(list))
+	})
+	if err != nil {
+		return s.statusError(ctx, err)
+	}
+
+	return nil
+}
+
+func (s *Server) CreateReport(ctx context.Context, req *segmentsv1.CreateReportRequest) (*segmentsv1.Report, error) {
+	if req.GetUserId() == 0 || req.GetFrom() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id and from are required")
+	}
+
+	info, err := s.svc.CreateLog(ctx, req.GetUserId(), req.GetFrom())
+	if err != nil {
+		var parseErr *time.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid from: %v", err)
+		}
+
+		return nil, s.statusError(ctx, err)
+	}
+
+	return &segmentsv1.Report{UserId: info.UserID, From: info.From, Url: info.Path}, nil
+}
+
+// statusError maps errors of the service to status codes and hides the details of
+// unexpected ones from the client.
+func (s *Server) statusError(ctx context.Context, err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, storage.ErrSegmentExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, storage.ErrSegmentNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, rule.ErrSyntax) || errors.Is(err, service.ErrInvalidWindow) ||
+		errors.Is(err, service.ErrInvalidCapacity) || errors.Is(err, service.ErrInvalidPrerequisite):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	s.logger.ErrorContext(ctx, "call failed", "error", err)
+
+	return status.Error(codes.Internal, "Internal error")
+}
+
+func (s *Server) authUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (s *Server) authStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// authorize authenticates the call, checks the role the method requires and binds
+// the call to its namespace, like the role middleware of the HTTP API.
+func (s *Server) authorize(ctx context.Context, method string) (context.Context, error) {
+	role, ok := methodRoles[method]
+	if !ok {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	principal, err := s.authn.AuthenticateToken(ctx, token(md))
+	if err != nil {
+		if errors.Is(err, auth.ErrMissingCredentials) || errors.Is(err, auth.ErrInvalidCredentials) {
+			return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+		}
+
+		s.logger.ErrorContext(ctx, "couldn't authenticate call", "error", err)
+		return nil, status.Error(codes.Internal, "Internal error")
+	}
+
+	if !principal.Role.Allows(role) {
+		return nil, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+
+	ns := first(md, "x-namespace")
+	if ns == "" {
+		ns = principal.Namespace
+	}
+	if ns == "" {
+		ns = namespace.Default
+	}
+
+	if !namespace.Valid(ns) {
+		return nil, status.Error(codes.InvalidArgument, "Invalid namespace")
+	}
+	if !principal.CanAccess(ns) {
+		return nil, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+
+	return namespace.With(auth.WithPrincipal(ctx, principal), ns), nil
+}
+
+// token reads credentials from the x-api-key metadata or the authorization bearer
+// token.
+func token(md metadata.MD) string {
+	if key := first(md, "x-api-key"); key != "" {
+		return key
+	}
+
+	scheme, credentials, _ := strings.Cut(first(md, "authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(credentials)
+	}
+
+	return ""
+}
+
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+func (s *Server) logUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	s.logCall(ctx, info.FullMethod, start, err)
+
+	return resp, err
+}
+
+func (s *Server) logStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	s.logCall(ss.Context(), info.FullMethod, start, err)
+
+	return err
+}
+
+func (s *Server) logCall(ctx context.Context, method string, start time.Time, err error) {
+	if _, ok := methodRoles[method]; !ok {
+		return
+	}
+
+	s.logger.InfoContext(ctx, "call",
+		"method", method,
+		"code", status.Code(err).String(),
+		"duration", time.Since(start),
+	)
+}
+
+// serverStream replaces the context of a stream with the authorized one.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func settingsFromProto(settings *segmentsv1.SegmentSettings) api.SegmentSettings {
+	if settings == nil {
+		return api.SegmentSettings{}
+	}
+
+	return api.SegmentSettings{
+		Group:      settings.GetGroup(),
+		Requires:   settings.GetRequires(),
+		Rule:       settings.GetRule(),
+		StartsAt:   settings.GetStartsAt(),
+		EndsAt:     settings.GetEndsAt(),
+		MaxMembers: settings.MaxMembers,
+	}
+}
+
+func segmentToProto(segment *api.Segment) *segmentsv1.Segment {
+	return &segmentsv1.Segment{
+		Id:      segment.ID,
+		Name:    segment.Name,
+		Version: segment.Version,
+		Settings: &segmentsv1.SegmentSettings{
+			Group:      segment.Group,
+			Requires:   segment.Requires,
+			Rule:       segment.Rule,
+			StartsAt:   segment.StartsAt,
+			EndsAt:     segment.EndsAt,
+			MaxMembers: segment.MaxMembers,
+		},
+		Members: segment.Members,
+		Variant: segment.Variant,
+	}
+}
+
+func membershipsToProto(memberships []*api.UserExperiment) []*segmentsv1.Segment {
+	segments := make([]*segmentsv1.Segment, 0, len(memberships))
+	for _, m := range memberships {
+		segments = append(segments, segmentToProto(&m.Segment))
+	}
+
+	return segments
+}
+
+func userSegmentsToProto(list *api.UserExperimentList) *segmentsv1.UserSegments {
+	segments := make([]*segmentsv1.Segment, 0, len(list.Segments))
+	for i := range list.Segments {
+		segments = append(segments, segmentToProto(&list.Segments[i]))
+	}
+
+	return &segmentsv1.UserSegments{
+		UserId:   list.UserID,
+		Version:  list.Version,
+		Segments: segments,
+	}
+}
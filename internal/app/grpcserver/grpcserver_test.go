@@ -0,0 +1,194 @@
+package grpcserver_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/auth"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/grpcserver"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/memory"
+	segmentsv1 "github.com/psxzz/backend-trainee-assignment/pkg/pb/segments/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const adminKey = "sk_admin"
+
+type testServer struct {
+	svc    *service.Service
+	conn   *grpc.ClientConn
+	client segmentsv1.SegmentServiceClient
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	svc := service.New(memory.New(), t.TempDir())
+	srv := grpcserver.New(svc, auth.New(svc, auth.WithBootstrapKey(adminKey)))
+
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis) //nolint:errcheck
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &testServer{svc: svc, conn: conn, client: segmentsv1.NewSegmentServiceClient(conn)}
+}
+
+func withKey(key string, kv ...string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), append([]string{"x-api-key", key}, kv...)...)
+}
+
+func TestServer(t *testing.T) {
+	t.Run("manages segments and memberships", func(t *testing.T) {
+		s := newTestServer(t)
+		ctx := withKey(adminKey)
+
+		segment, err := s.client.CreateSegment(ctx, &segmentsv1.CreateSegmentRequest{
+			Name:     "AVITO_VOICE_MESSAGES",
+			Settings: &segmentsv1.SegmentSettings{Group: "voice"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "AVITO_VOICE_MESSAGES", segment.GetName())
+		assert.Equal(t, "voice", segment.GetSettings().GetGroup())
+
+		_, err = s.client.CreateSegment(ctx, &segmentsv1.CreateSegmentRequest{Name: "AVITO_VOICE_MESSAGES"})
+		assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+		_, err = s.client.CreateSegment(ctx, &segmentsv1.CreateSegmentRequest{
+			Name:     "AVITO_VOICE_CALLS",
+			Settings: &segmentsv1.SegmentSettings{Group: "voice"},
+		})
+		require.NoError(t, err)
+
+		updated, err := s.client.UpdateUserSegments(ctx, &segmentsv1.UpdateUserSegmentsRequest{
+			UserId: 1000,
+			Add:    []*segmentsv1.SegmentItem{{Name: "AVITO_VOICE_MESSAGES"}, {Name: "AVITO_VOICE_CALLS"}},
+		})
+		require.NoError(t, err)
+		require.Len(t, updated.GetAdded(), 1)
+		assert.Equal(t, "AVITO_VOICE_MESSAGES", updated.GetAdded()[0].GetName())
+		require.Len(t, updated.GetRejected(), 1)
+		assert.Equal(t, "AVITO_VOICE_CALLS", updated.GetRejected()[0].GetName())
+
+		list, err := s.client.GetUserSegments(ctx, &segmentsv1.GetUserSegmentsRequest{UserId: 1000})
+		require.NoError(t, err)
+		require.Len(t, list.GetSegments(), 1)
+		assert.Equal(t, "AVITO_VOICE_MESSAGES", list.GetSegments()[0].GetName())
+
+		report, err := s.client.CreateReport(ctx, &segmentsv1.CreateReportRequest{UserId: 1000, From: "2023-08"})
+		require.NoError(t, err)
+		assert.NotEmpty(t, report.GetUrl())
+
+		_, err = s.client.CreateReport(ctx, &segmentsv1.CreateReportRequest{UserId: 1000, From: "August"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = s.client.DeleteSegment(ctx, &segmentsv1.DeleteSegmentRequest{Name: "AVITO_VOICE_MESSAGES"})
+		require.NoError(t, err)
+
+		_, err = s.client.GetSegment(ctx, &segmentsv1.GetSegmentRequest{Name: "AVITO_VOICE_MESSAGES"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("streams segments of a batch of users", func(t *testing.T) {
+		s := newTestServer(t)
+		ctx := withKey(adminKey)
+
+		_, err := s.client.CreateSegment(ctx, &segmentsv1.CreateSegmentRequest{Name: "AVITO_DISCOUNT_30"})
+		require.NoError(t, err)
+		_, err = s.client.UpdateUserSegments(ctx, &segmentsv1.UpdateUserSegmentsRequest{
+			UserId: 1,
+			Add:    []*segmentsv1.SegmentItem{{Name: "AVITO_DISCOUNT_30"}},
+		})
+		require.NoError(t, err)
+
+		stream, err := s.client.BatchGetUserSegments(ctx, &segmentsv1.BatchGetUserSegmentsRequest{UserIds: []int64{1, 2}})
+		require.NoError(t, err)
+
+		got := make(map[int64]int)
+		for {
+			list, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			got[list.GetUserId()] = len(list.GetSegments())
+		}
+		assert.Equal(t, map[int64]int{1: 1, 2: 0}, got)
+
+		stream, err = s.client.BatchGetUserSegments(ctx, &segmentsv1.BatchGetUserSegmentsRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("checks credentials and roles", func(t *testing.T) {
+		s := newTestServer(t)
+
+		_, err := s.client.GetSegment(context.Background(), &segmentsv1.GetSegmentRequest{Name: "A"})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		_, err = s.client.GetSegment(withKey("sk_unknown"), &segmentsv1.GetSegmentRequest{Name: "A"})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		key, err := s.svc.CreateAPIKey(context.Background(), "reader", string(auth.RoleReader))
+		require.NoError(t, err)
+
+		_, err = s.client.CreateSegment(withKey(key.Key), &segmentsv1.CreateSegmentRequest{Name: "A"})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		_, err = s.client.GetSegment(withKey(key.Key), &segmentsv1.GetSegmentRequest{Name: "A"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+
+		// keys are bound to the namespace they were created in
+		_, err = s.client.GetSegment(withKey(key.Key, "x-namespace", "team-a"), &segmentsv1.GetSegmentRequest{Name: "A"})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		bearer := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+adminKey)
+		_, err = s.client.GetSegment(bearer, &segmentsv1.GetSegmentRequest{Name: "A"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("works in the namespace of the call", func(t *testing.T) {
+		s := newTestServer(t)
+
+		_, err := s.client.CreateSegment(withKey(adminKey, "x-namespace", "team-a"), &segmentsv1.CreateSegmentRequest{Name: "A"})
+		require.NoError(t, err)
+
+		_, err = s.svc.SegmentInfo(namespace.With(context.Background(), "team-a"), "A")
+		assert.NoError(t, err)
+
+		_, err = s.client.GetSegment(withKey(adminKey), &segmentsv1.GetSegmentRequest{Name: "A"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+
+		_, err = s.client.GetSegment(withKey(adminKey, "x-namespace", "Team A"), &segmentsv1.GetSegmentRequest{Name: "A"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("serves health checks without credentials", func(t *testing.T) {
+		s := newTestServer(t)
+
+		resp, err := healthpb.NewHealthClient(s.conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+	})
+}
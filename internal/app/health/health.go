@@ -0,0 +1,156 @@
+// Package health serves liveness and readiness probes. Readiness runs the registered
+// component checks and reports each of them, so orchestrators stop routing traffic
+// to an instance that can't serve it.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOK           = "ok"
+	StatusFail         = "fail"
+	StatusUnavailable  = "unavailable"
+	StatusShuttingDown = "shutting_down"
+)
+
+// checkTimeout bounds every readiness check.
+const checkTimeout = 3 * time.Second
+
+// Check returns nil if the component is able to serve requests.
+type Check func(context.Context) error
+
+type Component struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components,omitempty"`
+}
+
+type Health struct {
+	names        []string
+	checks       []Check
+	shuttingDown atomic.Bool
+}
+
+func New() *Health {
+	return &Health{}
+}
+
+// Add registers a readiness check of the named component. It must be called before
+// the probes are served.
+func (h *Health) Add(name string, check Check) {
+	h.names = append(h.names, name)
+	h.checks = append(h.checks, check)
+}
+
+// Shutdown switches readiness to not ready for the rest of the process lifetime.
+func (h *Health) Shutdown() {
+	h.shuttingDown.Store(true)
+}
+
+// Ready runs all checks concurrently and reports the result of each.
+func (h *Health) Ready(ctx context.Context) Report {
+	if h.shuttingDown.Load() {
+		return Report{Status: StatusShuttingDown}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	errs := make([]error, len(h.checks))
+
+	var wg sync.WaitGroup
+	for i, check := range h.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			errs[i] = check(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Components: make(map[string]Component, len(h.checks))}
+	for i, name := range h.names {
+		if errs[i] != nil {
+			report.Status = StatusUnavailable
+			report.Components[name] = Component{Status: StatusFail, Error: errs[i].Error()}
+			continue
+		}
+		report.Components[name] = Component{Status: StatusOK}
+	}
+
+	return report
+}
+
+// LiveHandler reports that the process is up and able to handle requests.
+func (h *Health) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, http.StatusOK, Report{Status: StatusOK})
+	})
+}
+
+// ReadyHandler responds with 200 if all checks pass and with 503 otherwise.
+func (h *Health) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.Ready(r.Context())
+
+		code := http.StatusOK
+		if report.Status != StatusOK {
+			code = http.StatusServiceUnavailable
+		}
+		writeReport(w, code, report)
+	})
+}
+
+func writeReport(w http.ResponseWriter, code int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// WritableDir checks that files can be created in dir, creating it if needed.
+func WritableDir(dir string) Check {
+	return func(context.Context) error {
+		if err := os.MkdirAll(dir, 0777); err != nil { //nolint:gomnd
+			return err
+		}
+
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+
+		return os.Remove(f.Name())
+	}
+}
+
+// Heartbeat checks that a background worker completed a run within maxAge. last
+// returns the time of its last successful run, zero if it hasn't run yet.
+func Heartbeat(last func() time.Time, maxAge time.Duration) Check {
+	return func(context.Context) error {
+		at := last()
+		if at.IsZero() {
+			return errors.New("hasn't run yet")
+		}
+
+		if age := time.Since(at); age > maxAge {
+			return fmt.Errorf("last successful run %s ago", age.Round(time.Second))
+		}
+
+		return nil
+	}
+}
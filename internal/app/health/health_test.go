@@ -0,0 +1,91 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ready(t *testing.T, h *health.Health) (int, health.Report) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ReadyHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var report health.Report
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+
+	return rec.Code, report
+}
+
+func TestReadiness(t *testing.T) {
+	t.Run("reports every component", func(t *testing.T) {
+		h := health.New()
+		h.Add("database", func(context.Context) error { return nil })
+		h.Add("schema", func(context.Context) error { return errors.New("schema version is 0, expected 1") })
+
+		code, report := ready(t, h)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, health.StatusUnavailable, report.Status)
+		assert.Equal(t, map[string]health.Component{
+			"database": {Status: health.StatusOK},
+			"schema":   {Status: health.StatusFail, Error: "schema version is 0, expected 1"},
+		}, report.Components)
+	})
+
+	t.Run("not ready during shutdown", func(t *testing.T) {
+		h := health.New()
+		h.Add("database", func(context.Context) error { return nil })
+
+		code, report := ready(t, h)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, health.StatusOK, report.Status)
+
+		h.Shutdown()
+		code, report = ready(t, h)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, health.StatusShuttingDown, report.Status)
+
+		rec := httptest.NewRecorder()
+		h.LiveHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
+
+func TestChecks(t *testing.T) {
+	t.Run("writable dir", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "logs")
+		assert.NoError(t, health.WritableDir(dir)(context.Background()))
+
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+
+		file := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(file, nil, 0600))
+		assert.Error(t, health.WritableDir(file)(context.Background()))
+	})
+
+	t.Run("heartbeat", func(t *testing.T) {
+		var last time.Time
+		check := health.Heartbeat(func() time.Time { return last }, time.Minute)
+
+		assert.EqualError(t, check(context.Background()), "hasn't run yet")
+
+		last = time.Now().Add(-time.Second)
+		assert.NoError(t, check(context.Background()))
+
+		last = time.Now().Add(-2 * time.Minute)
+		assert.Error(t, check(context.Background()))
+	})
+}
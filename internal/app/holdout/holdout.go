@@ -0,0 +1,75 @@
+// Package holdout selects the global population that never gets into experiments.
+package holdout
+
+import (
+	"hash/fnv"
+	"slices"
+	"strconv"
+)
+
+// buckets is the resolution of the percentage split: 0.01%.
+const buckets = 10000
+
+type Holdout struct {
+	percent float64
+	salt    string
+	users   map[int64]struct{}
+}
+
+// New creates a holdout of explicitly listed users and a percent of all users
+// selected by a stable hash of the salted user ID.
+func New(percent float64, salt string, users []int64) *Holdout {
+	h := &Holdout{
+		percent: percent,
+		salt:    salt,
+		users:   make(map[int64]struct{}, len(users)),
+	}
+
+	for _, userID := range users {
+		h.users[userID] = struct{}{}
+	}
+
+	return h
+}
+
+// Contains reports whether the user is in the holdout. A nil holdout is empty.
+func (h *Holdout) Contains(userID int64) bool {
+	if h == nil {
+		return false
+	}
+
+	if _, ok := h.users[userID]; ok {
+		return true
+	}
+
+	return h.percent > 0 && float64(h.bucket(userID)) < h.percent*buckets/100
+}
+
+// Hides reports whether the holdout hides a membership of the user. Holdout users
+// keep only the memberships they were forced into.
+func (h *Holdout) Hides(userID int64, forced bool) bool {
+	return !forced && h.Contains(userID)
+}
+
+// Settings returns what the holdout was created with, so a copy can be created
+// elsewhere. A nil holdout has zero settings.
+func (h *Holdout) Settings() (percent float64, salt string, users []int64) {
+	if h == nil {
+		return 0, "", nil
+	}
+
+	users = make([]int64, 0, len(h.users))
+	for userID := range h.users {
+		users = append(users, userID)
+	}
+	slices.Sort(users)
+
+	return h.percent, h.salt, users
+}
+
+func (h *Holdout) bucket(userID int64) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(h.salt + ":" + strconv.FormatInt(userID, 10))) //nolint:errcheck
+
+	return hash.Sum64() % buckets
+}
@@ -0,0 +1,130 @@
+package holdout_test
+
+import (
+	"testing"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/holdout"
+	"github.com/stretchr/testify/assert"
+)
+
+const users = 100000
+
+func TestContains(t *testing.T) {
+	tests := []struct {
+		name    string
+		holdout *holdout.Holdout
+		userID  int64
+		want    bool
+	}{
+		{name: "nil holdout", holdout: nil, userID: 1, want: false},
+		{name: "empty holdout", holdout: holdout.New(0, "salt", nil), userID: 1, want: false},
+		{name: "listed user", holdout: holdout.New(0, "salt", []int64{1, 2}), userID: 2, want: true},
+		{name: "unlisted user", holdout: holdout.New(0, "salt", []int64{1, 2}), userID: 3, want: false},
+		{name: "everyone", holdout: holdout.New(100, "salt", nil), userID: 3, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.holdout.Contains(tt.userID))
+		})
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		percent float64
+		// share is the expected fraction of users in the holdout, give or take delta
+		share, delta float64
+	}{
+		{percent: 0, share: 0, delta: 0},
+		{percent: 0.01, share: 0.0001, delta: 0.0001},
+		{percent: 1, share: 0.01, delta: 0.002},
+		{percent: 10, share: 0.1, delta: 0.005},
+		{percent: 50, share: 0.5, delta: 0.01},
+		{percent: 99.99, share: 0.9999, delta: 0.0001},
+		{percent: 100, share: 1, delta: 0},
+	}
+
+	for _, tt := range tests {
+		h := holdout.New(tt.percent, "salt", nil)
+
+		var in int
+		for userID := int64(1); userID <= users; userID++ {
+			if h.Contains(userID) {
+				in++
+			}
+		}
+
+		assert.InDelta(t, tt.share, float64(in)/users, tt.delta, "percent %v", tt.percent)
+	}
+}
+
+func TestStability(t *testing.T) {
+	t.Run("assigns the same users with the same salt", func(t *testing.T) {
+		a, b := holdout.New(10, "salt", nil), holdout.New(10, "salt", nil)
+
+		for userID := int64(1); userID <= users; userID++ {
+			assert.Equal(t, a.Contains(userID), b.Contains(userID), "user %d", userID)
+		}
+	})
+
+	t.Run("keeps users when the percent grows", func(t *testing.T) {
+		small, large := holdout.New(5, "salt", nil), holdout.New(10, "salt", nil)
+
+		for userID := int64(1); userID <= users; userID++ {
+			if small.Contains(userID) {
+				assert.True(t, large.Contains(userID), "user %d", userID)
+			}
+		}
+	})
+
+	t.Run("reshuffles users with another salt", func(t *testing.T) {
+		a, b := holdout.New(10, "salt", nil), holdout.New(10, "pepper", nil)
+
+		var differ int
+		for userID := int64(1); userID <= users; userID++ {
+			if a.Contains(userID) != b.Contains(userID) {
+				differ++
+			}
+		}
+
+		// independent 10% samples differ for about 18% of users
+		assert.InDelta(t, 0.18, float64(differ)/users, 0.01)
+	})
+}
+
+func TestHides(t *testing.T) {
+	h := holdout.New(0, "salt", []int64{1})
+
+	tests := []struct {
+		name    string
+		holdout *holdout.Holdout
+		userID  int64
+		forced  bool
+		want    bool
+	}{
+		{name: "holdout user", holdout: h, userID: 1, forced: false, want: true},
+		{name: "forced holdout user", holdout: h, userID: 1, forced: true, want: false},
+		{name: "other user", holdout: h, userID: 2, forced: false, want: false},
+		{name: "nil holdout", holdout: nil, userID: 1, forced: false, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.holdout.Hides(tt.userID, tt.forced))
+		})
+	}
+}
+
+func TestSettings(t *testing.T) {
+	percent, salt, listed := holdout.New(2.5, "salt", []int64{3, 1, 2}).Settings()
+	assert.Equal(t, 2.5, percent)
+	assert.Equal(t, "salt", salt)
+	assert.Equal(t, []int64{1, 2, 3}, listed)
+
+	var h *holdout.Holdout
+	percent, salt, listed = h.Settings()
+	assert.Zero(t, percent)
+	assert.Empty(t, salt)
+	assert.Nil(t, listed)
+}
@@ -0,0 +1,193 @@
+// Package idempotency makes mutating requests safe to retry. The first response to
+// a request with an Idempotency-Key header is stored and replayed to retries with
+// the same key.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/auth"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+)
+
+const (
+	// HeaderKey is the request header carrying the client's key.
+	HeaderKey = "Idempotency-Key"
+	// HeaderReplayed is set on responses replayed from the store.
+	HeaderReplayed = "Idempotent-Replayed"
+
+	// MaxKeyLength limits the keys clients can send.
+	MaxKeyLength = 255
+	// MaxBodySize limits the bodies of requests with a key, which are read into
+	// memory to be hashed.
+	MaxBodySize = 1 << 20
+
+	headerETag    = "ETag"
+	headerIfMatch = "If-Match"
+)
+
+// Store keeps requests and their responses by key.
+type Store interface {
+	// ReserveIdempotencyKey stores an in-progress record for key and returns nil, or
+	// returns the record already stored under key if it hasn't expired.
+	ReserveIdempotencyKey(ctx context.Context, key, requestHash string, expiresAt time.Time) (*storage.IdempotencyRecordDTO, error)
+	CompleteIdempotencyKey(ctx context.Context, key string, status int, contentType, etag string, body []byte) error
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+}
+
+// Middleware replays stored responses to requests with a known Idempotency-Key and
+// stores responses to new ones for ttl. Reusing a key for a different request, or
+// while the first request is still running, is a conflict. Requests without the
+// header are passed through.
+//
+// Keys are scoped to the client and namespace, so it must run after authentication.
+func Middleware(store Store, ttl time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			req := ctx.Request()
+
+			key := req.Header.Get(HeaderKey)
+			if key == "" {
+				return next(ctx)
+			}
+			if len(key) > MaxKeyLength {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					fmt.Sprintf("%s must be at most %d characters", HeaderKey, MaxKeyLength))
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(ctx.Response(), req.Body, MaxBodySize))
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+						fmt.Sprintf("Request body must be at most %d bytes", MaxBodySize))
+				}
+				return echo.NewHTTPError(http.StatusBadRequest, "Couldn't read request body")
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+
+			key = scopedKey(req.Context(), key)
+			hash := requestHash(req, body)
+
+			record, err := store.ReserveIdempotencyKey(req.Context(), key, hash, time.Now().Add(ttl))
+			if err != nil {
+				slog.ErrorContext(req.Context(), "couldn't reserve idempotency key", "error", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Internal error")
+			}
+
+			if record != nil {
+				return replay(ctx, record, hash)
+			}
+
+			res := ctx.Response()
+			rec := &recorder{ResponseWriter: res.Writer}
+			res.Writer = rec
+			err = next(ctx)
+			res.Writer = rec.ResponseWriter
+
+			// failed requests may be retried with the same key
+			if err != nil || !res.Committed || res.Status >= http.StatusInternalServerError {
+				if err := store.ReleaseIdempotencyKey(context.WithoutCancel(req.Context()), key); err != nil {
+					slog.ErrorContext(req.Context(), "couldn't release idempotency key", "error", err)
+				}
+				return err
+			}
+
+			if err := store.CompleteIdempotencyKey(context.WithoutCancel(req.Context()), key,
+				res.Status, res.Header().Get(echo.HeaderContentType), res.Header().Get(headerETag),
+				rec.body.Bytes()); err != nil {
+				slog.ErrorContext(req.Context(), "couldn't store idempotent response", "error", err)
+			}
+
+			return nil
+		}
+	}
+}
+
+// RunCleanup deletes expired records every interval until ctx is canceled.
+func RunCleanup(ctx context.Context, store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := store.DeleteExpiredIdempotencyKeys(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "couldn't delete expired idempotency keys", "error", err)
+				continue
+			}
+			if removed > 0 {
+				slog.DebugContext(ctx, "deleted expired idempotency keys", "count", removed)
+			}
+		}
+	}
+}
+
+func replay(ctx echo.Context, record *storage.IdempotencyRecordDTO, hash string) error {
+	if record.RequestHash != hash {
+		return echo.NewHTTPError(http.StatusConflict, HeaderKey+" was used with a different request")
+	}
+
+	if !record.Completed {
+		return echo.NewHTTPError(http.StatusConflict, "A request with this "+HeaderKey+" is in progress")
+	}
+
+	ctx.Response().Header().Set(HeaderReplayed, "true")
+	if record.ETag != "" {
+		ctx.Response().Header().Set(headerETag, record.ETag)
+	}
+	return ctx.Blob(record.Status, record.ContentType, record.Body)
+}
+
+// scopedKey ties key to the namespace and the caller. The parts are hashed, so the
+// stored key has a fixed length whatever the size of the principal's subject.
+func scopedKey(ctx context.Context, key string) string {
+	subject := ""
+	if principal := auth.FromContext(ctx); principal != nil {
+		subject = principal.Subject
+	}
+
+	h := sha256.New()
+	h.Write([]byte(namespace.FromContext(ctx) + "\x00" + subject + "\x00" + key))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// requestHash tells requests apart by route, precondition and body, so a key reused
+// for another endpoint or version is a conflict too.
+func requestHash(req *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	if ifMatch := req.Header.Get(headerIfMatch); ifMatch != "" {
+		h.Write([]byte(headerIfMatch + ": " + ifMatch + "\n"))
+	}
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder copies the response body while it's written to the client.
+type recorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
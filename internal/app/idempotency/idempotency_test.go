@@ -0,0 +1,198 @@
+package idempotency_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/auth"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/idempotency"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type server struct {
+	echo  *echo.Echo
+	calls int
+	// status is returned by the handler
+	status int
+	// before is called by the handler first if set
+	before func()
+	// header is added to every request
+	header http.Header
+}
+
+func newServer(store idempotency.Store, ttl time.Duration) *server {
+	s := &server{echo: echo.New(), status: http.StatusCreated}
+
+	withPrincipal := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			req := ctx.Request()
+			reqCtx := auth.WithPrincipal(req.Context(), &auth.Principal{Subject: req.Header.Get("X-Subject")})
+			ctx.SetRequest(req.WithContext(namespace.With(reqCtx, namespace.Default)))
+			return next(ctx)
+		}
+	}
+
+	handler := func(ctx echo.Context) error {
+		if s.before != nil {
+			s.before()
+		}
+		s.calls++
+		ctx.Response().Header().Set("ETag", fmt.Sprintf(`"%d"`, s.calls))
+		return ctx.JSON(s.status, map[string]int{"call": s.calls})
+	}
+
+	s.echo.POST("/experiments", handler, withPrincipal, idempotency.Middleware(store, ttl))
+	s.echo.POST("/overrides/set", handler, withPrincipal, idempotency.Middleware(store, ttl))
+
+	return s
+}
+
+func (s *server) do(path, key, subject, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-Subject", subject)
+	for name, values := range s.header {
+		req.Header[name] = values
+	}
+	if key != "" {
+		req.Header.Set(idempotency.HeaderKey, key)
+	}
+
+	rec := httptest.NewRecorder()
+	s.echo.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Run("replays the first response", func(t *testing.T) {
+		s := newServer(memory.New(), time.Hour)
+
+		first := s.do("/experiments", "key", "client", `{"user_id":1}`)
+		require.Equal(t, http.StatusCreated, first.Code)
+		assert.Empty(t, first.Header().Get(idempotency.HeaderReplayed))
+
+		retry := s.do("/experiments", "key", "client", `{"user_id":1}`)
+		assert.Equal(t, http.StatusCreated, retry.Code)
+		assert.Equal(t, "true", retry.Header().Get(idempotency.HeaderReplayed))
+		assert.Equal(t, first.Body.String(), retry.Body.String())
+		assert.Equal(t, first.Header().Get(echo.HeaderContentType), retry.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, `"1"`, retry.Header().Get("ETag"))
+		assert.Equal(t, 1, s.calls)
+	})
+
+	t.Run("passes requests without a key", func(t *testing.T) {
+		s := newServer(memory.New(), time.Hour)
+
+		s.do("/experiments", "", "client", `{"user_id":1}`)
+		s.do("/experiments", "", "client", `{"user_id":1}`)
+		assert.Equal(t, 2, s.calls)
+	})
+
+	t.Run("rejects a key reused for another request", func(t *testing.T) {
+		s := newServer(memory.New(), time.Hour)
+
+		s.do("/experiments", "key", "client", `{"user_id":1}`)
+
+		rec := s.do("/experiments", "key", "client", `{"user_id":2}`)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+
+		rec = s.do("/overrides/set", "key", "client", `{"user_id":1}`)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Equal(t, 1, s.calls)
+	})
+
+	t.Run("rejects a key reused with another precondition", func(t *testing.T) {
+		s := newServer(memory.New(), time.Hour)
+
+		s.header = http.Header{"If-Match": {`"1"`}}
+		s.do("/experiments", "key", "client", `{"user_id":1}`)
+
+		s.header = http.Header{"If-Match": {`"2"`}}
+		rec := s.do("/experiments", "key", "client", `{"user_id":1}`)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Equal(t, 1, s.calls)
+	})
+
+	t.Run("rejects a key while the request is in progress", func(t *testing.T) {
+		s := newServer(memory.New(), time.Hour)
+
+		var retry *httptest.ResponseRecorder
+		s.before = func() {
+			s.before = nil
+			retry = s.do("/experiments", "key", "client", `{"user_id":1}`)
+		}
+
+		rec := s.do("/experiments", "key", "client", `{"user_id":1}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		require.NotNil(t, retry)
+		assert.Equal(t, http.StatusConflict, retry.Code)
+		assert.Equal(t, 1, s.calls)
+	})
+
+	t.Run("scopes keys to the client", func(t *testing.T) {
+		s := newServer(memory.New(), time.Hour)
+
+		s.do("/experiments", "key", "client", `{"user_id":1}`)
+		rec := s.do("/experiments", "key", "other", `{"user_id":1}`)
+		assert.Empty(t, rec.Header().Get(idempotency.HeaderReplayed))
+		assert.Equal(t, 2, s.calls)
+	})
+
+	t.Run("lets failed requests be retried", func(t *testing.T) {
+		s := newServer(memory.New(), time.Hour)
+
+		s.status = http.StatusInternalServerError
+		rec := s.do("/experiments", "key", "client", `{"user_id":1}`)
+		require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+		s.status = http.StatusCreated
+		rec = s.do("/experiments", "key", "client", `{"user_id":1}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Empty(t, rec.Header().Get(idempotency.HeaderReplayed))
+		assert.Equal(t, 2, s.calls)
+	})
+
+	t.Run("forgets keys after ttl", func(t *testing.T) {
+		store := memory.New()
+		s := newServer(store, time.Millisecond)
+
+		s.do("/experiments", "key", "client", `{"user_id":1}`)
+		time.Sleep(5 * time.Millisecond)
+
+		rec := s.do("/experiments", "key", "client", `{"user_id":2}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Equal(t, 2, s.calls)
+
+		time.Sleep(5 * time.Millisecond)
+		removed, err := store.DeleteExpiredIdempotencyKeys(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), removed)
+	})
+
+	t.Run("rejects long keys", func(t *testing.T) {
+		s := newServer(memory.New(), time.Hour)
+
+		rec := s.do("/experiments", strings.Repeat("k", idempotency.MaxKeyLength+1), "client", `{}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, 0, s.calls)
+	})
+
+	t.Run("rejects large bodies", func(t *testing.T) {
+		s := newServer(memory.New(), time.Hour)
+
+		body := `{"user_id":1,"padding":"` + strings.Repeat("x", idempotency.MaxBodySize) + `"}`
+		rec := s.do("/experiments", "key", "client", body)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+		assert.Equal(t, 0, s.calls)
+	})
+}
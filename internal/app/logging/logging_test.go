@@ -0,0 +1,44 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.New(&buf, slog.LevelInfo)
+
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	logger.With("component", "test").InfoContext(ctx, "handled", "status", 200)
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "handled", record["msg"])
+	assert.Equal(t, "req-1", record["request_id"])
+	assert.Equal(t, "test", record["component"])
+	assert.NotContains(t, record, "trace_id")
+}
+
+func TestLevel(t *testing.T) {
+	level, err := logging.ParseLevel("warn")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	logger := logging.New(&buf, level)
+	logger.Info("skipped")
+	assert.Zero(t, buf.Len())
+
+	logger.Warn("written")
+	assert.Contains(t, buf.String(), `"level":"WARN"`)
+
+	_, err = logging.ParseLevel("verbose")
+	assert.Error(t, err)
+}
@@ -0,0 +1,247 @@
+// Package metrics collects Prometheus metrics of the service. A nil *Metrics is valid
+// and records nothing, so instrumented components work without metrics configured.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "segments"
+
+// totalsTimeout bounds the queries run on every scrape.
+const totalsTimeout = 5 * time.Second
+
+// TotalsFunc returns the number of active segments and memberships.
+type TotalsFunc func(context.Context) (segments, memberships int64, err error)
+
+// CacheStatsFunc returns the counters of the user segments cache and its size.
+type CacheStatsFunc func() (hits, misses, evictions, size int64)
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+	expired         prometheus.Counter
+	reports         *prometheus.CounterVec
+	rateLimited     *prometheus.CounterVec
+	webhooks        *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by route, method and status code.",
+		}, []string{"method", "route", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Storage operation latency by operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"op"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_errors_total",
+			Help:      "Number of failed storage operations by operation.",
+		}, []string{"op"}),
+		expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "expired_memberships_removed_total",
+			Help:      "Number of memberships removed by the expiry sweep.",
+		}),
+		reports: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reports_created_total",
+			Help:      "Number of user history reports by result.",
+		}, []string{"result"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_requests_total",
+			Help:      "Number of requests rejected by rate limits by route class.",
+		}, []string{"class"}),
+		webhooks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_deliveries_total",
+			Help:      "Number of webhook delivery attempts by result.",
+		}, []string{"result"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.storageDuration,
+		m.storageErrors,
+		m.expired,
+		m.reports,
+		m.rateLimited,
+		m.webhooks,
+	)
+
+	return m
+}
+
+// Handler serves metrics in Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// RegisterDB exports connection pool stats of db.
+func (m *Metrics) RegisterDB(db *sql.DB, name string) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// RegisterTotals exports active segment and membership gauges computed by fn on every scrape.
+func (m *Metrics) RegisterTotals(fn TotalsFunc) {
+	m.registry.MustRegister(&totalsCollector{
+		fn: fn,
+		segments: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "active"),
+			"Number of segments with an open activation window.", nil, nil),
+		memberships: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "memberships"),
+			"Number of not expired user memberships.", nil, nil),
+	})
+}
+
+// RegisterCache exports the user segments cache counters read from fn on every scrape.
+func (m *Metrics) RegisterCache(fn CacheStatsFunc) {
+	m.registry.MustRegister(&cacheCollector{
+		fn: fn,
+		hits: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", "hits_total"),
+			"Number of user segments lookups served from the cache.", nil, nil),
+		misses: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", "misses_total"),
+			"Number of user segments lookups that missed the cache.", nil, nil),
+		evictions: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", "evictions_total"),
+			"Number of users evicted from the cache to stay within its size.", nil, nil),
+		size: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", "size"),
+			"Number of users in the cache.", nil, nil),
+	})
+}
+
+func (m *Metrics) ObserveRequest(method, route string, code int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.requests.WithLabelValues(method, route, strconv.Itoa(code)).Inc()
+	m.requestDuration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ObserveStorage(op string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.storageDuration.WithLabelValues(op).Observe(duration.Seconds())
+	if err != nil {
+		m.storageErrors.WithLabelValues(op).Inc()
+	}
+}
+
+func (m *Metrics) ExpiredRemoved(n int64) {
+	if m == nil {
+		return
+	}
+
+	m.expired.Add(float64(n))
+}
+
+func (m *Metrics) ReportCreated(err error) {
+	if m == nil {
+		return
+	}
+
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.reports.WithLabelValues(result).Inc()
+}
+
+func (m *Metrics) RateLimited(class string) {
+	if m == nil {
+		return
+	}
+
+	m.rateLimited.WithLabelValues(class).Inc()
+}
+
+// WebhookDelivered counts a delivery attempt. Result is "delivered", "retry" or "dead".
+func (m *Metrics) WebhookDelivered(result string) {
+	if m == nil {
+		return
+	}
+
+	m.webhooks.WithLabelValues(result).Inc()
+}
+
+type totalsCollector struct {
+	fn          TotalsFunc
+	segments    *prometheus.Desc
+	memberships *prometheus.Desc
+}
+
+func (c *totalsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.segments
+	ch <- c.memberships
+}
+
+func (c *totalsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), totalsTimeout)
+	defer cancel()
+
+	segments, memberships, err := c.fn(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't collect totals", "error", err)
+		ch <- prometheus.NewInvalidMetric(c.segments, err)
+		ch <- prometheus.NewInvalidMetric(c.memberships, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.segments, prometheus.GaugeValue, float64(segments))
+	ch <- prometheus.MustNewConstMetric(c.memberships, prometheus.GaugeValue, float64(memberships))
+}
+
+type cacheCollector struct {
+	fn        CacheStatsFunc
+	hits      *prometheus.Desc
+	misses    *prometheus.Desc
+	evictions *prometheus.Desc
+	size      *prometheus.Desc
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+	ch <- c.size
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	hits, misses, evictions, size := c.fn()
+
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(misses))
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(evictions))
+	ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(size))
+}
@@ -0,0 +1,57 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("exposes recorded metrics", func(t *testing.T) {
+		m := metrics.New()
+		m.ObserveRequest("POST", "/list", 200, time.Millisecond)
+		m.ObserveStorage("storage.postgresql.UserSegments", time.Millisecond, errors.New("boom"))
+		m.ExpiredRemoved(3)
+		m.ReportCreated(nil)
+		m.RateLimited("read")
+		m.RegisterTotals(func(context.Context) (int64, int64, error) { return 2, 5, nil })
+		m.RegisterCache(func() (int64, int64, int64, int64) { return 7, 3, 1, 2 })
+
+		rec := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body, err := io.ReadAll(rec.Body)
+		assert.NoError(t, err)
+
+		for _, line := range []string{
+			`segments_http_requests_total{code="200",method="POST",route="/list"} 1`,
+			`segments_storage_operation_errors_total{op="storage.postgresql.UserSegments"} 1`,
+			`segments_expired_memberships_removed_total 3`,
+			`segments_reports_created_total{result="success"} 1`,
+			`segments_rate_limited_requests_total{class="read"} 1`,
+			`segments_active 2`,
+			`segments_memberships 5`,
+			`segments_cache_hits_total 7`,
+			`segments_cache_misses_total 3`,
+			`segments_cache_evictions_total 1`,
+			`segments_cache_size 2`,
+		} {
+			assert.Contains(t, string(body), line)
+		}
+	})
+
+	t.Run("ignores records without metrics", func(t *testing.T) {
+		var m *metrics.Metrics
+		assert.NotPanics(t, func() {
+			m.ObserveRequest("POST", "/list", 200, time.Millisecond)
+			m.ObserveStorage("storage.postgresql.UserSegments", time.Millisecond, nil)
+			m.ExpiredRemoved(1)
+			m.ReportCreated(nil)
+		})
+	})
+}
@@ -0,0 +1,35 @@
+// Package namespace carries the namespace of a request in its context. Storages
+// scope segments, memberships, attributes, logs and API keys to it, so teams can
+// reuse segment names without colliding.
+package namespace
+
+import (
+	"context"
+	"regexp"
+)
+
+// Default is the namespace of requests that don't specify one.
+const Default = "default"
+
+var nameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+type key struct{}
+
+// Valid reports whether name can be used as a namespace: up to 64 lowercase
+// letters, digits, dashes and underscores.
+func Valid(name string) bool {
+	return nameRe.MatchString(name)
+}
+
+func With(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, key{}, name)
+}
+
+// FromContext returns the namespace of ctx or Default.
+func FromContext(ctx context.Context) string {
+	if name, ok := ctx.Value(key{}).(string); ok && name != "" {
+		return name
+	}
+
+	return Default
+}
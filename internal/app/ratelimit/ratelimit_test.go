@@ -0,0 +1,72 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	t.Run("rejects requests over burst", func(t *testing.T) {
+		var (
+			m     = ratelimit.NewMemory()
+			limit = ratelimit.Limit{Rate: 1, Burst: 2}
+		)
+
+		res, err := m.Take(context.Background(), "key", limit)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, 2, res.Limit)
+		assert.Equal(t, 1, res.Remaining)
+
+		res, err = m.Take(context.Background(), "key", limit)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, 0, res.Remaining)
+
+		res, err = m.Take(context.Background(), "key", limit)
+		require.NoError(t, err)
+		assert.False(t, res.Allowed)
+		assert.InDelta(t, time.Second, res.RetryAfter, float64(100*time.Millisecond))
+		assert.InDelta(t, 2*time.Second, res.Reset, float64(100*time.Millisecond))
+	})
+
+	t.Run("keeps keys apart", func(t *testing.T) {
+		var (
+			m     = ratelimit.NewMemory()
+			limit = ratelimit.Limit{Rate: 1, Burst: 1}
+		)
+
+		res, err := m.Take(context.Background(), "a", limit)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+
+		res, err = m.Take(context.Background(), "b", limit)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+
+		res, err = m.Take(context.Background(), "a", limit)
+		require.NoError(t, err)
+		assert.False(t, res.Allowed)
+	})
+
+	t.Run("refills over time", func(t *testing.T) {
+		var (
+			m     = ratelimit.NewMemory()
+			limit = ratelimit.Limit{Rate: 100, Burst: 1}
+		)
+
+		res, err := m.Take(context.Background(), "key", limit)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+
+		assert.Eventually(t, func() bool {
+			res, err := m.Take(context.Background(), "key", limit)
+			return err == nil && res.Allowed
+		}, time.Second, 5*time.Millisecond)
+	})
+}
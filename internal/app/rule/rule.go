@@ -0,0 +1,320 @@
+// Package rule implements targeting expressions evaluated over user attributes, e.g.
+//
+//	region in ["MSK", "SPB"] AND platform == "ios"
+//
+// Supported operators are ==, !=, <, <=, >, >=, in, not in, AND, OR, NOT and parentheses.
+// Values are compared as numbers when both sides are numeric and as strings otherwise,
+// so dates in 2006-01-02 format compare chronologically.
+package rule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+)
+
+var ErrSyntax = api.ErrRuleSyntax
+
+type Rule struct {
+	source string
+	root   node
+}
+
+// Parse compiles an expression into a rule.
+func Parse(expr string) (*Rule, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("%w: unexpected %q at position %d", ErrSyntax, tok.text, tok.pos)
+	}
+
+	return &Rule{source: expr, root: root}, nil
+}
+
+// Match reports whether the attributes satisfy the rule. Comparisons against
+// missing attributes are false.
+func (r *Rule) Match(attributes map[string]string) bool {
+	return r.root.eval(attributes)
+}
+
+func (r *Rule) String() string {
+	return r.source
+}
+
+type node interface {
+	eval(map[string]string) bool
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) eval(attrs map[string]string) bool {
+	return n.left.eval(attrs) && n.right.eval(attrs)
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) eval(attrs map[string]string) bool {
+	return n.left.eval(attrs) || n.right.eval(attrs)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) eval(attrs map[string]string) bool {
+	return !n.operand.eval(attrs)
+}
+
+type compareNode struct {
+	attribute string
+	operator  string
+	value     string
+}
+
+func (n compareNode) eval(attrs map[string]string) bool {
+	actual, ok := attrs[n.attribute]
+	if !ok {
+		return false
+	}
+
+	cmp := compare(actual, n.value)
+
+	switch n.operator {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+
+	return false
+}
+
+type inNode struct {
+	attribute string
+	values    []string
+	negated   bool
+}
+
+func (n inNode) eval(attrs map[string]string) bool {
+	actual, ok := attrs[n.attribute]
+	if !ok {
+		return false
+	}
+
+	for _, value := range n.values {
+		if compare(actual, value) == 0 {
+			return !n.negated
+		}
+	}
+
+	return n.negated
+}
+
+func compare(a, b string) int {
+	x, errX := strconv.ParseFloat(a, 64)
+	y, errY := strconv.ParseFloat(b, 64)
+
+	if errX == nil && errY == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return strings.Compare(a, b)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+
+	return tok
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, fmt.Errorf("%w: expected %s at position %d", ErrSyntax, what, tok.pos)
+	}
+
+	return tok, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().isKeyword("or") {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().isKeyword("and") {
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.peek().isKeyword("not") {
+		p.next()
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return notNode{operand: operand}, nil
+	}
+
+	if p.peek().kind == tokenLParen {
+		p.next()
+
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := p.expect(tokenRParen, "')'"); err != nil {
+			return nil, err
+		}
+
+		return inner, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	ident, err := p.expect(tokenIdent, "attribute name")
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.next()
+
+	switch {
+	case tok.kind == tokenOperator:
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		return compareNode{attribute: ident.text, operator: tok.text, value: value}, nil
+	case tok.isKeyword("in"):
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+
+		return inNode{attribute: ident.text, values: values}, nil
+	case tok.isKeyword("not"):
+		if in := p.next(); !in.isKeyword("in") {
+			return nil, fmt.Errorf("%w: expected 'in' at position %d", ErrSyntax, in.pos)
+		}
+
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+
+		return inNode{attribute: ident.text, values: values, negated: true}, nil
+	}
+
+	return nil, fmt.Errorf("%w: expected operator at position %d", ErrSyntax, tok.pos)
+}
+
+func (p *parser) parseValue() (string, error) {
+	tok := p.next()
+	if tok.kind != tokenString && tok.kind != tokenNumber {
+		return "", fmt.Errorf("%w: expected value at position %d", ErrSyntax, tok.pos)
+	}
+
+	return tok.text, nil
+}
+
+func (p *parser) parseList() ([]string, error) {
+	if _, err := p.expect(tokenLBracket, "'['"); err != nil {
+		return nil, err
+	}
+
+	var values []string
+
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		tok := p.next()
+		if tok.kind == tokenRBracket {
+			return values, nil
+		}
+		if tok.kind != tokenComma {
+			return nil, fmt.Errorf("%w: expected ',' or ']' at position %d", ErrSyntax, tok.pos)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package rule_test
+
+import (
+	"testing"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/rule"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	attrs := map[string]string{
+		"region":        "MSK",
+		"platform":      "ios",
+		"age":           "27",
+		"registered_at": "2023-05-14",
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`region in ["MSK", "SPB"] AND platform == "ios"`, true},
+		{`region in ["EKB"] OR platform == "android"`, false},
+		{`region not in ["EKB"]`, true},
+		{`NOT (platform == "ios")`, false},
+		{`age >= 18 and age < 30`, true},
+		{`age > 100`, false},
+		{`registered_at < "2023-06-01"`, true},
+		{`platform != "android"`, true},
+		{`country == "RU"`, false},
+		{`country != "RU"`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			r, err := rule.Parse(tt.expr)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, r.Match(attrs))
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`region = "MSK"`,
+		`region in "MSK"`,
+		`(region == "MSK"`,
+		`region == "MSK" AND`,
+		`region == "MSK`,
+	} {
+		t.Run(expr, func(t *testing.T) {
+			_, err := rule.Parse(expr)
+			assert.ErrorIs(t, err, rule.ErrSyntax)
+		})
+	}
+}
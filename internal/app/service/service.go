@@ -1,18 +1,31 @@
 package service
 
 import (
+	"cmp"
 	"context"
 	"encoding/csv"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/psxzz/backend-trainee-assignment/internal/app/model"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/auth"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/evaluation"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/holdout"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/metrics"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
 	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/webhook"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -20,57 +33,372 @@ const (
 	logFilenameTemplate = "log_user_%d_%v.csv"
 )
 
+var (
+	ErrPrerequisitesNotMet = api.ErrPrerequisitesNotMet
+	ErrInvalidWindow       = api.ErrInvalidWindow
+	ErrInvalidCapacity     = api.ErrInvalidCapacity
+	ErrUserInHoldout       = api.ErrUserInHoldout
+	ErrInvalidOverride     = api.ErrInvalidOverride
+	ErrInvalidRole         = api.ErrInvalidRole
+	ErrInvalidPrerequisite = api.ErrInvalidPrerequisite
+	ErrInvalidWebhook      = api.ErrInvalidWebhook
+	ErrInvalidEventFilter  = api.ErrInvalidEventFilter
+)
+
+// webhookEvents are the event types webhooks and event streams can subscribe to.
+var webhookEvents = []string{
+	storage.EventMembershipAdded,
+	storage.EventMembershipRemoved,
+	storage.EventMembershipExpired,
+	storage.EventSegmentCreated,
+	storage.EventSegmentUpdated,
+	storage.EventSegmentDeleted,
+}
+
+// maxWebhookDeliveries limits the deliveries listed at once.
+const maxWebhookDeliveries = 1000
+
+const (
+	OverrideModeInclude = evaluation.OverrideModeInclude
+	OverrideModeExclude = evaluation.OverrideModeExclude
+)
+
+var tracer = otel.Tracer("github.com/psxzz/backend-trainee-assignment/internal/app/service")
+
+// PrerequisitePolicy decides what happens to dependent segments
+// when a user is removed from their prerequisite.
+type PrerequisitePolicy string
+
+const (
+	PrerequisitePolicyKeep    PrerequisitePolicy = "keep"
+	PrerequisitePolicyCascade PrerequisitePolicy = "cascade"
+)
+
 type Storage interface {
 	AddSegment(context.Context, string) (*storage.SegmentDTO, error)
+	AddSegmentWithSettings(context.Context, string, storage.SegmentSettingsDTO) (*storage.SegmentDTO, error)
+	UpdateSegment(context.Context, string, storage.SegmentSettingsDTO, int64) (*storage.SegmentDTO, error)
 	DeleteSegment(context.Context, string) (*storage.SegmentDTO, error)
-	AddUserToSegment(context.Context, int64, string) (*storage.UserExperimentDTO, error)
-	AddUserToSegmentWithExpiracy(context.Context, int64, string, time.Time) (*storage.UserExperimentDTO, error)
+	DeleteSegmentWithVersion(context.Context, string, int64) (*storage.SegmentDTO, error)
+	AddUserToSegment(context.Context, int64, string, bool) (*storage.UserExperimentDTO, error)
+	AddUserToSegmentWithExpiracy(context.Context, int64, string, time.Time, bool) (*storage.UserExperimentDTO, error)
 	DeleteUserFromSegment(context.Context, int64, string) (*storage.UserExperimentDTO, error)
+	Segment(context.Context, string) (*storage.SegmentDTO, error)
+	SegmentDependents(context.Context, string) ([]string, error)
+	SegmentMembers(context.Context, string) (int64, error)
 	UserSegments(context.Context, int64) (*storage.UserExperimentListDTO, error)
+	UsersSegments(context.Context, []int64) (map[int64][]storage.SegmentDTO, error)
+	UserVersion(context.Context, int64) (int64, error)
+	BumpUserVersion(context.Context, int64, int64) (int64, error)
+	RuleSegments(context.Context) ([]storage.SegmentDTO, error)
+	SetUserAttributes(context.Context, int64, map[string]string) error
+	UserAttributes(context.Context, int64) (map[string]string, error)
+	UsersAttributes(context.Context, []int64) (map[int64]map[string]string, error)
 	UserExperimentLogs(context.Context, int64, time.Time) ([]*storage.UserExperimentLogRecordDTO, error)
-	DeleteOldExperiments(context.Context) error
+	DeleteOldExperiments(context.Context) (int64, error)
+	SyncSegmentWindows(context.Context) ([]*storage.SegmentLogRecordDTO, error)
+	SetOverride(context.Context, storage.OverrideDTO) (*storage.OverrideDTO, error)
+	DeleteOverride(context.Context, int64, string, string) (*storage.OverrideDTO, error)
+	UserOverrides(context.Context, int64) ([]storage.OverrideDTO, error)
+	UsersOverrides(context.Context, []int64) (map[int64][]storage.OverrideDTO, error)
+	Overrides(context.Context) ([]storage.OverrideDTO, error)
+	AddAPIKey(context.Context, storage.APIKeyDTO) (*storage.APIKeyDTO, error)
+	RevokeAPIKey(context.Context, int64) (*storage.APIKeyDTO, error)
+	APIKeyByHash(context.Context, string) (*storage.APIKeyDTO, error)
+	APIKeys(context.Context) ([]storage.APIKeyDTO, error)
+	Namespaces(context.Context) ([]string, error)
+	AddWebhook(context.Context, storage.WebhookDTO) (*storage.WebhookDTO, error)
+	DeleteWebhook(context.Context, int64) (*storage.WebhookDTO, error)
+	Webhooks(context.Context) ([]storage.WebhookDTO, error)
+	WebhookDeliveries(context.Context, string, int) ([]storage.WebhookDeliveryDTO, error)
+	ReplayWebhookDelivery(context.Context, int64) (*storage.WebhookDeliveryDTO, error)
+	EventsAfter(context.Context, int64, int) ([]storage.WebhookEventDTO, error)
+	LastEventID(context.Context) (int64, error)
+}
+
+// EventFilter selects events of a stream. Empty fields match all events.
+type EventFilter struct {
+	Segments []string
+	Types    []string
+	UserID   int64
+}
+
+func (f EventFilter) validate() error {
+	for _, eventType := range f.Types {
+		if !slices.Contains(webhookEvents, eventType) {
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidEventFilter, eventType)
+		}
+	}
+
+	if f.UserID < 0 {
+		return fmt.Errorf("%w: invalid user id", ErrInvalidEventFilter)
+	}
+
+	return nil
+}
+
+func (f EventFilter) match(event *storage.WebhookEventDTO) bool {
+	return (len(f.Segments) == 0 || slices.Contains(f.Segments, event.Segment)) &&
+		(len(f.Types) == 0 || slices.Contains(f.Types, event.Type)) &&
+		(f.UserID == 0 || f.UserID == event.UserID)
 }
 
 type Service struct {
-	storage  Storage
-	logsPath string
+	storage            Storage
+	logsPath           string
+	prerequisitePolicy PrerequisitePolicy
+	holdout            *holdout.Holdout
+	metrics            *metrics.Metrics
+	logger             *slog.Logger
+	evaluator          *evaluation.Evaluator
+	lastSchedulerRun   atomic.Int64
+}
+
+type Option func(*Service)
+
+func WithPrerequisitePolicy(policy PrerequisitePolicy) Option {
+	return func(svc *Service) {
+		svc.prerequisitePolicy = policy
+	}
+}
+
+// WithHoldout excludes the holdout users from experiments.
+func WithHoldout(h *holdout.Holdout) Option {
+	return func(svc *Service) {
+		svc.holdout = h
+	}
+}
+
+// WithMetrics records expiry sweep results and report counts.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(svc *Service) {
+		svc.metrics = m
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(svc *Service) {
+		svc.logger = logger
+	}
 }
 
-func New(storage Storage, logsPath string) *Service {
+func New(storage Storage, logsPath string, opts ...Option) *Service {
 	logsPath = strings.TrimRight(logsPath, "/")
 
-	return &Service{
-		storage:  storage,
-		logsPath: logsPath,
+	svc := &Service{
+		storage:            storage,
+		logsPath:           logsPath,
+		prerequisitePolicy: PrerequisitePolicyKeep,
+		logger:             slog.Default(),
+	}
+
+	for _, opt := range opts {
+		opt(svc)
 	}
+
+	svc.evaluator = evaluation.New(svc.logger)
+
+	return svc
 }
 
-func (svc *Service) CreateSegment(ctx context.Context, name string) (*model.Segment, error) {
+func (svc *Service) CreateSegment(ctx context.Context, name string) (*api.Segment, error) {
+	ctx, span := tracer.Start(ctx, "service.CreateSegment",
+		trace.WithAttributes(attribute.String("segment", name)))
+	defer span.End()
+
 	segmentDTO, err := svc.storage.AddSegment(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 
-	return &model.Segment{
-		ID:   segmentDTO.ID,
-		Name: segmentDTO.Name,
+	return evaluation.SegmentFromDTO(segmentDTO), nil
+}
+
+func (svc *Service) CreateSegmentWithSettings(ctx context.Context, name string, settings api.SegmentSettings) (*api.Segment, error) {
+	ctx, span := tracer.Start(ctx, "service.CreateSegmentWithSettings",
+		trace.WithAttributes(attribute.String("segment", name)))
+	defer span.End()
+
+	settingsDTO, err := svc.segmentSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	segmentDTO, err := svc.storage.AddSegmentWithSettings(ctx, name, settingsDTO)
+	if err != nil {
+		return nil, err
+	}
+
+	return evaluation.SegmentFromDTO(segmentDTO), nil
+}
+
+// UpdateSegment replaces the segment settings if the segment is still at version.
+// A zero version updates it unconditionally.
+func (svc *Service) UpdateSegment(ctx context.Context, name string, settings api.SegmentSettings, version int64) (*api.Segment, error) {
+	ctx, span := tracer.Start(ctx, "service.UpdateSegment",
+		trace.WithAttributes(attribute.String("segment", name), attribute.Int64("version", version)))
+	defer span.End()
+
+	settingsDTO, err := svc.segmentSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	cyclic, err := svc.requires(ctx, settingsDTO.Requires, name)
+	if err != nil {
+		return nil, err
+	}
+	if cyclic {
+		return nil, fmt.Errorf("%w: segment can't require itself", ErrInvalidPrerequisite)
+	}
+
+	segmentDTO, err := svc.storage.UpdateSegment(ctx, name, settingsDTO, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return evaluation.SegmentFromDTO(segmentDTO), nil
+}
+
+// requires reports whether target is one of names or their transitive prerequisites.
+// Unknown segments are skipped and left for the storage to reject.
+func (svc *Service) requires(ctx context.Context, names []string, target string) (bool, error) {
+	visited := make(map[string]struct{})
+	queue := append([]string(nil), names...)
+
+	for i := 0; i < len(queue); i++ {
+		name := queue[i]
+		if name == target {
+			return true, nil
+		}
+
+		if _, ok := visited[name]; ok {
+			continue
+		}
+		visited[name] = struct{}{}
+
+		segment, err := svc.storage.Segment(ctx, name)
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		queue = append(queue, segment.Requires...)
+	}
+
+	return false, nil
+}
+
+// segmentSettings validates the settings and converts them for the storage.
+func (svc *Service) segmentSettings(settings api.SegmentSettings) (storage.SegmentSettingsDTO, error) {
+	if settings.Rule != "" {
+		if _, err := svc.evaluator.Compile(settings.Rule); err != nil {
+			return storage.SegmentSettingsDTO{}, err
+		}
+	}
+
+	if settings.MaxMembers != nil {
+		if *settings.MaxMembers <= 0 {
+			return storage.SegmentSettingsDTO{}, fmt.Errorf("%w: max_members must be positive", ErrInvalidCapacity)
+		}
+		if settings.Rule != "" {
+			return storage.SegmentSettingsDTO{}, fmt.Errorf("%w: rule-based segments can't be limited", ErrInvalidCapacity)
+		}
+	}
+
+	startsAt, endsAt, err := parseWindow(settings.StartsAt, settings.EndsAt)
+	if err != nil {
+		return storage.SegmentSettingsDTO{}, err
+	}
+
+	return storage.SegmentSettingsDTO{
+		Group:      settings.Group,
+		Requires:   uniqueNames(settings.Requires),
+		Rule:       settings.Rule,
+		StartsAt:   startsAt,
+		EndsAt:     endsAt,
+		MaxMembers: settings.MaxMembers,
 	}, nil
 }
 
-func (svc *Service) DeleteSegment(ctx context.Context, name string) (*model.Segment, error) {
+// SegmentInfo returns the segment settings together with the current number of members.
+func (svc *Service) SegmentInfo(ctx context.Context, name string) (*api.Segment, error) {
+	ctx, span := tracer.Start(ctx, "service.SegmentInfo",
+		trace.WithAttributes(attribute.String("segment", name)))
+	defer span.End()
+
+	segmentDTO, err := svc.storage.Segment(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := svc.storage.SegmentMembers(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	segment := evaluation.SegmentFromDTO(segmentDTO)
+	segment.Members = &members
+
+	return segment, nil
+}
+
+func (svc *Service) DeleteSegment(ctx context.Context, name string) (*api.Segment, error) {
+	ctx, span := tracer.Start(ctx, "service.DeleteSegment",
+		trace.WithAttributes(attribute.String("segment", name)))
+	defer span.End()
+
 	segmentDTO, err := svc.storage.DeleteSegment(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 
-	return &model.Segment{
-		ID:   segmentDTO.ID,
-		Name: segmentDTO.Name,
-	}, nil
+	return evaluation.SegmentFromDTO(segmentDTO), nil
 }
 
-func (svc *Service) AddUserExperiments(ctx context.Context, userID int64, segments []*model.UserExperimentItem) ([]*model.UserExperiment, error) {
-	experiments := make([]*model.UserExperiment, 0, len(segments))
+// DeleteSegmentWithVersion deletes the segment if it is still at version.
+func (svc *Service) DeleteSegmentWithVersion(ctx context.Context, name string, version int64) (*api.Segment, error) {
+	ctx, span := tracer.Start(ctx, "service.DeleteSegmentWithVersion",
+		trace.WithAttributes(attribute.String("segment", name), attribute.Int64("version", version)))
+	defer span.End()
+
+	segmentDTO, err := svc.storage.DeleteSegmentWithVersion(ctx, name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return evaluation.SegmentFromDTO(segmentDTO), nil
+}
+
+// UserVersion returns the version of the user's memberships. It changes whenever
+// the user is added to or removed from a segment.
+func (svc *Service) UserVersion(ctx context.Context, userID int64) (int64, error) {
+	return svc.storage.UserVersion(ctx, userID)
+}
+
+// CheckUserVersion claims the next version of the user's memberships if they are
+// still at version, so concurrent changes made against the same version fail
+// with storage.ErrVersionMismatch.
+func (svc *Service) CheckUserVersion(ctx context.Context, userID, version int64) error {
+	_, err := svc.storage.BumpUserVersion(ctx, userID, version)
+	return err
+}
+
+func (svc *Service) AddUserExperiments(ctx context.Context, userID int64, segments []*api.UserExperimentItem) ([]*api.UserExperiment, []*api.RejectedExperiment, error) {
+	ctx, span := tracer.Start(ctx, "service.AddUserExperiments",
+		trace.WithAttributes(attribute.Int64("user_id", userID), attribute.Int("segments", len(segments))))
+	defer span.End()
+
+	experiments := make([]*api.UserExperiment, 0, len(segments))
+	rejected := make([]*api.RejectedExperiment, 0)
+
+	members, err := svc.userSegmentNames(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inHoldout := svc.holdout.Contains(userID)
 
 	for _, segment := range segments {
 		var (
@@ -79,50 +407,78 @@ func (svc *Service) AddUserExperiments(ctx context.Context, userID int64, segmen
 			err       error
 		)
 
+		if inHoldout && !segment.Force {
+			rejected = append(rejected, &api.RejectedExperiment{
+				Name:   segment.Name,
+				Reason: ErrUserInHoldout.Error(),
+			})
+			continue
+		}
+
+		missing, err := svc.missingPrerequisites(ctx, segment.Name, members)
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(missing) > 0 {
+			rejected = append(rejected, &api.RejectedExperiment{
+				Name:   segment.Name,
+				Reason: fmt.Sprintf("%v: %s", ErrPrerequisitesNotMet, strings.Join(missing, ", ")),
+			})
+			continue
+		}
+
 		if segment.ExpiresAt == "" {
-			expDTO, err = svc.storage.AddUserToSegment(ctx, userID, segment.Name)
+			expDTO, err = svc.storage.AddUserToSegment(ctx, userID, segment.Name, segment.Force)
 		} else {
 			expiresAt, err = time.Parse(time.DateTime, segment.ExpiresAt)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			expiresAt = expiresAt.Add(time.Duration(-3) * time.Hour)
-			expDTO, err = svc.storage.AddUserToSegmentWithExpiracy(ctx, userID, segment.Name, expiresAt)
+			expDTO, err = svc.storage.AddUserToSegmentWithExpiracy(ctx, userID, segment.Name, expiresAt, segment.Force)
+		}
+
+		if errors.Is(err, storage.ErrExclusionGroupConflict) || errors.Is(err, storage.ErrCapacityExceeded) {
+			rejected = append(rejected, &api.RejectedExperiment{
+				Name:   segment.Name,
+				Reason: rejectionReason(err),
+			})
+			continue
 		}
 
 		if err != nil &&
 			!(errors.Is(err, storage.ErrSegmentNotFound) ||
 				errors.Is(err, storage.ErrAlreadyInExperiment)) {
-			return nil, err
+			return nil, nil, err
 		}
 
 		if expDTO == nil {
 			continue
 		}
 
-		exp := &model.UserExperiment{
-			ID:     expDTO.ID,
-			UserID: expDTO.UserID,
-			Segment: model.Segment{
-				ID:   expDTO.Segment.ID,
-				Name: expDTO.Segment.Name,
-			},
-		}
-
-		experiments = append(experiments, exp)
+		members[expDTO.Segment.Name] = struct{}{}
+		experiments = append(experiments, experimentFromDTO(expDTO))
 	}
 
-	if err := svc.storage.DeleteOldExperiments(ctx); err != nil {
-		log.Println(err)
-	}
+	svc.deleteOldExperiments(ctx)
 
-	return experiments, nil
+	return experiments, rejected, nil
 }
 
-func (svc *Service) RemoveUserExperiments(ctx context.Context, userID int64, segmentNames []string) ([]*model.UserExperiment, error) {
-	experiments := make([]*model.UserExperiment, 0, len(segmentNames))
+func (svc *Service) RemoveUserExperiments(ctx context.Context, userID int64, segmentNames []string) ([]*api.UserExperiment, error) {
+	ctx, span := tracer.Start(ctx, "service.RemoveUserExperiments",
+		trace.WithAttributes(attribute.Int64("user_id", userID), attribute.Int("segments", len(segmentNames))))
+	defer span.End()
 
-	for _, segmentName := range segmentNames {
+	experiments := make([]*api.UserExperiment, 0, len(segmentNames))
+	queue := append([]string(nil), segmentNames...)
+
+	for i := 0; i < len(queue); i++ {
+		segmentName := queue[i]
 		expDTO, err := svc.storage.DeleteUserFromSegment(ctx, userID, segmentName)
 
 		if err != nil &&
@@ -135,44 +491,587 @@ func (svc *Service) RemoveUserExperiments(ctx context.Context, userID int64, seg
 			continue
 		}
 
-		exp := &model.UserExperiment{
-			ID:     expDTO.ID,
-			UserID: expDTO.UserID,
-			Segment: model.Segment{
-				ID:   expDTO.Segment.ID,
-				Name: expDTO.Segment.Name,
-			},
-		}
+		experiments = append(experiments, experimentFromDTO(expDTO))
 
-		experiments = append(experiments, exp)
+		if svc.prerequisitePolicy == PrerequisitePolicyCascade {
+			dependents, err := svc.storage.SegmentDependents(ctx, segmentName)
+			if err != nil {
+				return nil, err
+			}
+			queue = append(queue, dependents...)
+		}
 	}
 
-	if err := svc.storage.DeleteOldExperiments(ctx); err != nil {
-		log.Println(err)
-	}
+	svc.deleteOldExperiments(ctx)
 
 	return experiments, nil
 }
 
-func (svc *Service) ListUserSegments(ctx context.Context, userID int64) (*model.UserExperimentList, error) {
+// ListUserSegments evaluates the user's segments: overrides take precedence over
+// stored memberships, which in turn take precedence over rule-based matches.
+func (svc *Service) ListUserSegments(ctx context.Context, userID int64) (*api.UserExperimentList, error) {
+	ctx, span := tracer.Start(ctx, "service.ListUserSegments",
+		trace.WithAttributes(attribute.Int64("user_id", userID)))
+	defer span.End()
+
 	listDTO, err := svc.storage.UserSegments(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	list := &model.UserExperimentList{
+	overrides, err := svc.storage.UserOverrides(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now        = time.Now()
+		candidates []storage.SegmentDTO
+		attributes map[string]string
+	)
+
+	// holdout users don't match rules
+	if !svc.holdout.Contains(userID) {
+		candidates, err = svc.ruleCandidates(ctx, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(candidates) > 0 {
+		attributes, err = svc.storage.UserAttributes(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &api.UserExperimentList{
 		UserID:   listDTO.UserID,
-		Segments: make([]model.Segment, 0, len(listDTO.Segments)),
+		Segments: svc.evaluator.Evaluate(ctx, svc.memberships(userID, listDTO.Segments), overrides, candidates, attributes, now),
+	}, nil
+}
+
+// ListUsersSegments evaluates segments of many users at once, loading their
+// memberships, overrides and attributes with set-based queries. Results are passed
+// to emit one user at a time in the order of first appearance in userIDs.
+func (svc *Service) ListUsersSegments(ctx context.Context, userIDs []int64, emit func(*api.UserExperimentList) error) error {
+	ctx, span := tracer.Start(ctx, "service.ListUsersSegments",
+		trace.WithAttributes(attribute.Int("users", len(userIDs))))
+	defer span.End()
+
+	userIDs = uniqueIDs(userIDs)
+
+	segments, err := svc.storage.UsersSegments(ctx, userIDs)
+	if err != nil {
+		return err
 	}
 
-	for _, seg := range listDTO.Segments {
-		list.Segments = append(list.Segments, (model.Segment)(seg))
+	overrides, err := svc.storage.UsersOverrides(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	candidates, err := svc.ruleCandidates(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	var attributes map[int64]map[string]string
+	if len(candidates) > 0 {
+		attributes, err = svc.storage.UsersAttributes(ctx, userIDs)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, userID := range userIDs {
+		userCandidates := candidates
+		if svc.holdout.Contains(userID) {
+			userCandidates = nil
+		}
+
+		list := &api.UserExperimentList{
+			UserID:   userID,
+			Segments: svc.evaluator.Evaluate(ctx, svc.memberships(userID, segments[userID]), overrides[userID], userCandidates, attributes[userID], now),
+		}
+
+		if err := emit(list); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// memberships returns the stored memberships that apply to the user. Holdout users
+// keep only the ones that were forced, so a user who falls into the holdout after
+// its settings change leaves earlier experiments.
+func (svc *Service) memberships(userID int64, segments []storage.SegmentDTO) []storage.SegmentDTO {
+	if !svc.holdout.Contains(userID) {
+		return segments
+	}
+
+	visible := make([]storage.SegmentDTO, 0, len(segments))
+	for _, segment := range segments {
+		if !svc.holdout.Hides(userID, segment.Forced) {
+			visible = append(visible, segment)
+		}
+	}
+
+	return visible
+}
+
+// Snapshot returns what clients need to evaluate segments of users locally with the
+// same code as ListUserSegments, except the memberships and attributes, which are
+// returned by UsersSnapshot.
+func (svc *Service) Snapshot(ctx context.Context) (*api.Snapshot, error) {
+	ctx, span := tracer.Start(ctx, "service.Snapshot")
+	defer span.End()
+
+	candidates, err := svc.storage.RuleSegments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := svc.storage.Overrides(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &api.Snapshot{
+		Segments:  make([]api.Segment, 0, len(candidates)),
+		Overrides: make([]*api.Override, 0, len(overrides)),
+	}
+
+	names := make(map[string]struct{}, len(candidates))
+	for i := range candidates {
+		snapshot.Segments = append(snapshot.Segments, *evaluation.SegmentFromDTO(&candidates[i]))
+		names[candidates[i].Name] = struct{}{}
+	}
+
+	for i := range overrides {
+		if _, ok := names[overrides[i].Segment.Name]; !ok {
+			snapshot.Segments = append(snapshot.Segments, *evaluation.SegmentFromDTO(&overrides[i].Segment))
+			names[overrides[i].Segment.Name] = struct{}{}
+		}
+		snapshot.Overrides = append(snapshot.Overrides, overrideFromDTO(&overrides[i]))
+	}
+
+	percent, salt, users := svc.holdout.Settings()
+	snapshot.Holdout = api.HoldoutSettings{Percent: percent, Salt: salt, Users: users}
+
+	return snapshot, nil
+}
+
+// UsersSnapshot returns the stored memberships and attributes of the users, which
+// complete Snapshot for them.
+func (svc *Service) UsersSnapshot(ctx context.Context, userIDs []int64) (*api.UserSnapshotList, error) {
+	ctx, span := tracer.Start(ctx, "service.UsersSnapshot",
+		trace.WithAttributes(attribute.Int("users", len(userIDs))))
+	defer span.End()
+
+	userIDs = uniqueIDs(userIDs)
+
+	segments, err := svc.storage.UsersSegments(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes, err := svc.storage.UsersAttributes(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &api.UserSnapshotList{Users: make([]*api.UserSnapshot, 0, len(userIDs))}
+
+	for _, userID := range userIDs {
+		user := &api.UserSnapshot{
+			UserID:     userID,
+			Segments:   make([]api.Segment, 0, len(segments[userID])),
+			Attributes: attributes[userID],
+		}
+		if user.Attributes == nil {
+			user.Attributes = map[string]string{}
+		}
+
+		// the order is fixed, so that unchanged snapshots are equal
+		stored := svc.memberships(userID, segments[userID])
+		slices.SortFunc(stored, func(a, b storage.SegmentDTO) int {
+			return cmp.Compare(a.ID, b.ID)
+		})
+		for i := range stored {
+			user.Segments = append(user.Segments, *evaluation.SegmentFromDTO(&stored[i]))
+		}
+
+		list.Users = append(list.Users, user)
+	}
+
+	return list, nil
+}
+
+// SetOverride forces the user into or out of a segment regardless of rules,
+// exclusion groups, activation windows and holdout.
+func (svc *Service) SetOverride(ctx context.Context, override *api.Override) (*api.Override, error) {
+	ctx, span := tracer.Start(ctx, "service.SetOverride",
+		trace.WithAttributes(attribute.Int64("user_id", override.UserID), attribute.String("segment", override.Segment)))
+	defer span.End()
+
+	if override.Mode != OverrideModeInclude && override.Mode != OverrideModeExclude {
+		return nil, fmt.Errorf("%w: unknown mode %q", ErrInvalidOverride, override.Mode)
+	}
+
+	if override.Mode == OverrideModeExclude && override.Variant != "" {
+		return nil, fmt.Errorf("%w: variant can be set only for included users", ErrInvalidOverride)
+	}
+
+	overrideDTO := storage.OverrideDTO{
+		UserID:  override.UserID,
+		Segment: storage.SegmentDTO{Name: override.Segment},
+		Mode:    override.Mode,
+		Variant: override.Variant,
+		Actor:   override.Actor,
+	}
+
+	if override.ExpiresAt != "" {
+		expiresAt, err := evaluation.ParseTime(override.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidOverride, err)
+		}
+		overrideDTO.ExpiresAt = &expiresAt
+	}
+
+	created, err := svc.storage.SetOverride(ctx, overrideDTO)
+	if err != nil {
+		return nil, err
+	}
+
+	return overrideFromDTO(created), nil
+}
+
+func (svc *Service) DeleteOverride(ctx context.Context, userID int64, segmentName, actor string) (*api.Override, error) {
+	ctx, span := tracer.Start(ctx, "service.DeleteOverride",
+		trace.WithAttributes(attribute.Int64("user_id", userID), attribute.String("segment", segmentName)))
+	defer span.End()
+
+	deleted, err := svc.storage.DeleteOverride(ctx, userID, segmentName, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	return overrideFromDTO(deleted), nil
+}
+
+func (svc *Service) UserOverrides(ctx context.Context, userID int64) (*api.UserOverrideList, error) {
+	ctx, span := tracer.Start(ctx, "service.UserOverrides",
+		trace.WithAttributes(attribute.Int64("user_id", userID)))
+	defer span.End()
+
+	overrides, err := svc.storage.UserOverrides(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &api.UserOverrideList{
+		UserID:    userID,
+		Overrides: make([]*api.Override, 0, len(overrides)),
+	}
+
+	for i := range overrides {
+		list.Overrides = append(list.Overrides, overrideFromDTO(&overrides[i]))
+	}
+
+	return list, nil
+}
+
+// CreateAPIKey issues a key with the role. Only its hash is stored, so the returned
+// plain text key can't be recovered later.
+func (svc *Service) CreateAPIKey(ctx context.Context, name, role string) (*api.APIKey, error) {
+	ctx, span := tracer.Start(ctx, "service.CreateAPIKey",
+		trace.WithAttributes(attribute.String("name", name), attribute.String("role", role)))
+	defer span.End()
+
+	if !auth.Role(role).Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRole, role)
+	}
+
+	key, prefix, err := auth.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := svc.storage.AddAPIKey(ctx, storage.APIKeyDTO{
+		Name:   name,
+		Role:   role,
+		Prefix: prefix,
+		Hash:   auth.HashKey(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey := apiKeyFromDTO(created)
+	apiKey.Key = key
+
+	return apiKey, nil
+}
+
+func (svc *Service) RevokeAPIKey(ctx context.Context, id int64) (*api.APIKey, error) {
+	ctx, span := tracer.Start(ctx, "service.RevokeAPIKey",
+		trace.WithAttributes(attribute.Int64("id", id)))
+	defer span.End()
+
+	revoked, err := svc.storage.RevokeAPIKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return apiKeyFromDTO(revoked), nil
+}
+
+func (svc *Service) APIKeys(ctx context.Context) (*api.APIKeyList, error) {
+	ctx, span := tracer.Start(ctx, "service.APIKeys")
+	defer span.End()
+
+	keys, err := svc.storage.APIKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &api.APIKeyList{Keys: make([]*api.APIKey, 0, len(keys))}
+	for i := range keys {
+		list.Keys = append(list.Keys, apiKeyFromDTO(&keys[i]))
+	}
+
+	return list, nil
+}
+
+// AuthenticateAPIKey returns the not revoked key matching the plain text key.
+func (svc *Service) AuthenticateAPIKey(ctx context.Context, key string) (*api.APIKey, error) {
+	ctx, span := tracer.Start(ctx, "service.AuthenticateAPIKey")
+	defer span.End()
+
+	found, err := svc.storage.APIKeyByHash(ctx, auth.HashKey(key))
+	if err != nil {
+		if errors.Is(err, storage.ErrAPIKeyNotFound) {
+			return nil, auth.ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	return apiKeyFromDTO(found), nil
+}
+
+// CreateWebhook subscribes url to events of the segments. Empty segments or events
+// subscribe to all of them. The signing secret is returned only here.
+func (svc *Service) CreateWebhook(ctx context.Context, rawURL string, segments, events []string) (*api.Webhook, error) {
+	ctx, span := tracer.Start(ctx, "service.CreateWebhook",
+		trace.WithAttributes(attribute.String("url", rawURL)))
+	defer span.End()
+
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: url must be an absolute http or https url", ErrInvalidWebhook)
+	}
+
+	for _, event := range events {
+		if !slices.Contains(webhookEvents, event) {
+			return nil, fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, event)
+		}
+	}
+
+	secret, err := webhook.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := svc.storage.AddWebhook(ctx, storage.WebhookDTO{
+		URL:      rawURL,
+		Secret:   secret,
+		Segments: uniqueNames(segments),
+		Events:   uniqueNames(events),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hook := webhookFromDTO(created)
+	hook.Secret = secret
+
+	return hook, nil
+}
+
+func (svc *Service) DeleteWebhook(ctx context.Context, id int64) (*api.Webhook, error) {
+	ctx, span := tracer.Start(ctx, "service.DeleteWebhook",
+		trace.WithAttributes(attribute.Int64("id", id)))
+	defer span.End()
+
+	deleted, err := svc.storage.DeleteWebhook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return webhookFromDTO(deleted), nil
+}
+
+func (svc *Service) Webhooks(ctx context.Context) (*api.WebhookList, error) {
+	ctx, span := tracer.Start(ctx, "service.Webhooks")
+	defer span.End()
+
+	webhooks, err := svc.storage.Webhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &api.WebhookList{Webhooks: make([]*api.Webhook, 0, len(webhooks))}
+	for i := range webhooks {
+		list.Webhooks = append(list.Webhooks, webhookFromDTO(&webhooks[i]))
+	}
+
+	return list, nil
+}
+
+// WebhookDeliveries lists the most recent deliveries with the status, dead ones by default.
+func (svc *Service) WebhookDeliveries(ctx context.Context, status string, limit int) (*api.WebhookDeliveryList, error) {
+	ctx, span := tracer.Start(ctx, "service.WebhookDeliveries",
+		trace.WithAttributes(attribute.String("status", status)))
+	defer span.End()
+
+	if status == "" {
+		status = storage.DeliveryDead
+	}
+	if status != storage.DeliveryPending && status != storage.DeliveryDelivered && status != storage.DeliveryDead {
+		return nil, fmt.Errorf("%w: unknown delivery status %q", ErrInvalidWebhook, status)
+	}
+	if limit <= 0 || limit > maxWebhookDeliveries {
+		limit = maxWebhookDeliveries
+	}
+
+	deliveries, err := svc.storage.WebhookDeliveries(ctx, status, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &api.WebhookDeliveryList{Deliveries: make([]*api.WebhookDelivery, 0, len(deliveries))}
+	for i := range deliveries {
+		list.Deliveries = append(list.Deliveries, deliveryFromDTO(&deliveries[i]))
+	}
+
+	return list, nil
+}
+
+// ReplayWebhookDelivery sends a dead or delivered delivery again.
+func (svc *Service) ReplayWebhookDelivery(ctx context.Context, id int64) (*api.WebhookDelivery, error) {
+	ctx, span := tracer.Start(ctx, "service.ReplayWebhookDelivery",
+		trace.WithAttributes(attribute.Int64("id", id)))
+	defer span.End()
+
+	delivery, err := svc.storage.ReplayWebhookDelivery(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveryFromDTO(delivery), nil
+}
+
+// Events reads up to limit events following afterID and returns the ones matching the
+// filter together with the ID to continue from, which moves past the skipped events
+// too. The returned ID equals afterID once there are no more events.
+func (svc *Service) Events(ctx context.Context, afterID int64, filter EventFilter, limit int) ([]*api.Event, int64, error) {
+	ctx, span := tracer.Start(ctx, "service.Events",
+		trace.WithAttributes(attribute.Int64("after_id", afterID)))
+	defer span.End()
+
+	if err := filter.validate(); err != nil {
+		return nil, afterID, err
+	}
+
+	batch, err := svc.storage.EventsAfter(ctx, afterID, limit)
+	if err != nil {
+		return nil, afterID, err
+	}
+
+	var events []*api.Event
+	for i := range batch {
+		if filter.match(&batch[i]) {
+			events = append(events, eventFromDTO(&batch[i]))
+		}
+		afterID = batch[i].ID
+	}
+
+	return events, afterID, nil
+}
+
+// LastEventID returns the position of a stream that starts with the next event.
+func (svc *Service) LastEventID(ctx context.Context) (int64, error) {
+	ctx, span := tracer.Start(ctx, "service.LastEventID")
+	defer span.End()
+
+	return svc.storage.LastEventID(ctx)
+}
+
+// Namespaces lists namespaces in use. The default namespace is always listed.
+func (svc *Service) Namespaces(ctx context.Context) (*api.NamespaceList, error) {
+	ctx, span := tracer.Start(ctx, "service.Namespaces")
+	defer span.End()
+
+	names, err := svc.storage.Namespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &api.NamespaceList{Namespaces: []string{namespace.Default}}
+	for _, name := range names {
+		if name != namespace.Default {
+			list.Namespaces = append(list.Namespaces, name)
+		}
 	}
 
 	return list, nil
 }
 
-func (s *Service) CreateLog(ctx context.Context, userID int64, start string) (*model.LogInfo, error) {
+func (svc *Service) HoldoutStatus(ctx context.Context, userID int64) *api.HoldoutStatus {
+	return &api.HoldoutStatus{
+		UserID:    userID,
+		InHoldout: svc.holdout.Contains(userID),
+	}
+}
+
+func (svc *Service) SetUserAttributes(ctx context.Context, userID int64, attributes map[string]string) (*api.UserAttributes, error) {
+	ctx, span := tracer.Start(ctx, "service.SetUserAttributes",
+		trace.WithAttributes(attribute.Int64("user_id", userID)))
+	defer span.End()
+
+	if err := svc.storage.SetUserAttributes(ctx, userID, attributes); err != nil {
+		return nil, err
+	}
+
+	return svc.UserAttributes(ctx, userID)
+}
+
+func (svc *Service) UserAttributes(ctx context.Context, userID int64) (*api.UserAttributes, error) {
+	ctx, span := tracer.Start(ctx, "service.UserAttributes",
+		trace.WithAttributes(attribute.Int64("user_id", userID)))
+	defer span.End()
+
+	attributes, err := svc.storage.UserAttributes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.UserAttributes{
+		UserID:     userID,
+		Attributes: attributes,
+	}, nil
+}
+
+func (s *Service) CreateLog(ctx context.Context, userID int64, start string) (_ *api.LogInfo, err error) {
+	ctx, span := tracer.Start(ctx, "service.CreateLog",
+		trace.WithAttributes(attribute.Int64("user_id", userID)))
+	defer span.End()
+
+	defer func() { s.metrics.ReportCreated(err) }()
+
 	from, err := time.Parse(logDateFormat, start)
 	if err != nil {
 		return nil, err
@@ -183,12 +1082,14 @@ func (s *Service) CreateLog(ctx context.Context, userID int64, start string) (*m
 		return nil, err
 	}
 
-	if err := os.Mkdir(s.logsPath, 0777); err != nil && !errors.Is(err, os.ErrExist) { //nolint:gomnd
+	// reports of every namespace are kept in its own directory
+	dir := path.Join(s.logsPath, namespace.FromContext(ctx))
+	if err := os.MkdirAll(dir, 0777); err != nil { //nolint:gomnd
 		return nil, err
 	}
 
 	logName := fmt.Sprintf(logFilenameTemplate, userID, start)
-	path := path.Join(s.logsPath, logName)
+	path := path.Join(dir, logName)
 
 	f, err := os.Create(path)
 	if err != nil {
@@ -218,9 +1119,260 @@ func (s *Service) CreateLog(ctx context.Context, userID int64, start string) (*m
 		}
 	}
 
-	return &model.LogInfo{
+	return &api.LogInfo{
 		UserID: userID,
 		From:   start,
 		Path:   path,
 	}, nil
 }
+
+// deleteOldExperiments sweeps expired memberships. Failures are logged only, since
+// expired memberships are already hidden from reads.
+func (svc *Service) deleteOldExperiments(ctx context.Context) {
+	removed, err := svc.storage.DeleteOldExperiments(ctx)
+	if err != nil {
+		svc.logger.ErrorContext(ctx, "couldn't delete expired memberships", "error", err)
+		return
+	}
+
+	svc.metrics.ExpiredRemoved(removed)
+}
+
+func (svc *Service) userSegmentNames(ctx context.Context, userID int64) (map[string]struct{}, error) {
+	listDTO, err := svc.storage.UserSegments(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]struct{}, len(listDTO.Segments))
+	for _, seg := range listDTO.Segments {
+		names[seg.Name] = struct{}{}
+	}
+
+	return names, nil
+}
+
+// missingPrerequisites returns prerequisites of the segment the user is not in.
+func (svc *Service) missingPrerequisites(ctx context.Context, segmentName string, members map[string]struct{}) ([]string, error) {
+	segmentDTO, err := svc.storage.Segment(ctx, segmentName)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, required := range segmentDTO.Requires {
+		if _, ok := members[required]; !ok {
+			missing = append(missing, required)
+		}
+	}
+
+	return missing, nil
+}
+
+// ruleCandidates returns segments with targeting rules whose activation window contains now.
+func (svc *Service) ruleCandidates(ctx context.Context, now time.Time) ([]storage.SegmentDTO, error) {
+	candidates, err := svc.storage.RuleSegments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return evaluation.Active(candidates, now), nil
+}
+
+// RunScheduler opens and closes segment activation windows every interval until ctx is done.
+func (svc *Service) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		svc.syncSegmentWindows(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SchedulerHeartbeat returns the time of the last successful scheduler run, zero
+// before the first one.
+func (svc *Service) SchedulerHeartbeat() time.Time {
+	at := svc.lastSchedulerRun.Load()
+	if at == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, at)
+}
+
+func (svc *Service) syncSegmentWindows(ctx context.Context) {
+	records, err := svc.storage.SyncSegmentWindows(ctx)
+	if err != nil {
+		svc.logger.ErrorContext(ctx, "couldn't sync segment windows", "error", err)
+		return
+	}
+	svc.lastSchedulerRun.Store(time.Now().UnixNano())
+
+	for _, record := range records {
+		svc.logger.InfoContext(ctx, "segment window changed",
+			"namespace", record.Namespace, "segment", record.SegmentName,
+			"operation", record.Operation, "at", evaluation.FormatTime(&record.AddedAt))
+	}
+}
+
+func parseWindow(start, end string) (*time.Time, *time.Time, error) {
+	var startsAt, endsAt *time.Time
+
+	if start != "" {
+		t, err := evaluation.ParseTime(start)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidWindow, err)
+		}
+		startsAt = &t
+	}
+
+	if end != "" {
+		t, err := evaluation.ParseTime(end)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidWindow, err)
+		}
+		endsAt = &t
+	}
+
+	if startsAt != nil && endsAt != nil && !endsAt.After(*startsAt) {
+		return nil, nil, fmt.Errorf("%w: ends_at must be after starts_at", ErrInvalidWindow)
+	}
+
+	return startsAt, endsAt, nil
+}
+
+func overrideFromDTO(dto *storage.OverrideDTO) *api.Override {
+	return &api.Override{
+		UserID:    dto.UserID,
+		Segment:   dto.Segment.Name,
+		Mode:      dto.Mode,
+		Variant:   dto.Variant,
+		ExpiresAt: evaluation.FormatTime(dto.ExpiresAt),
+		Actor:     dto.Actor,
+		CreatedAt: evaluation.FormatTime(&dto.CreatedAt),
+	}
+}
+
+func apiKeyFromDTO(dto *storage.APIKeyDTO) *api.APIKey {
+	return &api.APIKey{
+		ID:        dto.ID,
+		Namespace: dto.Namespace,
+		Name:      dto.Name,
+		Role:      dto.Role,
+		Prefix:    dto.Prefix,
+		CreatedAt: evaluation.FormatTime(&dto.CreatedAt),
+		RevokedAt: evaluation.FormatTime(dto.RevokedAt),
+	}
+}
+
+func webhookFromDTO(dto *storage.WebhookDTO) *api.Webhook {
+	return &api.Webhook{
+		ID:        dto.ID,
+		Namespace: dto.Namespace,
+		URL:       dto.URL,
+		Segments:  nonNil(dto.Segments),
+		Events:    nonNil(dto.Events),
+		CreatedAt: evaluation.FormatTime(&dto.CreatedAt),
+	}
+}
+
+func deliveryFromDTO(dto *storage.WebhookDeliveryDTO) *api.WebhookDelivery {
+	delivery := &api.WebhookDelivery{
+		ID:          dto.ID,
+		WebhookID:   dto.Webhook.ID,
+		EventID:     dto.Event.ID,
+		Event:       dto.Event.Type,
+		Segment:     dto.Event.Segment,
+		UserID:      dto.Event.UserID,
+		Status:      dto.Status,
+		Attempts:    dto.Attempts,
+		LastError:   dto.LastError,
+		DeliveredAt: evaluation.FormatTime(dto.DeliveredAt),
+	}
+
+	if dto.Status == storage.DeliveryPending {
+		delivery.NextAttemptAt = evaluation.FormatTime(&dto.NextAttemptAt)
+	}
+
+	return delivery
+}
+
+func eventFromDTO(dto *storage.WebhookEventDTO) *api.Event {
+	return &api.Event{
+		ID:        dto.ID,
+		Type:      dto.Type,
+		Namespace: dto.Namespace,
+		CreatedAt: dto.CreatedAt.UTC(),
+		Data: api.EventData{
+			Segment: dto.Segment,
+			UserID:  dto.UserID,
+		},
+	}
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
+
+func experimentFromDTO(dto *storage.UserExperimentDTO) *api.UserExperiment {
+	return &api.UserExperiment{
+		ID:      dto.ID,
+		UserID:  dto.UserID,
+		Segment: *evaluation.SegmentFromDTO(&dto.Segment),
+	}
+}
+
+func uniqueNames(names []string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]struct{}, len(names))
+	unique := make([]string, 0, len(names))
+
+	for _, name := range names {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			unique = append(unique, name)
+		}
+	}
+
+	return unique
+}
+
+// uniqueIDs drops repeated IDs, keeping the order of first appearance.
+func uniqueIDs(ids []int64) []int64 {
+	var (
+		seen   = make(map[int64]struct{}, len(ids))
+		unique = make([]int64, 0, len(ids))
+	)
+
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+
+	return unique
+}
+
+// rejectionReason strips the storage operation prefix from err.
+func rejectionReason(err error) string {
+	if inner := errors.Unwrap(err); inner != nil {
+		return inner.Error()
+	}
+
+	return err.Error()
+}
@@ -2,13 +2,26 @@ package service_test
 
 import (
 	"context"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/psxzz/backend-trainee-assignment/internal/app/model"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/auth"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/holdout"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/rule"
 	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
 	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
 	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/memory"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/webhook"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestSegments(t *testing.T) {
@@ -21,7 +34,7 @@ func TestSegments(t *testing.T) {
 		resp, err := svc.CreateSegment(context.Background(), "Hello")
 		assert.NoError(t, err)
 
-		assert.Equal(t, resp, &model.Segment{ID: 0, Name: "Hello"})
+		assert.Equal(t, resp, &api.Segment{ID: 0, Name: "Hello", Version: 1})
 	})
 
 	t.Run("returns error if duplicate", func(t *testing.T) {
@@ -71,7 +84,7 @@ func TestUserExperiments(t *testing.T) {
 		_, err := svc.CreateSegment(context.Background(), "Hello")
 		assert.NoError(t, err)
 
-		exp, err := svc.AddUserExperiments(context.Background(), 1010, []*model.UserExperimentItem{{Name: "Hello"}})
+		exp, _, err := svc.AddUserExperiments(context.Background(), 1010, []*api.UserExperimentItem{{Name: "Hello"}})
 		assert.NoError(t, err)
 
 		assert.Contains(t, db.Experiments()[1010], struct {
@@ -90,10 +103,10 @@ func TestUserExperiments(t *testing.T) {
 		_, err := svc.CreateSegment(context.Background(), "Hello")
 		assert.NoError(t, err)
 
-		_, err = svc.AddUserExperiments(context.Background(), 1010, []*model.UserExperimentItem{{Name: "Hello"}})
+		_, _, err = svc.AddUserExperiments(context.Background(), 1010, []*api.UserExperimentItem{{Name: "Hello"}})
 		assert.NoError(t, err)
 
-		resp, err := svc.AddUserExperiments(context.Background(), 1010, []*model.UserExperimentItem{{Name: "Hello"}})
+		resp, _, err := svc.AddUserExperiments(context.Background(), 1010, []*api.UserExperimentItem{{Name: "Hello"}})
 		assert.NoError(t, err)
 		assert.Equal(t, 0, len(resp))
 	})
@@ -106,7 +119,7 @@ func TestUserExperiments(t *testing.T) {
 
 		_, err := svc.CreateSegment(context.Background(), "Hello")
 		assert.NoError(t, err)
-		respCreate, err := svc.AddUserExperiments(context.Background(), 1010, []*model.UserExperimentItem{{Name: "Hello"}})
+		respCreate, _, err := svc.AddUserExperiments(context.Background(), 1010, []*api.UserExperimentItem{{Name: "Hello"}})
 		assert.NoError(t, err)
 		respDelete, err := svc.RemoveUserExperiments(context.Background(), 1010, []string{"Hello"})
 		assert.NoError(t, err)
@@ -124,6 +137,157 @@ func TestUserExperiments(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, 0, len(resp))
 	})
+
+	t.Run("removes expired user experiments", func(t *testing.T) {
+		var (
+			db      = memory.New()
+			svc     = service.New(db, "")
+			expired = time.Now().Add(-time.Minute).In(time.FixedZone("MSK", 3*60*60)).Format(time.DateTime)
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "Hello")
+		assert.NoError(t, err)
+
+		exp, _, err := svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "Hello", ExpiresAt: expired}})
+		assert.NoError(t, err)
+		assert.Len(t, exp, 1)
+
+		assert.Empty(t, db.Experiments()[1010])
+
+		events := db.WebhookEvents()
+		if assert.NotEmpty(t, events) {
+			assert.Equal(t, storage.EventMembershipExpired, events[len(events)-1].Type)
+		}
+	})
+}
+
+func TestExclusionGroups(t *testing.T) {
+	t.Run("rejects segment from the same group", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_30",
+			api.SegmentSettings{Group: "discounts"})
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_50",
+			api.SegmentSettings{Group: "discounts"})
+		assert.NoError(t, err)
+
+		added, rejected, err := svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_DISCOUNT_30"}, {Name: "AVITO_DISCOUNT_50"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(added))
+		assert.Equal(t, "AVITO_DISCOUNT_30", added[0].Segment.Name)
+
+		assert.Equal(t, 1, len(rejected))
+		assert.Equal(t, "AVITO_DISCOUNT_50", rejected[0].Name)
+		assert.Contains(t, rejected[0].Reason, "AVITO_DISCOUNT_30")
+	})
+
+	t.Run("allows segments without group", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_30",
+			api.SegmentSettings{Group: "discounts"})
+		assert.NoError(t, err)
+		_, err = svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+
+		added, rejected, err := svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_DISCOUNT_30"}, {Name: "AVITO_VOICE_MESSAGES"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(added))
+		assert.Equal(t, 0, len(rejected))
+	})
+}
+
+func TestPrerequisites(t *testing.T) {
+	t.Run("rejects segment without prerequisite", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(context.Background(), "AVITO_VOICE_UI",
+			api.SegmentSettings{Requires: []string{"AVITO_VOICE_MESSAGES"}})
+		assert.NoError(t, err)
+
+		added, rejected, err := svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_VOICE_UI"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(added))
+		assert.Equal(t, 1, len(rejected))
+		assert.Contains(t, rejected[0].Reason, "AVITO_VOICE_MESSAGES")
+
+		added, rejected, err = svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}, {Name: "AVITO_VOICE_UI"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(added))
+		assert.Equal(t, 0, len(rejected))
+	})
+
+	t.Run("returns error if prerequisite not exists", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_VOICE_UI",
+			api.SegmentSettings{Requires: []string{"AVITO_VOICE_MESSAGES"}})
+		assert.ErrorIs(t, err, storage.ErrSegmentNotFound)
+	})
+
+	t.Run("keeps dependents on removal by default", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(context.Background(), "AVITO_VOICE_UI",
+			api.SegmentSettings{Requires: []string{"AVITO_VOICE_MESSAGES"}})
+		assert.NoError(t, err)
+		_, _, err = svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}, {Name: "AVITO_VOICE_UI"}})
+		assert.NoError(t, err)
+
+		removed, err := svc.RemoveUserExperiments(context.Background(), 1010, []string{"AVITO_VOICE_MESSAGES"})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(removed))
+	})
+
+	t.Run("cascades removal to dependents", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "", service.WithPrerequisitePolicy(service.PrerequisitePolicyCascade))
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(context.Background(), "AVITO_VOICE_UI",
+			api.SegmentSettings{Requires: []string{"AVITO_VOICE_MESSAGES"}})
+		assert.NoError(t, err)
+		_, _, err = svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}, {Name: "AVITO_VOICE_UI"}})
+		assert.NoError(t, err)
+
+		removed, err := svc.RemoveUserExperiments(context.Background(), 1010, []string{"AVITO_VOICE_MESSAGES"})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(removed))
+
+		resp, err := svc.ListUserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(resp.Segments))
+	})
 }
 
 func TestListExperiments(t *testing.T) {
@@ -142,11 +306,853 @@ func TestListExperiments(t *testing.T) {
 
 		seg2, err := svc.CreateSegment(context.Background(), "World")
 		assert.NoError(t, err)
-		_, err = svc.AddUserExperiments(context.Background(), 1010, []*model.UserExperimentItem{{Name: "Hello"}, {Name: "World"}})
+		_, _, err = svc.AddUserExperiments(context.Background(), 1010, []*api.UserExperimentItem{{Name: "Hello"}, {Name: "World"}})
 		assert.NoError(t, err)
 
 		resp, err = svc.ListUserSegments(context.Background(), 1010)
 		assert.NoError(t, err)
-		assert.ElementsMatch(t, resp.Segments, []model.Segment{*seg1, *seg2})
+		assert.ElementsMatch(t, resp.Segments, []api.Segment{*seg1, *seg2})
+	})
+}
+
+func TestRuleSegments(t *testing.T) {
+	t.Run("lists segments matching user attributes", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+		seg, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_IOS_CAPITALS",
+			api.SegmentSettings{Rule: `region in ["MSK", "SPB"] AND platform == "ios"`})
+		assert.NoError(t, err)
+
+		_, err = svc.SetUserAttributes(context.Background(), 1010,
+			map[string]string{"region": "MSK", "platform": "ios"})
+		assert.NoError(t, err)
+		_, err = svc.SetUserAttributes(context.Background(), 2020,
+			map[string]string{"region": "EKB", "platform": "ios"})
+		assert.NoError(t, err)
+
+		resp, err := svc.ListUserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, resp.Segments, []api.Segment{*seg})
+
+		resp, err = svc.ListUserSegments(context.Background(), 2020)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(resp.Segments))
+	})
+
+	t.Run("skips matches conflicting with exclusion group", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		seg, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_30",
+			api.SegmentSettings{Group: "discounts"})
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_50",
+			api.SegmentSettings{Group: "discounts", Rule: `platform == "ios"`})
+		assert.NoError(t, err)
+
+		_, _, err = svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_DISCOUNT_30"}})
+		assert.NoError(t, err)
+		_, err = svc.SetUserAttributes(context.Background(), 1010, map[string]string{"platform": "ios"})
+		assert.NoError(t, err)
+
+		resp, err := svc.ListUserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, resp.Segments, []api.Segment{*seg})
+	})
+
+	t.Run("rejects invalid rule", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_IOS",
+			api.SegmentSettings{Rule: `platform = "ios"`})
+		assert.ErrorIs(t, err, rule.ErrSyntax)
+	})
+}
+
+func TestSegmentWindows(t *testing.T) {
+	t.Run("hides segments outside activation window", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		active, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_30",
+			api.SegmentSettings{StartsAt: "2023-01-01 00:00:00"})
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_50",
+			api.SegmentSettings{StartsAt: "2099-01-01 00:00:00"})
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_70",
+			api.SegmentSettings{StartsAt: "2023-01-01 00:00:00", EndsAt: "2023-02-01 00:00:00"})
+		assert.NoError(t, err)
+
+		added, _, err := svc.AddUserExperiments(context.Background(), 1010, []*api.UserExperimentItem{
+			{Name: "AVITO_DISCOUNT_30"}, {Name: "AVITO_DISCOUNT_50"}, {Name: "AVITO_DISCOUNT_70"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(added))
+
+		resp, err := svc.ListUserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, resp.Segments, []api.Segment{*active})
+	})
+
+	t.Run("rejects window ending before start", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_30",
+			api.SegmentSettings{StartsAt: "2023-02-01 00:00:00", EndsAt: "2023-01-01 00:00:00"})
+		assert.ErrorIs(t, err, service.ErrInvalidWindow)
+	})
+
+	t.Run("scheduler reports heartbeat", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+		assert.True(t, svc.SchedulerHeartbeat().IsZero())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go svc.RunScheduler(ctx, time.Hour)
+
+		assert.Eventually(t, func() bool { return !svc.SchedulerHeartbeat().IsZero() },
+			time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestSegmentCapacity(t *testing.T) {
+	t.Run("rejects users over capacity", func(t *testing.T) {
+		var (
+			db       = memory.New()
+			svc      = service.New(db, "")
+			capacity = int64(1)
+		)
+
+		_, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_50",
+			api.SegmentSettings{MaxMembers: &capacity})
+		assert.NoError(t, err)
+
+		added, rejected, err := svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_DISCOUNT_50"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(added))
+		assert.Equal(t, 0, len(rejected))
+
+		added, rejected, err = svc.AddUserExperiments(context.Background(), 2020,
+			[]*api.UserExperimentItem{{Name: "AVITO_DISCOUNT_50"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(added))
+		assert.Equal(t, 1, len(rejected))
+		assert.Contains(t, rejected[0].Reason, storage.ErrCapacityExceeded.Error())
+
+		info, err := svc.SegmentInfo(context.Background(), "AVITO_DISCOUNT_50")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), *info.Members)
+		assert.Equal(t, capacity, *info.MaxMembers)
+	})
+
+	t.Run("does not overshoot under concurrent requests", func(t *testing.T) {
+		var (
+			db       = memory.New()
+			svc      = service.New(db, "")
+			capacity = int64(10)
+			wg       sync.WaitGroup
+		)
+
+		_, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_50",
+			api.SegmentSettings{MaxMembers: &capacity})
+		assert.NoError(t, err)
+
+		for userID := int64(1); userID <= 50; userID++ {
+			wg.Add(1)
+			go func(userID int64) {
+				defer wg.Done()
+				_, _, err := svc.AddUserExperiments(context.Background(), userID,
+					[]*api.UserExperimentItem{{Name: "AVITO_DISCOUNT_50"}})
+				assert.NoError(t, err)
+			}(userID)
+		}
+		wg.Wait()
+
+		info, err := svc.SegmentInfo(context.Background(), "AVITO_DISCOUNT_50")
+		assert.NoError(t, err)
+		assert.Equal(t, capacity, *info.Members)
+	})
+
+	t.Run("rejects non-positive capacity", func(t *testing.T) {
+		var (
+			db       = memory.New()
+			svc      = service.New(db, "")
+			capacity = int64(0)
+		)
+
+		_, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_DISCOUNT_50",
+			api.SegmentSettings{MaxMembers: &capacity})
+		assert.ErrorIs(t, err, service.ErrInvalidCapacity)
+	})
+}
+
+func TestHoldout(t *testing.T) {
+	t.Run("rejects holdout users unless forced", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "", service.WithHoldout(holdout.New(0, "", []int64{1010})))
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+
+		added, rejected, err := svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(added))
+		assert.Equal(t, 1, len(rejected))
+
+		added, _, err = svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES", Force: true}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(added))
+	})
+
+	t.Run("excludes holdout users from rule segments", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "", service.WithHoldout(holdout.New(0, "", []int64{1010})))
+		)
+
+		_, err := svc.CreateSegmentWithSettings(context.Background(), "AVITO_IOS",
+			api.SegmentSettings{Rule: `platform == "ios"`})
+		assert.NoError(t, err)
+
+		for _, userID := range []int64{1010, 2020} {
+			_, err = svc.SetUserAttributes(context.Background(), userID, map[string]string{"platform": "ios"})
+			assert.NoError(t, err)
+		}
+
+		resp, err := svc.ListUserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(resp.Segments))
+
+		resp, err = svc.ListUserSegments(context.Background(), 2020)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(resp.Segments))
+
+		assert.True(t, svc.HoldoutStatus(context.Background(), 1010).InHoldout)
+		assert.False(t, svc.HoldoutStatus(context.Background(), 2020).InHoldout)
+	})
+
+	t.Run("keeps only forced memberships of users who fall into holdout", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			ctx = context.Background()
+		)
+
+		before := service.New(db, "")
+		for _, name := range []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"} {
+			_, err := before.CreateSegment(ctx, name)
+			assert.NoError(t, err)
+		}
+
+		added, _, err := before.AddUserExperiments(ctx, 1010, []*api.UserExperimentItem{
+			{Name: "AVITO_VOICE_MESSAGES"},
+			{Name: "AVITO_DISCOUNT_30", Force: true},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(added))
+
+		after := service.New(db, "", service.WithHoldout(holdout.New(0, "", []int64{1010})))
+
+		resp, err := after.ListUserSegments(ctx, 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(resp.Segments))
+		assert.Equal(t, "AVITO_DISCOUNT_30", resp.Segments[0].Name)
+
+		err = after.ListUsersSegments(ctx, []int64{1010}, func(list *api.UserExperimentList) error {
+			assert.Equal(t, 1, len(list.Segments))
+			return nil
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("selects stable percentage of users", func(t *testing.T) {
+		var (
+			h        = holdout.New(5, "salt", nil)
+			same     = holdout.New(5, "salt", nil)
+			selected int
+		)
+
+		for userID := int64(0); userID < 100000; userID++ {
+			if h.Contains(userID) {
+				selected++
+				assert.True(t, same.Contains(userID))
+			}
+		}
+
+		assert.InDelta(t, 5000, selected, 500)
+	})
+}
+
+func TestOverrides(t *testing.T) {
+	t.Run("includes user ignoring group and holdout", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "", service.WithHoldout(holdout.New(0, "", []int64{1010})))
+		)
+
+		for _, name := range []string{"AVITO_CHAT_A", "AVITO_CHAT_B"} {
+			_, err := svc.CreateSegmentWithSettings(context.Background(), name,
+				api.SegmentSettings{Group: "chat"})
+			assert.NoError(t, err)
+		}
+
+		_, _, err := svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_CHAT_A", Force: true}})
+		assert.NoError(t, err)
+
+		override, err := svc.SetOverride(context.Background(), &api.Override{
+			UserID:  1010,
+			Segment: "AVITO_CHAT_B",
+			Mode:    service.OverrideModeInclude,
+			Variant: "treatment",
+			Actor:   "qa@avito.ru",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "treatment", override.Variant)
+
+		resp, err := svc.ListUserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		variants := make(map[string]string)
+		for _, segment := range resp.Segments {
+			variants[segment.Name] = segment.Variant
+		}
+		assert.Equal(t, map[string]string{"AVITO_CHAT_A": "", "AVITO_CHAT_B": "treatment"}, variants)
+	})
+
+	t.Run("excludes user from stored and rule segments", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(context.Background(), "AVITO_IOS",
+			api.SegmentSettings{Rule: `platform == "ios"`})
+		assert.NoError(t, err)
+
+		_, _, err = svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}})
+		assert.NoError(t, err)
+		_, err = svc.SetUserAttributes(context.Background(), 1010, map[string]string{"platform": "ios"})
+		assert.NoError(t, err)
+
+		for _, name := range []string{"AVITO_VOICE_MESSAGES", "AVITO_IOS"} {
+			_, err = svc.SetOverride(context.Background(), &api.Override{
+				UserID: 1010, Segment: name, Mode: service.OverrideModeExclude, Actor: "support",
+			})
+			assert.NoError(t, err)
+		}
+
+		resp, err := svc.ListUserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(resp.Segments))
+
+		_, err = svc.DeleteOverride(context.Background(), 1010, "AVITO_IOS", "support")
+		assert.NoError(t, err)
+
+		resp, err = svc.ListUserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(resp.Segments))
+
+		list, err := svc.UserOverrides(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(list.Overrides))
+	})
+
+	t.Run("ignores expired overrides", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+
+		_, err = svc.SetOverride(context.Background(), &api.Override{
+			UserID:    1010,
+			Segment:   "AVITO_VOICE_MESSAGES",
+			Mode:      service.OverrideModeInclude,
+			ExpiresAt: "2023-01-01 00:00:00",
+			Actor:     "qa@avito.ru",
+		})
+		assert.NoError(t, err)
+
+		resp, err := svc.ListUserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(resp.Segments))
+	})
+
+	t.Run("returns error if override not exists", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+
+		_, err = svc.DeleteOverride(context.Background(), 1010, "AVITO_VOICE_MESSAGES", "support")
+		assert.ErrorIs(t, err, storage.ErrOverrideNotFound)
+
+		_, err = svc.SetOverride(context.Background(), &api.Override{
+			UserID: 1010, Segment: "AVITO_VOICE_MESSAGES", Mode: service.OverrideModeExclude,
+			Variant: "control", Actor: "support",
+		})
+		assert.ErrorIs(t, err, service.ErrInvalidOverride)
+	})
+}
+
+func TestBatchList(t *testing.T) {
+	t.Run("evaluates many users at once", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "", service.WithHoldout(holdout.New(0, "", []int64{3030})))
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(context.Background(), "AVITO_IOS",
+			api.SegmentSettings{Rule: `platform == "ios"`})
+		assert.NoError(t, err)
+
+		_, _, err = svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}})
+		assert.NoError(t, err)
+
+		for _, userID := range []int64{1010, 2020, 3030} {
+			_, err = svc.SetUserAttributes(context.Background(), userID, map[string]string{"platform": "ios"})
+			assert.NoError(t, err)
+		}
+
+		var userIDs []int64
+		result := make(map[int64][]string)
+
+		err = svc.ListUsersSegments(context.Background(), []int64{1010, 2020, 3030, 4040, 1010},
+			func(list *api.UserExperimentList) error {
+				userIDs = append(userIDs, list.UserID)
+				for _, segment := range list.Segments {
+					result[list.UserID] = append(result[list.UserID], segment.Name)
+				}
+				return nil
+			})
+		assert.NoError(t, err)
+
+		assert.Equal(t, []int64{1010, 2020, 3030, 4040}, userIDs)
+		assert.ElementsMatch(t, []string{"AVITO_VOICE_MESSAGES", "AVITO_IOS"}, result[1010])
+		assert.Equal(t, []string{"AVITO_IOS"}, result[2020])
+		assert.Empty(t, result[3030])
+		assert.Empty(t, result[4040])
+
+		for _, userID := range userIDs {
+			single, err := svc.ListUserSegments(context.Background(), userID)
+			assert.NoError(t, err)
+			assert.Equal(t, len(result[userID]), len(single.Segments))
+		}
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Run("returns what local evaluation needs", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "", service.WithHoldout(holdout.New(5, "salt", []int64{3030})))
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+		_, err = svc.CreateSegment(context.Background(), "AVITO_DISCOUNT")
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(context.Background(), "AVITO_IOS",
+			api.SegmentSettings{Rule: `platform == "ios"`})
+		assert.NoError(t, err)
+
+		_, err = svc.SetOverride(context.Background(), &api.Override{
+			UserID: 1010, Segment: "AVITO_VOICE_MESSAGES", Mode: service.OverrideModeInclude, Variant: "b", Actor: "qa",
+		})
+		assert.NoError(t, err)
+
+		snapshot, err := svc.Snapshot(context.Background())
+		assert.NoError(t, err)
+
+		var names []string
+		for _, segment := range snapshot.Segments {
+			names = append(names, segment.Name)
+		}
+		// segments without rules are sent only if overrides refer to them
+		assert.Equal(t, []string{"AVITO_IOS", "AVITO_VOICE_MESSAGES"}, names)
+		assert.Len(t, snapshot.Overrides, 1)
+		assert.Equal(t, "b", snapshot.Overrides[0].Variant)
+		assert.Equal(t, api.HoldoutSettings{Percent: 5, Salt: "salt", Users: []int64{3030}}, snapshot.Holdout)
+	})
+
+	t.Run("returns memberships and attributes of users", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+
+		_, _, err = svc.AddUserExperiments(context.Background(), 1010,
+			[]*api.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}})
+		assert.NoError(t, err)
+		_, err = svc.SetUserAttributes(context.Background(), 1010, map[string]string{"platform": "ios"})
+		assert.NoError(t, err)
+
+		list, err := svc.UsersSnapshot(context.Background(), []int64{1010, 2020, 1010})
+		assert.NoError(t, err)
+
+		assert.Len(t, list.Users, 2)
+		assert.Equal(t, "AVITO_VOICE_MESSAGES", list.Users[0].Segments[0].Name)
+		assert.Equal(t, map[string]string{"platform": "ios"}, list.Users[0].Attributes)
+		assert.Equal(t, &api.UserSnapshot{UserID: 2020, Segments: []api.Segment{}, Attributes: map[string]string{}},
+			list.Users[1])
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	var (
+		db  = memory.New()
+		svc = service.New(db, "")
+		ctx = context.Background()
+	)
+
+	_, err := svc.CreateAPIKey(ctx, "ci", "root")
+	assert.ErrorIs(t, err, service.ErrInvalidRole)
+
+	created, err := svc.CreateAPIKey(ctx, "ci", "analyst")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.Key)
+	assert.True(t, strings.HasPrefix(created.Key, created.Prefix))
+
+	found, err := svc.AuthenticateAPIKey(ctx, created.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, "analyst", found.Role)
+	assert.Empty(t, found.Key)
+
+	list, err := svc.APIKeys(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, list.Keys, 1)
+	assert.Empty(t, list.Keys[0].Key)
+
+	revoked, err := svc.RevokeAPIKey(ctx, created.ID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, revoked.RevokedAt)
+
+	_, err = svc.AuthenticateAPIKey(ctx, created.Key)
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+	_, err = svc.RevokeAPIKey(ctx, created.ID)
+	assert.ErrorIs(t, err, storage.ErrAPIKeyNotFound)
+}
+
+func TestWebhooks(t *testing.T) {
+	var (
+		db    = memory.New()
+		svc   = service.New(db, "")
+		ctx   = context.Background()
+		teamA = namespace.With(ctx, "team-a")
+	)
+
+	_, err := svc.CreateWebhook(ctx, "ftp://example.com", nil, nil)
+	assert.ErrorIs(t, err, service.ErrInvalidWebhook)
+
+	_, err = svc.CreateWebhook(ctx, "https://example.com/hook", nil, []string{"segment.renamed"})
+	assert.ErrorIs(t, err, service.ErrInvalidWebhook)
+
+	created, err := svc.CreateWebhook(ctx, "https://example.com/hook", []string{"AVITO_TEST"}, nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(created.Secret, webhook.SecretPrefix))
+	assert.Equal(t, []string{}, created.Events)
+
+	list, err := svc.Webhooks(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, list.Webhooks, 1)
+	assert.Empty(t, list.Webhooks[0].Secret)
+
+	list, err = svc.Webhooks(teamA)
+	assert.NoError(t, err)
+	assert.Empty(t, list.Webhooks)
+
+	_, err = svc.DeleteWebhook(teamA, created.ID)
+	assert.ErrorIs(t, err, storage.ErrWebhookNotFound)
+
+	_, err = svc.WebhookDeliveries(ctx, "lost", 0)
+	assert.ErrorIs(t, err, service.ErrInvalidWebhook)
+
+	_, err = svc.ReplayWebhookDelivery(ctx, 1)
+	assert.ErrorIs(t, err, storage.ErrDeliveryNotFound)
+
+	_, err = svc.DeleteWebhook(ctx, created.ID)
+	assert.NoError(t, err)
+}
+
+func TestEvents(t *testing.T) {
+	var (
+		db    = memory.New()
+		svc   = service.New(db, "")
+		ctx   = context.Background()
+		teamA = namespace.With(ctx, "team-a")
+	)
+
+	start, err := svc.LastEventID(ctx)
+	assert.NoError(t, err)
+
+	_, err = svc.CreateSegment(ctx, "AVITO_TEST")
+	assert.NoError(t, err)
+	_, err = svc.CreateSegment(ctx, "AVITO_OTHER")
+	assert.NoError(t, err)
+	_, _, err = svc.AddUserExperiments(ctx, 1000, []*api.UserExperimentItem{
+		{Name: "AVITO_TEST"}, {Name: "AVITO_OTHER"},
+	})
+	assert.NoError(t, err)
+	_, err = svc.CreateSegment(teamA, "AVITO_TEST")
+	assert.NoError(t, err)
+
+	events, next, err := svc.Events(ctx, start, service.EventFilter{}, 100)
+	assert.NoError(t, err)
+	assert.Len(t, events, 4)
+	assert.Equal(t, events[3].ID, next)
+
+	events, _, err = svc.Events(ctx, start, service.EventFilter{
+		Segments: []string{"AVITO_TEST"},
+		Types:    []string{storage.EventMembershipAdded},
+	}, 100)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, api.EventData{Segment: "AVITO_TEST", UserID: 1000}, events[0].Data)
+	}
+
+	// skipped events move the position too
+	events, next, err = svc.Events(ctx, start, service.EventFilter{UserID: 2000}, 2)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	assert.Equal(t, start+2, next)
+
+	events, after, err := svc.Events(ctx, next+2, service.EventFilter{}, 100)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	assert.Equal(t, next+2, after)
+
+	last, err := svc.LastEventID(teamA)
+	assert.NoError(t, err)
+	events, _, err = svc.Events(teamA, 0, service.EventFilter{}, 100)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, last, events[0].ID)
+		assert.Equal(t, storage.EventSegmentCreated, events[0].Type)
+	}
+
+	_, _, err = svc.Events(ctx, 0, service.EventFilter{Types: []string{"segment.renamed"}}, 100)
+	assert.ErrorIs(t, err, service.ErrInvalidEventFilter)
+}
+
+func TestNamespaces(t *testing.T) {
+	var (
+		db    = memory.New()
+		svc   = service.New(db, t.TempDir())
+		teamA = namespace.With(context.Background(), "team-a")
+		teamB = namespace.With(context.Background(), "team-b")
+	)
+
+	_, err := svc.CreateSegment(teamA, "AVITO_VOICE_MESSAGES")
+	assert.NoError(t, err)
+	_, err = svc.CreateSegment(teamA, "AVITO_VOICE_MESSAGES")
+	assert.ErrorIs(t, err, storage.ErrSegmentExists)
+	_, err = svc.CreateSegment(teamB, "AVITO_VOICE_MESSAGES")
+	assert.NoError(t, err)
+
+	added, _, err := svc.AddUserExperiments(teamA, 1010, []*api.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}})
+	assert.NoError(t, err)
+	assert.Len(t, added, 1)
+
+	listA, err := svc.ListUserSegments(teamA, 1010)
+	assert.NoError(t, err)
+	assert.Len(t, listA.Segments, 1)
+
+	listB, err := svc.ListUserSegments(teamB, 1010)
+	assert.NoError(t, err)
+	assert.Empty(t, listB.Segments)
+
+	_, err = svc.SegmentInfo(context.Background(), "AVITO_VOICE_MESSAGES")
+	assert.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	key, err := svc.CreateAPIKey(teamB, "ci", "reader")
+	assert.NoError(t, err)
+	assert.Equal(t, "team-b", key.Namespace)
+
+	keys, err := svc.APIKeys(teamA)
+	assert.NoError(t, err)
+	assert.Empty(t, keys.Keys)
+
+	namespaces, err := svc.Namespaces(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{namespace.Default, "team-a", "team-b"}, namespaces.Namespaces)
+
+	report, err := svc.CreateLog(teamA, 1010, "2023-08")
+	assert.NoError(t, err)
+	assert.Contains(t, report.Path, "/team-a/")
+}
+
+func TestVersions(t *testing.T) {
+	t.Run("updates segment at current version", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+			ctx = context.Background()
+		)
+
+		created, err := svc.CreateSegment(ctx, "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), created.Version)
+
+		updated, err := svc.UpdateSegment(ctx, "AVITO_VOICE_MESSAGES", api.SegmentSettings{Group: "voice"}, created.Version)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), updated.Version)
+		assert.Equal(t, "voice", updated.Group)
+
+		_, err = svc.UpdateSegment(ctx, "AVITO_VOICE_MESSAGES", api.SegmentSettings{}, created.Version)
+		assert.ErrorIs(t, err, storage.ErrVersionMismatch)
+
+		_, err = svc.DeleteSegmentWithVersion(ctx, "AVITO_VOICE_MESSAGES", created.Version)
+		assert.ErrorIs(t, err, storage.ErrVersionMismatch)
+
+		_, err = svc.DeleteSegmentWithVersion(ctx, "AVITO_VOICE_MESSAGES", updated.Version)
+		assert.NoError(t, err)
+
+		_, err = svc.UpdateSegment(ctx, "AVITO_VOICE_MESSAGES", api.SegmentSettings{}, updated.Version)
+		assert.ErrorIs(t, err, storage.ErrSegmentNotFound)
+	})
+
+	t.Run("rejects prerequisite cycles", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+			ctx = context.Background()
+		)
+
+		_, err := svc.CreateSegment(ctx, "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+		_, err = svc.CreateSegmentWithSettings(ctx, "AVITO_VOICE_TRANSCRIPTS",
+			api.SegmentSettings{Requires: []string{"AVITO_VOICE_MESSAGES"}})
+		assert.NoError(t, err)
+
+		_, err = svc.UpdateSegment(ctx, "AVITO_VOICE_MESSAGES",
+			api.SegmentSettings{Requires: []string{"AVITO_VOICE_MESSAGES"}}, 0)
+		assert.ErrorIs(t, err, service.ErrInvalidPrerequisite)
+
+		_, err = svc.UpdateSegment(ctx, "AVITO_VOICE_MESSAGES",
+			api.SegmentSettings{Requires: []string{"AVITO_VOICE_TRANSCRIPTS"}}, 0)
+		assert.ErrorIs(t, err, service.ErrInvalidPrerequisite)
+	})
+
+	t.Run("bumps user version on membership changes", func(t *testing.T) {
+		var (
+			db  = memory.New()
+			svc = service.New(db, "")
+			ctx = context.Background()
+		)
+
+		_, err := svc.CreateSegment(ctx, "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+
+		version, err := svc.UserVersion(ctx, 1000)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), version)
+
+		assert.NoError(t, svc.CheckUserVersion(ctx, 1000, version))
+		_, _, err = svc.AddUserExperiments(ctx, 1000, []*api.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}})
+		assert.NoError(t, err)
+
+		// a concurrent change made against the same version loses
+		assert.ErrorIs(t, svc.CheckUserVersion(ctx, 1000, version), storage.ErrVersionMismatch)
+
+		version, err = svc.UserVersion(ctx, 1000)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), version)
+
+		_, err = svc.RemoveUserExperiments(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"})
+		assert.NoError(t, err)
+		assert.ErrorIs(t, svc.CheckUserVersion(ctx, 1000, version), storage.ErrVersionMismatch)
+	})
+}
+
+func TestTracing(t *testing.T) {
+	// the global provider forwards the service's tracer to the first provider set,
+	// so the subtests share one
+	var (
+		recorder = tracetest.NewSpanRecorder()
+		provider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	)
+
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	t.Run("continues incoming trace", func(t *testing.T) {
+		var (
+			db    = memory.New()
+			svc   = service.New(db, "")
+			ended = len(recorder.Ended())
+		)
+
+		traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+		spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+		ctx := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     spanID,
+			TraceFlags: trace.FlagsSampled,
+		}))
+
+		_, err := svc.ListUserSegments(ctx, 1010)
+		assert.NoError(t, err)
+
+		spans := recorder.Ended()[ended:]
+		assert.Equal(t, 1, len(spans))
+		assert.Equal(t, "service.ListUserSegments", spans[0].Name())
+		assert.Equal(t, traceID, spans[0].SpanContext().TraceID())
+		assert.Equal(t, spanID, spans[0].Parent().SpanID())
+	})
+
+	t.Run("traces segment creation", func(t *testing.T) {
+		var (
+			db    = memory.New()
+			svc   = service.New(db, "")
+			ended = len(recorder.Ended())
+		)
+
+		_, err := svc.CreateSegment(context.Background(), "Hello")
+		assert.NoError(t, err)
+
+		spans := recorder.Ended()[ended:]
+		if assert.Equal(t, 1, len(spans)) {
+			assert.Equal(t, "service.CreateSegment", spans[0].Name())
+			assert.Contains(t, spans[0].Attributes(), attribute.String("segment", "Hello"))
+		}
 	})
 }
@@ -0,0 +1,263 @@
+// Package cache implements a read-through cache of user segment lookups in front of
+// any service.Storage. Entries live in an in-process LRU and expire after a TTL, so
+// readers may observe memberships that are at most TTL old.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+)
+
+// Stats is a snapshot of cache counters.
+type Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Size      int   `json:"size"`
+}
+
+// entryKey identifies a user within a namespace.
+type entryKey struct {
+	namespace string
+	userID    int64
+}
+
+type entry struct {
+	key       entryKey
+	segments  []storage.SegmentDTO
+	expiresAt time.Time
+}
+
+// Storage caches UserSegments and UsersSegments of the wrapped storage and
+// invalidates a user on every membership change.
+type Storage struct {
+	service.Storage
+
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[entryKey]*list.Element
+	order   *list.List
+	// version is bumped on every invalidation so that lookups started before
+	// a write do not store results read before it.
+	version uint64
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// New wraps next with a cache of at most size users whose entries expire after ttl.
+func New(next service.Storage, size int, ttl time.Duration) *Storage {
+	return &Storage{
+		Storage: next,
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[entryKey]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+func (s *Storage) UserSegments(ctx context.Context, userID int64) (*storage.UserExperimentListDTO, error) {
+	key := entryKey{namespace: namespace.FromContext(ctx), userID: userID}
+
+	if segments, ok := s.get(key); ok {
+		s.hits.Add(1)
+		return &storage.UserExperimentListDTO{UserID: userID, Segments: segments}, nil
+	}
+	s.misses.Add(1)
+
+	version := s.currentVersion()
+
+	list, err := s.Storage.UserSegments(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	s.put(version, key, list.Segments)
+
+	return list, nil
+}
+
+func (s *Storage) UsersSegments(ctx context.Context, userIDs []int64) (map[int64][]storage.SegmentDTO, error) {
+	var (
+		ns       = namespace.FromContext(ctx)
+		segments = make(map[int64][]storage.SegmentDTO, len(userIDs))
+		missing  []int64
+	)
+
+	for _, userID := range userIDs {
+		if cached, ok := s.get(entryKey{namespace: ns, userID: userID}); ok {
+			s.hits.Add(1)
+			if len(cached) > 0 {
+				segments[userID] = cached
+			}
+			continue
+		}
+		s.misses.Add(1)
+		missing = append(missing, userID)
+	}
+
+	if len(missing) == 0 {
+		return segments, nil
+	}
+
+	version := s.currentVersion()
+
+	loaded, err := s.Storage.UsersSegments(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, userID := range missing {
+		s.put(version, entryKey{namespace: ns, userID: userID}, loaded[userID])
+		if len(loaded[userID]) > 0 {
+			segments[userID] = loaded[userID]
+		}
+	}
+
+	return segments, nil
+}
+
+func (s *Storage) AddUserToSegment(ctx context.Context, userID int64, segmentName string, forced bool) (*storage.UserExperimentDTO, error) {
+	defer s.invalidate(ctx, userID)
+	return s.Storage.AddUserToSegment(ctx, userID, segmentName, forced)
+}
+
+func (s *Storage) AddUserToSegmentWithExpiracy(ctx context.Context, userID int64, segmentName string, expiredAt time.Time, forced bool) (*storage.UserExperimentDTO, error) {
+	defer s.invalidate(ctx, userID)
+	return s.Storage.AddUserToSegmentWithExpiracy(ctx, userID, segmentName, expiredAt, forced)
+}
+
+func (s *Storage) DeleteUserFromSegment(ctx context.Context, userID int64, segmentName string) (*storage.UserExperimentDTO, error) {
+	defer s.invalidate(ctx, userID)
+	return s.Storage.DeleteUserFromSegment(ctx, userID, segmentName)
+}
+
+// DeleteSegment drops the whole cache since any user may have been a member.
+func (s *Storage) DeleteSegment(ctx context.Context, name string) (*storage.SegmentDTO, error) {
+	defer s.purge()
+	return s.Storage.DeleteSegment(ctx, name)
+}
+
+// UpdateSegment drops the whole cache since members hold copies of the settings.
+func (s *Storage) UpdateSegment(ctx context.Context, name string, settings storage.SegmentSettingsDTO, version int64) (*storage.SegmentDTO, error) {
+	defer s.purge()
+	return s.Storage.UpdateSegment(ctx, name, settings, version)
+}
+
+func (s *Storage) DeleteSegmentWithVersion(ctx context.Context, name string, version int64) (*storage.SegmentDTO, error) {
+	defer s.purge()
+	return s.Storage.DeleteSegmentWithVersion(ctx, name, version)
+}
+
+// DeleteOldExperiments drops the whole cache if expired memberships of any user were removed.
+func (s *Storage) DeleteOldExperiments(ctx context.Context) (int64, error) {
+	removed, err := s.Storage.DeleteOldExperiments(ctx)
+	if removed > 0 {
+		s.purge()
+	}
+
+	return removed, err
+}
+
+// Stats returns current cache counters.
+func (s *Storage) Stats() Stats {
+	s.mu.Lock()
+	size := s.order.Len()
+	s.mu.Unlock()
+
+	return Stats{
+		Hits:      s.hits.Load(),
+		Misses:    s.misses.Load(),
+		Evictions: s.evictions.Load(),
+		Size:      size,
+	}
+}
+
+func (s *Storage) get(key entryKey) ([]storage.SegmentDTO, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := elem.Value.(*entry)
+	if !s.now().Before(e.expiresAt) {
+		s.remove(elem)
+		return nil, false
+	}
+	s.order.MoveToFront(elem)
+
+	return append([]storage.SegmentDTO(nil), e.segments...), true
+}
+
+func (s *Storage) put(version uint64, key entryKey, segments []storage.SegmentDTO) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version != s.version {
+		return
+	}
+
+	e := &entry{
+		key:       key,
+		segments:  append([]storage.SegmentDTO(nil), segments...),
+		expiresAt: s.now().Add(s.ttl),
+	}
+
+	if elem, ok := s.entries[key]; ok {
+		elem.Value = e
+		s.order.MoveToFront(elem)
+		return
+	}
+
+	s.entries[key] = s.order.PushFront(e)
+
+	for s.order.Len() > s.size {
+		s.remove(s.order.Back())
+		s.evictions.Add(1)
+	}
+}
+
+func (s *Storage) currentVersion() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.version
+}
+
+func (s *Storage) invalidate(ctx context.Context, userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.version++
+	if elem, ok := s.entries[entryKey{namespace: namespace.FromContext(ctx), userID: userID}]; ok {
+		s.remove(elem)
+	}
+}
+
+func (s *Storage) purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.version++
+	s.entries = make(map[entryKey]*list.Element, s.size)
+	s.order.Init()
+}
+
+func (s *Storage) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.entries, elem.Value.(*entry).key)
+}
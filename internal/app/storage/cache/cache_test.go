@@ -0,0 +1,112 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/cache"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	t.Run("serves repeated lookups from cache", func(t *testing.T) {
+		var (
+			db     = memory.New()
+			cached = cache.New(db, 10, time.Minute)
+		)
+
+		_, err := cached.AddSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			_, err = cached.UserSegments(context.Background(), 1010)
+			assert.NoError(t, err)
+		}
+
+		assert.Equal(t, cache.Stats{Hits: 2, Misses: 1, Size: 1}, cached.Stats())
+	})
+
+	t.Run("invalidates user on membership change", func(t *testing.T) {
+		var (
+			db     = memory.New()
+			cached = cache.New(db, 10, time.Minute)
+		)
+
+		_, err := cached.AddSegment(context.Background(), "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+
+		list, err := cached.UserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(list.Segments))
+
+		_, err = cached.AddUserToSegment(context.Background(), 1010, "AVITO_VOICE_MESSAGES", false)
+		assert.NoError(t, err)
+
+		list, err = cached.UserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(list.Segments))
+
+		_, err = cached.DeleteUserFromSegment(context.Background(), 1010, "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+
+		segments, err := cached.UsersSegments(context.Background(), []int64{1010})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(segments[1010]))
+	})
+
+	t.Run("keeps namespaces apart", func(t *testing.T) {
+		var (
+			db     = memory.New()
+			cached = cache.New(db, 10, time.Minute)
+			teamA  = namespace.With(context.Background(), "team-a")
+			teamB  = namespace.With(context.Background(), "team-b")
+		)
+
+		_, err := cached.AddSegment(teamA, "AVITO_VOICE_MESSAGES")
+		assert.NoError(t, err)
+		_, err = cached.AddUserToSegment(teamA, 1010, "AVITO_VOICE_MESSAGES", false)
+		assert.NoError(t, err)
+
+		list, err := cached.UserSegments(teamA, 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(list.Segments))
+
+		list, err = cached.UserSegments(teamB, 1010)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(list.Segments))
+	})
+
+	t.Run("keeps entries when sweep removes nothing", func(t *testing.T) {
+		var (
+			db     = memory.New()
+			cached = cache.New(db, 10, time.Minute)
+		)
+
+		_, err := cached.UserSegments(context.Background(), 1010)
+		assert.NoError(t, err)
+
+		_, err = cached.DeleteOldExperiments(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, cached.Stats().Size)
+	})
+
+	t.Run("evicts least recently used and expired users", func(t *testing.T) {
+		var (
+			db     = memory.New()
+			cached = cache.New(db, 2, 50*time.Millisecond)
+		)
+
+		_, err := cached.UsersSegments(context.Background(), []int64{1010, 2020, 3030})
+		assert.NoError(t, err)
+		assert.Equal(t, cache.Stats{Misses: 3, Evictions: 1, Size: 2}, cached.Stats())
+
+		time.Sleep(100 * time.Millisecond)
+
+		_, err = cached.UserSegments(context.Background(), 3030)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), cached.Stats().Misses)
+	})
+}
@@ -3,8 +3,11 @@ package memory
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
 	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
 )
 
@@ -14,23 +17,65 @@ var (
 )
 
 type Storage struct {
-	segments map[string]struct {
-		ID   int64
-		Name string
-	}
+	mu sync.RWMutex
+
+	spaces          map[string]*space
 	userExperiments map[int64][]struct {
 		ID        int64
 		UserID    int64
 		SegmentID int64
 	}
+	// forced holds the memberships added with force by user and segment ID
+	forced map[int64]map[int64]bool
+	// expires holds the expiry of memberships added with one by user and segment ID
+	expires      map[int64]map[int64]time.Time
+	overridesIdx int64
+	apiKeys      []storage.APIKeyDTO
+	idempotency  map[string]idempotencyRecord
+
+	webhooksIdx   int64
+	webhooks      []storage.WebhookDTO
+	webhookEvents []webhookEvent
+	deliveries    []storage.WebhookDeliveryDTO
+	notify        func(namespace string)
+}
+
+type webhookEvent struct {
+	storage.WebhookEventDTO
+	dispatched bool
+}
+
+type idempotencyRecord struct {
+	storage.IdempotencyRecordDTO
+	expiresAt time.Time
+}
+
+// space holds the data of one namespace. Memberships reference segments by their
+// globally unique IDs, so they are shared and scoped through the segments.
+type space struct {
+	segments       map[string]storage.SegmentDTO
+	userAttributes map[int64]map[string]string
+	windowActive   map[string]bool
+	overrides      map[int64]map[string]storage.OverrideDTO
+	userVersions   map[int64]int64
+}
+
+func newSpace() *space {
+	return &space{
+		segments:       make(map[string]storage.SegmentDTO),
+		userAttributes: make(map[int64]map[string]string),
+		windowActive:   make(map[string]bool),
+		overrides:      make(map[int64]map[string]storage.OverrideDTO),
+		userVersions:   make(map[int64]int64),
+	}
 }
 
 func New() *Storage {
 	return &Storage{
-		segments: make(map[string]struct {
-			ID   int64
-			Name string
-		}),
+		spaces:      make(map[string]*space),
+		idempotency: make(map[string]idempotencyRecord),
+		forced:      make(map[int64]map[int64]bool),
+		expires:     make(map[int64]map[int64]time.Time),
 		userExperiments: make(map[int64][]struct {
 			ID        int64
 			UserID    int64
@@ -39,11 +84,30 @@ func New() *Storage {
 	}
 }
 
-func (s *Storage) Segments() map[string]struct {
-	ID   int64
-	Name string
-} {
-	return s.segments
+// space returns the namespace of ctx or an empty one if it has no data yet.
+// It must be called with at least a read lock held.
+func (s *Storage) space(ctx context.Context) *space {
+	if sp, ok := s.spaces[namespace.FromContext(ctx)]; ok {
+		return sp
+	}
+
+	return newSpace()
+}
+
+// ensureSpace returns the namespace of ctx, creating it. It must be called with
+// the write lock held.
+func (s *Storage) ensureSpace(ctx context.Context) *space {
+	name := namespace.FromContext(ctx)
+	if _, ok := s.spaces[name]; !ok {
+		s.spaces[name] = newSpace()
+	}
+
+	return s.spaces[name]
+}
+
+// Segments returns segments of the default namespace.
+func (s *Storage) Segments() map[string]storage.SegmentDTO {
+	return s.space(context.Background()).segments
 }
 
 func (s *Storage) Experiments() map[int64][]struct {
@@ -55,43 +119,161 @@ func (s *Storage) Experiments() map[int64][]struct {
 }
 
 func (s *Storage) AddSegment(ctx context.Context, name string) (*storage.SegmentDTO, error) {
-	if _, ok := s.segments[name]; ok {
+	return s.AddSegmentWithSettings(ctx, name, storage.SegmentSettingsDTO{})
+}
+
+func (s *Storage) AddSegmentWithSettings(ctx context.Context, name string, settings storage.SegmentSettingsDTO) (*storage.SegmentDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp := s.ensureSpace(ctx)
+
+	if _, ok := sp.segments[name]; ok {
 		return nil, fmt.Errorf("mock storage add: %w", storage.ErrSegmentExists)
 	}
 
-	s.segments[name] = struct {
-		ID   int64
-		Name string
-	}{
-		segmentsIdx,
-		name,
+	for _, required := range settings.Requires {
+		if _, ok := sp.segments[required]; !ok {
+			return nil, fmt.Errorf("mock storage add: prerequisite %w", storage.ErrSegmentNotFound)
+		}
 	}
 
-	res := &storage.SegmentDTO{
-		ID:   segmentsIdx,
-		Name: name,
+	sp.segments[name] = storage.SegmentDTO{
+		ID:                 segmentsIdx,
+		Name:               name,
+		Version:            1,
+		SegmentSettingsDTO: settings,
 	}
+
+	res := sp.segments[name]
+	sp.windowActive[name] = windowContains(settings, time.Now())
 	segmentsIdx++
+	s.addEvent(ctx, storage.EventSegmentCreated, name, 0)
 
-	return res, nil
+	return &res, nil
+}
+
+func (s *Storage) UpdateSegment(ctx context.Context, name string, settings storage.SegmentSettingsDTO, version int64) (*storage.SegmentDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp := s.ensureSpace(ctx)
+
+	segment, ok := sp.segments[name]
+	if !ok {
+		return nil, fmt.Errorf("mock storage update: %w", storage.ErrSegmentNotFound)
+	}
+
+	if version != 0 && segment.Version != version {
+		return nil, fmt.Errorf("mock storage update: %w", storage.ErrVersionMismatch)
+	}
+
+	for _, required := range settings.Requires {
+		if _, ok := sp.segments[required]; !ok {
+			return nil, fmt.Errorf("mock storage update: prerequisite %w", storage.ErrSegmentNotFound)
+		}
+	}
+
+	segment.Version++
+	segment.SegmentSettingsDTO = settings
+	sp.segments[name] = segment
+	s.addEvent(ctx, storage.EventSegmentUpdated, name, 0)
+
+	return &segment, nil
 }
 
 func (s *Storage) DeleteSegment(ctx context.Context, name string) (*storage.SegmentDTO, error) {
-	if _, ok := s.segments[name]; !ok {
+	return s.DeleteSegmentWithVersion(ctx, name, 0)
+}
+
+func (s *Storage) DeleteSegmentWithVersion(ctx context.Context, name string, version int64) (*storage.SegmentDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp := s.ensureSpace(ctx)
+
+	if _, ok := sp.segments[name]; !ok {
 		return nil, fmt.Errorf("mock storage delete: %w", storage.ErrSegmentNotFound)
 	}
 
-	res := &storage.SegmentDTO{
-		ID:   s.segments[name].ID,
-		Name: s.segments[name].Name,
+	if version != 0 && sp.segments[name].Version != version {
+		return nil, fmt.Errorf("mock storage delete: %w", storage.ErrVersionMismatch)
 	}
-	delete(s.segments, name)
 
-	return res, nil
+	res := sp.segments[name]
+	delete(sp.segments, name)
+	delete(sp.windowActive, name)
+	s.addEvent(ctx, storage.EventSegmentDeleted, name, 0)
+
+	for key, segment := range sp.segments {
+		for i, required := range segment.Requires {
+			if required == name {
+				segment.Requires = append(segment.Requires[:i:i], segment.Requires[i+1:]...)
+				sp.segments[key] = segment
+				break
+			}
+		}
+	}
+
+	return &res, nil
 }
 
-func (s *Storage) AddUserToSegment(ctx context.Context, userID int64, segmentName string) (*storage.UserExperimentDTO, error) {
-	segment, ok := s.segments[segmentName]
+func (s *Storage) Segment(ctx context.Context, name string) (*storage.SegmentDTO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sp := s.space(ctx)
+
+	segment, ok := sp.segments[name]
+	if !ok {
+		return nil, fmt.Errorf("mock storage segment: %w", storage.ErrSegmentNotFound)
+	}
+
+	return &segment, nil
+}
+
+func (s *Storage) SegmentMembers(ctx context.Context, name string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sp := s.space(ctx)
+
+	segment, ok := sp.segments[name]
+	if !ok {
+		return 0, fmt.Errorf("mock storage segment members: %w", storage.ErrSegmentNotFound)
+	}
+
+	return s.countMembers(segment.ID), nil
+}
+
+func (s *Storage) SegmentDependents(ctx context.Context, name string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sp := s.space(ctx)
+
+	var dependents []string
+
+	for _, segment := range sp.segments {
+		for _, required := range segment.Requires {
+			if required == name {
+				dependents = append(dependents, segment.Name)
+				break
+			}
+		}
+	}
+
+	return dependents, nil
+}
+
+func (s *Storage) AddUserToSegment(ctx context.Context, userID int64, segmentName string, forced bool) (*storage.UserExperimentDTO, error) {
+	return s.addUserToSegment(ctx, userID, segmentName, nil, forced)
+}
+
+func (s *Storage) AddUserToSegmentWithExpiracy(ctx context.Context, userID int64, segmentName string, expiresAt time.Time, forced bool) (*storage.UserExperimentDTO, error) {
+	return s.addUserToSegment(ctx, userID, segmentName, &expiresAt, forced)
+}
+
+func (s *Storage) addUserToSegment(ctx context.Context, userID int64, segmentName string, expiresAt *time.Time, forced bool) (*storage.UserExperimentDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp := s.ensureSpace(ctx)
+
+	segment, ok := sp.segments[segmentName]
 	if !ok {
 		return nil, storage.ErrSegmentNotFound
 	}
@@ -102,6 +284,18 @@ func (s *Storage) AddUserToSegment(ctx context.Context, userID int64, segmentNam
 		}
 	}
 
+	if conflicting, ok := s.groupConflict(sp, userID, segment); ok {
+		return nil, fmt.Errorf("mock storage add user to segment: %w",
+			fmt.Errorf("%w: %s", storage.ErrExclusionGroupConflict, conflicting))
+	}
+
+	if segment.MaxMembers != nil {
+		if members := s.countMembers(segment.ID); members >= *segment.MaxMembers {
+			return nil, fmt.Errorf("mock storage add user to segment: %w",
+				fmt.Errorf("%w: %d of %d", storage.ErrCapacityExceeded, members, *segment.MaxMembers))
+		}
+	}
+
 	s.userExperiments[userID] = append(s.userExperiments[userID], struct {
 		ID        int64
 		UserID    int64
@@ -111,22 +305,35 @@ func (s *Storage) AddUserToSegment(ctx context.Context, userID int64, segmentNam
 		UserID:    userID,
 		SegmentID: segment.ID,
 	})
+	if s.forced[userID] == nil {
+		s.forced[userID] = make(map[int64]bool)
+	}
+	s.forced[userID][segment.ID] = forced
+	if expiresAt != nil {
+		if s.expires[userID] == nil {
+			s.expires[userID] = make(map[int64]time.Time)
+		}
+		s.expires[userID][segment.ID] = *expiresAt
+	}
 
 	res := &storage.UserExperimentDTO{
-		ID:     userExperimentsIdx,
-		UserID: userID,
-		Segment: storage.SegmentDTO{
-			ID:   segment.ID,
-			Name: segmentName,
-		},
+		ID:      userExperimentsIdx,
+		UserID:  userID,
+		Segment: segment,
 	}
 	userExperimentsIdx++
+	sp.userVersions[userID]++
+	s.addEvent(ctx, storage.EventMembershipAdded, segmentName, userID)
 
 	return res, nil
 }
 
 func (s *Storage) DeleteUserFromSegment(ctx context.Context, userID int64, segmentName string) (*storage.UserExperimentDTO, error) {
-	segment, ok := s.segments[segmentName]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp := s.ensureSpace(ctx)
+
+	segment, ok := sp.segments[segmentName]
 	if !ok {
 		return nil, storage.ErrSegmentNotFound
 	}
@@ -143,40 +350,49 @@ func (s *Storage) DeleteUserFromSegment(ctx context.Context, userID int64, segme
 				idx = i
 				res.ID = record.ID
 				res.UserID = userID
-				res.Segment.ID = segment.ID
-				res.Segment.Name = segmentName
+				res.Segment = segment
 				break
 			}
 		}
+	}
 
-		if idx == -1 {
-			return nil, fmt.Errorf("mock storage delete user from segment: %w", storage.ErrUserExperimentNotFound)
-		}
-		s.userExperiments[userID] = append(s.userExperiments[userID][:idx],
-			s.userExperiments[userID][idx+1:]...)
+	if idx == -1 {
+		return nil, fmt.Errorf("mock storage delete user from segment: %w", storage.ErrUserExperimentNotFound)
 	}
+	s.userExperiments[userID] = append(s.userExperiments[userID][:idx],
+		s.userExperiments[userID][idx+1:]...)
+	delete(s.expires[userID], segment.ID)
+	sp.userVersions[userID]++
+	s.addEvent(ctx, storage.EventMembershipRemoved, segmentName, userID)
 
 	return res, nil
 }
 
 func (s *Storage) UserSegments(ctx context.Context, userID int64) (*storage.UserExperimentListDTO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sp := s.space(ctx)
+
 	res := &storage.UserExperimentListDTO{
 		UserID: userID,
 	}
 
-	segmentKeys := make([]string, 0, len(s.segments))
-	for k := range s.segments {
+	segmentKeys := make([]string, 0, len(sp.segments))
+	for k := range sp.segments {
 		segmentKeys = append(segmentKeys, k)
 	}
 
+	now := time.Now()
 	for _, record := range s.userExperiments[userID] {
+		if s.expired(userID, record.SegmentID, now) {
+			continue
+		}
 
 		for _, key := range segmentKeys {
-			if s.segments[key].ID == record.SegmentID {
-				res.Segments = append(res.Segments, storage.SegmentDTO{
-					ID:   s.segments[key].ID,
-					Name: s.segments[key].Name,
-				})
+			if sp.segments[key].ID == record.SegmentID {
+				segment := sp.segments[key]
+				segment.Forced = s.forced[userID][record.SegmentID]
+				res.Segments = append(res.Segments, segment)
 				break
 			}
 		}
@@ -185,14 +401,747 @@ func (s *Storage) UserSegments(ctx context.Context, userID int64) (*storage.User
 	return res, nil
 }
 
-func (s *Storage) UserExperimentLogs(ctx context.Context, userID int64, start time.Time) ([]*storage.UserExperimentLogRecordDTO, error) {
+func (s *Storage) UserVersion(ctx context.Context, userID int64) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.space(ctx).userVersions[userID], nil
+}
+
+func (s *Storage) BumpUserVersion(ctx context.Context, userID, version int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp := s.ensureSpace(ctx)
+
+	if sp.userVersions[userID] != version {
+		return 0, fmt.Errorf("mock storage bump user version: %w", storage.ErrVersionMismatch)
+	}
+	sp.userVersions[userID]++
+
+	return sp.userVersions[userID], nil
+}
+
+func (s *Storage) UsersSegments(ctx context.Context, userIDs []int64) (map[int64][]storage.SegmentDTO, error) {
+	segments := make(map[int64][]storage.SegmentDTO, len(userIDs))
+
+	for _, userID := range userIDs {
+		list, err := s.UserSegments(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(list.Segments) > 0 {
+			segments[userID] = list.Segments
+		}
+	}
+
+	return segments, nil
+}
+
+func (s *Storage) RuleSegments(ctx context.Context) ([]storage.SegmentDTO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sp := s.space(ctx)
+
+	var segments []storage.SegmentDTO
+
+	for _, segment := range sp.segments {
+		if segment.Rule != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].ID < segments[j].ID
+	})
+
+	return segments, nil
+}
+
+func (s *Storage) SetUserAttributes(ctx context.Context, userID int64, attributes map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp := s.ensureSpace(ctx)
+
+	if _, ok := sp.userAttributes[userID]; !ok {
+		sp.userAttributes[userID] = make(map[string]string)
+	}
+
+	for key, value := range attributes {
+		if value == "" {
+			delete(sp.userAttributes[userID], key)
+		} else {
+			sp.userAttributes[userID][key] = value
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) UserAttributes(ctx context.Context, userID int64) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sp := s.space(ctx)
+
+	attributes := make(map[string]string, len(sp.userAttributes[userID]))
+	for key, value := range sp.userAttributes[userID] {
+		attributes[key] = value
+	}
+
+	return attributes, nil
+}
+
+func (s *Storage) UsersAttributes(ctx context.Context, userIDs []int64) (map[int64]map[string]string, error) {
+	attributes := make(map[int64]map[string]string, len(userIDs))
+
+	for _, userID := range userIDs {
+		userAttributes, err := s.UserAttributes(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(userAttributes) > 0 {
+			attributes[userID] = userAttributes
+		}
+	}
+
+	return attributes, nil
+}
+
+func (s *Storage) SyncSegmentWindows(ctx context.Context) ([]*storage.SegmentLogRecordDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		now     = time.Now()
+		records []*storage.SegmentLogRecordDTO
+	)
+
+	for ns, sp := range s.spaces {
+		for name, segment := range sp.segments {
+			active := windowContains(segment.SegmentSettingsDTO, now)
+			if active == sp.windowActive[name] {
+				continue
+			}
+			sp.windowActive[name] = active
+
+			rec := &storage.SegmentLogRecordDTO{
+				Namespace:   ns,
+				SegmentName: name,
+				Operation:   "deactivate",
+				AddedAt:     now,
+			}
+			if active {
+				rec.Operation = "activate"
+			}
+			records = append(records, rec)
+		}
+	}
+
+	return records, nil
+}
+
+func (s *Storage) SetOverride(ctx context.Context, override storage.OverrideDTO) (*storage.OverrideDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp := s.ensureSpace(ctx)
+
+	segment, ok := sp.segments[override.Segment.Name]
+	if !ok {
+		return nil, fmt.Errorf("mock storage set override: %w", storage.ErrSegmentNotFound)
+	}
+
+	if _, ok := sp.overrides[override.UserID]; !ok {
+		sp.overrides[override.UserID] = make(map[string]storage.OverrideDTO)
+	}
+
+	override.ID = s.overridesIdx
+	override.Segment = segment
+	override.CreatedAt = time.Now()
+	sp.overrides[override.UserID][segment.Name] = override
+	s.overridesIdx++
+
+	return &override, nil
+}
+
+func (s *Storage) DeleteOverride(ctx context.Context, userID int64, segmentName, actor string) (*storage.OverrideDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp := s.ensureSpace(ctx)
+
+	override, ok := sp.overrides[userID][segmentName]
+	if !ok {
+		return nil, fmt.Errorf("mock storage delete override: %w", storage.ErrOverrideNotFound)
+	}
+	delete(sp.overrides[userID], segmentName)
+
+	override.Actor = actor
+
+	return &override, nil
+}
+
+func (s *Storage) UserOverrides(ctx context.Context, userID int64) ([]storage.OverrideDTO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sp := s.space(ctx)
+
+	var (
+		now       = time.Now()
+		overrides []storage.OverrideDTO
+	)
+
+	for name, override := range sp.overrides[userID] {
+		segment, ok := sp.segments[name]
+		if !ok || segment.ID != override.Segment.ID {
+			continue
+		}
+		if override.ExpiresAt != nil && !override.ExpiresAt.After(now) {
+			continue
+		}
+
+		override.Segment = segment
+		overrides = append(overrides, override)
+	}
+
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].ID < overrides[j].ID
+	})
+
+	return overrides, nil
+}
+
+func (s *Storage) UsersOverrides(ctx context.Context, userIDs []int64) (map[int64][]storage.OverrideDTO, error) {
+	overrides := make(map[int64][]storage.OverrideDTO, len(userIDs))
+
+	for _, userID := range userIDs {
+		userOverrides, err := s.UserOverrides(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(userOverrides) > 0 {
+			overrides[userID] = userOverrides
+		}
+	}
+
+	return overrides, nil
+}
+
+func (s *Storage) Overrides(ctx context.Context) ([]storage.OverrideDTO, error) {
+	s.mu.RLock()
+	userIDs := make([]int64, 0, len(s.space(ctx).overrides))
+	for userID := range s.space(ctx).overrides {
+		userIDs = append(userIDs, userID)
+	}
+	s.mu.RUnlock()
+
+	var overrides []storage.OverrideDTO
+
+	for _, userID := range userIDs {
+		userOverrides, err := s.UserOverrides(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, userOverrides...)
+	}
+
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].ID < overrides[j].ID
+	})
+
+	return overrides, nil
+}
+
+func (s *Storage) AddAPIKey(ctx context.Context, key storage.APIKeyDTO) (*storage.APIKeyDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key.ID = int64(len(s.apiKeys)) + 1
+	key.Namespace = namespace.FromContext(ctx)
+	key.CreatedAt = time.Now()
+	s.apiKeys = append(s.apiKeys, key)
+
+	return &key, nil
+}
+
+func (s *Storage) RevokeAPIKey(ctx context.Context, id int64) (*storage.APIKeyDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.apiKeys {
+		if s.apiKeys[i].ID == id && s.apiKeys[i].Namespace == namespace.FromContext(ctx) && s.apiKeys[i].RevokedAt == nil {
+			now := time.Now()
+			s.apiKeys[i].RevokedAt = &now
+			key := s.apiKeys[i]
+			return &key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("mock storage revoke api key: %w", storage.ErrAPIKeyNotFound)
+}
+
+func (s *Storage) APIKeyByHash(ctx context.Context, hash string) (*storage.APIKeyDTO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.apiKeys {
+		if key.Hash == hash && key.RevokedAt == nil {
+			return &key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("mock storage api key by hash: %w", storage.ErrAPIKeyNotFound)
+}
+
+func (s *Storage) APIKeys(ctx context.Context) ([]storage.APIKeyDTO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []storage.APIKeyDTO
+	for _, key := range s.apiKeys {
+		if key.Namespace == namespace.FromContext(ctx) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (s *Storage) Namespaces(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set := make(map[string]struct{}, len(s.spaces))
+	for name, sp := range s.spaces {
+		if len(sp.segments) > 0 {
+			set[name] = struct{}{}
+		}
+	}
+	for _, key := range s.apiKeys {
+		set[key.Namespace] = struct{}{}
+	}
+
+	namespaces := make([]string, 0, len(set))
+	for name := range set {
+		namespaces = append(namespaces, name)
+	}
+	sort.Strings(namespaces)
+
+	return namespaces, nil
+}
+
+func (s *Storage) ReserveIdempotencyKey(ctx context.Context, key, requestHash string, expiresAt time.Time) (*storage.IdempotencyRecordDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, ok := s.idempotency[key]; ok && record.expiresAt.After(time.Now()) {
+		return &record.IdempotencyRecordDTO, nil
+	}
+
+	s.idempotency[key] = idempotencyRecord{
+		IdempotencyRecordDTO: storage.IdempotencyRecordDTO{RequestHash: requestHash},
+		expiresAt:            expiresAt,
+	}
+
 	return nil, nil
 }
 
-func (s *Storage) DeleteOldExperiments(ctx context.Context) error {
+func (s *Storage) CompleteIdempotencyKey(ctx context.Context, key string, status int, contentType, etag string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.idempotency[key]
+	if !ok {
+		return nil
+	}
+
+	record.Completed = true
+	record.Status = status
+	record.ContentType = contentType
+	record.ETag = etag
+	record.Body = append([]byte(nil), body...)
+	s.idempotency[key] = record
+
+	return nil
+}
+
+func (s *Storage) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, ok := s.idempotency[key]; ok && !record.Completed {
+		delete(s.idempotency, key)
+	}
+
+	return nil
+}
+
+func (s *Storage) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed int64
+	for key, record := range s.idempotency {
+		if !record.expiresAt.After(time.Now()) {
+			delete(s.idempotency, key)
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// addEvent writes a webhook event to the outbox. It must be called with the write
+// lock held, so the event is recorded atomically with the change.
+func (s *Storage) addEvent(ctx context.Context, eventType, segmentName string, userID int64) {
+	s.webhookEvents = append(s.webhookEvents, webhookEvent{WebhookEventDTO: storage.WebhookEventDTO{
+		ID:        int64(len(s.webhookEvents)) + 1,
+		Namespace: namespace.FromContext(ctx),
+		Type:      eventType,
+		Segment:   segmentName,
+		UserID:    userID,
+		CreatedAt: time.Now(),
+	}})
+
+	if s.notify != nil {
+		s.notify(namespace.FromContext(ctx))
+	}
+}
+
+// OnEvent makes the storage call notify with the namespace of every written event.
+// Notify is called with the lock held, so it must not block or use the storage.
+func (s *Storage) OnEvent(notify func(namespace string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.notify = notify
+}
+
+func (s *Storage) EventsAfter(ctx context.Context, afterID int64, limit int) ([]storage.WebhookEventDTO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []storage.WebhookEventDTO
+	for _, event := range s.webhookEvents {
+		if len(events) == limit {
+			break
+		}
+
+		if event.ID > afterID && event.Namespace == namespace.FromContext(ctx) {
+			events = append(events, event.WebhookEventDTO)
+		}
+	}
+
+	return events, nil
+}
+
+func (s *Storage) LastEventID(ctx context.Context) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := len(s.webhookEvents) - 1; i >= 0; i-- {
+		if s.webhookEvents[i].Namespace == namespace.FromContext(ctx) {
+			return s.webhookEvents[i].ID, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// WebhookEvents returns all events written to the outbox.
+func (s *Storage) WebhookEvents() []storage.WebhookEventDTO {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := make([]storage.WebhookEventDTO, 0, len(s.webhookEvents))
+	for _, event := range s.webhookEvents {
+		events = append(events, event.WebhookEventDTO)
+	}
+
+	return events
+}
+
+func (s *Storage) AddWebhook(ctx context.Context, webhook storage.WebhookDTO) (*storage.WebhookDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.webhooksIdx++
+	webhook.ID = s.webhooksIdx
+	webhook.Namespace = namespace.FromContext(ctx)
+	webhook.CreatedAt = time.Now()
+	s.webhooks = append(s.webhooks, webhook)
+
+	return &webhook, nil
+}
+
+func (s *Storage) DeleteWebhook(ctx context.Context, id int64) (*storage.WebhookDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, webhook := range s.webhooks {
+		if webhook.ID == id && webhook.Namespace == namespace.FromContext(ctx) {
+			s.webhooks = append(s.webhooks[:i:i], s.webhooks[i+1:]...)
+
+			deliveries := s.deliveries[:0:0]
+			for _, delivery := range s.deliveries {
+				if delivery.Webhook.ID != id {
+					deliveries = append(deliveries, delivery)
+				}
+			}
+			s.deliveries = deliveries
+
+			return &webhook, nil
+		}
+	}
+
+	return nil, fmt.Errorf("mock storage delete webhook: %w", storage.ErrWebhookNotFound)
+}
+
+func (s *Storage) Webhooks(ctx context.Context) ([]storage.WebhookDTO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var webhooks []storage.WebhookDTO
+	for _, webhook := range s.webhooks {
+		if webhook.Namespace == namespace.FromContext(ctx) {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+
+	return webhooks, nil
+}
+
+func (s *Storage) DispatchWebhookEvents(ctx context.Context, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dispatched int64
+	for i := range s.webhookEvents {
+		if dispatched == int64(limit) {
+			break
+		}
+
+		event := &s.webhookEvents[i]
+		if event.dispatched {
+			continue
+		}
+
+		for _, webhook := range s.webhooks {
+			if webhook.Namespace == event.Namespace && matches(webhook.Segments, event.Segment) &&
+				matches(webhook.Events, event.Type) {
+				s.deliveries = append(s.deliveries, storage.WebhookDeliveryDTO{
+					ID:            int64(len(s.deliveries)) + 1,
+					Webhook:       webhook,
+					Event:         event.WebhookEventDTO,
+					Status:        storage.DeliveryPending,
+					NextAttemptAt: time.Now(),
+				})
+			}
+		}
+
+		event.dispatched = true
+		dispatched++
+	}
+
+	return dispatched, nil
+}
+
+func (s *Storage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]storage.WebhookDeliveryDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claimed []storage.WebhookDeliveryDTO
+	for i := range s.deliveries {
+		if len(claimed) == limit {
+			break
+		}
+
+		delivery := &s.deliveries[i]
+		if delivery.Status != storage.DeliveryPending || delivery.NextAttemptAt.After(time.Now()) {
+			continue
+		}
+
+		delivery.Attempts++
+		delivery.NextAttemptAt = time.Now().Add(lease)
+		claimed = append(claimed, *delivery)
+	}
+
+	return claimed, nil
+}
+
+func (s *Storage) CompleteWebhookDelivery(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if delivery := s.delivery(id); delivery != nil {
+		now := time.Now()
+		delivery.Status = storage.DeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+	}
+
+	return nil
+}
+
+func (s *Storage) FailWebhookDelivery(ctx context.Context, id int64, lastError string, retryAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if delivery := s.delivery(id); delivery != nil {
+		delivery.LastError = lastError
+		if retryAt == nil {
+			delivery.Status = storage.DeliveryDead
+		} else {
+			delivery.NextAttemptAt = *retryAt
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) WebhookDeliveries(ctx context.Context, status string, limit int) ([]storage.WebhookDeliveryDTO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var deliveries []storage.WebhookDeliveryDTO
+	for i := len(s.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		delivery := s.deliveries[i]
+		if delivery.Webhook.Namespace == namespace.FromContext(ctx) && delivery.Status == status {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (s *Storage) ReplayWebhookDelivery(ctx context.Context, id int64) (*storage.WebhookDeliveryDTO, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery := s.delivery(id)
+	if delivery == nil || delivery.Webhook.Namespace != namespace.FromContext(ctx) ||
+		delivery.Status == storage.DeliveryPending {
+		return nil, fmt.Errorf("mock storage replay webhook delivery: %w", storage.ErrDeliveryNotFound)
+	}
+
+	delivery.Status = storage.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now()
+	delivery.LastError = ""
+	delivery.DeliveredAt = nil
+	res := *delivery
+
+	return &res, nil
+}
+
+func (s *Storage) PurgeWebhookEvents(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// delivery returns the delivery with the id. It must be called with the write lock held.
+func (s *Storage) delivery(id int64) *storage.WebhookDeliveryDTO {
+	for i := range s.deliveries {
+		if s.deliveries[i].ID == id {
+			return &s.deliveries[i]
+		}
+	}
+
 	return nil
 }
 
-func (s *Storage) AddUserToSegmentWithExpiracy(ctx context.Context, userID int64, segmentName string, expiredAt time.Time) (*storage.UserExperimentDTO, error) {
+// matches reports whether a subscription filter accepts the value. Empty filters
+// accept everything.
+func matches(filter []string, value string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+
+	for _, v := range filter {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Storage) UserExperimentLogs(ctx context.Context, userID int64, start time.Time) ([]*storage.UserExperimentLogRecordDTO, error) {
 	return nil, nil
 }
+
+// DeleteOldExperiments removes expired memberships, bumps versions of the affected
+// users and writes webhook events. It returns the number of removed memberships.
+func (s *Storage) DeleteOldExperiments(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		removed int64
+		now     = time.Now()
+	)
+
+	for userID, records := range s.userExperiments {
+		kept := records[:0]
+		for _, record := range records {
+			if !s.expired(userID, record.SegmentID, now) {
+				kept = append(kept, record)
+				continue
+			}
+
+			delete(s.expires[userID], record.SegmentID)
+			removed++
+
+			for name, sp := range s.spaces {
+				for _, segment := range sp.segments {
+					if segment.ID == record.SegmentID {
+						sp.userVersions[userID]++
+						s.addEvent(namespace.With(ctx, name), storage.EventMembershipExpired, segment.Name, userID)
+					}
+				}
+			}
+		}
+		s.userExperiments[userID] = kept
+	}
+
+	return removed, nil
+}
+
+// expired reports whether the user's membership in the segment has expired by now.
+// It must be called with at least a read lock held.
+func (s *Storage) expired(userID, segmentID int64, now time.Time) bool {
+	expiresAt, ok := s.expires[userID][segmentID]
+	return ok && !expiresAt.After(now)
+}
+
+// groupConflict returns the name of a user's segment sharing the exclusion group with segment.
+func (s *Storage) groupConflict(sp *space, userID int64, segment storage.SegmentDTO) (string, bool) {
+	if segment.Group == "" {
+		return "", false
+	}
+
+	for _, record := range s.userExperiments[userID] {
+		for _, other := range sp.segments {
+			if other.ID == record.SegmentID && other.ID != segment.ID && other.Group == segment.Group {
+				return other.Name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func (s *Storage) countMembers(segmentID int64) int64 {
+	var members int64
+
+	for _, records := range s.userExperiments {
+		for _, record := range records {
+			if record.SegmentID == segmentID {
+				members++
+			}
+		}
+	}
+
+	return members
+}
+
+func windowContains(settings storage.SegmentSettingsDTO, t time.Time) bool {
+	return (settings.StartsAt == nil || !settings.StartsAt.After(t)) &&
+		(settings.EndsAt == nil || settings.EndsAt.After(t))
+}
@@ -0,0 +1,133 @@
+package postgresql_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/postgresql"
+)
+
+// Load benchmarks run against a database with the schema from migrations applied:
+//
+//	AVITO_TEST_DATABASE_DSN=postgres://... go test -run - -bench . ./internal/app/storage/postgresql/
+//
+// The pool is deliberately smaller than the number of concurrent callers, so a method
+// holding more than one connection at a time would stall instead of reporting throughput.
+const (
+	loadPoolSize    = 4
+	loadParallelism = 16
+	loadUsers       = 1000
+)
+
+func BenchmarkUserSegments(b *testing.B) {
+	db, s := openLoadStorage(b)
+	ctx := context.Background()
+
+	name := loadSegment(b, db, s)
+	for userID := int64(1); userID <= loadUsers; userID++ {
+		if _, err := s.AddUserToSegment(ctx, userID, name, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var next atomic.Int64
+
+	b.SetParallelism(loadParallelism)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := s.UserSegments(ctx, next.Add(1)%loadUsers+1); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+}
+
+func BenchmarkAddDeleteUser(b *testing.B) {
+	db, s := openLoadStorage(b)
+	ctx := context.Background()
+
+	name := loadSegment(b, db, s)
+
+	var next atomic.Int64
+
+	b.SetParallelism(loadParallelism)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			userID := next.Add(1)
+
+			if _, err := s.AddUserToSegment(ctx, userID, name, false); err != nil {
+				b.Error(err)
+				return
+			}
+
+			if _, err := s.DeleteUserFromSegment(ctx, userID, name); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+}
+
+func openLoadStorage(b *testing.B) (*sql.DB, *postgresql.Storage) {
+	b.Helper()
+
+	dsn := os.Getenv("AVITO_TEST_DATABASE_DSN")
+	if dsn == "" {
+		b.Skip("AVITO_TEST_DATABASE_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	db.SetMaxOpenConns(loadPoolSize)
+	db.SetMaxIdleConns(loadPoolSize)
+
+	if err := db.Ping(); err != nil {
+		b.Fatal(err)
+	}
+
+	return db, postgresql.New(db)
+}
+
+// loadSegment creates a segment removed with all its memberships after the benchmark.
+func loadSegment(b *testing.B, db *sql.DB, s *postgresql.Storage) string {
+	b.Helper()
+
+	name := fmt.Sprintf("LOAD_TEST_%d", time.Now().UnixNano())
+
+	segment, err := s.AddSegment(context.Background(), name)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Cleanup(func() {
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "DELETE FROM user_experiments WHERE segment_id = $1;", segment.ID); err != nil {
+			b.Error(err)
+		}
+		if _, err := s.DeleteSegment(ctx, name); err != nil {
+			b.Error(err)
+		}
+	})
+
+	return name
+}
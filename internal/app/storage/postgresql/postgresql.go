@@ -4,32 +4,111 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/lib/pq"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/metrics"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
 	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// EventsChannel is notified with the namespace of events written to the outbox.
+const EventsChannel = "segment_events"
+
+const (
+	listenMinReconnect = time.Second
+	listenMaxReconnect = time.Minute
+	listenPingInterval = 90 * time.Second
+)
+
+// SchemaVersion is the number of the latest migration the storage expects in schema_migrations.
+const SchemaVersion = 22
+
 type Storage struct {
-	db *sql.DB
+	db      *sql.DB
+	metrics *metrics.Metrics
+	logger  *slog.Logger
+}
+
+type Option func(*Storage)
+
+// WithMetrics records latency and errors of every storage operation labeled by its op name.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(s *Storage) {
+		s.metrics = m
+	}
+}
+
+var tracer = otel.Tracer("github.com/psxzz/backend-trainee-assignment/internal/app/storage/postgresql")
+
+// observe starts a span named after op. The returned function ends it and records
+// the operation latency and error.
+func (s *Storage) observe(ctx context.Context, op string) (context.Context, func(*error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, op, trace.WithSpanKind(trace.SpanKindClient))
+
+	return ctx, func(err *error) {
+		if *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+
+		duration := time.Since(start)
+		s.metrics.ObserveStorage(op, duration, *err)
+		s.logger.DebugContext(ctx, "storage operation", "op", op, "duration", duration, "error", *err)
+	}
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx, so helpers run either on the
+// pool or inside the caller's transaction without taking another connection.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Storage) {
+		s.logger = logger
+	}
 }
 
-func New(db *sql.DB) *Storage {
-	return &Storage{db: db}
+func New(db *sql.DB, opts ...Option) *Storage {
+	s := &Storage{db: db, logger: slog.Default()}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
 func (s *Storage) AddSegment(ctx context.Context, name string) (*storage.SegmentDTO, error) {
-	op := "storage.postgresql.AddSegment"
+	return s.AddSegmentWithSettings(ctx, name, storage.SegmentSettingsDTO{})
+}
+
+func (s *Storage) AddSegmentWithSettings(ctx context.Context, name string, settings storage.SegmentSettingsDTO) (_ *storage.SegmentDTO, err error) {
+	op := "storage.postgresql.AddSegmentWithSettings"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
 
-	conn, err := s.db.Conn(ctx)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	defer conn.Close()
+	defer tx.Rollback() //nolint:errcheck
 
-	row := conn.QueryRowContext(ctx,
-		"INSERT INTO Segments(segment_name) VALUES ($1) RETURNING *;", name)
+	row := tx.QueryRowContext(ctx,
+		"INSERT INTO Segments(segment_name, group_name, rule_expr, starts_at, ends_at, max_members, window_active, namespace) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, ($4 IS NULL OR $4 <= NOW()) AND ($5 IS NULL OR $5 > NOW()), $7) "+
+			"RETURNING id, version;",
+		name, nullString(settings.Group), nullString(settings.Rule),
+		nullTime(settings.StartsAt), nullTime(settings.EndsAt), nullInt64(settings.MaxMembers),
+		namespace.FromContext(ctx))
 
 	if err := row.Err(); err != nil {
 		if err, ok := err.(*pq.Error); ok && err.Code == "23505" { //nolint:errorlint
@@ -38,119 +117,379 @@ func (s *Storage) AddSegment(ctx context.Context, name string) (*storage.Segment
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	var segment storage.SegmentDTO
-	if err := row.Scan(&segment.ID, &segment.Name); err != nil {
+	segment := &storage.SegmentDTO{
+		Name:               name,
+		SegmentSettingsDTO: settings,
+	}
+	if err := row.Scan(&segment.ID, &segment.Version); err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return &segment, nil
+	if len(settings.Requires) > 0 {
+		if err := addPrerequisites(ctx, tx, segment.ID, settings.Requires); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := addEvent(ctx, tx, storage.EventSegmentCreated, name, 0); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return segment, nil
 }
 
-func (s *Storage) DeleteSegment(ctx context.Context, name string) (*storage.SegmentDTO, error) {
-	op := "storage.postgresql.DeleteSegment"
+// Segment returns a segment with its settings.
+func (s *Storage) Segment(ctx context.Context, name string) (_ *storage.SegmentDTO, err error) {
+	op := "storage.postgresql.Segment"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
 
-	conn, err := s.db.Conn(ctx)
+	row := s.db.QueryRowContext(ctx,
+		"SELECT "+segmentColumns+" FROM segments s WHERE s.namespace = $1 AND s.segment_name = $2;",
+		namespace.FromContext(ctx), name)
+
+	segment, err := scanSegment(row)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+		}
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	defer conn.Close()
 
-	id, err := s.getSegmentID(ctx, name)
+	return segment, nil
+}
+
+// SegmentMembers returns the number of users explicitly added to the segment.
+func (s *Storage) SegmentMembers(ctx context.Context, name string) (_ int64, err error) {
+	op := "storage.postgresql.SegmentMembers"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	segmentID, err := getSegmentID(ctx, s.db, name)
 	if err != nil {
-		return nil, fmt.Errorf("%s.getSegmentID: %w", op, err)
+		return 0, fmt.Errorf("%s.getSegmentID: %w", op, err)
 	}
 
-	row := conn.QueryRowContext(ctx,
-		"DELETE FROM Segments WHERE id = $1 RETURNING *;", id)
+	var members int64
+	row := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM user_experiments WHERE segment_id = $1;", segmentID)
+	if err := row.Scan(&members); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
 
-	if err := row.Err(); err != nil {
+	return members, nil
+}
+
+// SegmentDependents returns names of segments that require the given one.
+func (s *Storage) SegmentDependents(ctx context.Context, name string) (_ []string, err error) {
+	op := "storage.postgresql.SegmentDependents"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT s.segment_name FROM segment_prerequisites p "+
+			"JOIN segments s ON p.segment_id = s.id "+
+			"JOIN segments r ON p.required_id = r.id WHERE r.namespace = $1 AND r.segment_name = $2;",
+		namespace.FromContext(ctx), name)
+	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
+	defer rows.Close()
+
+	var dependents []string
+
+	for rows.Next() {
+		var dependent string
+		if err := rows.Scan(&dependent); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		dependents = append(dependents, dependent)
+	}
 
-	var deleted storage.SegmentDTO
-	if err := row.Scan(&deleted.ID, &deleted.Name); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return &deleted, nil
+	return dependents, nil
 }
 
-func (s *Storage) AddUserToSegment(ctx context.Context, userID int64, segmentName string) (*storage.UserExperimentDTO, error) {
-	op := "storage.postgresql.AddUserToSegment"
+// UpdateSegment replaces the settings of a segment if its version is still version,
+// or unconditionally if version is 0. Activation changes are picked up by SyncSegmentWindows.
+func (s *Storage) UpdateSegment(ctx context.Context, name string, settings storage.SegmentSettingsDTO, version int64) (_ *storage.SegmentDTO, err error) {
+	op := "storage.postgresql.UpdateSegment"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
 
-	conn, err := s.db.Conn(ctx)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	defer conn.Close()
+	defer tx.Rollback() //nolint:errcheck
+
+	var segmentID int64
+	row := tx.QueryRowContext(ctx,
+		"UPDATE segments SET group_name = $3, rule_expr = $4, starts_at = $5, ends_at = $6, max_members = $7, "+
+			"version = version + 1 WHERE namespace = $1 AND segment_name = $2 AND ($8 = 0 OR version = $8) RETURNING id;",
+		namespace.FromContext(ctx), name, nullString(settings.Group), nullString(settings.Rule),
+		nullTime(settings.StartsAt), nullTime(settings.EndsAt), nullInt64(settings.MaxMembers), version)
+	if err := row.Scan(&segmentID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, segmentVersionError(ctx, tx, name))
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM segment_prerequisites WHERE segment_id = $1;", segmentID); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if len(settings.Requires) > 0 {
+		if err := addPrerequisites(ctx, tx, segmentID, settings.Requires); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
 
-	segmentID, err := s.getSegmentID(ctx, segmentName)
+	updated, err := scanSegment(tx.QueryRowContext(ctx,
+		"SELECT "+segmentColumns+" FROM segments s WHERE s.id = $1;", segmentID))
 	if err != nil {
-		return nil, fmt.Errorf("%s.getSegmentID: %w", op, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	row := conn.QueryRowContext(ctx,
-		"INSERT INTO user_experiments(user_id, segment_id) VALUES ($1, $2) RETURNING id;",
-		userID, segmentID)
+	if err := addEvent(ctx, tx, storage.EventSegmentUpdated, name, 0); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
 
-	if err := row.Err(); err != nil {
-		if err := err.(*pq.Error); err != nil && err.Code == "23505" { //nolint:errorlint
-			return nil, fmt.Errorf("%s: %w", op, storage.ErrAlreadyInExperiment)
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return updated, nil
+}
+
+func (s *Storage) DeleteSegment(ctx context.Context, name string) (*storage.SegmentDTO, error) {
+	return s.DeleteSegmentWithVersion(ctx, name, 0)
+}
+
+// DeleteSegmentWithVersion deletes a segment if its version is still version, or
+// unconditionally if version is 0.
+func (s *Storage) DeleteSegmentWithVersion(ctx context.Context, name string, version int64) (_ *storage.SegmentDTO, err error) {
+	op := "storage.postgresql.DeleteSegment"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	deleted, err := scanSegment(tx.QueryRowContext(ctx,
+		"DELETE FROM segments s WHERE s.namespace = $1 AND s.segment_name = $2 AND ($3 = 0 OR s.version = $3) "+
+			"RETURNING "+segmentColumns+";",
+		namespace.FromContext(ctx), name, version))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, segmentVersionError(ctx, tx, name))
 		}
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	var id int64
-	if err := row.Scan(&id); err != nil {
+	if err := addEvent(ctx, tx, storage.EventSegmentDeleted, name, 0); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	if err := s.logExperiment(ctx, userID, segmentName, "add"); err != nil {
-		log.Println(err)
+	return deleted, nil
+}
+
+// segmentVersionError tells why a versioned change matched no segment.
+func segmentVersionError(ctx context.Context, q querier, name string) error {
+	if _, err := getSegmentID(ctx, q, name); err != nil {
+		return err
 	}
 
-	return &storage.UserExperimentDTO{
-		ID:     id,
-		UserID: userID,
-		Segment: storage.SegmentDTO{
-			ID:   segmentID,
-			Name: segmentName,
-		},
-	}, nil
+	return storage.ErrVersionMismatch
+}
+
+// UserVersion returns the version of the user's memberships, 0 if they never changed.
+func (s *Storage) UserVersion(ctx context.Context, userID int64) (_ int64, err error) {
+	op := "storage.postgresql.UserVersion"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	var version int64
+	row := s.db.QueryRowContext(ctx,
+		"SELECT version FROM user_versions WHERE namespace = $1 AND user_id = $2;",
+		namespace.FromContext(ctx), userID)
+	if err := row.Scan(&version); err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return version, nil
 }
 
-func (s *Storage) AddUserToSegmentWithExpiracy(ctx context.Context, userID int64, segmentName string, expiresAt time.Time) (*storage.UserExperimentDTO, error) {
+// BumpUserVersion increments the version of the user's memberships if it is still
+// version and returns the new one.
+func (s *Storage) BumpUserVersion(ctx context.Context, userID, version int64) (_ int64, err error) {
+	op := "storage.postgresql.BumpUserVersion"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	var row *sql.Row
+	if version == 0 {
+		row = s.db.QueryRowContext(ctx,
+			"INSERT INTO user_versions(namespace, user_id, version) VALUES ($1, $2, 1) "+
+				"ON CONFLICT (namespace, user_id) DO NOTHING RETURNING version;",
+			namespace.FromContext(ctx), userID)
+	} else {
+		row = s.db.QueryRowContext(ctx,
+			"UPDATE user_versions SET version = version + 1 WHERE namespace = $1 AND user_id = $2 AND version = $3 "+
+				"RETURNING version;",
+			namespace.FromContext(ctx), userID, version)
+	}
+
+	if err := row.Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrVersionMismatch)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return version, nil
+}
+
+// bumpUserVersion increments the version of the user's memberships unconditionally.
+func bumpUserVersion(ctx context.Context, q querier, userID int64) error {
+	_, err := q.ExecContext(ctx,
+		"INSERT INTO user_versions(namespace, user_id, version) VALUES ($1, $2, 1) "+
+			"ON CONFLICT (namespace, user_id) DO UPDATE SET version = user_versions.version + 1;",
+		namespace.FromContext(ctx), userID)
+
+	return err
+}
+
+func (s *Storage) AddUserToSegment(ctx context.Context, userID int64, segmentName string, forced bool) (_ *storage.UserExperimentDTO, err error) {
+	op := "storage.postgresql.AddUserToSegment"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	return s.addUserToSegment(ctx, op, userID, segmentName, sql.NullTime{}, forced)
+}
+
+func (s *Storage) AddUserToSegmentWithExpiracy(ctx context.Context, userID int64, segmentName string, expiresAt time.Time, forced bool) (_ *storage.UserExperimentDTO, err error) {
 	op := "storage.postgresql.AddUserToSegmentWithExpicary"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	return s.addUserToSegment(ctx, op, userID, segmentName, sql.NullTime{Time: expiresAt, Valid: true}, forced)
+}
 
-	conn, err := s.db.Conn(ctx)
+// addUserToSegment inserts a membership inside a transaction. If the segment belongs
+// to an exclusion group, the user is locked and checked against other segments of the group.
+// If the segment has a capacity, the segment row is locked while its members are counted,
+// so concurrent inserts can't overshoot it.
+func (s *Storage) addUserToSegment(ctx context.Context, op string, userID int64, segmentName string, expiresAt sql.NullTime, forced bool) (*storage.UserExperimentDTO, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	defer conn.Close()
-
-	segmentID, err := s.getSegmentID(ctx, segmentName)
-	if err != nil {
-		return nil, fmt.Errorf("%s.getSegmentID: %w", op, err)
+	defer tx.Rollback() //nolint:errcheck
+
+	var (
+		segmentID int64
+		group     sql.NullString
+		capacity  sql.NullInt64
+	)
+
+	row := tx.QueryRowContext(ctx,
+		"SELECT id, group_name, max_members FROM segments WHERE namespace = $1 AND segment_name = $2;",
+		namespace.FromContext(ctx), segmentName)
+	if err := row.Scan(&segmentID, &group, &capacity); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	row := conn.QueryRowContext(ctx,
-		"INSERT INTO user_experiments(user_id, segment_id, expires_at) VALUES ($1, $2, $3) RETURNING id;",
-		userID, segmentID, expiresAt)
+	if capacity.Valid {
+		if _, err := tx.ExecContext(ctx,
+			"SELECT id FROM segments WHERE id = $1 FOR UPDATE;", segmentID); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		var members, own int64
+		row := tx.QueryRowContext(ctx,
+			"SELECT COUNT(*), COUNT(*) FILTER (WHERE user_id = $2) FROM user_experiments "+
+				"WHERE segment_id = $1;", segmentID, userID)
+		if err := row.Scan(&members, &own); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
 
-	if err := row.Err(); err != nil {
-		if err := err.(*pq.Error); err != nil && err.Code == "23505" { //nolint:errorlint
+		if own > 0 {
 			return nil, fmt.Errorf("%s: %w", op, storage.ErrAlreadyInExperiment)
 		}
-		return nil, fmt.Errorf("%s: %w", op, err)
+
+		if members >= capacity.Int64 {
+			return nil, fmt.Errorf("%s: %w", op,
+				fmt.Errorf("%w: %d of %d", storage.ErrCapacityExceeded, members, capacity.Int64))
+		}
 	}
 
+	if group.Valid {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1);", userID); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		var conflicting string
+		row := tx.QueryRowContext(ctx,
+			"SELECT s.segment_name FROM user_experiments u JOIN segments s ON u.segment_id = s.id "+
+				"WHERE u.user_id = $1 AND s.namespace = $2 AND s.group_name = $3 AND s.id <> $4 LIMIT 1;",
+			userID, namespace.FromContext(ctx), group.String, segmentID)
+
+		err := row.Scan(&conflicting)
+		if err == nil {
+			return nil, fmt.Errorf("%s: %w", op,
+				fmt.Errorf("%w: %s", storage.ErrExclusionGroupConflict, conflicting))
+		}
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	row = tx.QueryRowContext(ctx,
+		"INSERT INTO user_experiments(user_id, segment_id, expires_at, forced) VALUES ($1, $2, $3, $4) RETURNING id;",
+		userID, segmentID, expiresAt, forced)
+
 	var id int64
 	if err := row.Scan(&id); err != nil {
+		if err, ok := err.(*pq.Error); ok && err.Code == "23505" { //nolint:errorlint
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrAlreadyInExperiment)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := logExperiment(ctx, tx, userID, segmentName, "add"); err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	if err := s.logExperiment(ctx, userID, segmentName, "add"); err != nil {
-		log.Println(err)
+	if err := addEvent(ctx, tx, storage.EventMembershipAdded, segmentName, userID); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := bumpUserVersion(ctx, tx, userID); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return &storage.UserExperimentDTO{
@@ -159,32 +498,33 @@ func (s *Storage) AddUserToSegmentWithExpiracy(ctx context.Context, userID int64
 		Segment: storage.SegmentDTO{
 			ID:   segmentID,
 			Name: segmentName,
+			SegmentSettingsDTO: storage.SegmentSettingsDTO{
+				Group: group.String,
+			},
 		},
 	}, nil
 }
 
-func (s *Storage) DeleteUserFromSegment(ctx context.Context, userID int64, segmentName string) (*storage.UserExperimentDTO, error) {
+func (s *Storage) DeleteUserFromSegment(ctx context.Context, userID int64, segmentName string) (_ *storage.UserExperimentDTO, err error) {
 	op := "storage.postgresql.DeleteUserFromSegment"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
 
-	conn, err := s.db.Conn(ctx)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	defer conn.Close()
+	defer tx.Rollback() //nolint:errcheck
 
-	segmentID, err := s.getSegmentID(ctx, segmentName)
+	segmentID, err := getSegmentID(ctx, tx, segmentName)
 	if err != nil {
 		return nil, fmt.Errorf("%s.getSegmentID: %w", op, err)
 	}
 
-	row := conn.QueryRowContext(ctx,
-		"DELETE FROM user_experiments WHERE user_id = $1 AND segment_id = $2 RETURNING *;",
+	row := tx.QueryRowContext(ctx,
+		"DELETE FROM user_experiments WHERE user_id = $1 AND segment_id = $2 RETURNING id, user_id, segment_id;",
 		userID, segmentID)
 
-	if err := row.Err(); err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
-	}
-
 	deleted := storage.UserExperimentDTO{
 		Segment: storage.SegmentDTO{
 			Name: segmentName,
@@ -198,38 +538,52 @@ func (s *Storage) DeleteUserFromSegment(ctx context.Context, userID int64, segme
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	if err := s.logExperiment(ctx, userID, segmentName, "remove"); err != nil {
-		log.Println(err)
+	if err := logExperiment(ctx, tx, userID, segmentName, "remove"); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := addEvent(ctx, tx, storage.EventMembershipRemoved, segmentName, userID); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := bumpUserVersion(ctx, tx, userID); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return &deleted, nil
 }
 
-func (s *Storage) UserSegments(ctx context.Context, userID int64) (*storage.UserExperimentListDTO, error) {
+func (s *Storage) UserSegments(ctx context.Context, userID int64) (_ *storage.UserExperimentListDTO, err error) {
 	op := "storage.postgresql.UserSegments"
-	conn, err := s.db.Conn(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
-	}
-	defer conn.Close()
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
 
-	rows, err := conn.QueryContext(ctx,
-		"SELECT s.id, s.segment_name FROM user_experiments u JOIN segments s "+
-			"ON u.segment_id = s.id WHERE u.user_id = $1", userID)
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT u.forced, "+segmentColumns+" FROM user_experiments u JOIN segments s "+
+			"ON u.segment_id = s.id WHERE u.user_id = $1 AND s.namespace = $2 "+
+			"AND (u.expires_at IS NULL OR u.expires_at > NOW())", userID, namespace.FromContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
+	defer rows.Close()
 
 	expList := &storage.UserExperimentListDTO{
 		UserID: userID,
 	}
 
 	for rows.Next() {
-		var seg storage.SegmentDTO
-		if err := rows.Scan(&seg.ID, &seg.Name); err != nil {
+		var forced bool
+
+		seg, err := scanSegment(segmentScanner{row: rows, prefix: []any{&forced}})
+		if err != nil {
 			return nil, fmt.Errorf("%s: %w", op, err)
 		}
-		expList.Segments = append(expList.Segments, seg)
+		seg.Forced = forced
+		expList.Segments = append(expList.Segments, *seg)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -239,146 +593,1329 @@ func (s *Storage) UserSegments(ctx context.Context, userID int64) (*storage.User
 	return expList, nil
 }
 
-func (s *Storage) UserExperimentLogs(ctx context.Context, userID int64, start time.Time) ([]*storage.UserExperimentLogRecordDTO, error) {
-	op := "storage.postgresql.UserExperimentLogs"
-	conn, err := s.db.Conn(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
-	}
-	defer conn.Close()
-
-	rows, err := conn.QueryContext(ctx,
-		"SELECT user_id, segment_name, op_type, added_at FROM "+
-			"log_user_experiments WHERE user_id = $1 AND "+
-			"added_at BETWEEN $2 AND $2 + INTERVAL '1 month'", userID, start.UTC())
+// UsersSegments returns stored segments of every given user with a single query.
+func (s *Storage) UsersSegments(ctx context.Context, userIDs []int64) (_ map[int64][]storage.SegmentDTO, err error) {
+	op := "storage.postgresql.UsersSegments"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT u.user_id, u.forced, "+segmentColumns+" FROM user_experiments u JOIN segments s "+
+			"ON u.segment_id = s.id WHERE u.user_id = ANY($1) AND s.namespace = $2 "+
+			"AND (u.expires_at IS NULL OR u.expires_at > NOW())",
+		pq.Array(userIDs), namespace.FromContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
+	defer rows.Close()
 
-	var records []*storage.UserExperimentLogRecordDTO
+	segments := make(map[int64][]storage.SegmentDTO, len(userIDs))
 
 	for rows.Next() {
-		var rec storage.UserExperimentLogRecordDTO
+		var (
+			userID int64
+			forced bool
+		)
 
-		if err := rows.Scan(&rec.UserID, &rec.SegmentName,
-			&rec.Operation, &rec.AddedAt); err != nil {
+		seg, err := scanSegment(segmentScanner{row: rows, prefix: []any{&userID, &forced}})
+		if err != nil {
 			return nil, fmt.Errorf("%s: %w", op, err)
 		}
-
-		records = append(records, &rec)
+		seg.Forced = forced
+		segments[userID] = append(segments[userID], *seg)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return records, nil
+	return segments, nil
 }
 
-func (s *Storage) getSegmentID(ctx context.Context, name string) (int64, error) {
-	conn, err := s.db.Conn(ctx)
+// RuleSegments returns segments with targeting rules.
+func (s *Storage) RuleSegments(ctx context.Context) (_ []storage.SegmentDTO, err error) {
+	op := "storage.postgresql.RuleSegments"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+segmentColumns+" FROM segments s WHERE s.namespace = $1 AND s.rule_expr IS NOT NULL ORDER BY s.id;",
+		namespace.FromContext(ctx))
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	defer conn.Close()
+	defer rows.Close()
 
-	var id int64
-	row := conn.QueryRowContext(ctx,
-		"SELECT id FROM Segments WHERE segment_name = $1;", name)
+	var segments []storage.SegmentDTO
 
-	if err := row.Err(); err != nil {
-		return 0, err
+	for rows.Next() {
+		seg, err := scanSegment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		segments = append(segments, *seg)
 	}
 
-	if err := row.Scan(&id); err != nil {
-		if err == sql.ErrNoRows {
-			return 0, storage.ErrSegmentNotFound
-		}
-		return 0, err
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return id, nil
+	return segments, nil
 }
 
-func (s *Storage) getSegmentName(ctx context.Context, id int64) (string, error) {
-	conn, err := s.db.Conn(ctx)
+// SetUserAttributes upserts user attributes. Attributes with empty values are removed.
+func (s *Storage) SetUserAttributes(ctx context.Context, userID int64, attributes map[string]string) (err error) {
+	op := "storage.postgresql.SetUserAttributes"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("%s: %w", op, err)
 	}
-	defer conn.Close()
-
-	var name string
-	row := conn.QueryRowContext(ctx,
-		"SELECT segment_name FROM segments WHERE id = $1", id)
+	defer tx.Rollback() //nolint:errcheck
+
+	ns := namespace.FromContext(ctx)
+
+	for key, value := range attributes {
+		if value == "" {
+			_, err = tx.ExecContext(ctx,
+				"DELETE FROM user_attributes WHERE namespace = $1 AND user_id = $2 AND attr_key = $3;",
+				ns, userID, key)
+		} else {
+			_, err = tx.ExecContext(ctx,
+				"INSERT INTO user_attributes(namespace, user_id, attr_key, attr_value) VALUES ($1, $2, $3, $4) "+
+					"ON CONFLICT (namespace, user_id, attr_key) DO UPDATE SET attr_value = EXCLUDED.attr_value;",
+				ns, userID, key, value)
+		}
 
-	if err := row.Err(); err != nil {
-		return "", err
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
 	}
 
-	if err := row.Scan(&name); err != nil {
-		return "", err
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	return name, nil
+	return nil
 }
 
-func (s *Storage) logExperiment(ctx context.Context, userID int64, segmentName, opType string) error {
-	op := "storage.postgresql.logExperiment"
-	conn, err := s.db.Conn(ctx)
+func (s *Storage) UserAttributes(ctx context.Context, userID int64) (_ map[string]string, err error) {
+	op := "storage.postgresql.UserAttributes"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT attr_key, attr_value FROM user_attributes WHERE namespace = $1 AND user_id = $2;",
+		namespace.FromContext(ctx), userID)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	defer conn.Close()
+	defer rows.Close()
 
-	_, err = conn.ExecContext(ctx,
-		"INSERT INTO log_user_experiments(user_id, segment_name, op_type)"+
-			"VALUES ($1, $2, $3);", userID, segmentName, opType)
+	attributes := make(map[string]string)
 
-	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		attributes[key] = value
 	}
 
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return attributes, nil
 }
 
-func (s *Storage) DeleteOldExperiments(ctx context.Context) error {
-	op := "storage.postgresql.deleteOldExperiments"
+// UsersAttributes returns attributes of every given user with a single query.
+func (s *Storage) UsersAttributes(ctx context.Context, userIDs []int64) (_ map[int64]map[string]string, err error) {
+	op := "storage.postgresql.UsersAttributes"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
 
-	conn, err := s.db.Conn(ctx)
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT user_id, attr_key, attr_value FROM user_attributes WHERE namespace = $1 AND user_id = ANY($2);",
+		namespace.FromContext(ctx), pq.Array(userIDs))
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	defer conn.Close()
+	defer rows.Close()
 
-	rows, err := conn.QueryContext(ctx,
-		"DELETE FROM user_experiments WHERE expires_at IS NOT NULL AND expires_at < NOW() "+
-			"RETURNING user_id, segment_id;")
-	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
-	}
+	attributes := make(map[int64]map[string]string, len(userIDs))
 
 	for rows.Next() {
 		var (
-			userID    int64
-			segmentID int64
+			userID     int64
+			key, value string
 		)
-		if err := rows.Scan(&userID, &segmentID); err != nil {
-			return fmt.Errorf("%s: %w", op, err)
+		if err := rows.Scan(&userID, &key, &value); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
 		}
 
-		segmentName, err := s.getSegmentName(ctx, segmentID)
-		if err != nil {
-			return fmt.Errorf("%s: %w", op, err)
+		if _, ok := attributes[userID]; !ok {
+			attributes[userID] = make(map[string]string)
 		}
+		attributes[userID][key] = value
+	}
 
-		if err := s.logExperiment(ctx, userID, segmentName, "remove"); err != nil {
-			return fmt.Errorf("%s: %w", op, err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return attributes, nil
+}
+
+// SetOverride creates or replaces the user's override for a segment and logs it with the actor.
+func (s *Storage) SetOverride(ctx context.Context, override storage.OverrideDTO) (_ *storage.OverrideDTO, err error) {
+	op := "storage.postgresql.SetOverride"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	segment, err := scanSegment(tx.QueryRowContext(ctx,
+		"SELECT "+segmentColumns+" FROM segments s WHERE s.namespace = $1 AND s.segment_name = $2;",
+		namespace.FromContext(ctx), override.Segment.Name))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	override.Segment = *segment
+
+	row := tx.QueryRowContext(ctx,
+		"INSERT INTO segment_overrides(user_id, segment_id, mode, variant, expires_at, actor) "+
+			"VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (user_id, segment_id) DO UPDATE SET "+
+			"mode = EXCLUDED.mode, variant = EXCLUDED.variant, expires_at = EXCLUDED.expires_at, "+
+			"actor = EXCLUDED.actor, created_at = NOW() RETURNING id, created_at;",
+		override.UserID, segment.ID, override.Mode, nullString(override.Variant),
+		nullTime(override.ExpiresAt), override.Actor)
+	if err := row.Scan(&override.ID, &override.CreatedAt); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := logOverride(ctx, tx, &override, "set"); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &override, nil
+}
+
+// DeleteOverride removes the user's override for a segment and logs it with the actor.
+func (s *Storage) DeleteOverride(ctx context.Context, userID int64, segmentName, actor string) (_ *storage.OverrideDTO, err error) {
+	op := "storage.postgresql.DeleteOverride"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	deleted, err := scanOverride(tx.QueryRowContext(ctx,
+		"DELETE FROM segment_overrides o USING segments s WHERE o.segment_id = s.id "+
+			"AND o.user_id = $1 AND s.namespace = $2 AND s.segment_name = $3 RETURNING "+overrideColumns+";",
+		userID, namespace.FromContext(ctx), segmentName))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrOverrideNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	deleted.Actor = actor
+	if err := logOverride(ctx, tx, deleted, "remove"); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deleted, nil
+}
+
+// UserOverrides returns the user's overrides that have not expired yet.
+func (s *Storage) UserOverrides(ctx context.Context, userID int64) (_ []storage.OverrideDTO, err error) {
+	op := "storage.postgresql.UserOverrides"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+overrideColumns+" FROM segment_overrides o JOIN segments s ON o.segment_id = s.id "+
+			"WHERE o.user_id = $1 AND s.namespace = $2 AND (o.expires_at IS NULL OR o.expires_at > NOW()) ORDER BY o.id;",
+		userID, namespace.FromContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var overrides []storage.OverrideDTO
+
+	for rows.Next() {
+		override, err := scanOverride(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		overrides = append(overrides, *override)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return overrides, nil
+}
+
+// UsersOverrides returns not expired overrides of every given user with a single query.
+func (s *Storage) UsersOverrides(ctx context.Context, userIDs []int64) (_ map[int64][]storage.OverrideDTO, err error) {
+	op := "storage.postgresql.UsersOverrides"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+overrideColumns+" FROM segment_overrides o JOIN segments s ON o.segment_id = s.id "+
+			"WHERE o.user_id = ANY($1) AND s.namespace = $2 AND (o.expires_at IS NULL OR o.expires_at > NOW()) ORDER BY o.id;",
+		pq.Array(userIDs), namespace.FromContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	overrides := make(map[int64][]storage.OverrideDTO, len(userIDs))
+
+	for rows.Next() {
+		override, err := scanOverride(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		overrides[override.UserID] = append(overrides[override.UserID], *override)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return overrides, nil
+}
+
+// Overrides returns not expired overrides of all users of the namespace.
+func (s *Storage) Overrides(ctx context.Context) (_ []storage.OverrideDTO, err error) {
+	op := "storage.postgresql.Overrides"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+overrideColumns+" FROM segment_overrides o JOIN segments s ON o.segment_id = s.id "+
+			"WHERE s.namespace = $1 AND (o.expires_at IS NULL OR o.expires_at > NOW()) ORDER BY o.id;",
+		namespace.FromContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var overrides []storage.OverrideDTO
+
+	for rows.Next() {
+		override, err := scanOverride(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		overrides = append(overrides, *override)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return overrides, nil
+}
+
+func (s *Storage) UserExperimentLogs(ctx context.Context, userID int64, start time.Time) (_ []*storage.UserExperimentLogRecordDTO, err error) {
+	op := "storage.postgresql.UserExperimentLogs"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT user_id, segment_name, op_type, added_at FROM "+
+			"log_user_experiments WHERE namespace = $1 AND user_id = $2 AND "+
+			"added_at BETWEEN $3 AND $3 + INTERVAL '1 month'", namespace.FromContext(ctx), userID, start.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var records []*storage.UserExperimentLogRecordDTO
+
+	for rows.Next() {
+		var rec storage.UserExperimentLogRecordDTO
+
+		if err := rows.Scan(&rec.UserID, &rec.SegmentName,
+			&rec.Operation, &rec.AddedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		records = append(records, &rec)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return records, nil
+}
+
+func getSegmentID(ctx context.Context, q querier, name string) (int64, error) {
+	ctx, span := tracer.Start(ctx, "storage.postgresql.getSegmentID")
+	defer span.End()
+
+	var id int64
+	row := q.QueryRowContext(ctx,
+		"SELECT id FROM segments WHERE namespace = $1 AND segment_name = $2;", namespace.FromContext(ctx), name)
+
+	if err := row.Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, storage.ErrSegmentNotFound
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func logExperiment(ctx context.Context, q querier, userID int64, segmentName, opType string) error {
+	op := "storage.postgresql.logExperiment"
+
+	ctx, span := tracer.Start(ctx, op)
+	defer span.End()
+
+	_, err := q.ExecContext(ctx,
+		"INSERT INTO log_user_experiments(namespace, user_id, segment_name, op_type) "+
+			"VALUES ($1, $2, $3, $4);", namespace.FromContext(ctx), userID, segmentName, opType)
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// DeleteOldExperiments removes expired memberships, logs their removal, bumps
+// versions of the affected users and writes webhook events in one statement.
+// It returns the number of removed memberships.
+func (s *Storage) DeleteOldExperiments(ctx context.Context) (_ int64, err error) {
+	op := "storage.postgresql.deleteOldExperiments"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	res, err := s.db.ExecContext(ctx,
+		"WITH deleted AS (DELETE FROM user_experiments u USING segments s WHERE u.segment_id = s.id "+
+			"AND u.expires_at IS NOT NULL AND u.expires_at < NOW() RETURNING s.namespace, u.user_id, s.segment_name), "+
+			"bumped AS (INSERT INTO user_versions(namespace, user_id, version) "+
+			"SELECT DISTINCT namespace, user_id, 1 FROM deleted "+
+			"ON CONFLICT (namespace, user_id) DO UPDATE SET version = user_versions.version + 1), "+
+			"events AS (INSERT INTO webhook_outbox(namespace, event_type, segment_name, user_id) "+
+			"SELECT namespace, '"+storage.EventMembershipExpired+"', segment_name, user_id FROM deleted) "+
+			"INSERT INTO log_user_experiments(namespace, user_id, segment_name, op_type) "+
+			"SELECT namespace, user_id, segment_name, 'remove' FROM deleted;")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return removed, nil
+}
+
+// Totals returns the number of segments with an open activation window and of not
+// expired memberships.
+func (s *Storage) Totals(ctx context.Context) (segments, memberships int64, err error) {
+	op := "storage.postgresql.Totals"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	row := s.db.QueryRowContext(ctx,
+		"SELECT (SELECT COUNT(*) FROM segments WHERE window_active), "+
+			"(SELECT COUNT(*) FROM user_experiments WHERE expires_at IS NULL OR expires_at > NOW());")
+	if err := row.Scan(&segments, &memberships); err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return segments, memberships, nil
+}
+
+// Namespaces returns the namespaces that have segments or API keys.
+func (s *Storage) Namespaces(ctx context.Context) (_ []string, err error) {
+	op := "storage.postgresql.Namespaces"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT namespace FROM segments UNION SELECT namespace FROM api_keys ORDER BY namespace;")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var namespaces []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		namespaces = append(namespaces, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return namespaces, nil
+}
+
+// ReserveIdempotencyKey stores an in-progress record for key unless a not expired one
+// exists. It returns the existing record, or nil if the key has been reserved.
+func (s *Storage) ReserveIdempotencyKey(ctx context.Context, key, requestHash string, expiresAt time.Time) (_ *storage.IdempotencyRecordDTO, err error) {
+	op := "storage.postgresql.ReserveIdempotencyKey"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	var (
+		record      storage.IdempotencyRecordDTO
+		status      sql.NullInt64
+		contentType sql.NullString
+		etag        sql.NullString
+	)
+
+	for {
+		// an expired record is replaced as if it didn't exist
+		var reserved string
+		err = s.db.QueryRowContext(ctx,
+			"INSERT INTO idempotency_keys(key, request_hash, expires_at) VALUES ($1, $2, $3) "+
+				"ON CONFLICT (key) DO UPDATE SET request_hash = EXCLUDED.request_hash, status = NULL, "+
+				"content_type = NULL, etag = NULL, body = NULL, created_at = NOW(), expires_at = EXCLUDED.expires_at "+
+				"WHERE idempotency_keys.expires_at <= NOW() RETURNING key;",
+			key, requestHash, expiresAt).Scan(&reserved)
+		if err == nil {
+			return nil, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		row := s.db.QueryRowContext(ctx,
+			"SELECT request_hash, status, content_type, etag, body FROM idempotency_keys WHERE key = $1;", key)
+		err = row.Scan(&record.RequestHash, &status, &contentType, &etag, &record.Body)
+		if err == nil {
+			break
+		}
+		// the record was released after the insert conflicted with it, so the key is free again
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	record.Completed = status.Valid
+	record.Status = int(status.Int64)
+	record.ContentType = contentType.String
+	record.ETag = etag.String
+
+	return &record, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request reserved under key.
+func (s *Storage) CompleteIdempotencyKey(ctx context.Context, key string, status int, contentType, etag string, body []byte) (err error) {
+	op := "storage.postgresql.CompleteIdempotencyKey"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	if _, err := s.db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status = $2, content_type = $3, etag = $4, body = $5 WHERE key = $1;",
+		key, status, contentType, etag, body); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey drops an in-progress record, so the request can be retried.
+func (s *Storage) ReleaseIdempotencyKey(ctx context.Context, key string) (err error) {
+	op := "storage.postgresql.ReleaseIdempotencyKey"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	if _, err := s.db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE key = $1 AND status IS NULL;", key); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) DeleteExpiredIdempotencyKeys(ctx context.Context) (_ int64, err error) {
+	op := "storage.postgresql.DeleteExpiredIdempotencyKeys"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= NOW();")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return removed, nil
+}
+
+func (s *Storage) Ping(ctx context.Context) (err error) {
+	op := "storage.postgresql.Ping"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// CheckSchema returns an error unless every migration up to SchemaVersion is recorded
+// in schema_migrations and none newer is.
+func (s *Storage) CheckSchema(ctx context.Context) (err error) {
+	op := "storage.postgresql.CheckSchema"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	var version, applied int
+	row := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(version), 0), COUNT(*) FILTER (WHERE version BETWEEN 1 AND $1)
+		FROM schema_migrations;`, SchemaVersion)
+	if err := row.Scan(&version, &applied); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if version != SchemaVersion {
+		return fmt.Errorf("%s: schema version is %d, expected %d", op, version, SchemaVersion)
+	}
+
+	if applied != SchemaVersion {
+		return fmt.Errorf("%s: %d of %d migrations applied", op, applied, SchemaVersion)
+	}
+
+	return nil
+}
+
+func (s *Storage) AddAPIKey(ctx context.Context, key storage.APIKeyDTO) (_ *storage.APIKeyDTO, err error) {
+	op := "storage.postgresql.AddAPIKey"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	row := s.db.QueryRowContext(ctx,
+		"INSERT INTO api_keys(namespace, name, role, prefix, key_hash) VALUES ($1, $2, $3, $4, $5) "+
+			"RETURNING id, namespace, created_at;",
+		namespace.FromContext(ctx), key.Name, key.Role, key.Prefix, key.Hash)
+	if err := row.Scan(&key.ID, &key.Namespace, &key.CreatedAt); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &key, nil
+}
+
+// RevokeAPIKey marks a not revoked key of the namespace as revoked. Revoked keys are
+// kept for audit.
+func (s *Storage) RevokeAPIKey(ctx context.Context, id int64) (_ *storage.APIKeyDTO, err error) {
+	op := "storage.postgresql.RevokeAPIKey"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx,
+		"UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND namespace = $2 AND revoked_at IS NULL "+
+			"RETURNING "+apiKeyColumns+";", id, namespace.FromContext(ctx)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+// APIKeyByHash returns the not revoked key with the hash in any namespace.
+func (s *Storage) APIKeyByHash(ctx context.Context, hash string) (_ *storage.APIKeyDTO, err error) {
+	op := "storage.postgresql.APIKeyByHash"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx,
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL;", hash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+func (s *Storage) APIKeys(ctx context.Context) (_ []storage.APIKeyDTO, err error) {
+	op := "storage.postgresql.APIKeys"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE namespace = $1 ORDER BY id;", namespace.FromContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var keys []storage.APIKeyDTO
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		keys = append(keys, *key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return keys, nil
+}
+
+const apiKeyColumns = "id, namespace, name, role, prefix, key_hash, created_at, revoked_at"
+
+func scanAPIKey(row scanner) (*storage.APIKeyDTO, error) {
+	var (
+		key       storage.APIKeyDTO
+		revokedAt sql.NullTime
+	)
+
+	if err := row.Scan(&key.ID, &key.Namespace, &key.Name, &key.Role, &key.Prefix, &key.Hash,
+		&key.CreatedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+
+	return &key, nil
+}
+
+// addPrerequisites links segment to the required segments, all of which must exist.
+func addPrerequisites(ctx context.Context, tx *sql.Tx, segmentID int64, requires []string) error {
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO segment_prerequisites(segment_id, required_id) "+
+			"SELECT $1, id FROM segments WHERE namespace = $2 AND segment_name = ANY($3);",
+		segmentID, namespace.FromContext(ctx), pq.Array(requires))
+	if err != nil {
+		return err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if inserted != int64(len(requires)) {
+		return fmt.Errorf("prerequisite %w", storage.ErrSegmentNotFound)
+	}
+
+	return nil
+}
+
+// segmentColumns selects a segment aliased as s together with its settings.
+const segmentColumns = "s.id, s.segment_name, s.group_name, s.rule_expr, s.starts_at, s.ends_at, s.max_members, ARRAY(" +
+	"SELECT r.segment_name FROM segment_prerequisites p JOIN segments r " +
+	"ON p.required_id = r.id WHERE p.segment_id = s.id ORDER BY r.segment_name), s.version"
+
+// overrideColumns selects an override aliased as o with its segment aliased as s.
+const overrideColumns = "o.id, o.user_id, o.mode, o.variant, o.expires_at, o.actor, o.created_at, " +
+	segmentColumns
+
+func scanOverride(row scanner) (*storage.OverrideDTO, error) {
+	var (
+		override  storage.OverrideDTO
+		variant   sql.NullString
+		expiresAt sql.NullTime
+		segment   = segmentScanner{row: row}
+	)
+
+	segment.prefix = []any{&override.ID, &override.UserID, &override.Mode,
+		&variant, &expiresAt, &override.Actor, &override.CreatedAt}
+
+	seg, err := scanSegment(segment)
+	if err != nil {
+		return nil, err
+	}
+
+	override.Segment = *seg
+	override.Variant = variant.String
+	if expiresAt.Valid {
+		override.ExpiresAt = &expiresAt.Time
+	}
+
+	return &override, nil
+}
+
+// segmentScanner lets scanSegment read a segment selected after other columns.
+type segmentScanner struct {
+	row    scanner
+	prefix []any
+}
+
+func (s segmentScanner) Scan(dest ...any) error {
+	return s.row.Scan(append(s.prefix, dest...)...)
+}
+
+func logOverride(ctx context.Context, tx *sql.Tx, override *storage.OverrideDTO, opType string) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO log_segment_overrides(namespace, user_id, segment_name, mode, variant, actor, op_type) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7);",
+		namespace.FromContext(ctx), override.UserID, override.Segment.Name, override.Mode, nullString(override.Variant),
+		override.Actor, opType)
+
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanSegment reads a segment selected with segmentColumns.
+func scanSegment(row scanner) (*storage.SegmentDTO, error) {
+	var (
+		segment  storage.SegmentDTO
+		group    sql.NullString
+		rule     sql.NullString
+		startsAt sql.NullTime
+		endsAt   sql.NullTime
+		capacity sql.NullInt64
+	)
+
+	if err := row.Scan(&segment.ID, &segment.Name, &group, &rule,
+		&startsAt, &endsAt, &capacity, pq.Array(&segment.Requires), &segment.Version); err != nil {
+		return nil, err
+	}
+	segment.Group = group.String
+	segment.Rule = rule.String
+
+	if startsAt.Valid {
+		segment.StartsAt = &startsAt.Time
+	}
+	if endsAt.Valid {
+		segment.EndsAt = &endsAt.Time
+	}
+	if capacity.Valid {
+		segment.MaxMembers = &capacity.Int64
+	}
+
+	return &segment, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullInt64(n *int64) sql.NullInt64 {
+	if n == nil {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: *n, Valid: true}
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+// SyncSegmentWindows updates the activity of segments with scheduled windows
+// and records every transition in the segments log.
+func (s *Storage) SyncSegmentWindows(ctx context.Context) (_ []*storage.SegmentLogRecordDTO, err error) {
+	op := "storage.postgresql.SyncSegmentWindows"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	rows, err := tx.QueryContext(ctx,
+		"UPDATE segments SET window_active = NOT window_active WHERE window_active <> "+
+			"((starts_at IS NULL OR starts_at <= NOW()) AND (ends_at IS NULL OR ends_at > NOW())) "+
+			"RETURNING namespace, segment_name, window_active;")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var records []*storage.SegmentLogRecordDTO
+
+	for rows.Next() {
+		var (
+			rec    storage.SegmentLogRecordDTO
+			active bool
+		)
+		if err := rows.Scan(&rec.Namespace, &rec.SegmentName, &active); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		rec.Operation = "deactivate"
+		if active {
+			rec.Operation = "activate"
+		}
+		records = append(records, &rec)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	rows.Close()
+
+	for _, rec := range records {
+		row := tx.QueryRowContext(ctx,
+			"INSERT INTO log_segments(namespace, segment_name, op_type) VALUES ($1, $2, $3) RETURNING added_at;",
+			rec.Namespace, rec.SegmentName, rec.Operation)
+		if err := row.Scan(&rec.AddedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return records, nil
+}
+
+// addEvent writes a webhook event to the outbox. It runs in the transaction of the
+// change it describes, so events are neither lost nor sent for rolled back changes.
+func addEvent(ctx context.Context, q querier, eventType, segmentName string, userID int64) error {
+	_, err := q.ExecContext(ctx,
+		"INSERT INTO webhook_outbox(namespace, event_type, segment_name, user_id) VALUES ($1, $2, $3, $4);",
+		namespace.FromContext(ctx), eventType, segmentName, sql.NullInt64{Int64: userID, Valid: userID != 0})
+
+	return err
+}
+
+func (s *Storage) AddWebhook(ctx context.Context, webhook storage.WebhookDTO) (_ *storage.WebhookDTO, err error) {
+	op := "storage.postgresql.AddWebhook"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	created, err := scanWebhook(s.db.QueryRowContext(ctx,
+		"INSERT INTO webhooks(namespace, url, secret, segments, events) VALUES ($1, $2, $3, $4, $5) "+
+			"RETURNING "+webhookColumns+";",
+		namespace.FromContext(ctx), webhook.URL, webhook.Secret,
+		pq.Array(nonNil(webhook.Segments)), pq.Array(nonNil(webhook.Events))))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return created, nil
+}
+
+// DeleteWebhook deletes a subscription of the namespace together with its deliveries.
+func (s *Storage) DeleteWebhook(ctx context.Context, id int64) (_ *storage.WebhookDTO, err error) {
+	op := "storage.postgresql.DeleteWebhook"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	deleted, err := scanWebhook(s.db.QueryRowContext(ctx,
+		"DELETE FROM webhooks WHERE id = $1 AND namespace = $2 RETURNING "+webhookColumns+";",
+		id, namespace.FromContext(ctx)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrWebhookNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deleted, nil
+}
+
+func (s *Storage) Webhooks(ctx context.Context) (_ []storage.WebhookDTO, err error) {
+	op := "storage.postgresql.Webhooks"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+webhookColumns+" FROM webhooks WHERE namespace = $1 ORDER BY id;", namespace.FromContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var webhooks []storage.WebhookDTO
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
 		}
+		webhooks = append(webhooks, *webhook)
 	}
 
 	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return webhooks, nil
+}
+
+// DispatchWebhookEvents creates deliveries of up to limit outbox events for the
+// matching subscriptions of all namespaces and marks the events as dispatched.
+// Concurrent dispatchers skip events locked by each other.
+func (s *Storage) DispatchWebhookEvents(ctx context.Context, limit int) (_ int64, err error) {
+	op := "storage.postgresql.DispatchWebhookEvents"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	res, err := s.db.ExecContext(ctx,
+		"WITH events AS (SELECT id, namespace, event_type, segment_name FROM webhook_outbox "+
+			"WHERE dispatched_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED), "+
+			"deliveries AS (INSERT INTO webhook_deliveries(webhook_id, event_id) "+
+			"SELECT w.id, e.id FROM events e JOIN webhooks w ON w.namespace = e.namespace "+
+			"AND (cardinality(w.segments) = 0 OR e.segment_name = ANY(w.segments)) "+
+			"AND (cardinality(w.events) = 0 OR e.event_type = ANY(w.events)) ON CONFLICT DO NOTHING) "+
+			"UPDATE webhook_outbox o SET dispatched_at = NOW() FROM events e WHERE o.id = e.id;", limit)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	dispatched, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return dispatched, nil
+}
+
+// ClaimWebhookDeliveries takes up to limit due deliveries of all namespaces, counts
+// an attempt for each and hides them from other workers for lease. A delivery that
+// isn't completed or failed within lease is retried.
+func (s *Storage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) (_ []storage.WebhookDeliveryDTO, err error) {
+	op := "storage.postgresql.ClaimWebhookDeliveries"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"WITH due AS (SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= NOW() "+
+			"ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED) "+
+			"UPDATE webhook_deliveries d SET attempts = d.attempts + 1, "+
+			"next_attempt_at = NOW() + make_interval(secs => $2) "+
+			"FROM due, webhooks w, webhook_outbox o WHERE d.id = due.id AND w.id = d.webhook_id AND o.id = d.event_id "+
+			"RETURNING "+deliveryColumns+";", limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	deliveries, err := scanDeliveries(rows)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deliveries, nil
+}
+
+func (s *Storage) CompleteWebhookDelivery(ctx context.Context, id int64) (err error) {
+	op := "storage.postgresql.CompleteWebhookDelivery"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	if _, err := s.db.ExecContext(ctx,
+		"UPDATE webhook_deliveries SET status = 'delivered', delivered_at = NOW(), last_error = NULL WHERE id = $1;",
+		id); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// FailWebhookDelivery records a failed attempt and schedules the next one at retryAt.
+// Without retryAt the delivery is dead.
+func (s *Storage) FailWebhookDelivery(ctx context.Context, id int64, lastError string, retryAt *time.Time) (err error) {
+	op := "storage.postgresql.FailWebhookDelivery"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	status := storage.DeliveryPending
+	if retryAt == nil {
+		status = storage.DeliveryDead
+	}
+
+	if _, err := s.db.ExecContext(ctx,
+		"UPDATE webhook_deliveries SET status = $2, last_error = $3, next_attempt_at = COALESCE($4, next_attempt_at) "+
+			"WHERE id = $1;", id, status, lastError, nullTime(retryAt)); err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
 
 	return nil
 }
+
+// WebhookDeliveries returns up to limit deliveries of the namespace with the status,
+// most recent first.
+func (s *Storage) WebhookDeliveries(ctx context.Context, status string, limit int) (_ []storage.WebhookDeliveryDTO, err error) {
+	op := "storage.postgresql.WebhookDeliveries"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+deliveryColumns+" FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id "+
+			"JOIN webhook_outbox o ON o.id = d.event_id WHERE w.namespace = $1 AND d.status = $2 "+
+			"ORDER BY d.id DESC LIMIT $3;", namespace.FromContext(ctx), status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	deliveries, err := scanDeliveries(rows)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deliveries, nil
+}
+
+// ReplayWebhookDelivery schedules a dead or delivered delivery of the namespace to be
+// sent again right away with a fresh set of attempts.
+func (s *Storage) ReplayWebhookDelivery(ctx context.Context, id int64) (_ *storage.WebhookDeliveryDTO, err error) {
+	op := "storage.postgresql.ReplayWebhookDelivery"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	rows, err := s.db.QueryContext(ctx,
+		"UPDATE webhook_deliveries d SET status = 'pending', attempts = 0, next_attempt_at = NOW(), "+
+			"last_error = NULL, delivered_at = NULL FROM webhooks w, webhook_outbox o "+
+			"WHERE d.id = $1 AND w.id = d.webhook_id AND o.id = d.event_id AND w.namespace = $2 "+
+			"AND d.status <> 'pending' RETURNING "+deliveryColumns+";", id, namespace.FromContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	deliveries, err := scanDeliveries(rows)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if len(deliveries) == 0 {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrDeliveryNotFound)
+	}
+
+	return &deliveries[0], nil
+}
+
+// PurgeWebhookEvents deletes events dispatched before the time whose deliveries
+// have all been delivered.
+func (s *Storage) PurgeWebhookEvents(ctx context.Context, before time.Time) (_ int64, err error) {
+	op := "storage.postgresql.PurgeWebhookEvents"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	res, err := s.db.ExecContext(ctx,
+		"DELETE FROM webhook_outbox o WHERE o.dispatched_at < $1 AND NOT EXISTS "+
+			"(SELECT 1 FROM webhook_deliveries d WHERE d.event_id = o.id AND d.status <> 'delivered');",
+		before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return purged, nil
+}
+
+// EventsAfter returns up to limit events of the namespace following the event with
+// the id in stream order.
+//
+// IDs are taken when events are written, so a transaction may commit an event after
+// another one with a greater ID is already read. The stream therefore holds back
+// events of transactions that may still be running and orders the rest by
+// transaction, which makes it append-only: nothing can appear before an event once
+// it's been returned.
+func (s *Storage) EventsAfter(ctx context.Context, afterID int64, limit int) (_ []storage.WebhookEventDTO, err error) {
+	op := "storage.postgresql.EventsAfter"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	// the cursor of a purged event falls back to the oldest transaction after it
+	rows, err := s.db.QueryContext(ctx,
+		"WITH cursor AS (SELECT COALESCE((SELECT tx_id FROM webhook_outbox WHERE id = $2), "+
+			"(SELECT MIN(tx_id) FROM webhook_outbox WHERE namespace = $1 AND id > $2), '0'::xid8) AS tx_id) "+
+			"SELECT "+eventColumns+" FROM webhook_outbox o, cursor c WHERE o.namespace = $1 "+
+			"AND o.tx_id < pg_snapshot_xmin(pg_current_snapshot()) "+
+			"AND (o.tx_id > c.tx_id OR (o.tx_id = c.tx_id AND o.id > $2)) "+
+			"ORDER BY o.tx_id, o.id LIMIT $3;", namespace.FromContext(ctx), afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var events []storage.WebhookEventDTO
+	for rows.Next() {
+		var (
+			event  storage.WebhookEventDTO
+			userID sql.NullInt64
+		)
+
+		if err := rows.Scan(&event.ID, &event.Namespace, &event.Type, &event.Segment, &userID,
+			&event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		event.UserID = userID.Int64
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return events, nil
+}
+
+// LastEventID returns the ID of the last event of the namespace in stream order,
+// or 0 if there are none.
+func (s *Storage) LastEventID(ctx context.Context) (_ int64, err error) {
+	op := "storage.postgresql.LastEventID"
+	ctx, done := s.observe(ctx, op)
+	defer done(&err)
+
+	var id int64
+	err = s.db.QueryRowContext(ctx,
+		"SELECT id FROM webhook_outbox WHERE namespace = $1 AND tx_id < pg_snapshot_xmin(pg_current_snapshot()) "+
+			"ORDER BY tx_id DESC, id DESC LIMIT 1;", namespace.FromContext(ctx)).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return id, nil
+}
+
+// Listen calls notify with the namespace of every committed event until ctx is
+// canceled, and with an empty namespace whenever notifications might have been missed.
+// It opens a dedicated connection, since LISTEN doesn't work through a pool.
+func Listen(ctx context.Context, dsn string, notify func(namespace string)) error {
+	listener := pq.NewListener(dsn, listenMinReconnect, listenMaxReconnect, nil)
+	defer listener.Close()
+
+	if err := listener.Listen(EventsChannel); err != nil {
+		return fmt.Errorf("storage.postgresql.Listen: %w", err)
+	}
+
+	ticker := time.NewTicker(listenPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-listener.Notify:
+			// nil is sent after the connection is reestablished
+			if n == nil {
+				notify("")
+				continue
+			}
+			notify(n.Extra)
+		case <-ticker.C:
+			go listener.Ping() //nolint:errcheck
+		}
+	}
+}
+
+const eventColumns = "o.id, o.namespace, o.event_type, o.segment_name, o.user_id, o.created_at"
+
+const webhookColumns = "id, namespace, url, secret, segments, events, created_at"
+
+func scanWebhook(row scanner) (*storage.WebhookDTO, error) {
+	var webhook storage.WebhookDTO
+
+	if err := row.Scan(&webhook.ID, &webhook.Namespace, &webhook.URL, &webhook.Secret,
+		pq.Array(&webhook.Segments), pq.Array(&webhook.Events), &webhook.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &webhook, nil
+}
+
+// deliveryColumns selects a delivery aliased as d with its webhook w and event o.
+const deliveryColumns = "d.id, d.status, d.attempts, d.next_attempt_at, d.last_error, d.delivered_at, " +
+	"w.id, w.namespace, w.url, w.secret, w.segments, w.events, w.created_at, " +
+	"o.id, o.namespace, o.event_type, o.segment_name, o.user_id, o.created_at"
+
+func scanDeliveries(rows *sql.Rows) ([]storage.WebhookDeliveryDTO, error) {
+	var deliveries []storage.WebhookDeliveryDTO
+
+	for rows.Next() {
+		var (
+			delivery    storage.WebhookDeliveryDTO
+			lastError   sql.NullString
+			deliveredAt sql.NullTime
+			userID      sql.NullInt64
+			webhook     = &delivery.Webhook
+			event       = &delivery.Event
+		)
+
+		if err := rows.Scan(&delivery.ID, &delivery.Status, &delivery.Attempts, &delivery.NextAttemptAt,
+			&lastError, &deliveredAt,
+			&webhook.ID, &webhook.Namespace, &webhook.URL, &webhook.Secret,
+			pq.Array(&webhook.Segments), pq.Array(&webhook.Events), &webhook.CreatedAt,
+			&event.ID, &event.Namespace, &event.Type, &event.Segment, &userID, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		delivery.LastError = lastError.String
+		event.UserID = userID.Int64
+		if deliveredAt.Valid {
+			delivery.DeliveredAt = &deliveredAt.Time
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// nonNil keeps empty lists from being stored as NULL.
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
@@ -1,21 +1,43 @@
 package storage
 
 import (
-	"errors"
 	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
 )
 
 var (
-	// TODO: declare errors
-	ErrSegmentExists          = errors.New("segment with current name already exists")
-	ErrSegmentNotFound        = errors.New("segment with current name not found")
-	ErrAlreadyInExperiment    = errors.New("current user is already in segment")
-	ErrUserExperimentNotFound = errors.New("user experiment not found")
+	ErrSegmentExists          = api.ErrSegmentExists
+	ErrSegmentNotFound        = api.ErrSegmentNotFound
+	ErrAlreadyInExperiment    = api.ErrAlreadyInExperiment
+	ErrUserExperimentNotFound = api.ErrUserExperimentNotFound
+	ErrExclusionGroupConflict = api.ErrExclusionGroupConflict
+	ErrCapacityExceeded       = api.ErrCapacityExceeded
+	ErrOverrideNotFound       = api.ErrOverrideNotFound
+	ErrAPIKeyNotFound         = api.ErrAPIKeyNotFound
+	ErrVersionMismatch        = api.ErrVersionMismatch
+	ErrWebhookNotFound        = api.ErrWebhookNotFound
+	ErrDeliveryNotFound       = api.ErrDeliveryNotFound
 )
 
+type SegmentSettingsDTO struct {
+	Group      string
+	Requires   []string
+	Rule       string
+	StartsAt   *time.Time
+	EndsAt     *time.Time
+	MaxMembers *int64
+}
+
+// SegmentDTO is a segment with its settings. Version starts at 1 and is incremented
+// on every change of the settings. Forced is set on stored memberships that were
+// added with force.
 type SegmentDTO struct {
-	ID   int64
-	Name string
+	ID      int64
+	Name    string
+	Version int64
+	SegmentSettingsDTO
+	Forced bool
 }
 
 type UserExperimentDTO struct {
@@ -35,3 +57,93 @@ type UserExperimentLogRecordDTO struct {
 	Operation   string
 	AddedAt     time.Time
 }
+
+type SegmentLogRecordDTO struct {
+	Namespace   string
+	SegmentName string
+	Operation   string
+	AddedAt     time.Time
+}
+
+type OverrideDTO struct {
+	ID        int64
+	UserID    int64
+	Segment   SegmentDTO
+	Mode      string
+	Variant   string
+	ExpiresAt *time.Time
+	Actor     string
+	CreatedAt time.Time
+}
+
+type APIKeyDTO struct {
+	ID        int64
+	Namespace string
+	Name      string
+	Role      string
+	Prefix    string
+	Hash      string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+// IdempotencyRecordDTO is a request reserved under an idempotency key. The response
+// fields are set once the request has completed.
+type IdempotencyRecordDTO struct {
+	RequestHash string
+	Completed   bool
+	Status      int
+	ContentType string
+	ETag        string
+	Body        []byte
+}
+
+// Events written to the webhook outbox together with the changes they describe.
+const (
+	EventMembershipAdded   = "membership.added"
+	EventMembershipRemoved = "membership.removed"
+	EventMembershipExpired = "membership.expired"
+	EventSegmentCreated    = "segment.created"
+	EventSegmentUpdated    = "segment.updated"
+	EventSegmentDeleted    = "segment.deleted"
+)
+
+// Webhook delivery statuses. Dead deliveries ran out of attempts and wait for a replay.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// WebhookDTO is a subscription to the events of its namespace. Empty Segments or
+// Events match all of them.
+type WebhookDTO struct {
+	ID        int64
+	Namespace string
+	URL       string
+	Secret    string
+	Segments  []string
+	Events    []string
+	CreatedAt time.Time
+}
+
+// WebhookEventDTO is an outbox record. UserID is 0 for segment events.
+type WebhookEventDTO struct {
+	ID        int64
+	Namespace string
+	Type      string
+	Segment   string
+	UserID    int64
+	CreatedAt time.Time
+}
+
+type WebhookDeliveryDTO struct {
+	ID            int64
+	Webhook       WebhookDTO
+	Event         WebhookEventDTO
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	DeliveredAt   *time.Time
+}
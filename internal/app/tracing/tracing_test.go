@@ -0,0 +1,42 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetup(t *testing.T) {
+	t.Run("propagates W3C trace context", func(t *testing.T) {
+		shutdown, err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracing.ExporterNone})
+		assert.NoError(t, err)
+		defer shutdown(context.Background()) //nolint:errcheck
+
+		header := http.Header{}
+		header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(header))
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", trace.SpanContextFromContext(ctx).TraceID().String())
+	})
+
+	t.Run("creates stdout exporter", func(t *testing.T) {
+		shutdown, err := tracing.Setup(context.Background(), tracing.Config{
+			ServiceName: "test",
+			Exporter:    tracing.ExporterStdout,
+			SampleRatio: 1,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, shutdown(context.Background()))
+	})
+
+	t.Run("rejects unknown exporter", func(t *testing.T) {
+		_, err := tracing.Setup(context.Background(), tracing.Config{Exporter: "jaeger"})
+		assert.Error(t, err)
+	})
+}
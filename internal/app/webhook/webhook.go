@@ -0,0 +1,336 @@
+// Package webhook delivers events from the outbox to subscribed endpoints. Events are
+// written to the outbox in the transaction of the change they describe; the dispatcher
+// fans them out to matching subscriptions and sends them with retries, so a receiver
+// gets every event at least once and should deduplicate them by X-Webhook-ID.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/metrics"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+)
+
+const (
+	// HeaderID carries the event ID, which stays the same across retries.
+	HeaderID        = "X-Webhook-ID"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	// HeaderSignature carries "v1=" and the hex HMAC-SHA256 of "<timestamp>.<body>".
+	HeaderSignature = "X-Webhook-Signature"
+
+	// SecretPrefix starts every signing secret.
+	SecretPrefix = "whsec_"
+
+	signatureVersion = "v1="
+)
+
+const (
+	defaultMaxAttempts = 10
+	defaultBaseBackoff = 10 * time.Second
+	defaultMaxBackoff  = time.Hour
+	defaultTimeout     = 10 * time.Second
+	defaultRetention   = 7 * 24 * time.Hour
+	batchSize          = 100
+	purgeInterval      = time.Hour
+)
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Store keeps the outbox and the deliveries.
+type Store interface {
+	DispatchWebhookEvents(ctx context.Context, limit int) (int64, error)
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]storage.WebhookDeliveryDTO, error)
+	CompleteWebhookDelivery(ctx context.Context, id int64) error
+	FailWebhookDelivery(ctx context.Context, id int64, lastError string, retryAt *time.Time) error
+	PurgeWebhookEvents(ctx context.Context, before time.Time) (int64, error)
+}
+
+type Dispatcher struct {
+	store       Store
+	client      *http.Client
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	retention   time.Duration
+	logger      *slog.Logger
+	metrics     *metrics.Metrics
+}
+
+type Option func(*Dispatcher)
+
+func WithHTTPClient(client *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = client
+	}
+}
+
+// WithMaxAttempts sets the number of attempts after which a delivery is dead.
+func WithMaxAttempts(n int) Option {
+	return func(d *Dispatcher) {
+		d.maxAttempts = n
+	}
+}
+
+// WithBackoff sets the delay before the first retry, which doubles with every
+// attempt up to max.
+func WithBackoff(base, max time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.baseBackoff = base
+		d.maxBackoff = max
+	}
+}
+
+// WithRetention sets how long delivered events are kept in the outbox.
+func WithRetention(retention time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.retention = retention
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(d *Dispatcher) {
+		d.logger = logger
+	}
+}
+
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(d *Dispatcher) {
+		d.metrics = m
+	}
+}
+
+func New(store Store, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		store:       store,
+		client:      &http.Client{Timeout: defaultTimeout},
+		maxAttempts: defaultMaxAttempts,
+		baseBackoff: defaultBaseBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		retention:   defaultRetention,
+		logger:      slog.Default(),
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
+}
+
+// Run flushes the outbox every interval and purges old events until ctx is canceled.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastPurge time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Flush(ctx); err != nil {
+				d.logger.ErrorContext(ctx, "couldn't deliver webhooks", "error", err)
+			}
+
+			if time.Since(lastPurge) < purgeInterval {
+				continue
+			}
+			lastPurge = time.Now()
+
+			purged, err := d.store.PurgeWebhookEvents(ctx, time.Now().Add(-d.retention))
+			if err != nil {
+				d.logger.ErrorContext(ctx, "couldn't purge webhook events", "error", err)
+				continue
+			}
+			if purged > 0 {
+				d.logger.DebugContext(ctx, "purged webhook events", "count", purged)
+			}
+		}
+	}
+}
+
+// Flush fans new outbox events out to subscriptions and sends the due deliveries.
+func (d *Dispatcher) Flush(ctx context.Context) error {
+	for {
+		dispatched, err := d.store.DispatchWebhookEvents(ctx, batchSize)
+		if err != nil {
+			return fmt.Errorf("dispatch events: %w", err)
+		}
+		if dispatched < batchSize {
+			break
+		}
+	}
+
+	for {
+		deliveries, err := d.store.ClaimWebhookDeliveries(ctx, batchSize, d.lease())
+		if err != nil {
+			return fmt.Errorf("claim deliveries: %w", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := range deliveries {
+			wg.Add(1)
+			go func(delivery *storage.WebhookDeliveryDTO) {
+				defer wg.Done()
+				d.deliver(ctx, delivery)
+			}(&deliveries[i])
+		}
+		wg.Wait()
+
+		if len(deliveries) < batchSize {
+			return nil
+		}
+	}
+}
+
+// lease is how long a claimed delivery is hidden from other dispatchers. It outlasts
+// the request, so a delivery is only retried by another one if this one crashed.
+func (d *Dispatcher) lease() time.Duration {
+	if lease := 2 * d.client.Timeout; lease > time.Minute {
+		return lease
+	}
+
+	return time.Minute
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery *storage.WebhookDeliveryDTO) {
+	logger := d.logger.With("delivery_id", delivery.ID, "webhook_id", delivery.Webhook.ID,
+		"event_id", delivery.Event.ID, "attempt", delivery.Attempts)
+
+	sendErr := d.send(ctx, delivery)
+	if sendErr == nil {
+		if err := d.store.CompleteWebhookDelivery(ctx, delivery.ID); err != nil {
+			logger.ErrorContext(ctx, "couldn't complete webhook delivery", "error", err)
+		}
+		d.metrics.WebhookDelivered("delivered")
+		return
+	}
+
+	var retryAt *time.Time
+	if delivery.Attempts < d.maxAttempts {
+		at := time.Now().Add(d.backoff(delivery.Attempts))
+		retryAt = &at
+	}
+
+	if err := d.store.FailWebhookDelivery(ctx, delivery.ID, sendErr.Error(), retryAt); err != nil {
+		logger.ErrorContext(ctx, "couldn't fail webhook delivery", "error", err)
+	}
+
+	if retryAt == nil {
+		logger.WarnContext(ctx, "webhook delivery is dead", "error", sendErr)
+		d.metrics.WebhookDelivered("dead")
+		return
+	}
+
+	logger.InfoContext(ctx, "webhook delivery failed", "error", sendErr, "retry_at", *retryAt)
+	d.metrics.WebhookDelivered("retry")
+}
+
+func (d *Dispatcher) send(ctx context.Context, delivery *storage.WebhookDeliveryDTO) error {
+	body, err := json.Marshal(api.Event{
+		ID:        delivery.Event.ID,
+		Type:      delivery.Event.Type,
+		Namespace: delivery.Event.Namespace,
+		CreatedAt: delivery.Event.CreatedAt.UTC(),
+		Data: api.EventData{
+			Segment: delivery.Event.Segment,
+			UserID:  delivery.Event.UserID,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, strconv.FormatInt(delivery.Event.ID, 10))
+	req.Header.Set(HeaderEvent, delivery.Event.Type)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, signatureVersion+Sign(delivery.Webhook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// backoff returns the delay after the attempt-th failed attempt.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.baseBackoff
+	for i := 1; i < attempt && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, d.maxBackoff)
+}
+
+// GenerateSecret returns a new random signing secret.
+func GenerateSecret() (string, error) {
+	buf := make([]byte, 32) //nolint:gomnd
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return SecretPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Sign returns the hex HMAC-SHA256 of the timestamp and body with the secret.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a webhook request and rejects requests signed more
+// than tolerance ago, so captured requests can't be replayed later.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp := header.Get(HeaderTimestamp)
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: timestamp is out of tolerance", ErrInvalidSignature)
+	}
+
+	signature, ok := strings.CutPrefix(header.Get(HeaderSignature), signatureVersion)
+	if !ok || !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/memory"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/webhook"
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const secret = "whsec_test"
+
+type receiver struct {
+	mu     sync.Mutex
+	events []api.Event
+	// status is returned for every request
+	status int
+}
+
+func newReceiver(t *testing.T) (*receiver, *httptest.Server) {
+	r := &receiver{status: http.StatusOK}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.NoError(t, webhook.Verify(secret, req.Header, body, time.Minute))
+
+		var event api.Event
+		require.NoError(t, json.Unmarshal(body, &event))
+		assert.Equal(t, event.Type, req.Header.Get(webhook.HeaderEvent))
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.events = append(r.events, event)
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(srv.Close)
+
+	return r, srv
+}
+
+func (r *receiver) received() []api.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]api.Event(nil), r.events...)
+}
+
+func TestDispatcher(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("delivers matching events", func(t *testing.T) {
+		store := memory.New()
+		r, srv := newReceiver(t)
+
+		_, err := store.AddWebhook(ctx, storage.WebhookDTO{
+			URL:      srv.URL,
+			Secret:   secret,
+			Segments: []string{"AVITO_TEST"},
+			Events:   []string{storage.EventMembershipAdded},
+		})
+		require.NoError(t, err)
+
+		_, err = store.AddSegment(ctx, "AVITO_TEST")
+		require.NoError(t, err)
+		_, err = store.AddSegment(ctx, "AVITO_OTHER")
+		require.NoError(t, err)
+		_, err = store.AddUserToSegment(ctx, 1000, "AVITO_TEST", false)
+		require.NoError(t, err)
+		_, err = store.AddUserToSegment(ctx, 1000, "AVITO_OTHER", false)
+		require.NoError(t, err)
+		_, err = store.DeleteUserFromSegment(ctx, 1000, "AVITO_TEST")
+		require.NoError(t, err)
+
+		d := webhook.New(store)
+		require.NoError(t, d.Flush(ctx))
+
+		events := r.received()
+		require.Len(t, events, 1)
+		assert.Equal(t, storage.EventMembershipAdded, events[0].Type)
+		assert.Equal(t, api.EventData{Segment: "AVITO_TEST", UserID: 1000}, events[0].Data)
+
+		delivered, err := store.WebhookDeliveries(ctx, storage.DeliveryDelivered, 10)
+		require.NoError(t, err)
+		require.Len(t, delivered, 1)
+		assert.Equal(t, 1, delivered[0].Attempts)
+
+		// delivered events aren't sent again
+		require.NoError(t, d.Flush(ctx))
+		assert.Len(t, r.received(), 1)
+	})
+
+	t.Run("retries failed deliveries", func(t *testing.T) {
+		store := memory.New()
+		r, srv := newReceiver(t)
+		r.status = http.StatusServiceUnavailable
+
+		_, err := store.AddWebhook(ctx, storage.WebhookDTO{URL: srv.URL, Secret: secret})
+		require.NoError(t, err)
+		_, err = store.AddSegment(ctx, "AVITO_TEST")
+		require.NoError(t, err)
+
+		d := webhook.New(store, webhook.WithBackoff(0, 0))
+		require.NoError(t, d.Flush(ctx))
+
+		pending, err := store.WebhookDeliveries(ctx, storage.DeliveryPending, 10)
+		require.NoError(t, err)
+		require.Len(t, pending, 1)
+		assert.Equal(t, "unexpected status 503", pending[0].LastError)
+
+		r.status = http.StatusNoContent
+		require.NoError(t, d.Flush(ctx))
+
+		delivered, err := store.WebhookDeliveries(ctx, storage.DeliveryDelivered, 10)
+		require.NoError(t, err)
+		require.Len(t, delivered, 1)
+		assert.Equal(t, 2, delivered[0].Attempts)
+
+		events := r.received()
+		require.Len(t, events, 2)
+		assert.Equal(t, events[0].ID, events[1].ID)
+	})
+
+	t.Run("backs off between attempts", func(t *testing.T) {
+		store := memory.New()
+		r, srv := newReceiver(t)
+		r.status = http.StatusInternalServerError
+
+		_, err := store.AddWebhook(ctx, storage.WebhookDTO{URL: srv.URL, Secret: secret})
+		require.NoError(t, err)
+		_, err = store.AddSegment(ctx, "AVITO_TEST")
+		require.NoError(t, err)
+
+		d := webhook.New(store, webhook.WithBackoff(time.Hour, time.Hour))
+		require.NoError(t, d.Flush(ctx))
+		require.NoError(t, d.Flush(ctx))
+
+		assert.Len(t, r.received(), 1)
+	})
+
+	t.Run("moves deliveries out of attempts to dead letters and replays them", func(t *testing.T) {
+		store := memory.New()
+		r, srv := newReceiver(t)
+		r.status = http.StatusInternalServerError
+
+		_, err := store.AddWebhook(ctx, storage.WebhookDTO{URL: srv.URL, Secret: secret})
+		require.NoError(t, err)
+		_, err = store.AddSegment(ctx, "AVITO_TEST")
+		require.NoError(t, err)
+
+		d := webhook.New(store, webhook.WithBackoff(0, 0), webhook.WithMaxAttempts(3))
+		for i := 0; i < 5; i++ {
+			require.NoError(t, d.Flush(ctx))
+		}
+		assert.Len(t, r.received(), 3)
+
+		dead, err := store.WebhookDeliveries(ctx, storage.DeliveryDead, 10)
+		require.NoError(t, err)
+		require.Len(t, dead, 1)
+
+		r.status = http.StatusOK
+		_, err = store.ReplayWebhookDelivery(ctx, dead[0].ID)
+		require.NoError(t, err)
+		require.NoError(t, d.Flush(ctx))
+
+		assert.Len(t, r.received(), 4)
+		delivered, err := store.WebhookDeliveries(ctx, storage.DeliveryDelivered, 10)
+		require.NoError(t, err)
+		assert.Len(t, delivered, 1)
+	})
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	now := time.Now().Unix()
+
+	header := func(timestamp int64, signature string) http.Header {
+		h := http.Header{}
+		h.Set(webhook.HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		h.Set(webhook.HeaderSignature, signature)
+		return h
+	}
+
+	valid := "v1=" + webhook.Sign(secret, strconv.FormatInt(now, 10), body)
+	assert.NoError(t, webhook.Verify(secret, header(now, valid), body, time.Minute))
+
+	assert.ErrorIs(t, webhook.Verify("whsec_other", header(now, valid), body, time.Minute), webhook.ErrInvalidSignature)
+	assert.ErrorIs(t, webhook.Verify(secret, header(now, valid), []byte(`{"id":2}`), time.Minute), webhook.ErrInvalidSignature)
+
+	old := now - 3600
+	assert.ErrorIs(t, webhook.Verify(secret, header(old, "v1="+webhook.Sign(secret, strconv.FormatInt(old, 10), body)), body, time.Minute),
+		webhook.ErrInvalidSignature)
+}
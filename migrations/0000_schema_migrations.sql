@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS schema_version;
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    applied_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -1,4 +1,5 @@
 CREATE TABLE IF NOT EXISTS segments (
     id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
     name VARCHAR(256) UNIQUE NOT NULL
-);
\ No newline at end of file
+);
+INSERT INTO schema_migrations (version) VALUES (1) ON CONFLICT DO NOTHING;
@@ -4,4 +4,5 @@ CREATE TABLE IF NOT EXISTS user_experiments (
     segment_id INTEGER NOT NULL REFERENCES Segments(id),
     expires_at TIMESTAMP DEFAULT NULL,
     UNIQUE(user_id, segment_id)
-);
\ No newline at end of file
+);
+INSERT INTO schema_migrations (version) VALUES (2) ON CONFLICT DO NOTHING;
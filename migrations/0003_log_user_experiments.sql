@@ -1,8 +1,14 @@
-CREATE TYPE user_experiments_op AS ENUM('add', 'remove');
+DO $$
+BEGIN
+    CREATE TYPE user_experiments_op AS ENUM('add', 'remove');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END
+$$;
 CREATE TABLE IF NOT EXISTS log_user_experiments (
     id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
     user_id INTEGER NOT NULL,
     segment_name VARCHAR(256) NOT NULL,
     op_type user_experiments_op NOT NULL,
     added_at TIMESTAMP NOT NULL DEFAULT NOW()
-);
\ No newline at end of file
+);
+INSERT INTO schema_migrations (version) VALUES (3) ON CONFLICT DO NOTHING;
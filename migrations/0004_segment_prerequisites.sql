@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS segment_prerequisites (
+    segment_id INTEGER NOT NULL REFERENCES segments(id) ON DELETE CASCADE,
+    required_id INTEGER NOT NULL REFERENCES segments(id) ON DELETE CASCADE,
+    PRIMARY KEY(segment_id, required_id)
+);
+INSERT INTO schema_migrations (version) VALUES (4) ON CONFLICT DO NOTHING;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS user_attributes (
+    user_id INTEGER NOT NULL,
+    attr_key VARCHAR(256) NOT NULL,
+    attr_value VARCHAR(256) NOT NULL,
+    PRIMARY KEY(user_id, attr_key)
+);
+INSERT INTO schema_migrations (version) VALUES (5) ON CONFLICT DO NOTHING;
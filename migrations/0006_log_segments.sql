@@ -0,0 +1,13 @@
+DO $$
+BEGIN
+    CREATE TYPE segments_op AS ENUM('activate', 'deactivate');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END
+$$;
+CREATE TABLE IF NOT EXISTS log_segments (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    segment_name VARCHAR(256) NOT NULL,
+    op_type segments_op NOT NULL,
+    added_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+INSERT INTO schema_migrations (version) VALUES (6) ON CONFLICT DO NOTHING;
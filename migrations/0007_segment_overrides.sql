@@ -0,0 +1,18 @@
+DO $$
+BEGIN
+    CREATE TYPE segment_override_mode AS ENUM('include', 'exclude');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END
+$$;
+CREATE TABLE IF NOT EXISTS segment_overrides (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    user_id INTEGER NOT NULL,
+    segment_id INTEGER NOT NULL REFERENCES segments(id) ON DELETE CASCADE,
+    mode segment_override_mode NOT NULL,
+    variant VARCHAR(256) DEFAULT NULL,
+    expires_at TIMESTAMP DEFAULT NULL,
+    actor VARCHAR(256) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE(user_id, segment_id)
+);
+INSERT INTO schema_migrations (version) VALUES (7) ON CONFLICT DO NOTHING;
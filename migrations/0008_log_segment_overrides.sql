@@ -0,0 +1,17 @@
+DO $$
+BEGIN
+    CREATE TYPE segment_overrides_op AS ENUM('set', 'remove');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END
+$$;
+CREATE TABLE IF NOT EXISTS log_segment_overrides (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    user_id INTEGER NOT NULL,
+    segment_name VARCHAR(256) NOT NULL,
+    mode segment_override_mode NOT NULL,
+    variant VARCHAR(256) DEFAULT NULL,
+    actor VARCHAR(256) NOT NULL,
+    op_type segment_overrides_op NOT NULL,
+    added_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+INSERT INTO schema_migrations (version) VALUES (8) ON CONFLICT DO NOTHING;
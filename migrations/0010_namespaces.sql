@@ -0,0 +1,27 @@
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS namespace VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE segments DROP CONSTRAINT IF EXISTS segments_name_key;
+DO $$
+BEGIN
+    -- checked by name, since 0020 renames the column
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'segments_namespace_name_key') THEN
+        ALTER TABLE segments ADD CONSTRAINT segments_namespace_name_key UNIQUE(namespace, name);
+    END IF;
+END
+$$;
+ALTER TABLE user_attributes ADD COLUMN IF NOT EXISTS namespace VARCHAR(64) NOT NULL DEFAULT 'default';
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.key_column_usage
+        WHERE table_name = 'user_attributes' AND constraint_name = 'user_attributes_pkey' AND column_name = 'namespace'
+    ) THEN
+        ALTER TABLE user_attributes DROP CONSTRAINT user_attributes_pkey;
+        ALTER TABLE user_attributes ADD PRIMARY KEY(namespace, user_id, attr_key);
+    END IF;
+END
+$$;
+ALTER TABLE log_segments ADD COLUMN IF NOT EXISTS namespace VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE log_user_experiments ADD COLUMN IF NOT EXISTS namespace VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE log_segment_overrides ADD COLUMN IF NOT EXISTS namespace VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS namespace VARCHAR(64) NOT NULL DEFAULT 'default';
+INSERT INTO schema_migrations (version) VALUES (10) ON CONFLICT DO NOTHING;
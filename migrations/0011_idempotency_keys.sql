@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key VARCHAR(512) PRIMARY KEY,
+    request_hash CHAR(64) NOT NULL,
+    status INTEGER DEFAULT NULL,
+    content_type VARCHAR(256) DEFAULT NULL,
+    body BYTEA DEFAULT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at ON idempotency_keys(expires_at);
+INSERT INTO schema_migrations (version) VALUES (11) ON CONFLICT DO NOTHING;
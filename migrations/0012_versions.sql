@@ -0,0 +1,8 @@
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+CREATE TABLE IF NOT EXISTS user_versions (
+    namespace VARCHAR(64) NOT NULL DEFAULT 'default',
+    user_id INTEGER NOT NULL,
+    version BIGINT NOT NULL,
+    PRIMARY KEY(namespace, user_id)
+);
+INSERT INTO schema_migrations (version) VALUES (12) ON CONFLICT DO NOTHING;
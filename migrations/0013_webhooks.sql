@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    namespace VARCHAR(64) NOT NULL DEFAULT 'default',
+    url TEXT NOT NULL,
+    secret VARCHAR(128) NOT NULL,
+    segments TEXT[] NOT NULL DEFAULT '{}',
+    events TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+    id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    namespace VARCHAR(64) NOT NULL DEFAULT 'default',
+    event_type VARCHAR(64) NOT NULL,
+    segment_name VARCHAR(256) NOT NULL,
+    user_id INTEGER DEFAULT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    dispatched_at TIMESTAMP DEFAULT NULL
+);
+CREATE INDEX IF NOT EXISTS webhook_outbox_pending ON webhook_outbox(id) WHERE dispatched_at IS NULL;
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_id BIGINT NOT NULL REFERENCES webhook_outbox(id) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_error TEXT DEFAULT NULL,
+    delivered_at TIMESTAMP DEFAULT NULL,
+    UNIQUE(webhook_id, event_id)
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+INSERT INTO schema_migrations (version) VALUES (13) ON CONFLICT DO NOTHING;
@@ -0,0 +1,11 @@
+ALTER TABLE webhook_outbox ADD COLUMN IF NOT EXISTS tx_id XID8 NOT NULL DEFAULT pg_current_xact_id();
+CREATE INDEX IF NOT EXISTS webhook_outbox_stream ON webhook_outbox(namespace, tx_id, id);
+CREATE OR REPLACE FUNCTION notify_segment_events() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('segment_events', namespace) FROM (SELECT DISTINCT namespace FROM inserted) AS n;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+CREATE OR REPLACE TRIGGER webhook_outbox_notify AFTER INSERT ON webhook_outbox
+    REFERENCING NEW TABLE AS inserted FOR EACH STATEMENT EXECUTE FUNCTION notify_segment_events();
+INSERT INTO schema_migrations (version) VALUES (14) ON CONFLICT DO NOTHING;
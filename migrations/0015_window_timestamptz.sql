@@ -0,0 +1,13 @@
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'segments' AND column_name = 'starts_at' AND data_type = 'timestamp without time zone'
+    ) THEN
+        ALTER TABLE segments
+            ALTER COLUMN starts_at TYPE TIMESTAMPTZ USING starts_at AT TIME ZONE 'UTC',
+            ALTER COLUMN ends_at TYPE TIMESTAMPTZ USING ends_at AT TIME ZONE 'UTC';
+    END IF;
+END
+$$;
+INSERT INTO schema_migrations (version) VALUES (15) ON CONFLICT DO NOTHING;
@@ -0,0 +1,16 @@
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'idempotency_keys' AND column_name = 'key' AND data_type = 'character varying'
+    ) THEN
+        -- stored keys aren't hashed and would never match again
+        TRUNCATE idempotency_keys;
+        ALTER TABLE idempotency_keys
+            ALTER COLUMN key TYPE CHAR(64),
+            ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+            ALTER COLUMN expires_at TYPE TIMESTAMPTZ;
+    END IF;
+END
+$$;
+INSERT INTO schema_migrations (version) VALUES (16) ON CONFLICT DO NOTHING;
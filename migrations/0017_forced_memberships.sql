@@ -0,0 +1,2 @@
+ALTER TABLE user_experiments ADD COLUMN IF NOT EXISTS forced BOOLEAN NOT NULL DEFAULT FALSE;
+INSERT INTO schema_migrations (version) VALUES (17) ON CONFLICT DO NOTHING;
@@ -0,0 +1,8 @@
+ALTER TABLE segments
+    ADD COLUMN IF NOT EXISTS group_name VARCHAR(256) DEFAULT NULL,
+    ADD COLUMN IF NOT EXISTS rule_expr TEXT DEFAULT NULL,
+    ADD COLUMN IF NOT EXISTS starts_at TIMESTAMPTZ DEFAULT NULL,
+    ADD COLUMN IF NOT EXISTS ends_at TIMESTAMPTZ DEFAULT NULL,
+    ADD COLUMN IF NOT EXISTS max_members INTEGER DEFAULT NULL,
+    ADD COLUMN IF NOT EXISTS window_active BOOLEAN NOT NULL DEFAULT TRUE;
+INSERT INTO schema_migrations (version) VALUES (18) ON CONFLICT DO NOTHING;
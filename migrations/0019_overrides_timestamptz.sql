@@ -0,0 +1,14 @@
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'segment_overrides' AND column_name = 'expires_at' AND data_type = 'timestamp without time zone'
+    ) THEN
+        -- expires_at is written in UTC, created_at by NOW() in the session time zone
+        ALTER TABLE segment_overrides
+            ALTER COLUMN expires_at TYPE TIMESTAMPTZ USING expires_at AT TIME ZONE 'UTC',
+            ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+    END IF;
+END
+$$;
+INSERT INTO schema_migrations (version) VALUES (19) ON CONFLICT DO NOTHING;
@@ -0,0 +1,12 @@
+DO $$
+BEGIN
+    -- the storage has always queried segments.segment_name
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'segments' AND column_name = 'name'
+    ) THEN
+        ALTER TABLE segments RENAME COLUMN name TO segment_name;
+    END IF;
+END
+$$;
+INSERT INTO schema_migrations (version) VALUES (20) ON CONFLICT DO NOTHING;
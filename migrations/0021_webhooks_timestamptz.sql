@@ -0,0 +1,20 @@
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'webhook_deliveries' AND column_name = 'next_attempt_at' AND data_type = 'timestamp without time zone'
+    ) THEN
+        -- the columns are set by NOW() in the session time zone, except for retries
+        -- that FailWebhookDelivery scheduled in UTC; those may run off by the offset once
+        ALTER TABLE webhooks
+            ALTER COLUMN created_at TYPE TIMESTAMPTZ;
+        ALTER TABLE webhook_outbox
+            ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+            ALTER COLUMN dispatched_at TYPE TIMESTAMPTZ;
+        ALTER TABLE webhook_deliveries
+            ALTER COLUMN next_attempt_at TYPE TIMESTAMPTZ,
+            ALTER COLUMN delivered_at TYPE TIMESTAMPTZ;
+    END IF;
+END
+$$;
+INSERT INTO schema_migrations (version) VALUES (21) ON CONFLICT DO NOTHING;
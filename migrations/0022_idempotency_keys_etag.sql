@@ -0,0 +1,2 @@
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS etag VARCHAR(256) DEFAULT NULL;
+INSERT INTO schema_migrations (version) VALUES (22) ON CONFLICT DO NOTHING;
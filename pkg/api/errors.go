@@ -0,0 +1,29 @@
+package api
+
+import "errors"
+
+// Errors the API reports. The message of an error response starts with the text
+// of one of them, so clients can tell them apart.
+var (
+	ErrSegmentExists          = errors.New("segment with current name already exists")
+	ErrSegmentNotFound        = errors.New("segment with current name not found")
+	ErrAlreadyInExperiment    = errors.New("current user is already in segment")
+	ErrUserExperimentNotFound = errors.New("user experiment not found")
+	ErrExclusionGroupConflict = errors.New("user is already in segment of the same exclusion group")
+	ErrCapacityExceeded       = errors.New("segment capacity exceeded")
+	ErrOverrideNotFound       = errors.New("segment override not found")
+	ErrAPIKeyNotFound         = errors.New("api key not found")
+	ErrVersionMismatch        = errors.New("version mismatch")
+	ErrWebhookNotFound        = errors.New("webhook not found")
+	ErrDeliveryNotFound       = errors.New("webhook delivery not found")
+	ErrRuleSyntax             = errors.New("rule syntax error")
+	ErrPrerequisitesNotMet    = errors.New("user is not in prerequisite segments")
+	ErrInvalidWindow          = errors.New("invalid segment activation window")
+	ErrInvalidCapacity        = errors.New("invalid segment capacity")
+	ErrUserInHoldout          = errors.New("user is in global holdout")
+	ErrInvalidOverride        = errors.New("invalid segment override")
+	ErrInvalidRole            = errors.New("invalid api key role")
+	ErrInvalidPrerequisite    = errors.New("invalid segment prerequisite")
+	ErrInvalidWebhook         = errors.New("invalid webhook")
+	ErrInvalidEventFilter     = errors.New("invalid event filter")
+)
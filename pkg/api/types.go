@@ -0,0 +1,174 @@
+// Package api holds the wire types and errors of the segments API. It has no
+// dependencies, so the server and the Go client share it.
+package api
+
+import "time"
+
+type SegmentSettings struct {
+	Group      string   `json:"group,omitempty"`
+	Requires   []string `json:"requires,omitempty"`
+	Rule       string   `json:"rule,omitempty"`
+	StartsAt   string   `json:"starts_at,omitempty"`
+	EndsAt     string   `json:"ends_at,omitempty"`
+	MaxMembers *int64   `json:"max_members,omitempty"`
+}
+
+type Segment struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Version int64  `json:"version,omitempty"`
+	SegmentSettings
+	Members *int64 `json:"members,omitempty"`
+	Variant string `json:"variant,omitempty"`
+}
+
+type UserExperiment struct {
+	ID      int64   `json:"id"`
+	UserID  int64   `json:"user_id"`
+	Segment Segment `json:"segment"`
+}
+
+type UserExperimentList struct {
+	UserID   int64     `json:"user_id"`
+	Version  int64     `json:"version,omitempty"`
+	Segments []Segment `json:"segments"`
+}
+
+type LogInfo struct {
+	UserID int64  `json:"user_id"`
+	From   string `json:"from"`
+	Path   string `json:"url"`
+}
+
+type UserExperimentItem struct {
+	Name      string `json:"name" validate:"required"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Force     bool   `json:"force,omitempty"`
+}
+
+type RejectedExperiment struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+type UserAttributes struct {
+	UserID     int64             `json:"user_id"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type HoldoutStatus struct {
+	UserID    int64 `json:"user_id"`
+	InHoldout bool  `json:"in_holdout"`
+}
+
+type Override struct {
+	UserID    int64  `json:"user_id"`
+	Segment   string `json:"segment"`
+	Mode      string `json:"mode"`
+	Variant   string `json:"variant,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Actor     string `json:"actor"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+type UserOverrideList struct {
+	UserID    int64       `json:"user_id"`
+	Overrides []*Override `json:"overrides"`
+}
+
+// APIKey describes an issued key. Key holds the plain text key and is returned only
+// once, when the key is created.
+type APIKey struct {
+	ID        int64  `json:"id"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	Prefix    string `json:"prefix"`
+	Key       string `json:"key,omitempty"`
+	CreatedAt string `json:"created_at"`
+	RevokedAt string `json:"revoked_at,omitempty"`
+}
+
+type APIKeyList struct {
+	Keys []*APIKey `json:"keys"`
+}
+
+// Webhook describes a subscription. Secret signs the requests and is returned only
+// once, when the webhook is created.
+type Webhook struct {
+	ID        int64    `json:"id"`
+	Namespace string   `json:"namespace"`
+	URL       string   `json:"url"`
+	Segments  []string `json:"segments"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+type WebhookList struct {
+	Webhooks []*Webhook `json:"webhooks"`
+}
+
+type WebhookDelivery struct {
+	ID            int64  `json:"id"`
+	WebhookID     int64  `json:"webhook_id"`
+	EventID       int64  `json:"event_id"`
+	Event         string `json:"event"`
+	Segment       string `json:"segment"`
+	UserID        int64  `json:"user_id,omitempty"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	NextAttemptAt string `json:"next_attempt_at,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+	DeliveredAt   string `json:"delivered_at,omitempty"`
+}
+
+type WebhookDeliveryList struct {
+	Deliveries []*WebhookDelivery `json:"deliveries"`
+}
+
+// Event describes a change of a segment or a membership. It is the body of webhook
+// requests and the data of the event stream.
+type Event struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Namespace string    `json:"namespace"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      EventData `json:"data"`
+}
+
+// EventData describes the change. UserID is omitted for segment events.
+type EventData struct {
+	Segment string `json:"segment"`
+	UserID  int64  `json:"user_id,omitempty"`
+}
+
+type NamespaceList struct {
+	Namespaces []string `json:"namespaces"`
+}
+
+// Snapshot holds what a client needs to evaluate segments of any user locally:
+// segments with rules and the ones overrides refer to, active overrides of all
+// users and the holdout. Stored memberships and attributes are kept per user, so
+// they are in UserSnapshot.
+type Snapshot struct {
+	Segments  []Segment       `json:"segments"`
+	Overrides []*Override     `json:"overrides"`
+	Holdout   HoldoutSettings `json:"holdout"`
+}
+
+type HoldoutSettings struct {
+	Percent float64 `json:"percent"`
+	Salt    string  `json:"salt,omitempty"`
+	Users   []int64 `json:"users"`
+}
+
+type UserSnapshot struct {
+	UserID     int64             `json:"user_id"`
+	Segments   []Segment         `json:"segments"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type UserSnapshotList struct {
+	Users []*UserSnapshot `json:"users"`
+}
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,18 +15,34 @@ import (
 	_ "github.com/lib/pq"
 
 	"github.com/labstack/echo/v4"
-	"github.com/psxzz/backend-trainee-assignment/internal/app/endpoint"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/events"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/grpcserver"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/health"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/holdout"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/idempotency"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/logging"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/metrics"
 	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/cache"
 	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/postgresql"
-	"github.com/psxzz/backend-trainee-assignment/internal/app/validator"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/tracing"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/webhook"
 	"github.com/psxzz/backend-trainee-assignment/internal/config"
 )
 
 type App struct {
-	cfg  *config.Config
-	svc  *service.Service
-	endp *endpoint.Endpoint
-	echo *echo.Echo
+	cfg    *config.Config
+	logger *slog.Logger
+	svc    *service.Service
+	health *health.Health
+	echo   *echo.Echo
+	grpc   *grpcserver.Server
+
+	idempotency idempotency.Store
+	webhooks    *webhook.Dispatcher
+	events      *events.Broker
+
+	shutdownTracing func(context.Context) error
 }
 
 func New() (*App, error) {
@@ -32,40 +50,142 @@ func New() (*App, error) {
 	cfg := config.New()
 	app := &App{cfg: cfg}
 
+	level, err := logging.ParseLevel(app.cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger = logging.New(os.Stdout, level)
+	slog.SetDefault(app.logger)
+
+	app.shutdownTracing, err = tracing.Setup(context.Background(), tracing.Config{
+		ServiceName:  app.cfg.ServiceName,
+		Exporter:     app.cfg.TracingExporter,
+		OTLPEndpoint: app.cfg.OTLPEndpoint,
+		OTLPInsecure: app.cfg.OTLPInsecure,
+		SampleRatio:  app.cfg.TracingSampleRatio,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set up tracing: %w", err)
+	}
+
 	db, err := sql.Open("postgres", app.cfg.DatabaseDSN)
 	if err != nil {
 		return nil, fmt.Errorf("invalid database connection credentials: %w", err)
 	}
 
+	db.SetMaxOpenConns(app.cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(app.cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(app.cfg.DBConnMaxLifetime)
+	db.SetConnMaxIdleTime(app.cfg.DBConnMaxIdleTime)
+
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("couldn't connect to database: %w", err)
 	}
 
-	storage := postgresql.New(db)
-	app.svc = service.New(storage, app.cfg.LogsPath)
+	policy := service.PrerequisitePolicy(app.cfg.PrerequisitePolicy)
+	if policy != service.PrerequisitePolicyKeep && policy != service.PrerequisitePolicyCascade {
+		return nil, fmt.Errorf("unknown prerequisite policy: %q", policy)
+	}
+
+	if p := app.cfg.HoldoutPercent; p < 0 || p > 100 {
+		return nil, fmt.Errorf("holdout percent must be between 0 and 100: %v", p)
+	}
+
+	m := metrics.New()
+	m.RegisterDB(db, "experimental_segments")
+
+	pg := postgresql.New(db, postgresql.WithMetrics(m), postgresql.WithLogger(app.logger))
+	m.RegisterTotals(pg.Totals)
+
+	var storage service.Storage = pg
+	if app.cfg.CacheSize > 0 {
+		cached := cache.New(storage, app.cfg.CacheSize, app.cfg.CacheTTL)
+		m.RegisterCache(func() (int64, int64, int64, int64) {
+			stats := cached.Stats()
+			return stats.Hits, stats.Misses, stats.Evictions, int64(stats.Size)
+		})
+		storage = cached
+	}
+
+	app.svc = service.New(storage, app.cfg.LogsPath,
+		service.WithPrerequisitePolicy(policy),
+		service.WithHoldout(holdout.New(app.cfg.HoldoutPercent, app.cfg.HoldoutSalt, app.cfg.HoldoutUsers)),
+		service.WithMetrics(m),
+		service.WithLogger(app.logger),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create a service: %w", err)
 	}
 
-	app.endp = endpoint.New(app.svc)
-
-	app.echo = echo.New()
-	app.echo.Validator = validator.New()
+	// the scheduler is unhealthy after missing a few runs in a row
+	app.health = health.New()
+	app.health.Add("database", pg.Ping)
+	app.health.Add("schema", pg.CheckSchema)
+	app.health.Add("logs", health.WritableDir(app.cfg.LogsPath))
+	app.health.Add("scheduler", health.Heartbeat(app.svc.SchedulerHeartbeat, 3*app.cfg.SchedulerInterval))
+
+	app.idempotency = pg
+	app.webhooks = webhook.New(pg,
+		webhook.WithHTTPClient(&http.Client{Timeout: app.cfg.WebhookTimeout}),
+		webhook.WithMaxAttempts(app.cfg.WebhookMaxAttempts),
+		webhook.WithLogger(app.logger),
+		webhook.WithMetrics(m),
+	)
+	app.events = events.NewBroker()
+
+	app.echo, err = NewServer(app.cfg, app.svc, app.idempotency,
+		WithLogger(app.logger),
+		WithMetrics(m),
+		WithHealth(app.health),
+		WithEvents(app.events),
+	)
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO: Declare endpoint handlers here
-	app.echo.POST("/create", app.endp.HandleCreate)
-	app.echo.POST("/delete", app.endp.HandleDelete)
-	app.echo.POST("/experiments", app.endp.HandleExperiments)
-	app.echo.POST("/list", app.endp.HandleUserExperimentList)
-	app.echo.POST("/log/create", app.endp.HandleCreateLog)
+	// the authenticator is stateless, so the grpc server gets its own
+	authn, err := newAuthenticator(app.cfg, app.svc)
+	if err != nil {
+		return nil, err
+	}
+	app.grpc = grpcserver.New(app.svc, authn, grpcserver.WithLogger(app.logger))
 
 	return app, nil
 }
 
 func (a App) Run() {
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	defer stopScheduler()
+
+	go a.svc.RunScheduler(schedulerCtx, a.cfg.SchedulerInterval)
+	go idempotency.RunCleanup(schedulerCtx, a.idempotency, a.cfg.SchedulerInterval)
+	go a.webhooks.Run(schedulerCtx, a.cfg.WebhookPollInterval)
 	go func() {
+		if err := postgresql.Listen(schedulerCtx, a.cfg.DatabaseDSN, a.events.Notify); err != nil {
+			a.logger.Error("couldn't listen for events, streams fall back to polling", "error", err)
+		}
+	}()
+
+	go func() {
+		a.logger.Info("server started", "address", ":8080")
 		if err := a.echo.Start(":8080"); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			a.echo.Logger.Fatal(err)
+			a.logger.Error("server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	go func() {
+		lis, err := net.Listen("tcp", a.cfg.GRPCAddress)
+		if err != nil {
+			a.logger.Error("couldn't listen for grpc", "error", err)
+			os.Exit(1)
+		}
+
+		a.logger.Info("grpc server started", "address", a.cfg.GRPCAddress)
+		if err := a.grpc.Serve(lis); err != nil {
+			a.logger.Error("grpc server failed", "error", err)
+			os.Exit(1)
 		}
 	}()
 
@@ -73,12 +193,23 @@ func (a App) Run() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
+	a.health.Shutdown()
+	stopScheduler()
+	// streams would hold the server open until the shutdown timeout
+	a.events.Close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second) //nolint:gomnd
 	defer cancel()
 
+	a.grpc.Stop(ctx)
+
 	err := a.echo.Shutdown(ctx)
 	if err != nil {
-		a.echo.Logger.Fatal(err)
+		a.logger.Error("couldn't shut down server", "error", err)
+		os.Exit(1)
+	}
+
+	if err := a.shutdownTracing(ctx); err != nil {
+		a.logger.Error("couldn't flush traces", "error", err)
 	}
 }
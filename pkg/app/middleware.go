@@ -0,0 +1,211 @@
+package app
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/auth"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/logging"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/metrics"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/namespace"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/ratelimit"
+)
+
+// requestIDMiddleware takes the request ID from X-Request-ID or generates a new one,
+// returns it in the response and stores it in the request context for logging.
+func requestIDMiddleware() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(ctx echo.Context, id string) {
+			req := ctx.Request()
+			ctx.SetRequest(req.WithContext(logging.WithRequestID(req.Context(), id)))
+		},
+	})
+}
+
+// requireRole authenticates the request and rejects it unless the client's role
+// grants the permissions of role. It also binds the request to its namespace, see
+// requestNamespace.
+func requireRole(authn *auth.Authenticator, role auth.Role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			req := ctx.Request()
+
+			principal, err := authn.Authenticate(req)
+			if err != nil {
+				if errors.Is(err, auth.ErrMissingCredentials) || errors.Is(err, auth.ErrInvalidCredentials) {
+					ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="segments"`)
+					return echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized")
+				}
+
+				slog.ErrorContext(req.Context(), "couldn't authenticate request", "error", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Internal error")
+			}
+
+			if !principal.Role.Allows(role) {
+				return echo.NewHTTPError(http.StatusForbidden, "Forbidden")
+			}
+
+			ns := requestNamespace(req, principal)
+			if !namespace.Valid(ns) {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid namespace")
+			}
+			if !principal.CanAccess(ns) {
+				return echo.NewHTTPError(http.StatusForbidden, "Forbidden")
+			}
+
+			reqCtx := auth.WithPrincipal(req.Context(), principal)
+			ctx.SetRequest(req.WithContext(namespace.With(reqCtx, ns)))
+
+			return next(ctx)
+		}
+	}
+}
+
+// requestNamespace takes the namespace from the X-Namespace header or the namespace
+// query parameter. Without them, requests work in the namespace the credentials
+// are bound to or in the default one.
+func requestNamespace(req *http.Request, principal *auth.Principal) string {
+	if ns := req.Header.Get("X-Namespace"); ns != "" {
+		return ns
+	}
+
+	if ns := req.URL.Query().Get("namespace"); ns != "" {
+		return ns
+	}
+
+	if principal.Namespace != "" {
+		return principal.Namespace
+	}
+
+	return namespace.Default
+}
+
+// rateLimitMiddleware limits requests of every client to limit, counting routes of
+// the same class together. key tells clients apart.
+func rateLimitMiddleware(backend ratelimit.Backend, class string, limit ratelimit.Limit, key func(echo.Context) string, m *metrics.Metrics) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !limit.Enabled() {
+			return next
+		}
+
+		return func(ctx echo.Context) error {
+			req := ctx.Request()
+
+			res, err := backend.Take(req.Context(), class+":"+key(ctx), limit)
+			if err != nil {
+				// a limiter outage shouldn't take the API down with it
+				slog.WarnContext(req.Context(), "couldn't check rate limit", "error", err)
+				return next(ctx)
+			}
+
+			header := ctx.Response().Header()
+			header.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			header.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+
+			if !res.Allowed {
+				m.RateLimited(class)
+				header.Set(echo.HeaderRetryAfter, strconv.Itoa(ceilSeconds(res.RetryAfter)))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "Too many requests")
+			}
+
+			return next(ctx)
+		}
+	}
+}
+
+// authenticated runs limit before authn, so floods of invalid credentials are
+// throttled before they reach the key store.
+func authenticated(limit, authn echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return limit(authn(next))
+	}
+}
+
+// principalKey identifies the authenticated client by its credentials.
+func principalKey(ctx echo.Context) string {
+	reqCtx := ctx.Request().Context()
+	if principal := auth.FromContext(reqCtx); principal != nil {
+		return namespace.FromContext(reqCtx) + "/" + principal.Subject
+	}
+
+	return ipKey(ctx)
+}
+
+func ipKey(ctx echo.Context) string {
+	return "ip/" + ctx.RealIP()
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// accessLogMiddleware logs every request with its status and latency.
+func accessLogMiddleware(logger *slog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			start := time.Now()
+			err := next(ctx)
+
+			attrs := []any{
+				"method", ctx.Request().Method,
+				"path", ctx.Request().URL.Path,
+				"status", responseStatus(ctx, err),
+				"duration", time.Since(start),
+				"remote_ip", ctx.RealIP(),
+			}
+			if principal := auth.FromContext(ctx.Request().Context()); principal != nil {
+				attrs = append(attrs, "subject", principal.Subject,
+					"namespace", namespace.FromContext(ctx.Request().Context()))
+			}
+
+			logger.InfoContext(ctx.Request().Context(), "request", attrs...)
+
+			return err
+		}
+	}
+}
+
+// metricsMiddleware counts requests and observes their latency by route template,
+// so path parameters don't multiply label values.
+func metricsMiddleware(m *metrics.Metrics) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			start := time.Now()
+			err := next(ctx)
+
+			route := ctx.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+
+			m.ObserveRequest(ctx.Request().Method, route, responseStatus(ctx, err), time.Since(start))
+
+			return err
+		}
+	}
+}
+
+// responseStatus returns the status the client receives once echo handles err.
+func responseStatus(ctx echo.Context, err error) int {
+	if err == nil {
+		return ctx.Response().Status
+	}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+
+	if ctx.Response().Committed {
+		return ctx.Response().Status
+	}
+
+	return http.StatusInternalServerError
+}
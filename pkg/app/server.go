@@ -0,0 +1,201 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/auth"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/endpoint"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/events"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/health"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/idempotency"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/metrics"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/ratelimit"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/validator"
+	"github.com/psxzz/backend-trainee-assignment/internal/config"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+)
+
+type server struct {
+	logger  *slog.Logger
+	metrics *metrics.Metrics
+	health  *health.Health
+	events  *events.Broker
+}
+
+type ServerOption func(*server)
+
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(s *server) {
+		s.logger = logger
+	}
+}
+
+func WithMetrics(m *metrics.Metrics) ServerOption {
+	return func(s *server) {
+		s.metrics = m
+	}
+}
+
+// WithHealth serves the checks of h on /readyz. Without it the server is always ready.
+func WithHealth(h *health.Health) ServerOption {
+	return func(s *server) {
+		s.health = h
+	}
+}
+
+func WithEvents(b *events.Broker) ServerOption {
+	return func(s *server) {
+		s.events = b
+	}
+}
+
+// NewServer builds the HTTP API over svc. App serves it on PostgreSQL; contract tests
+// of the SDKs serve it on the memory storage.
+func NewServer(cfg *config.Config, svc *service.Service, idem idempotency.Store, opts ...ServerOption) (*echo.Echo, error) {
+	s := &server{logger: slog.Default()}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.metrics == nil {
+		s.metrics = metrics.New()
+	}
+	if s.health == nil {
+		s.health = health.New()
+	}
+	if s.events == nil {
+		s.events = events.NewBroker()
+	}
+
+	authn, err := newAuthenticator(cfg, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	endp := endpoint.New(svc, endpoint.WithLogger(s.logger), endpoint.WithEvents(s.events))
+	m := s.metrics
+
+	ipExtractor, err := newIPExtractor(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	e := echo.New()
+	e.IPExtractor = ipExtractor
+	e.Validator = validator.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Use(requestIDMiddleware())
+	e.Use(otelecho.Middleware(cfg.ServiceName))
+	e.Use(accessLogMiddleware(s.logger))
+	e.Use(metricsMiddleware(m))
+
+	limiter := ratelimit.NewMemory()
+	var (
+		// requests are counted by IP before authentication and by client after it
+		ip = rateLimitMiddleware(limiter, "ip", ratelimit.Limit{
+			Rate: cfg.RateLimitIPRPS, Burst: cfg.RateLimitIPBurst}, ipKey, m)
+
+		reader  = authenticated(ip, requireRole(authn, auth.RoleReader))
+		analyst = authenticated(ip, requireRole(authn, auth.RoleAnalyst))
+		admin   = authenticated(ip, requireRole(authn, auth.RoleAdmin))
+
+		// reads and writes have separate buckets, so a bulk reader can't use up writes
+		read = rateLimitMiddleware(limiter, "read", ratelimit.Limit{
+			Rate: cfg.RateLimitReadRPS, Burst: cfg.RateLimitReadBurst}, principalKey, m)
+		write = rateLimitMiddleware(limiter, "write", ratelimit.Limit{
+			Rate: cfg.RateLimitWriteRPS, Burst: cfg.RateLimitWriteBurst}, principalKey, m)
+
+		idempotent = idempotency.Middleware(idem, cfg.IdempotencyTTL)
+	)
+
+	// TODO: Declare endpoint handlers here
+	e.POST("/create", endp.HandleCreate, admin, write, idempotent)
+	e.POST("/delete", endp.HandleDelete, admin, write, idempotent)
+	e.POST("/segment/info", endp.HandleSegmentInfo, reader, read)
+	e.POST("/experiments", endp.HandleExperiments, analyst, write, idempotent)
+	e.POST("/list", endp.HandleUserExperimentList, reader, read)
+	e.POST("/list/batch", endp.HandleUsersExperimentList, reader, read)
+	e.POST("/holdout", endp.HandleHoldout, reader, read)
+	e.POST("/log/create", endp.HandleCreateLog, analyst, write, idempotent)
+	e.POST("/attributes/set", endp.HandleSetAttributes, analyst, write, idempotent)
+	e.POST("/attributes/get", endp.HandleGetAttributes, reader, read)
+	e.POST("/overrides/set", endp.HandleSetOverride, analyst, write, idempotent)
+	e.POST("/overrides/delete", endp.HandleDeleteOverride, analyst, write, idempotent)
+	e.POST("/overrides/list", endp.HandleListOverrides, reader, read)
+	// replaying a created key would mean storing it in plain text
+	e.POST("/keys/create", endp.HandleCreateAPIKey, admin, write)
+	e.POST("/keys/revoke", endp.HandleRevokeAPIKey, admin, write, idempotent)
+	e.POST("/keys/list", endp.HandleListAPIKeys, admin, read)
+	e.POST("/namespaces/list", endp.HandleListNamespaces, reader, read)
+	e.GET("/events", endp.HandleEvents, reader, read)
+	// the secret of a created webhook isn't stored for replays either
+	e.POST("/webhooks/create", endp.HandleCreateWebhook, admin, write)
+	e.POST("/webhooks/delete", endp.HandleDeleteWebhook, admin, write, idempotent)
+	e.POST("/webhooks/list", endp.HandleListWebhooks, admin, read)
+	e.POST("/webhooks/deliveries", endp.HandleListWebhookDeliveries, admin, read)
+	e.POST("/webhooks/replay", endp.HandleReplayWebhookDelivery, admin, write, idempotent)
+
+	v2 := e.Group("/v2")
+	v2.POST("/segments", endp.HandleCreateSegmentV2, admin, write, idempotent)
+	v2.GET("/segments/:name", endp.HandleSegmentV2, reader, read)
+	v2.PUT("/segments/:name", endp.HandleUpdateSegmentV2, admin, write, idempotent)
+	v2.DELETE("/segments/:name", endp.HandleDeleteSegmentV2, admin, write, idempotent)
+	v2.GET("/users/:id/segments", endp.HandleUserSegmentsV2, reader, read)
+	v2.PATCH("/users/:id/segments", endp.HandleUpdateUserSegmentsV2, analyst, write, idempotent)
+	v2.GET("/snapshot", endp.HandleSnapshot, reader, read)
+	v2.POST("/snapshot/users", endp.HandleUsersSnapshot, reader, read)
+
+	e.GET("/metrics", echo.WrapHandler(m.Handler()), reader)
+
+	// probes stay open to orchestrators
+	e.GET("/healthz", echo.WrapHandler(s.health.LiveHandler()))
+	e.GET("/readyz", echo.WrapHandler(s.health.ReadyHandler()))
+
+	return e, nil
+}
+
+// newAuthenticator accepts the bootstrap key, stored API keys and, if public keys
+// are configured, JWTs.
+func newAuthenticator(cfg *config.Config, keys auth.KeyStore) (*auth.Authenticator, error) {
+	if key := cfg.AuthBootstrapKey; key != "" && !strings.HasPrefix(key, auth.KeyPrefix) {
+		return nil, fmt.Errorf("bootstrap key must start with %q", auth.KeyPrefix)
+	}
+
+	opts := []auth.Option{auth.WithBootstrapKey(cfg.AuthBootstrapKey)}
+	if len(cfg.JWTPublicKeys) > 0 {
+		publicKeys, err := auth.LoadPublicKeys(cfg.JWTPublicKeys)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load jwt public keys: %w", err)
+		}
+		opts = append(opts, auth.WithJWT(publicKeys, cfg.JWTIssuer, cfg.JWTAudience))
+	}
+
+	return auth.New(keys, opts...), nil
+}
+
+// newIPExtractor trusts X-Forwarded-For only from the proxies, so clients can't pick
+// their own IP and with it a fresh rate limit bucket.
+func newIPExtractor(proxies []string) (echo.IPExtractor, error) {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range proxies {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(proxy))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
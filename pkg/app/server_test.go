@@ -0,0 +1,125 @@
+package app_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/memory"
+	"github.com/psxzz/backend-trainee-assignment/internal/config"
+	"github.com/psxzz/backend-trainee-assignment/pkg/app"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStorage counts key lookups, i.e. the requests that reached the store.
+type countingStorage struct {
+	*memory.Storage
+	lookups atomic.Int64
+}
+
+func (s *countingStorage) APIKeyByHash(ctx context.Context, hash string) (*storage.APIKeyDTO, error) {
+	s.lookups.Add(1)
+	return s.Storage.APIKeyByHash(ctx, hash)
+}
+
+func TestUnauthenticatedFloodIsLimited(t *testing.T) {
+	db := &countingStorage{Storage: memory.New()}
+	cfg := &config.Config{
+		AuthBootstrapKey: "sk_bootstrap",
+		IdempotencyTTL:   time.Hour,
+		RateLimitIPRPS:   0.001,
+		RateLimitIPBurst: 3,
+	}
+
+	e, err := app.NewServer(cfg, service.New(db, t.TempDir()), db,
+		app.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	require.NoError(t, err)
+
+	statuses := make([]int, 0, 5)
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/list", nil)
+		req.Header.Set("X-API-Key", "sk_invalid")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		statuses = append(statuses, rec.Code)
+	}
+
+	assert.Equal(t, []int{
+		http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized,
+		http.StatusTooManyRequests, http.StatusTooManyRequests,
+	}, statuses)
+	assert.EqualValues(t, 3, db.lookups.Load())
+}
+
+func TestForwardedForIsTrustedOnlyFromProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		want    []int
+	}{
+		{
+			name: "direct",
+			want: []int{
+				http.StatusUnauthorized, http.StatusUnauthorized,
+				http.StatusTooManyRequests, http.StatusTooManyRequests,
+			},
+		},
+		{
+			// httptest requests come from 192.0.2.1
+			name:    "trusted proxy",
+			proxies: []string{"192.0.2.0/24"},
+			want: []int{
+				http.StatusUnauthorized, http.StatusUnauthorized,
+				http.StatusUnauthorized, http.StatusUnauthorized,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := memory.New()
+			cfg := &config.Config{
+				AuthBootstrapKey: "sk_bootstrap",
+				IdempotencyTTL:   time.Hour,
+				RateLimitIPRPS:   0.001,
+				RateLimitIPBurst: 2,
+				TrustedProxies:   tt.proxies,
+			}
+
+			e, err := app.NewServer(cfg, service.New(db, t.TempDir()), db,
+				app.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+			require.NoError(t, err)
+
+			statuses := make([]int, 0, len(tt.want))
+			for i := range tt.want {
+				req := httptest.NewRequest(http.MethodPost, "/list", nil)
+				req.Header.Set("X-API-Key", "sk_invalid")
+				req.Header.Set(echo.HeaderXForwardedFor, fmt.Sprintf("203.0.113.%d", i+1))
+				req.Header.Set(echo.HeaderXRealIP, fmt.Sprintf("198.51.100.%d", i+1))
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				statuses = append(statuses, rec.Code)
+			}
+
+			assert.Equal(t, tt.want, statuses)
+		})
+	}
+}
+
+func TestInvalidTrustedProxy(t *testing.T) {
+	db := memory.New()
+	cfg := &config.Config{IdempotencyTTL: time.Hour, TrustedProxies: []string{"10.0.0.1"}}
+
+	_, err := app.NewServer(cfg, service.New(db, t.TempDir()), db)
+	assert.Error(t, err)
+}
@@ -0,0 +1,307 @@
+// Package client is the Go SDK of the segments HTTP API. Methods map one to one to
+// the API operations, errors unwrap to the sentinel errors of the service, and
+// failed calls are retried: reads always, changes with an Idempotency-Key that stays
+// the same across the retries of a call, so a change is applied at most once.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+)
+
+// Types of the API. They are the models of the server itself, so requests and
+// responses can't drift apart.
+type (
+	Segment             = api.Segment
+	SegmentSettings     = api.SegmentSettings
+	UserExperiment      = api.UserExperiment
+	UserExperimentList  = api.UserExperimentList
+	UserExperimentItem  = api.UserExperimentItem
+	RejectedExperiment  = api.RejectedExperiment
+	LogInfo             = api.LogInfo
+	UserAttributes      = api.UserAttributes
+	HoldoutStatus       = api.HoldoutStatus
+	Override            = api.Override
+	UserOverrideList    = api.UserOverrideList
+	APIKey              = api.APIKey
+	APIKeyList          = api.APIKeyList
+	Webhook             = api.Webhook
+	WebhookList         = api.WebhookList
+	WebhookDelivery     = api.WebhookDelivery
+	WebhookDeliveryList = api.WebhookDeliveryList
+	Event               = api.Event
+	EventData           = api.EventData
+	NamespaceList       = api.NamespaceList
+	Snapshot            = api.Snapshot
+	HoldoutSettings     = api.HoldoutSettings
+	UserSnapshot        = api.UserSnapshot
+	UserSnapshotList    = api.UserSnapshotList
+)
+
+const (
+	headerAPIKey         = "X-API-Key"
+	headerNamespace      = "X-Namespace"
+	headerIdempotencyKey = "Idempotency-Key"
+
+	defaultTimeout    = 30 * time.Second
+	defaultMaxRetries = 3
+	defaultBackoff    = 100 * time.Millisecond
+	maxBackoff        = 5 * time.Second
+)
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	header     http.Header
+	maxRetries int
+	backoff    time.Duration
+}
+
+type Option func(*Client)
+
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = client
+	}
+}
+
+// WithAPIKey authenticates requests with an API key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.header.Set(headerAPIKey, key)
+	}
+}
+
+// WithBearerToken authenticates requests with a JWT or an API key in the
+// Authorization header.
+func WithBearerToken(token string) Option {
+	return func(c *Client) {
+		c.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// WithNamespace makes requests work in the namespace instead of the one the
+// credentials are bound to.
+func WithNamespace(namespace string) Option {
+	return func(c *Client) {
+		c.header.Set(headerNamespace, namespace)
+	}
+}
+
+// WithRetries sets how many times a failed call is retried and the delay before the
+// first retry, which doubles with every attempt. Zero retries disables them.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+// New returns a client of the API at baseURL, e.g. "http://localhost:8080".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		header:     make(http.Header),
+		maxRetries: defaultMaxRetries,
+		backoff:    defaultBackoff,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey makes the change called with ctx use key instead of a generated
+// one, so it can be retried safely by the caller too, e.g. after a restart.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// request describes a call. Reads are retried on any failure; changes only if they
+// are idempotent, since otherwise a failure may hide a change that was applied.
+// A call with etag is conditional: a non-empty ETag is sent in If-None-Match and
+// replaced with the ETag of the response.
+type request struct {
+	method     string
+	path       string
+	body       any
+	header     http.Header
+	write      bool
+	idempotent bool
+	etag       *string
+}
+
+func (c *Client) do(ctx context.Context, r request, out any) error {
+	var body []byte
+	if r.body != nil {
+		var err error
+		if body, err = json.Marshal(r.body); err != nil {
+			return err
+		}
+	}
+
+	header := c.mergeHeader(r.header)
+	if r.body != nil {
+		header.Set("Content-Type", "application/json")
+	}
+
+	if r.write && r.idempotent {
+		key, _ := ctx.Value(idempotencyKey{}).(string)
+		if key == "" {
+			var err error
+			if key, err = newIdempotencyKey(); err != nil {
+				return err
+			}
+		}
+		header.Set(headerIdempotencyKey, key)
+	}
+
+	if r.etag != nil && *r.etag != "" {
+		header.Set("If-None-Match", *r.etag)
+	}
+
+	retrySafe := !r.write || r.idempotent
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, r, header, body)
+		if err != nil {
+			if ctx.Err() != nil || !retrySafe || attempt >= c.maxRetries {
+				return err
+			}
+			if err := c.wait(ctx, attempt, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if resp.StatusCode < http.StatusBadRequest {
+			defer resp.Body.Close()
+			if r.etag != nil {
+				*r.etag = resp.Header.Get("ETag")
+			}
+			if resp.StatusCode == http.StatusNotModified {
+				return ErrNotModified
+			}
+			if out == nil {
+				return nil
+			}
+			return json.NewDecoder(resp.Body).Decode(out)
+		}
+
+		apiErr := readError(resp)
+		if !retryable(apiErr, retrySafe) || attempt >= c.maxRetries {
+			return apiErr
+		}
+		if err := c.wait(ctx, attempt, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// mergeHeader returns the headers of the client overridden by header.
+func (c *Client) mergeHeader(header http.Header) http.Header {
+	merged := c.header.Clone()
+	for name, values := range header {
+		merged[name] = values
+	}
+
+	return merged
+}
+
+func (c *Client) send(ctx context.Context, r request, header http.Header, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.method, c.baseURL+r.path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+
+	return c.httpClient.Do(req)
+}
+
+// retryable reports whether the request may succeed if sent again. Rate limited
+// requests never reached the handler, so they're retried even if unsafe.
+func retryable(err *Error, retrySafe bool) bool {
+	switch {
+	case err.StatusCode == http.StatusTooManyRequests:
+		return true
+	case err.StatusCode >= http.StatusInternalServerError:
+		return retrySafe
+	case errors.Is(err, ErrIdempotencyConflict):
+		// the first request with the key is still running
+		return strings.Contains(err.Message, "in progress")
+	}
+
+	return false
+}
+
+// wait sleeps before the retry after attempt, or as long as the Retry-After header
+// of resp asks.
+func (c *Client) wait(ctx context.Context, attempt int, resp *http.Response) error {
+	delay := c.backoff << attempt
+	if delay > maxBackoff || delay < 0 {
+		delay = maxBackoff
+	}
+
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			delay = time.Duration(seconds) * time.Second
+		}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+
+	var body struct {
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20)) //nolint:gomnd
+	if err := json.Unmarshal(data, &body); err != nil || body.Message == "" {
+		body.Message = strings.TrimSpace(string(data))
+	}
+	if body.Message == "" {
+		body.Message = http.StatusText(resp.StatusCode)
+	}
+
+	return newError(resp.StatusCode, body.Message)
+}
+
+func newIdempotencyKey() (string, error) {
+	buf := make([]byte, 16) //nolint:gomnd
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
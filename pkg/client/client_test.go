@@ -0,0 +1,418 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/events"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/memory"
+	"github.com/psxzz/backend-trainee-assignment/internal/config"
+	"github.com/psxzz/backend-trainee-assignment/pkg/app"
+	"github.com/psxzz/backend-trainee-assignment/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const adminKey = "sk_contract"
+
+// newServer serves the HTTP API on the memory storage. Wrap, if set, sits between
+// the client and the API.
+func newServer(t *testing.T, wrap func(http.Handler) http.Handler) *httptest.Server {
+	t.Helper()
+
+	var (
+		db     = memory.New()
+		svc    = service.New(db, t.TempDir())
+		broker = events.NewBroker()
+		cfg    = &config.Config{AuthBootstrapKey: adminKey, IdempotencyTTL: time.Hour}
+	)
+	db.OnEvent(broker.Notify)
+
+	e, err := app.NewServer(cfg, svc, db,
+		app.WithEvents(broker),
+		app.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	require.NoError(t, err)
+
+	var handler http.Handler = e
+	if wrap != nil {
+		handler = wrap(e)
+	}
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		broker.Close()
+		srv.Close()
+	})
+
+	return srv
+}
+
+func newClient(srv *httptest.Server, opts ...client.Option) *client.Client {
+	opts = append([]client.Option{client.WithAPIKey(adminKey), client.WithRetries(2, time.Millisecond)}, opts...)
+	return client.New(srv.URL, opts...)
+}
+
+func TestSegments(t *testing.T) {
+	var (
+		ctx = context.Background()
+		c   = newClient(newServer(t, nil))
+	)
+
+	segment, err := c.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", client.SegmentSettings{Group: "voice"})
+	require.NoError(t, err)
+	assert.Equal(t, "AVITO_VOICE_MESSAGES", segment.Name)
+	assert.Equal(t, "voice", segment.Group)
+
+	_, err = c.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", client.SegmentSettings{})
+	assert.ErrorIs(t, err, client.ErrSegmentExists)
+
+	_, err = c.CreateSegment(ctx, "", client.SegmentSettings{})
+	assert.ErrorIs(t, err, client.ErrValidation)
+
+	_, err = c.CreateSegment(ctx, "AVITO_BROKEN", client.SegmentSettings{Rule: "city =="})
+	assert.ErrorIs(t, err, client.ErrRuleSyntax)
+
+	info, err := c.SegmentInfo(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+	assert.Equal(t, segment.ID, info.ID)
+
+	_, err = c.DeleteSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+
+	_, err = c.SegmentInfo(ctx, "AVITO_VOICE_MESSAGES")
+	assert.ErrorIs(t, err, client.ErrSegmentNotFound)
+
+	var apiErr *client.Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+}
+
+func TestMemberships(t *testing.T) {
+	var (
+		ctx = context.Background()
+		c   = newClient(newServer(t, nil))
+	)
+
+	for _, name := range []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"} {
+		_, err := c.CreateSegment(ctx, name, client.SegmentSettings{})
+		require.NoError(t, err)
+	}
+
+	update, err := c.UpdateUserSegments(ctx, 1000, []*client.UserExperimentItem{
+		{Name: "AVITO_VOICE_MESSAGES"}, {Name: "AVITO_DISCOUNT_30"},
+	}, nil)
+	require.NoError(t, err)
+	assert.Len(t, update.Added, 2)
+
+	update, err = c.UpdateUserSegments(ctx, 1000, nil, []string{"AVITO_DISCOUNT_30"})
+	require.NoError(t, err)
+	assert.Len(t, update.Removed, 1)
+
+	list, err := c.UserSegments(ctx, 1000)
+	require.NoError(t, err)
+	require.Len(t, list.Segments, 1)
+	assert.Equal(t, "AVITO_VOICE_MESSAGES", list.Segments[0].Name)
+
+	users, err := c.UsersSegments(ctx, []int64{1000, 1001})
+	require.NoError(t, err)
+	assert.Len(t, users[1000], 1)
+	assert.Empty(t, users[1001])
+
+	holdout, err := c.Holdout(ctx, 1000)
+	require.NoError(t, err)
+	assert.False(t, holdout.InHoldout)
+
+	report, err := c.CreateReport(ctx, 1000, time.Now().Format("2006-01"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, report.Path)
+
+	_, err = c.UserSegments(ctx, 0)
+	assert.ErrorIs(t, err, client.ErrValidation)
+}
+
+func TestMembershipsWithTTL(t *testing.T) {
+	var (
+		ctx = context.Background()
+		c   = newClient(newServer(t, nil))
+		msk = time.FixedZone("MSK", 3*60*60)
+	)
+
+	for _, name := range []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"} {
+		_, err := c.CreateSegment(ctx, name, client.SegmentSettings{})
+		require.NoError(t, err)
+	}
+
+	update, err := c.UpdateUserSegments(ctx, 1000, []*client.UserExperimentItem{
+		{Name: "AVITO_VOICE_MESSAGES", ExpiresAt: time.Now().Add(time.Hour).In(msk).Format(time.DateTime)},
+		{Name: "AVITO_DISCOUNT_30", ExpiresAt: time.Now().Add(-time.Minute).In(msk).Format(time.DateTime)},
+	}, nil)
+	require.NoError(t, err)
+	assert.Len(t, update.Added, 2)
+
+	list, err := c.UserSegments(ctx, 1000)
+	require.NoError(t, err)
+	require.Len(t, list.Segments, 1)
+	assert.Equal(t, "AVITO_VOICE_MESSAGES", list.Segments[0].Name)
+
+	users, err := c.UsersSegments(ctx, []int64{1000})
+	require.NoError(t, err)
+	assert.Len(t, users[1000], 1)
+}
+
+func TestAttributesAndOverrides(t *testing.T) {
+	var (
+		ctx = context.Background()
+		c   = newClient(newServer(t, nil))
+	)
+
+	_, err := c.CreateSegment(ctx, "AVITO_MOSCOW", client.SegmentSettings{Rule: `city == "moscow"`})
+	require.NoError(t, err)
+
+	attributes, err := c.SetUserAttributes(ctx, 1000, map[string]string{"city": "moscow"})
+	require.NoError(t, err)
+	assert.Equal(t, "moscow", attributes.Attributes["city"])
+
+	attributes, err = c.UserAttributes(ctx, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"city": "moscow"}, attributes.Attributes)
+
+	// the actor comes from the credentials, not from the request
+	override, err := c.SetOverride(ctx, &client.Override{UserID: 1000, Segment: "AVITO_MOSCOW", Mode: "exclude", Actor: "qa"})
+	require.NoError(t, err)
+	assert.Equal(t, "exclude", override.Mode)
+	assert.Equal(t, "bootstrap", override.Actor)
+
+	_, err = c.SetOverride(ctx, &client.Override{UserID: 1000, Segment: "AVITO_MISSING", Mode: "include"})
+	assert.ErrorIs(t, err, client.ErrSegmentNotFound)
+
+	overrides, err := c.UserOverrides(ctx, 1000)
+	require.NoError(t, err)
+	assert.Len(t, overrides.Overrides, 1)
+
+	deleted, err := c.DeleteOverride(ctx, 1000, "AVITO_MOSCOW")
+	require.NoError(t, err)
+	assert.Equal(t, "bootstrap", deleted.Actor)
+
+	_, err = c.DeleteOverride(ctx, 1000, "AVITO_MOSCOW")
+	assert.ErrorIs(t, err, client.ErrOverrideNotFound)
+}
+
+func TestKeys(t *testing.T) {
+	var (
+		ctx = context.Background()
+		srv = newServer(t, nil)
+		c   = newClient(srv)
+	)
+
+	key, err := c.CreateAPIKey(ctx, "recommendations", "reader")
+	require.NoError(t, err)
+	assert.NotEmpty(t, key.Key)
+
+	_, err = c.CreateAPIKey(ctx, "recommendations", "owner")
+	assert.ErrorIs(t, err, client.ErrValidation)
+
+	reader := client.New(srv.URL, client.WithBearerToken(key.Key))
+
+	_, err = reader.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", client.SegmentSettings{})
+	assert.ErrorIs(t, err, client.ErrForbidden)
+
+	namespaces, err := reader.Namespaces(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default"}, namespaces.Namespaces)
+
+	_, err = client.New(srv.URL, client.WithBearerToken(key.Key), client.WithNamespace("team-a")).UserSegments(ctx, 1000)
+	assert.ErrorIs(t, err, client.ErrForbidden)
+
+	keys, err := c.APIKeys(ctx)
+	require.NoError(t, err)
+	assert.Len(t, keys.Keys, 1)
+
+	_, err = c.RevokeAPIKey(ctx, key.ID)
+	require.NoError(t, err)
+
+	_, err = c.RevokeAPIKey(ctx, key.ID)
+	assert.ErrorIs(t, err, client.ErrAPIKeyNotFound)
+
+	_, err = reader.UserSegments(ctx, 1000)
+	assert.ErrorIs(t, err, client.ErrUnauthorized)
+}
+
+func TestWebhooks(t *testing.T) {
+	var (
+		ctx = context.Background()
+		c   = newClient(newServer(t, nil))
+	)
+
+	_, err := c.CreateWebhook(ctx, "ftp://example.com", nil, nil)
+	assert.ErrorIs(t, err, client.ErrInvalidWebhook)
+
+	webhook, err := c.CreateWebhook(ctx, "https://example.com/hooks", nil, []string{"membership.added"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, webhook.Secret)
+
+	list, err := c.Webhooks(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list.Webhooks, 1)
+
+	deliveries, err := c.WebhookDeliveries(ctx, "", 10)
+	require.NoError(t, err)
+	assert.Empty(t, deliveries.Deliveries)
+
+	_, err = c.ReplayWebhookDelivery(ctx, 42)
+	assert.ErrorIs(t, err, client.ErrDeliveryNotFound)
+
+	_, err = c.DeleteWebhook(ctx, webhook.ID)
+	require.NoError(t, err)
+
+	_, err = c.DeleteWebhook(ctx, webhook.ID)
+	assert.ErrorIs(t, err, client.ErrWebhookNotFound)
+}
+
+func TestVersions(t *testing.T) {
+	var (
+		ctx = context.Background()
+		c   = newClient(newServer(t, nil))
+	)
+
+	created, err := c.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", client.SegmentSettings{})
+	require.NoError(t, err)
+
+	updated, err := c.UpdateSegment(ctx, "AVITO_VOICE_MESSAGES", client.SegmentSettings{Group: "voice"}, created.Version)
+	require.NoError(t, err)
+	assert.Equal(t, created.Version+1, updated.Version)
+
+	_, err = c.UpdateSegment(ctx, "AVITO_VOICE_MESSAGES", client.SegmentSettings{}, created.Version)
+	assert.ErrorIs(t, err, client.ErrVersionMismatch)
+
+	segment, err := c.Segment(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+	assert.Equal(t, "voice", segment.Group)
+
+	list, err := c.UserSegmentsWithVersion(ctx, 1000)
+	require.NoError(t, err)
+
+	update, err := c.UpdateUserSegmentsWithVersion(ctx, 1000, list.Version,
+		[]*client.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}}, nil)
+	require.NoError(t, err)
+	assert.Greater(t, update.Version, list.Version)
+
+	_, err = c.UpdateUserSegmentsWithVersion(ctx, 1000, list.Version, nil, []string{"AVITO_VOICE_MESSAGES"})
+	assert.ErrorIs(t, err, client.ErrVersionMismatch)
+
+	_, err = c.DeleteSegmentWithVersion(ctx, "AVITO_VOICE_MESSAGES", client.AnyVersion)
+	require.NoError(t, err)
+}
+
+// failFirst answers the first request to path with 502. If apply is set, the request
+// reaches the API before, as if the response was lost on the way back.
+func failFirst(path string, apply bool, calls *atomic.Int32) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if calls.Add(1) > 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if apply {
+				next.ServeHTTP(httptest.NewRecorder(), r)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	t.Run("retries changes with the same idempotency key", func(t *testing.T) {
+		var (
+			ctx   = context.Background()
+			calls atomic.Int32
+			c     = newClient(newServer(t, failFirst("/experiments", true, &calls)))
+		)
+
+		_, err := c.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", client.SegmentSettings{})
+		require.NoError(t, err)
+
+		// the retry gets the response to the applied change instead of applying it again
+		update, err := c.UpdateUserSegments(ctx, 1000, []*client.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}}, nil)
+		require.NoError(t, err)
+		assert.Len(t, update.Added, 1)
+		assert.Equal(t, int32(2), calls.Load())
+
+		_, err = c.CreateSegment(ctx, "AVITO_DISCOUNT_30", client.SegmentSettings{})
+		require.NoError(t, err)
+
+		// the caller can retry with its own key too
+		keyCtx := client.WithIdempotencyKey(ctx, "add-1000-discount")
+		for i := 0; i < 2; i++ {
+			update, err = c.UpdateUserSegments(keyCtx, 1000, []*client.UserExperimentItem{{Name: "AVITO_DISCOUNT_30"}}, nil)
+			require.NoError(t, err)
+			assert.Len(t, update.Added, 1)
+		}
+	})
+
+	t.Run("doesn't retry changes that can't be replayed", func(t *testing.T) {
+		var (
+			calls atomic.Int32
+			c     = newClient(newServer(t, failFirst("/keys/create", false, &calls)))
+		)
+
+		_, err := c.CreateAPIKey(context.Background(), "recommendations", "reader")
+
+		var apiErr *client.Error
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusBadGateway, apiErr.StatusCode)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("retries reads", func(t *testing.T) {
+		var (
+			calls atomic.Int32
+			c     = newClient(newServer(t, failFirst("/list", false, &calls)))
+		)
+
+		_, err := c.UserSegments(context.Background(), 1000)
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+}
+
+func TestEvents(t *testing.T) {
+	var (
+		c           = newClient(newServer(t, nil))
+		errReceived = errors.New("received")
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", client.SegmentSettings{})
+	require.NoError(t, err)
+
+	var got *client.Event
+	err = c.Events(ctx, client.EventFilter{Types: []string{"segment.created"}}, "0", func(event *client.Event) error {
+		got = event
+		return errReceived
+	})
+	require.ErrorIs(t, err, errReceived)
+	assert.Equal(t, "segment.created", got.Type)
+	assert.Equal(t, "AVITO_VOICE_MESSAGES", got.Data.Segment)
+
+	err = c.Events(ctx, client.EventFilter{Types: []string{"segment.renamed"}}, "", func(*client.Event) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, client.ErrInvalidEventFilter)
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/psxzz/backend-trainee-assignment/pkg/api"
+)
+
+// Errors of the service. They are the sentinel errors of the server itself, so
+// errors.Is works the same on both sides of the API.
+var (
+	ErrSegmentExists       = api.ErrSegmentExists
+	ErrSegmentNotFound     = api.ErrSegmentNotFound
+	ErrOverrideNotFound    = api.ErrOverrideNotFound
+	ErrAPIKeyNotFound      = api.ErrAPIKeyNotFound
+	ErrVersionMismatch     = api.ErrVersionMismatch
+	ErrWebhookNotFound     = api.ErrWebhookNotFound
+	ErrDeliveryNotFound    = api.ErrDeliveryNotFound
+	ErrRuleSyntax          = api.ErrRuleSyntax
+	ErrInvalidWindow       = api.ErrInvalidWindow
+	ErrInvalidCapacity     = api.ErrInvalidCapacity
+	ErrInvalidOverride     = api.ErrInvalidOverride
+	ErrInvalidRole         = api.ErrInvalidRole
+	ErrInvalidPrerequisite = api.ErrInvalidPrerequisite
+	ErrInvalidWebhook      = api.ErrInvalidWebhook
+	ErrInvalidEventFilter  = api.ErrInvalidEventFilter
+)
+
+// Errors of the API that have no counterpart in the service.
+var (
+	ErrValidation           = errors.New("validation error")
+	ErrUnauthorized         = errors.New("unauthorized")
+	ErrForbidden            = errors.New("forbidden")
+	ErrRateLimited          = errors.New("rate limited")
+	ErrIdempotencyConflict  = errors.New("idempotency key conflict")
+	ErrPreconditionRequired = errors.New("precondition required")
+	// ErrNotModified is returned by conditional calls if the client has the
+	// current version already.
+	ErrNotModified = errors.New("not modified")
+)
+
+// messageErrors are told apart by the message of the response, which starts with
+// the text of the error.
+var messageErrors = []error{
+	ErrSegmentExists,
+	ErrSegmentNotFound,
+	ErrOverrideNotFound,
+	ErrAPIKeyNotFound,
+	ErrVersionMismatch,
+	ErrWebhookNotFound,
+	ErrDeliveryNotFound,
+	ErrRuleSyntax,
+	ErrInvalidWindow,
+	ErrInvalidCapacity,
+	ErrInvalidOverride,
+	ErrInvalidRole,
+	ErrInvalidPrerequisite,
+	ErrInvalidWebhook,
+	ErrInvalidEventFilter,
+}
+
+// Error is a response with an unsuccessful status. It unwraps to one of the errors
+// above if the response describes one.
+type Error struct {
+	StatusCode int
+	Message    string
+
+	err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("segments api: %d %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+func newError(status int, message string) *Error {
+	e := &Error{StatusCode: status, Message: message}
+
+	for _, err := range messageErrors {
+		if message == err.Error() || strings.HasPrefix(message, err.Error()+":") {
+			e.err = err
+			return e
+		}
+	}
+
+	switch {
+	case status == http.StatusMethodNotAllowed || strings.HasPrefix(message, "Validation error"):
+		e.err = ErrValidation
+	case status == http.StatusUnauthorized:
+		e.err = ErrUnauthorized
+	case status == http.StatusForbidden:
+		e.err = ErrForbidden
+	case status == http.StatusTooManyRequests:
+		e.err = ErrRateLimited
+	case status == http.StatusConflict:
+		e.err = ErrIdempotencyConflict
+	case status == http.StatusPreconditionRequired:
+		e.err = ErrPreconditionRequired
+	}
+
+	return e
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// EventFilter selects the events of a stream. Empty fields match everything.
+type EventFilter struct {
+	Segments []string
+	Types    []string
+	UserID   int64
+}
+
+// Events streams changes matching the filter to handle until ctx is canceled or
+// handle returns an error, which Events returns. The stream starts after the event
+// with lastEventID, or with the next change if it's empty; after a dropped
+// connection it resumes from the last handled event, so none are missed.
+func (c *Client) Events(ctx context.Context, filter EventFilter, lastEventID string, handle func(*Event) error) error {
+	query := make(url.Values)
+	if len(filter.Segments) > 0 {
+		query.Set("segment", strings.Join(filter.Segments, ","))
+	}
+	if len(filter.Types) > 0 {
+		query.Set("type", strings.Join(filter.Types, ","))
+	}
+	if filter.UserID != 0 {
+		query.Set("user_id", strconv.FormatInt(filter.UserID, 10))
+	}
+
+	path := "/events"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var handleErr error
+	for attempt := 0; ; {
+		header := make(http.Header)
+		if lastEventID != "" {
+			header.Set("Last-Event-ID", lastEventID)
+		}
+
+		resp, err := c.send(ctx, request{method: http.MethodGet, path: path}, c.mergeHeader(header), nil)
+		if err == nil && resp.StatusCode >= http.StatusBadRequest {
+			apiErr := readError(resp)
+			if !retryable(apiErr, true) {
+				return apiErr
+			}
+			err = apiErr
+		}
+
+		if err == nil {
+			received := false
+			err = readEvents(resp, func(id string, event *Event) error {
+				if handleErr = handle(event); handleErr != nil {
+					return handleErr
+				}
+				lastEventID = id
+				received = true
+				return nil
+			})
+			if handleErr != nil {
+				return handleErr
+			}
+			// a stream that worked for a while starts the backoff over
+			if received {
+				attempt = 0
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= c.maxRetries {
+			if err == nil {
+				err = errors.New("event stream closed")
+			}
+			return err
+		}
+		if err := c.wait(ctx, attempt, nil); err != nil {
+			return err
+		}
+		attempt++
+	}
+}
+
+// readEvents reads Server-Sent Events from resp until it's closed.
+func readEvents(resp *http.Response, handle func(id string, event *Event) error) error {
+	defer resp.Body.Close()
+
+	var id, data string
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			if data != "" {
+				var event Event
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					return err
+				}
+				if err := handle(id, &event); err != nil {
+					return err
+				}
+			}
+			id, data = "", ""
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "id":
+			id = value
+		case "data":
+			data += value
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,355 @@
+// Package local evaluates user segments in process, without a request per lookup.
+// An Evaluator downloads a snapshot of segment rules, overrides and the holdout in
+// the background, together with stored memberships and attributes of the users it
+// tracks, and evaluates segments with the same code as the service. Snapshots are
+// downloaded conditionally with their ETags, so only the parts that changed since
+// the last sync are transferred. Until the first sync, and whenever the snapshot is
+// older than the max age, lookups fall back to the API.
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/evaluation"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/holdout"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage"
+	"github.com/psxzz/backend-trainee-assignment/pkg/client"
+)
+
+const (
+	defaultInterval = 30 * time.Second
+	defaultMaxAge   = 5 * time.Minute
+
+	// chunkSize is the number of tracked users downloaded in one request, which is
+	// also the granularity of their ETags.
+	chunkSize = 1000
+)
+
+type Evaluator struct {
+	client    *client.Client
+	evaluator *evaluation.Evaluator
+	interval  time.Duration
+	maxAge    time.Duration
+	logger    *slog.Logger
+
+	// mu guards tracked and makes syncs run one at a time
+	mu      sync.Mutex
+	tracked map[int64]struct{}
+
+	state atomic.Pointer[state]
+}
+
+// state is a synced snapshot. A sync replaces it as a whole, so lookups never see
+// a partially applied one.
+type state struct {
+	syncedAt   time.Time
+	etag       string
+	candidates []storage.SegmentDTO
+	overrides  map[int64][]storage.OverrideDTO
+	holdout    *holdout.Holdout
+	chunks     []*chunk
+	users      map[int64]*user
+}
+
+// chunk is a batch of tracked users downloaded in one request.
+type chunk struct {
+	userIDs []int64
+	etag    string
+	users   map[int64]*user
+}
+
+type user struct {
+	segments   []storage.SegmentDTO
+	attributes map[string]string
+}
+
+type Option func(*Evaluator)
+
+// WithInterval sets how often Run syncs the snapshot.
+func WithInterval(interval time.Duration) Option {
+	return func(e *Evaluator) {
+		e.interval = interval
+	}
+}
+
+// WithMaxAge sets how old the snapshot may get before lookups fall back to the API.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(e *Evaluator) {
+		e.maxAge = maxAge
+	}
+}
+
+// WithUsers tracks the users from the start, see Track.
+func WithUsers(userIDs ...int64) Option {
+	return func(e *Evaluator) {
+		for _, userID := range userIDs {
+			e.tracked[userID] = struct{}{}
+		}
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(e *Evaluator) {
+		e.logger = logger
+	}
+}
+
+// New returns an evaluator that syncs snapshots with c. Nothing is downloaded until
+// Sync or Run is called.
+func New(c *client.Client, opts ...Option) *Evaluator {
+	e := &Evaluator{
+		client:   c,
+		interval: defaultInterval,
+		maxAge:   defaultMaxAge,
+		logger:   slog.Default(),
+		tracked:  make(map[int64]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	e.evaluator = evaluation.New(e.logger)
+
+	return e
+}
+
+// Track makes the next syncs download stored memberships and attributes of the
+// users. Segments users were added to explicitly are only known for tracked users,
+// other users get the ones of rules and overrides.
+func (e *Evaluator) Track(userIDs ...int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, userID := range userIDs {
+		e.tracked[userID] = struct{}{}
+	}
+}
+
+// Run syncs the snapshot every interval until ctx is done. A failed sync is logged
+// and retried on the next tick, lookups meanwhile use the last snapshot.
+func (e *Evaluator) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.Sync(ctx); err != nil && ctx.Err() == nil {
+			e.logger.ErrorContext(ctx, "couldn't sync segments snapshot", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync downloads the parts of the snapshot that changed since the last sync.
+func (e *Evaluator) Sync(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	next := &state{}
+	if prev := e.state.Load(); prev != nil {
+		*next = *prev
+	}
+
+	snapshot, etag, err := e.client.Snapshot(ctx, next.etag)
+	switch {
+	case errors.Is(err, client.ErrNotModified):
+	case err != nil:
+		return fmt.Errorf("local: sync snapshot: %w", err)
+	default:
+		if err := next.setSnapshot(snapshot); err != nil {
+			return fmt.Errorf("local: sync snapshot: %w", err)
+		}
+		next.etag = etag
+	}
+
+	if err := e.syncUsers(ctx, next); err != nil {
+		return fmt.Errorf("local: sync users: %w", err)
+	}
+
+	next.syncedAt = time.Now()
+	e.state.Store(next)
+
+	return nil
+}
+
+// syncUsers downloads the chunks of tracked users that changed. Chunks are formed
+// from the sorted user IDs, so they stay the same until users are tracked.
+func (e *Evaluator) syncUsers(ctx context.Context, next *state) error {
+	userIDs := make([]int64, 0, len(e.tracked))
+	for userID := range e.tracked {
+		userIDs = append(userIDs, userID)
+	}
+	slices.Sort(userIDs)
+
+	prev := make(map[int64]*chunk, len(next.chunks))
+	for _, c := range next.chunks {
+		prev[c.userIDs[0]] = c
+	}
+
+	next.chunks = make([]*chunk, 0, len(userIDs)/chunkSize+1)
+	next.users = make(map[int64]*user, len(userIDs))
+
+	for start := 0; start < len(userIDs); start += chunkSize {
+		ids := userIDs[start:min(start+chunkSize, len(userIDs))]
+
+		c := &chunk{userIDs: ids}
+		if old, ok := prev[ids[0]]; ok && slices.Equal(old.userIDs, ids) {
+			c.etag, c.users = old.etag, old.users
+		}
+
+		list, etag, err := e.client.UsersSnapshot(ctx, ids, c.etag)
+		switch {
+		case errors.Is(err, client.ErrNotModified):
+		case err != nil:
+			return err
+		default:
+			if c.users, err = usersFromSnapshot(list); err != nil {
+				return err
+			}
+			c.etag = etag
+		}
+
+		next.chunks = append(next.chunks, c)
+		maps.Copy(next.users, c.users)
+	}
+
+	return nil
+}
+
+// SyncedAt returns the time of the last successful sync, zero before the first one.
+func (e *Evaluator) SyncedAt() time.Time {
+	if st := e.state.Load(); st != nil {
+		return st.syncedAt
+	}
+
+	return time.Time{}
+}
+
+// UserSegments evaluates the user's segments. Attributes complement the stored
+// attributes of a tracked user and take precedence over them; they're ignored when
+// the lookup falls back to the API, which uses the stored ones only.
+func (e *Evaluator) UserSegments(ctx context.Context, userID int64, attributes map[string]string) (*client.UserExperimentList, error) {
+	now := time.Now()
+
+	st := e.state.Load()
+	if st == nil || now.Sub(st.syncedAt) > e.maxAge {
+		return e.client.UserSegments(ctx, userID)
+	}
+
+	var stored []storage.SegmentDTO
+	if u, ok := st.users[userID]; ok {
+		stored = u.segments
+		if len(u.attributes) > 0 {
+			attributes = mergeAttributes(u.attributes, attributes)
+		}
+	}
+
+	// holdout users keep only memberships that were forced explicitly
+	var candidates []storage.SegmentDTO
+	if !st.holdout.Contains(userID) {
+		candidates = evaluation.Active(st.candidates, now)
+	}
+
+	return &client.UserExperimentList{
+		UserID:   userID,
+		Segments: e.evaluator.Evaluate(ctx, stored, activeOverrides(st.overrides[userID], now), candidates, attributes, now),
+	}, nil
+}
+
+func (st *state) setSnapshot(snapshot *client.Snapshot) error {
+	segments := make(map[string]storage.SegmentDTO, len(snapshot.Segments))
+	st.candidates = nil
+
+	for i := range snapshot.Segments {
+		segment, err := evaluation.SegmentToDTO(&snapshot.Segments[i])
+		if err != nil {
+			return err
+		}
+
+		segments[segment.Name] = segment
+		if segment.Rule != "" {
+			st.candidates = append(st.candidates, segment)
+		}
+	}
+
+	st.overrides = make(map[int64][]storage.OverrideDTO)
+
+	for _, override := range snapshot.Overrides {
+		dto := storage.OverrideDTO{
+			UserID:  override.UserID,
+			Segment: segments[override.Segment],
+			Mode:    override.Mode,
+			Variant: override.Variant,
+		}
+
+		if override.ExpiresAt != "" {
+			expiresAt, err := evaluation.ParseTime(override.ExpiresAt)
+			if err != nil {
+				return err
+			}
+			dto.ExpiresAt = &expiresAt
+		}
+
+		st.overrides[override.UserID] = append(st.overrides[override.UserID], dto)
+	}
+
+	st.holdout = holdout.New(snapshot.Holdout.Percent, snapshot.Holdout.Salt, snapshot.Holdout.Users)
+
+	return nil
+}
+
+func usersFromSnapshot(list *client.UserSnapshotList) (map[int64]*user, error) {
+	users := make(map[int64]*user, len(list.Users))
+
+	for _, snapshot := range list.Users {
+		u := &user{
+			segments:   make([]storage.SegmentDTO, 0, len(snapshot.Segments)),
+			attributes: snapshot.Attributes,
+		}
+
+		for i := range snapshot.Segments {
+			segment, err := evaluation.SegmentToDTO(&snapshot.Segments[i])
+			if err != nil {
+				return nil, err
+			}
+			u.segments = append(u.segments, segment)
+		}
+
+		users[snapshot.UserID] = u
+	}
+
+	return users, nil
+}
+
+// activeOverrides filters out overrides that expired since the sync.
+func activeOverrides(overrides []storage.OverrideDTO, now time.Time) []storage.OverrideDTO {
+	active := make([]storage.OverrideDTO, 0, len(overrides))
+
+	for _, override := range overrides {
+		if override.ExpiresAt == nil || override.ExpiresAt.After(now) {
+			active = append(active, override)
+		}
+	}
+
+	return active
+}
+
+func mergeAttributes(stored, attributes map[string]string) map[string]string {
+	merged := maps.Clone(stored)
+	maps.Copy(merged, attributes)
+
+	return merged
+}
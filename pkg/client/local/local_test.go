@@ -0,0 +1,265 @@
+package local_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/psxzz/backend-trainee-assignment/internal/app/holdout"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/memory"
+	"github.com/psxzz/backend-trainee-assignment/internal/config"
+	"github.com/psxzz/backend-trainee-assignment/pkg/app"
+	"github.com/psxzz/backend-trainee-assignment/pkg/client"
+	"github.com/psxzz/backend-trainee-assignment/pkg/client/local"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	adminKey    = "sk_local"
+	holdoutUser = 1003
+)
+
+// requests records the status of every request by path.
+type requests struct {
+	mu       sync.Mutex
+	statuses map[string][]int
+}
+
+func (r *requests) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.statuses[req.URL.Path] = append(r.statuses[req.URL.Path], rec.status)
+	})
+}
+
+// last returns the status of the last request to the path, 0 if there were none.
+func (r *requests) last(path string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if statuses := r.statuses[path]; len(statuses) > 0 {
+		return statuses[len(statuses)-1]
+	}
+
+	return 0
+}
+
+func (r *requests) count(path string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.statuses[path])
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// newClient serves the HTTP API on the memory storage and returns a client of it.
+func newClient(t *testing.T) (*client.Client, *requests) {
+	t.Helper()
+
+	var (
+		db  = memory.New()
+		svc = service.New(db, t.TempDir(), service.WithHoldout(holdout.New(0, "salt", []int64{holdoutUser})))
+		cfg = &config.Config{AuthBootstrapKey: adminKey, IdempotencyTTL: time.Hour}
+		log = &requests{statuses: make(map[string][]int)}
+	)
+
+	e, err := app.NewServer(cfg, svc, db, app.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(log.wrap(e))
+	t.Cleanup(srv.Close)
+
+	return client.New(srv.URL, client.WithAPIKey(adminKey), client.WithRetries(0, 0)), log
+}
+
+// seed creates segments of every kind and users that are in them in different ways.
+func seed(t *testing.T, ctx context.Context, c *client.Client) {
+	t.Helper()
+
+	segments := []struct {
+		name     string
+		settings client.SegmentSettings
+	}{
+		{"AVITO_VOICE_MESSAGES", client.SegmentSettings{}},
+		{"AVITO_MOSCOW", client.SegmentSettings{Group: "city", Rule: `city == "moscow"`}},
+		{"AVITO_CAPITALS", client.SegmentSettings{Group: "city", Rule: `city in ["moscow", "spb"]`}},
+		{"AVITO_IOS", client.SegmentSettings{Rule: `platform == "ios"`}},
+		{"AVITO_IOS_ENDED", client.SegmentSettings{Rule: `platform == "ios"`, EndsAt: "2020-01-01 00:00:00"}},
+		{"AVITO_IOS_VOICE", client.SegmentSettings{Rule: `platform == "ios"`, Requires: []string{"AVITO_VOICE_MESSAGES"}}},
+	}
+	for _, segment := range segments {
+		_, err := c.CreateSegment(ctx, segment.name, segment.settings)
+		require.NoError(t, err)
+	}
+
+	for _, userID := range []int64{1000, holdoutUser} {
+		_, err := c.SetUserAttributes(ctx, userID, map[string]string{"city": "moscow", "platform": "ios"})
+		require.NoError(t, err)
+
+		_, err = c.UpdateUserSegments(ctx, userID, []*client.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES", Force: true}}, nil)
+		require.NoError(t, err)
+	}
+
+	_, err := c.SetOverride(ctx, &client.Override{UserID: 1000, Segment: "AVITO_IOS", Mode: "exclude"})
+	require.NoError(t, err)
+
+	_, err = c.SetOverride(ctx, &client.Override{
+		UserID: 1001, Segment: "AVITO_VOICE_MESSAGES", Mode: "include", Variant: "b"})
+	require.NoError(t, err)
+}
+
+func TestEvaluateMatchesAPI(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		c, _      = newClient(t)
+		evaluator = local.New(c, local.WithUsers(1000, 1001), local.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	)
+	seed(t, ctx, c)
+
+	evaluator.Track(holdoutUser)
+	require.NoError(t, evaluator.Sync(ctx))
+	assert.False(t, evaluator.SyncedAt().IsZero())
+
+	for _, userID := range []int64{1000, 1001, 1002, holdoutUser} {
+		remote, err := c.UserSegments(ctx, userID)
+		require.NoError(t, err)
+
+		got, err := evaluator.UserSegments(ctx, userID, nil)
+		require.NoError(t, err)
+		assert.Equal(t, remote, got, "user %d", userID)
+	}
+
+	t.Run("passed attributes", func(t *testing.T) {
+		got, err := evaluator.UserSegments(ctx, 1002, map[string]string{"city": "spb", "platform": "ios"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"AVITO_CAPITALS", "AVITO_IOS"}, names(got))
+
+		// they take precedence over the stored ones of tracked users
+		got, err = evaluator.UserSegments(ctx, 1000, map[string]string{"city": "spb"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"AVITO_VOICE_MESSAGES", "AVITO_CAPITALS", "AVITO_IOS_VOICE"}, names(got))
+	})
+}
+
+func TestSyncDownloadsChanges(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		c, log    = newClient(t)
+		evaluator = local.New(c, local.WithUsers(1000, 1001))
+	)
+	seed(t, ctx, c)
+
+	require.NoError(t, evaluator.Sync(ctx))
+	assert.Equal(t, http.StatusOK, log.last("/v2/snapshot"))
+	assert.Equal(t, http.StatusOK, log.last("/v2/snapshot/users"))
+
+	require.NoError(t, evaluator.Sync(ctx))
+	assert.Equal(t, http.StatusNotModified, log.last("/v2/snapshot"))
+	assert.Equal(t, http.StatusNotModified, log.last("/v2/snapshot/users"))
+
+	_, err := c.SetUserAttributes(ctx, 1001, map[string]string{"platform": "ios"})
+	require.NoError(t, err)
+
+	require.NoError(t, evaluator.Sync(ctx))
+	assert.Equal(t, http.StatusNotModified, log.last("/v2/snapshot"))
+	assert.Equal(t, http.StatusOK, log.last("/v2/snapshot/users"))
+
+	got, err := evaluator.UserSegments(ctx, 1001, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AVITO_VOICE_MESSAGES", "AVITO_IOS", "AVITO_IOS_VOICE"}, names(got))
+
+	_, err = c.DeleteOverride(ctx, 1000, "AVITO_IOS")
+	require.NoError(t, err)
+
+	require.NoError(t, evaluator.Sync(ctx))
+	assert.Equal(t, http.StatusOK, log.last("/v2/snapshot"))
+	assert.Equal(t, http.StatusNotModified, log.last("/v2/snapshot/users"))
+
+	got, err = evaluator.UserSegments(ctx, 1000, nil)
+	require.NoError(t, err)
+	assert.Contains(t, names(got), "AVITO_IOS")
+}
+
+func TestFallbackToAPI(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		c, log = newClient(t)
+	)
+	seed(t, ctx, c)
+
+	t.Run("before the first sync", func(t *testing.T) {
+		evaluator := local.New(c)
+
+		got, err := evaluator.UserSegments(ctx, 1000, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"AVITO_VOICE_MESSAGES", "AVITO_MOSCOW", "AVITO_IOS_VOICE"}, names(got))
+		assert.Equal(t, 1, log.count("/list"))
+	})
+
+	t.Run("stale snapshot", func(t *testing.T) {
+		evaluator := local.New(c, local.WithMaxAge(time.Nanosecond))
+		require.NoError(t, evaluator.Sync(ctx))
+		time.Sleep(time.Millisecond)
+
+		_, err := evaluator.UserSegments(ctx, 1000, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 2, log.count("/list"))
+	})
+
+	t.Run("fresh snapshot", func(t *testing.T) {
+		evaluator := local.New(c)
+		require.NoError(t, evaluator.Sync(ctx))
+
+		_, err := evaluator.UserSegments(ctx, 1000, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 2, log.count("/list"))
+	})
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, _ := newClient(t)
+	evaluator := local.New(c, local.WithInterval(time.Millisecond))
+
+	done := make(chan struct{})
+	go func() {
+		evaluator.Run(ctx)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool { return !evaluator.SyncedAt().IsZero() }, time.Second, time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func names(list *client.UserExperimentList) []string {
+	names := make([]string, 0, len(list.Segments))
+	for _, segment := range list.Segments {
+		names = append(names, segment.Name)
+	}
+
+	return names
+}
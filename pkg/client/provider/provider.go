@@ -0,0 +1,200 @@
+// Package provider is an OpenFeature provider of flags backed by segments. A flag is
+// a segment: boolean flags resolve to whether the user is in it, string flags to
+// the variant the user got, and object flags to the variant decoded as a JSON
+// payload. The targetingKey of the evaluation context is the user ID.
+//
+// Provider implements openfeature.FeatureProvider, so it is registered with
+// openfeature.SetProvider and evaluated through an openfeature.Client.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/open-feature/go-sdk/openfeature"
+	"github.com/psxzz/backend-trainee-assignment/pkg/client"
+)
+
+const (
+	name = "segments"
+
+	defaultSegmentTTL = time.Minute
+)
+
+type Provider struct {
+	client     *client.Client
+	segmentTTL time.Duration
+
+	// segments caches when the existence of segments was last confirmed, so
+	// users outside a segment don't cost another request to tell it from a
+	// missing flag
+	segments sync.Map
+}
+
+type Option func(*Provider)
+
+// WithSegmentTTL sets for how long an existing segment is remembered. Deleted
+// segments resolve to their defaults until then instead of FLAG_NOT_FOUND.
+func WithSegmentTTL(ttl time.Duration) Option {
+	return func(p *Provider) {
+		p.segmentTTL = ttl
+	}
+}
+
+// New returns a provider that resolves flags with c.
+func New(c *client.Client, opts ...Option) *Provider {
+	p := &Provider{
+		client:     c,
+		segmentTTL: defaultSegmentTTL,
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
+}
+
+var _ openfeature.FeatureProvider = (*Provider)(nil)
+
+func (p *Provider) Metadata() openfeature.Metadata {
+	return openfeature.Metadata{Name: name}
+}
+
+// Hooks returns no hooks, the provider needs none.
+func (p *Provider) Hooks() []openfeature.Hook {
+	return nil
+}
+
+// BooleanEvaluation resolves to whether the user is in the segment.
+func (p *Provider) BooleanEvaluation(ctx context.Context, flag string, defaultValue bool, evalCtx openfeature.FlattenedContext) openfeature.BoolResolutionDetail {
+	segment, detail := p.resolve(ctx, flag, evalCtx)
+	if detail.Error() != nil {
+		return openfeature.BoolResolutionDetail{Value: defaultValue, ProviderResolutionDetail: detail}
+	}
+
+	return openfeature.BoolResolutionDetail{Value: segment != nil, ProviderResolutionDetail: detail}
+}
+
+// StringEvaluation resolves to the variant the user got in the segment, or to
+// defaultValue if the user isn't in it or got no variant.
+func (p *Provider) StringEvaluation(ctx context.Context, flag string, defaultValue string, evalCtx openfeature.FlattenedContext) openfeature.StringResolutionDetail {
+	segment, detail := p.resolve(ctx, flag, evalCtx)
+	if detail.Error() != nil || segment == nil || segment.Variant == "" {
+		return openfeature.StringResolutionDetail{Value: defaultValue, ProviderResolutionDetail: withDefaultReason(detail)}
+	}
+
+	return openfeature.StringResolutionDetail{Value: segment.Variant, ProviderResolutionDetail: detail}
+}
+
+// ObjectEvaluation resolves to the variant the user got in the segment decoded as
+// JSON, or to defaultValue if the user isn't in it or got no variant.
+func (p *Provider) ObjectEvaluation(ctx context.Context, flag string, defaultValue any, evalCtx openfeature.FlattenedContext) openfeature.InterfaceResolutionDetail {
+	segment, detail := p.resolve(ctx, flag, evalCtx)
+	if detail.Error() != nil || segment == nil || segment.Variant == "" {
+		return openfeature.InterfaceResolutionDetail{Value: defaultValue, ProviderResolutionDetail: withDefaultReason(detail)}
+	}
+
+	var value any
+	if err := json.Unmarshal([]byte(segment.Variant), &value); err != nil {
+		msg := fmt.Sprintf("variant %q of %s isn't JSON: %v", segment.Variant, flag, err)
+		return openfeature.InterfaceResolutionDetail{
+			Value:                    defaultValue,
+			ProviderResolutionDetail: failed(openfeature.NewParseErrorResolutionError(msg)),
+		}
+	}
+
+	return openfeature.InterfaceResolutionDetail{Value: value, ProviderResolutionDetail: detail}
+}
+
+// FloatEvaluation fails with TYPE_MISMATCH, since segments have no numeric values.
+func (p *Provider) FloatEvaluation(_ context.Context, flag string, defaultValue float64, _ openfeature.FlattenedContext) openfeature.FloatResolutionDetail {
+	return openfeature.FloatResolutionDetail{
+		Value:                    defaultValue,
+		ProviderResolutionDetail: failed(openfeature.NewTypeMismatchResolutionError(flag + " isn't a number")),
+	}
+}
+
+// IntEvaluation fails with TYPE_MISMATCH, since segments have no numeric values.
+func (p *Provider) IntEvaluation(_ context.Context, flag string, defaultValue int64, _ openfeature.FlattenedContext) openfeature.IntResolutionDetail {
+	return openfeature.IntResolutionDetail{
+		Value:                    defaultValue,
+		ProviderResolutionDetail: failed(openfeature.NewTypeMismatchResolutionError(flag + " isn't a number")),
+	}
+}
+
+// resolve returns the segment of the flag if the user of evalCtx is in it, nil if
+// they aren't, and the details of the resolution.
+func (p *Provider) resolve(ctx context.Context, flag string, evalCtx openfeature.FlattenedContext) (*client.Segment, openfeature.ProviderResolutionDetail) {
+	key, _ := evalCtx[openfeature.TargetingKey].(string)
+	if key == "" {
+		return nil, failed(openfeature.NewTargetingKeyMissingResolutionError("the user id is required as " + openfeature.TargetingKey))
+	}
+
+	userID, err := strconv.ParseInt(key, 10, 64)
+	if err != nil || userID <= 0 {
+		msg := fmt.Sprintf("%s %q isn't a user id", openfeature.TargetingKey, key)
+		return nil, failed(openfeature.NewInvalidContextResolutionError(msg))
+	}
+
+	list, err := p.client.UserSegments(ctx, userID)
+	if err != nil {
+		return nil, failed(openfeature.NewGeneralResolutionError(err.Error()))
+	}
+
+	for i := range list.Segments {
+		if segment := &list.Segments[i]; segment.Name == flag {
+			return segment, openfeature.ProviderResolutionDetail{
+				Reason:       openfeature.TargetingMatchReason,
+				Variant:      segment.Variant,
+				FlagMetadata: openfeature.FlagMetadata{"version": segment.Version},
+			}
+		}
+	}
+
+	if err := p.checkSegment(ctx, flag); err != nil {
+		if errors.Is(err, client.ErrSegmentNotFound) {
+			return nil, failed(openfeature.NewFlagNotFoundResolutionError("segment " + flag + " not found"))
+		}
+		return nil, failed(openfeature.NewGeneralResolutionError(err.Error()))
+	}
+
+	return nil, openfeature.ProviderResolutionDetail{Reason: openfeature.DefaultReason}
+}
+
+// checkSegment fails with client.ErrSegmentNotFound if there is no such segment.
+func (p *Provider) checkSegment(ctx context.Context, flag string) error {
+	if checkedAt, ok := p.segments.Load(flag); ok && time.Since(checkedAt.(time.Time)) < p.segmentTTL {
+		return nil
+	}
+
+	if _, err := p.client.SegmentInfo(ctx, flag); err != nil {
+		p.segments.Delete(flag)
+		return err
+	}
+	p.segments.Store(flag, time.Now())
+
+	return nil
+}
+
+// withDefaultReason turns the details of a match into the ones of a flag resolved
+// to the default value, keeping errors.
+func withDefaultReason(detail openfeature.ProviderResolutionDetail) openfeature.ProviderResolutionDetail {
+	if detail.Error() != nil {
+		return detail
+	}
+
+	return openfeature.ProviderResolutionDetail{Reason: openfeature.DefaultReason}
+}
+
+func failed(err openfeature.ResolutionError) openfeature.ProviderResolutionDetail {
+	return openfeature.ProviderResolutionDetail{
+		ResolutionError: err,
+		Reason:          openfeature.ErrorReason,
+	}
+}
@@ -0,0 +1,220 @@
+package provider_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/open-feature/go-sdk/openfeature"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/service"
+	"github.com/psxzz/backend-trainee-assignment/internal/app/storage/memory"
+	"github.com/psxzz/backend-trainee-assignment/internal/config"
+	"github.com/psxzz/backend-trainee-assignment/pkg/app"
+	"github.com/psxzz/backend-trainee-assignment/pkg/client"
+	"github.com/psxzz/backend-trainee-assignment/pkg/client/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const adminKey = "sk_provider"
+
+// newProvider serves the HTTP API on the memory storage with segments and users
+// in them, and returns a provider of it.
+func newProvider(t *testing.T) *provider.Provider {
+	t.Helper()
+
+	var (
+		ctx = context.Background()
+		db  = memory.New()
+		cfg = &config.Config{AuthBootstrapKey: adminKey, IdempotencyTTL: time.Hour}
+	)
+
+	e, err := app.NewServer(cfg, service.New(db, t.TempDir()), db,
+		app.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	c := client.New(srv.URL, client.WithAPIKey(adminKey), client.WithRetries(0, 0))
+
+	for _, name := range []string{"AVITO_VOICE_MESSAGES", "AVITO_CHECKOUT", "AVITO_DISCOUNT"} {
+		_, err := c.CreateSegment(ctx, name, client.SegmentSettings{})
+		require.NoError(t, err)
+	}
+
+	_, err = c.UpdateUserSegments(ctx, 1000, []*client.UserExperimentItem{{Name: "AVITO_VOICE_MESSAGES"}}, nil)
+	require.NoError(t, err)
+
+	overrides := []*client.Override{
+		{UserID: 1000, Segment: "AVITO_CHECKOUT", Mode: "include", Variant: "one_page"},
+		{UserID: 1000, Segment: "AVITO_DISCOUNT", Mode: "include", Variant: `{"percent": 30}`},
+	}
+	for _, override := range overrides {
+		_, err := c.SetOverride(ctx, override)
+		require.NoError(t, err)
+	}
+
+	return provider.New(c)
+}
+
+func user(id string) openfeature.FlattenedContext {
+	return openfeature.FlattenedContext{openfeature.TargetingKey: id}
+}
+
+func errorCode(detail openfeature.ProviderResolutionDetail) openfeature.ErrorCode {
+	return detail.ResolutionDetail().ErrorCode
+}
+
+func TestBooleanEvaluation(t *testing.T) {
+	var (
+		ctx = context.Background()
+		p   = newProvider(t)
+	)
+
+	assert.Equal(t, "segments", p.Metadata().Name)
+
+	detail := p.BooleanEvaluation(ctx, "AVITO_VOICE_MESSAGES", false, user("1000"))
+	assert.NoError(t, detail.Error())
+	assert.True(t, detail.Value)
+	assert.Equal(t, openfeature.TargetingMatchReason, detail.Reason)
+
+	detail = p.BooleanEvaluation(ctx, "AVITO_VOICE_MESSAGES", true, user("1001"))
+	assert.NoError(t, detail.Error())
+	assert.False(t, detail.Value)
+	assert.Equal(t, openfeature.DefaultReason, detail.Reason)
+
+	tests := []struct {
+		name    string
+		flag    string
+		evalCtx openfeature.FlattenedContext
+		code    openfeature.ErrorCode
+	}{
+		{"unknown flag", "AVITO_MISSING", user("1000"), openfeature.FlagNotFoundCode},
+		{"no targeting key", "AVITO_VOICE_MESSAGES", openfeature.FlattenedContext{}, openfeature.TargetingKeyMissingCode},
+		{"invalid targeting key", "AVITO_VOICE_MESSAGES", user("anonymous"), openfeature.InvalidContextCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detail := p.BooleanEvaluation(ctx, tt.flag, true, tt.evalCtx)
+			assert.True(t, detail.Value)
+			assert.Equal(t, openfeature.ErrorReason, detail.Reason)
+			assert.Equal(t, tt.code, errorCode(detail.ProviderResolutionDetail))
+			assert.Error(t, detail.Error())
+		})
+	}
+}
+
+func TestStringEvaluation(t *testing.T) {
+	var (
+		ctx = context.Background()
+		p   = newProvider(t)
+	)
+
+	detail := p.StringEvaluation(ctx, "AVITO_CHECKOUT", "classic", user("1000"))
+	assert.NoError(t, detail.Error())
+	assert.Equal(t, "one_page", detail.Value)
+	assert.Equal(t, "one_page", detail.Variant)
+	assert.Equal(t, openfeature.TargetingMatchReason, detail.Reason)
+
+	// members without a variant get the default too
+	for _, tt := range []struct{ flag, userID string }{{"AVITO_CHECKOUT", "1001"}, {"AVITO_VOICE_MESSAGES", "1000"}} {
+		detail = p.StringEvaluation(ctx, tt.flag, "classic", user(tt.userID))
+		assert.NoError(t, detail.Error())
+		assert.Equal(t, "classic", detail.Value)
+		assert.Equal(t, openfeature.DefaultReason, detail.Reason)
+	}
+
+	detail = p.StringEvaluation(ctx, "AVITO_MISSING", "classic", user("1000"))
+	assert.Equal(t, "classic", detail.Value)
+	assert.Equal(t, openfeature.FlagNotFoundCode, errorCode(detail.ProviderResolutionDetail))
+}
+
+func TestObjectEvaluation(t *testing.T) {
+	var (
+		ctx = context.Background()
+		p   = newProvider(t)
+	)
+
+	detail := p.ObjectEvaluation(ctx, "AVITO_DISCOUNT", nil, user("1000"))
+	assert.NoError(t, detail.Error())
+	assert.Equal(t, map[string]any{"percent": float64(30)}, detail.Value)
+	assert.Equal(t, openfeature.TargetingMatchReason, detail.Reason)
+
+	detail = p.ObjectEvaluation(ctx, "AVITO_DISCOUNT", "none", user("1001"))
+	assert.NoError(t, detail.Error())
+	assert.Equal(t, "none", detail.Value)
+	assert.Equal(t, openfeature.DefaultReason, detail.Reason)
+
+	detail = p.ObjectEvaluation(ctx, "AVITO_CHECKOUT", "none", user("1000"))
+	assert.Equal(t, "none", detail.Value)
+	assert.Equal(t, openfeature.ErrorReason, detail.Reason)
+	assert.Equal(t, openfeature.ParseErrorCode, errorCode(detail.ProviderResolutionDetail))
+}
+
+func TestNumericEvaluation(t *testing.T) {
+	var (
+		ctx = context.Background()
+		p   = newProvider(t)
+	)
+
+	float := p.FloatEvaluation(ctx, "AVITO_DISCOUNT", 0.5, user("1000"))
+	assert.Equal(t, 0.5, float.Value)
+	assert.Equal(t, openfeature.TypeMismatchCode, errorCode(float.ProviderResolutionDetail))
+
+	integer := p.IntEvaluation(ctx, "AVITO_DISCOUNT", 5, user("1000"))
+	assert.Equal(t, int64(5), integer.Value)
+	assert.Equal(t, openfeature.TypeMismatchCode, errorCode(integer.ProviderResolutionDetail))
+}
+
+func TestUnavailableService(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	srv.Close()
+
+	p := provider.New(client.New(srv.URL, client.WithRetries(0, 0)))
+
+	detail := p.BooleanEvaluation(context.Background(), "AVITO_VOICE_MESSAGES", true, user("1000"))
+	assert.True(t, detail.Value)
+	assert.Equal(t, openfeature.ErrorReason, detail.Reason)
+	assert.Equal(t, openfeature.GeneralCode, errorCode(detail.ProviderResolutionDetail))
+}
+
+func TestOpenFeatureClient(t *testing.T) {
+	ctx := context.Background()
+
+	require.NoError(t, openfeature.SetProviderAndWait(newProvider(t)))
+	t.Cleanup(openfeature.Shutdown)
+
+	var (
+		c      = openfeature.NewClient("segments-test")
+		member = openfeature.NewEvaluationContext("1000", nil)
+	)
+
+	details, err := c.BooleanValueDetails(ctx, "AVITO_VOICE_MESSAGES", false, member)
+	assert.NoError(t, err)
+	assert.True(t, details.Value)
+	assert.Equal(t, openfeature.TargetingMatchReason, details.Reason)
+
+	enabled, err := c.BooleanValue(ctx, "AVITO_VOICE_MESSAGES", true, openfeature.NewEvaluationContext("1001", nil))
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+
+	checkout, err := c.StringValue(ctx, "AVITO_CHECKOUT", "classic", member)
+	assert.NoError(t, err)
+	assert.Equal(t, "one_page", checkout)
+
+	discount, err := c.ObjectValue(ctx, "AVITO_DISCOUNT", nil, member)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"percent": float64(30)}, discount)
+
+	missing, err := c.BooleanValueDetails(ctx, "AVITO_MISSING", true, member)
+	assert.Error(t, err)
+	assert.True(t, missing.Value)
+	assert.Equal(t, openfeature.FlagNotFoundCode, missing.ErrorCode)
+
+	_, err = c.BooleanValue(ctx, "AVITO_VOICE_MESSAGES", false, openfeature.NewTargetlessEvaluationContext(nil))
+	assert.Error(t, err)
+}
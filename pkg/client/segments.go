@@ -0,0 +1,335 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// AnyVersion makes a versioned change skip the version check, like If-Match: *.
+const AnyVersion int64 = -1
+
+// UserSegmentsUpdate is the result of adding a user to and removing them from
+// segments. Version is set by the versioned methods only.
+type UserSegmentsUpdate struct {
+	UserID   int64                 `json:"user_id"`
+	Added    []*UserExperiment     `json:"added"`
+	Removed  []*UserExperiment     `json:"removed"`
+	Rejected []*RejectedExperiment `json:"rejected"`
+	Version  int64                 `json:"version,omitempty"`
+}
+
+type segmentRequest struct {
+	Name string `json:"name"`
+}
+
+type createSegmentRequest struct {
+	Name string `json:"name"`
+	SegmentSettings
+}
+
+type userRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+type userSegmentsRequest struct {
+	UserID   int64                 `json:"user_id,omitempty"`
+	ToAdd    []*UserExperimentItem `json:"to_add"`
+	ToRemove []string              `json:"to_remove"`
+}
+
+func (c *Client) CreateSegment(ctx context.Context, name string, settings SegmentSettings) (*Segment, error) {
+	return call[Segment](ctx, c, request{
+		method: http.MethodPost, path: "/create", write: true, idempotent: true,
+		body: createSegmentRequest{Name: name, SegmentSettings: settings},
+	})
+}
+
+func (c *Client) DeleteSegment(ctx context.Context, name string) (*Segment, error) {
+	return call[Segment](ctx, c, request{
+		method: http.MethodPost, path: "/delete", write: true, idempotent: true,
+		body: segmentRequest{Name: name},
+	})
+}
+
+// SegmentInfo returns the settings of the segment and the number of its members.
+func (c *Client) SegmentInfo(ctx context.Context, name string) (*Segment, error) {
+	return call[Segment](ctx, c, request{
+		method: http.MethodPost, path: "/segment/info",
+		body: segmentRequest{Name: name},
+	})
+}
+
+// UpdateUserSegments adds the user to and removes them from segments. Additions
+// the service refuses are returned in Rejected.
+func (c *Client) UpdateUserSegments(ctx context.Context, userID int64, add []*UserExperimentItem, remove []string) (*UserSegmentsUpdate, error) {
+	return call[UserSegmentsUpdate](ctx, c, request{
+		method: http.MethodPost, path: "/experiments", write: true, idempotent: true,
+		body: userSegmentsRequest{UserID: userID, ToAdd: nonNil(add), ToRemove: nonNil(remove)},
+	})
+}
+
+func (c *Client) UserSegments(ctx context.Context, userID int64) (*UserExperimentList, error) {
+	return call[UserExperimentList](ctx, c, request{
+		method: http.MethodPost, path: "/list",
+		body: userRequest{UserID: userID},
+	})
+}
+
+// UsersSegments returns segments of up to 5000 users by user id.
+func (c *Client) UsersSegments(ctx context.Context, userIDs []int64) (map[int64][]Segment, error) {
+	var resp struct {
+		Users map[int64][]Segment `json:"users"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost, path: "/list/batch",
+		body: struct {
+			UserIDs []int64 `json:"user_ids"`
+		}{userIDs},
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Users, nil
+}
+
+func (c *Client) Holdout(ctx context.Context, userID int64) (*HoldoutStatus, error) {
+	return call[HoldoutStatus](ctx, c, request{
+		method: http.MethodPost, path: "/holdout",
+		body: userRequest{UserID: userID},
+	})
+}
+
+// CreateReport writes the membership history of the user since the month from,
+// formatted as "2006-01", and returns where to download it.
+func (c *Client) CreateReport(ctx context.Context, userID int64, from string) (*LogInfo, error) {
+	return call[LogInfo](ctx, c, request{
+		method: http.MethodPost, path: "/log/create", write: true, idempotent: true,
+		body: struct {
+			UserID int64  `json:"user_id"`
+			From   string `json:"from"`
+		}{userID, from},
+	})
+}
+
+func (c *Client) SetUserAttributes(ctx context.Context, userID int64, attributes map[string]string) (*UserAttributes, error) {
+	return call[UserAttributes](ctx, c, request{
+		method: http.MethodPost, path: "/attributes/set", write: true, idempotent: true,
+		body: UserAttributes{UserID: userID, Attributes: nonNilMap(attributes)},
+	})
+}
+
+func (c *Client) UserAttributes(ctx context.Context, userID int64) (*UserAttributes, error) {
+	return call[UserAttributes](ctx, c, request{
+		method: http.MethodPost, path: "/attributes/get",
+		body: userRequest{UserID: userID},
+	})
+}
+
+// SetOverride includes the user in or excludes them from a segment regardless of
+// its rules. The audit log records the subject of the client's credentials as the
+// actor; Actor of override is ignored.
+func (c *Client) SetOverride(ctx context.Context, override *Override) (*Override, error) {
+	return call[Override](ctx, c, request{
+		method: http.MethodPost, path: "/overrides/set", write: true, idempotent: true,
+		body: override,
+	})
+}
+
+func (c *Client) DeleteOverride(ctx context.Context, userID int64, segment string) (*Override, error) {
+	return call[Override](ctx, c, request{
+		method: http.MethodPost, path: "/overrides/delete", write: true, idempotent: true,
+		body: struct {
+			UserID  int64  `json:"user_id"`
+			Segment string `json:"segment"`
+		}{userID, segment},
+	})
+}
+
+func (c *Client) UserOverrides(ctx context.Context, userID int64) (*UserOverrideList, error) {
+	return call[UserOverrideList](ctx, c, request{
+		method: http.MethodPost, path: "/overrides/list",
+		body: userRequest{UserID: userID},
+	})
+}
+
+// CreateAPIKey issues a key with the role. The key is returned only here, so the
+// call isn't retried once it may have reached the server.
+func (c *Client) CreateAPIKey(ctx context.Context, name, role string) (*APIKey, error) {
+	return call[APIKey](ctx, c, request{
+		method: http.MethodPost, path: "/keys/create", write: true,
+		body: struct {
+			Name string `json:"name"`
+			Role string `json:"role"`
+		}{name, role},
+	})
+}
+
+func (c *Client) RevokeAPIKey(ctx context.Context, id int64) (*APIKey, error) {
+	return call[APIKey](ctx, c, request{
+		method: http.MethodPost, path: "/keys/revoke", write: true, idempotent: true,
+		body: idRequest{ID: id},
+	})
+}
+
+func (c *Client) APIKeys(ctx context.Context) (*APIKeyList, error) {
+	return call[APIKeyList](ctx, c, request{method: http.MethodPost, path: "/keys/list"})
+}
+
+func (c *Client) Namespaces(ctx context.Context) (*NamespaceList, error) {
+	return call[NamespaceList](ctx, c, request{method: http.MethodPost, path: "/namespaces/list"})
+}
+
+// CreateWebhook subscribes the URL to events of the segments, or of all segments if
+// none are given. The signing secret is returned only here, so the call isn't
+// retried once it may have reached the server.
+func (c *Client) CreateWebhook(ctx context.Context, webhookURL string, segments, events []string) (*Webhook, error) {
+	return call[Webhook](ctx, c, request{
+		method: http.MethodPost, path: "/webhooks/create", write: true,
+		body: struct {
+			URL      string   `json:"url"`
+			Segments []string `json:"segments"`
+			Events   []string `json:"events"`
+		}{webhookURL, segments, events},
+	})
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, id int64) (*Webhook, error) {
+	return call[Webhook](ctx, c, request{
+		method: http.MethodPost, path: "/webhooks/delete", write: true, idempotent: true,
+		body: idRequest{ID: id},
+	})
+}
+
+func (c *Client) Webhooks(ctx context.Context) (*WebhookList, error) {
+	return call[WebhookList](ctx, c, request{method: http.MethodPost, path: "/webhooks/list"})
+}
+
+// WebhookDeliveries lists up to limit deliveries with the status, the dead ones if
+// it's empty.
+func (c *Client) WebhookDeliveries(ctx context.Context, status string, limit int) (*WebhookDeliveryList, error) {
+	return call[WebhookDeliveryList](ctx, c, request{
+		method: http.MethodPost, path: "/webhooks/deliveries",
+		body: struct {
+			Status string `json:"status,omitempty"`
+			Limit  int    `json:"limit,omitempty"`
+		}{status, limit},
+	})
+}
+
+func (c *Client) ReplayWebhookDelivery(ctx context.Context, id int64) (*WebhookDelivery, error) {
+	return call[WebhookDelivery](ctx, c, request{
+		method: http.MethodPost, path: "/webhooks/replay", write: true, idempotent: true,
+		body: idRequest{ID: id},
+	})
+}
+
+// Segment returns the segment with its version.
+func (c *Client) Segment(ctx context.Context, name string) (*Segment, error) {
+	return call[Segment](ctx, c, request{method: http.MethodGet, path: segmentPath(name)})
+}
+
+// UpdateSegment replaces the segment settings if the segment still has the version,
+// and fails with ErrVersionMismatch otherwise.
+func (c *Client) UpdateSegment(ctx context.Context, name string, settings SegmentSettings, version int64) (*Segment, error) {
+	return call[Segment](ctx, c, request{
+		method: http.MethodPut, path: segmentPath(name), write: true, idempotent: true,
+		header: ifMatch(version), body: settings,
+	})
+}
+
+// DeleteSegmentWithVersion deletes the segment if it still has the version, and
+// fails with ErrVersionMismatch otherwise.
+func (c *Client) DeleteSegmentWithVersion(ctx context.Context, name string, version int64) (*Segment, error) {
+	return call[Segment](ctx, c, request{
+		method: http.MethodDelete, path: segmentPath(name), write: true, idempotent: true,
+		header: ifMatch(version),
+	})
+}
+
+// UserSegmentsWithVersion returns the user's segments with the version of their
+// memberships.
+func (c *Client) UserSegmentsWithVersion(ctx context.Context, userID int64) (*UserExperimentList, error) {
+	return call[UserExperimentList](ctx, c, request{method: http.MethodGet, path: userSegmentsPath(userID)})
+}
+
+// UpdateUserSegmentsWithVersion is UpdateUserSegments that fails with
+// ErrVersionMismatch unless the user's memberships still have the version.
+func (c *Client) UpdateUserSegmentsWithVersion(ctx context.Context, userID, version int64, add []*UserExperimentItem, remove []string) (*UserSegmentsUpdate, error) {
+	return call[UserSegmentsUpdate](ctx, c, request{
+		method: http.MethodPatch, path: userSegmentsPath(userID), write: true, idempotent: true,
+		header: ifMatch(version),
+		body:   userSegmentsRequest{ToAdd: nonNil(add), ToRemove: nonNil(remove)},
+	})
+}
+
+// Snapshot returns what is needed to evaluate segments locally, see package local,
+// with its ETag. If etag is the ETag of the current snapshot, Snapshot fails with
+// ErrNotModified instead.
+func (c *Client) Snapshot(ctx context.Context, etag string) (*Snapshot, string, error) {
+	snapshot, err := call[Snapshot](ctx, c, request{method: http.MethodGet, path: "/v2/snapshot", etag: &etag})
+	return snapshot, etag, err
+}
+
+// UsersSnapshot returns stored memberships and attributes of up to 5000 users with
+// their ETag. If etag is the ETag of the current data, UsersSnapshot fails with
+// ErrNotModified instead.
+func (c *Client) UsersSnapshot(ctx context.Context, userIDs []int64, etag string) (*UserSnapshotList, string, error) {
+	list, err := call[UserSnapshotList](ctx, c, request{
+		method: http.MethodPost, path: "/v2/snapshot/users", etag: &etag,
+		body: struct {
+			UserIDs []int64 `json:"user_ids"`
+		}{userIDs},
+	})
+	return list, etag, err
+}
+
+// call does the request and decodes the response into a new T.
+func call[T any](ctx context.Context, c *Client, r request) (*T, error) {
+	var out T
+	if err := c.do(ctx, r, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+type idRequest struct {
+	ID int64 `json:"id"`
+}
+
+func segmentPath(name string) string {
+	return "/v2/segments/" + url.PathEscape(name)
+}
+
+func userSegmentsPath(userID int64) string {
+	return "/v2/users/" + strconv.FormatInt(userID, 10) + "/segments"
+}
+
+func ifMatch(version int64) http.Header {
+	value := "*"
+	if version != AnyVersion {
+		value = `"` + strconv.FormatInt(version, 10) + `"`
+	}
+
+	return http.Header{"If-Match": {value}}
+}
+
+// nonNil returns an empty slice for nil, since the API requires the lists.
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+
+	return s
+}
+
+func nonNilMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+
+	return m
+}
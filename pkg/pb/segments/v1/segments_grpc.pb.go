@@ -0,0 +1,373 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.1
+// source: segments/v1/segments.proto
+
+package segmentsv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	SegmentService_CreateSegment_FullMethodName        = "/segments.v1.SegmentService/CreateSegment"
+	SegmentService_DeleteSegment_FullMethodName        = "/segments.v1.SegmentService/DeleteSegment"
+	SegmentService_GetSegment_FullMethodName           = "/segments.v1.SegmentService/GetSegment"
+	SegmentService_UpdateUserSegments_FullMethodName   = "/segments.v1.SegmentService/UpdateUserSegments"
+	SegmentService_GetUserSegments_FullMethodName      = "/segments.v1.SegmentService/GetUserSegments"
+	SegmentService_BatchGetUserSegments_FullMethodName = "/segments.v1.SegmentService/BatchGetUserSegments"
+	SegmentService_CreateReport_FullMethodName         = "/segments.v1.SegmentService/CreateReport"
+)
+
+// SegmentServiceClient is the client API for SegmentService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SegmentServiceClient interface {
+	// CreateSegment requires the admin role.
+	CreateSegment(ctx context.Context, in *CreateSegmentRequest, opts ...grpc.CallOption) (*Segment, error)
+	// DeleteSegment requires the admin role.
+	DeleteSegment(ctx context.Context, in *DeleteSegmentRequest, opts ...grpc.CallOption) (*Segment, error)
+	GetSegment(ctx context.Context, in *GetSegmentRequest, opts ...grpc.CallOption) (*Segment, error)
+	// UpdateUserSegments adds and removes memberships of a user and requires the
+	// analyst role.
+	UpdateUserSegments(ctx context.Context, in *UpdateUserSegmentsRequest, opts ...grpc.CallOption) (*UpdateUserSegmentsResponse, error)
+	GetUserSegments(ctx context.Context, in *GetUserSegmentsRequest, opts ...grpc.CallOption) (*UserSegments, error)
+	// BatchGetUserSegments streams segments of every requested user.
+	BatchGetUserSegments(ctx context.Context, in *BatchGetUserSegmentsRequest, opts ...grpc.CallOption) (SegmentService_BatchGetUserSegmentsClient, error)
+	// CreateReport writes the membership history of a user and requires the analyst
+	// role.
+	CreateReport(ctx context.Context, in *CreateReportRequest, opts ...grpc.CallOption) (*Report, error)
+}
+
+type segmentServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSegmentServiceClient(cc grpc.ClientConnInterface) SegmentServiceClient {
+	return &segmentServiceClient{cc}
+}
+
+func (c *segmentServiceClient) CreateSegment(ctx context.Context, in *CreateSegmentRequest, opts ...grpc.CallOption) (*Segment, error) {
+	out := new(Segment)
+	err := c.cc.Invoke(ctx, SegmentService_CreateSegment_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) DeleteSegment(ctx context.Context, in *DeleteSegmentRequest, opts ...grpc.CallOption) (*Segment, error) {
+	out := new(Segment)
+	err := c.cc.Invoke(ctx, SegmentService_DeleteSegment_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) GetSegment(ctx context.Context, in *GetSegmentRequest, opts ...grpc.CallOption) (*Segment, error) {
+	out := new(Segment)
+	err := c.cc.Invoke(ctx, SegmentService_GetSegment_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) UpdateUserSegments(ctx context.Context, in *UpdateUserSegmentsRequest, opts ...grpc.CallOption) (*UpdateUserSegmentsResponse, error) {
+	out := new(UpdateUserSegmentsResponse)
+	err := c.cc.Invoke(ctx, SegmentService_UpdateUserSegments_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) GetUserSegments(ctx context.Context, in *GetUserSegmentsRequest, opts ...grpc.CallOption) (*UserSegments, error) {
+	out := new(UserSegments)
+	err := c.cc.Invoke(ctx, SegmentService_GetUserSegments_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) BatchGetUserSegments(ctx context.Context, in *BatchGetUserSegmentsRequest, opts ...grpc.CallOption) (SegmentService_BatchGetUserSegmentsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &SegmentService_ServiceDesc.Streams[0], SegmentService_BatchGetUserSegments_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &segmentServiceBatchGetUserSegmentsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type SegmentService_BatchGetUserSegmentsClient interface {
+	Recv() (*UserSegments, error)
+	grpc.ClientStream
+}
+
+type segmentServiceBatchGetUserSegmentsClient struct {
+	grpc.ClientStream
+}
+
+func (x *segmentServiceBatchGetUserSegmentsClient) Recv() (*UserSegments, error) {
+	m := new(UserSegments)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *segmentServiceClient) CreateReport(ctx context.Context, in *CreateReportRequest, opts ...grpc.CallOption) (*Report, error) {
+	out := new(Report)
+	err := c.cc.Invoke(ctx, SegmentService_CreateReport_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SegmentServiceServer is the server API for SegmentService service.
+// All implementations must embed UnimplementedSegmentServiceServer
+// for forward compatibility
+type SegmentServiceServer interface {
+	// CreateSegment requires the admin role.
+	CreateSegment(context.Context, *CreateSegmentRequest) (*Segment, error)
+	// DeleteSegment requires the admin role.
+	DeleteSegment(context.Context, *DeleteSegmentRequest) (*Segment, error)
+	GetSegment(context.Context, *GetSegmentRequest) (*Segment, error)
+	// UpdateUserSegments adds and removes memberships of a user and requires the
+	// analyst role.
+	UpdateUserSegments(context.Context, *UpdateUserSegmentsRequest) (*UpdateUserSegmentsResponse, error)
+	GetUserSegments(context.Context, *GetUserSegmentsRequest) (*UserSegments, error)
+	// BatchGetUserSegments streams segments of every requested user.
+	BatchGetUserSegments(*BatchGetUserSegmentsRequest, SegmentService_BatchGetUserSegmentsServer) error
+	// CreateReport writes the membership history of a user and requires the analyst
+	// role.
+	CreateReport(context.Context, *CreateReportRequest) (*Report, error)
+	mustEmbedUnimplementedSegmentServiceServer()
+}
+
+// UnimplementedSegmentServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedSegmentServiceServer struct {
+}
+
+func (UnimplementedSegmentServiceServer) CreateSegment(context.Context, *CreateSegmentRequest) (*Segment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateSegment not implemented")
+}
+func (UnimplementedSegmentServiceServer) DeleteSegment(context.Context, *DeleteSegmentRequest) (*Segment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteSegment not implemented")
+}
+func (UnimplementedSegmentServiceServer) GetSegment(context.Context, *GetSegmentRequest) (*Segment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSegment not implemented")
+}
+func (UnimplementedSegmentServiceServer) UpdateUserSegments(context.Context, *UpdateUserSegmentsRequest) (*UpdateUserSegmentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateUserSegments not implemented")
+}
+func (UnimplementedSegmentServiceServer) GetUserSegments(context.Context, *GetUserSegmentsRequest) (*UserSegments, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserSegments not implemented")
+}
+func (UnimplementedSegmentServiceServer) BatchGetUserSegments(*BatchGetUserSegmentsRequest, SegmentService_BatchGetUserSegmentsServer) error {
+	return status.Errorf(codes.Unimplemented, "method BatchGetUserSegments not implemented")
+}
+func (UnimplementedSegmentServiceServer) CreateReport(context.Context, *CreateReportRequest) (*Report, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateReport not implemented")
+}
+func (UnimplementedSegmentServiceServer) mustEmbedUnimplementedSegmentServiceServer() {}
+
+// UnsafeSegmentServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SegmentServiceServer will
+// result in compilation errors.
+type UnsafeSegmentServiceServer interface {
+	mustEmbedUnimplementedSegmentServiceServer()
+}
+
+func RegisterSegmentServiceServer(s grpc.ServiceRegistrar, srv SegmentServiceServer) {
+	s.RegisterService(&SegmentService_ServiceDesc, srv)
+}
+
+func _SegmentService_CreateSegment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateSegmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).CreateSegment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_CreateSegment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).CreateSegment(ctx, req.(*CreateSegmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_DeleteSegment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteSegmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).DeleteSegment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_DeleteSegment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).DeleteSegment(ctx, req.(*DeleteSegmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_GetSegment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSegmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).GetSegment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_GetSegment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).GetSegment(ctx, req.(*GetSegmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_UpdateUserSegments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateUserSegmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).UpdateUserSegments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_UpdateUserSegments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).UpdateUserSegments(ctx, req.(*UpdateUserSegmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_GetUserSegments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserSegmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).GetUserSegments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_GetUserSegments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).GetUserSegments(ctx, req.(*GetUserSegmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_BatchGetUserSegments_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BatchGetUserSegmentsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SegmentServiceServer).BatchGetUserSegments(m, &segmentServiceBatchGetUserSegmentsServer{stream})
+}
+
+type SegmentService_BatchGetUserSegmentsServer interface {
+	Send(*UserSegments) error
+	grpc.ServerStream
+}
+
+type segmentServiceBatchGetUserSegmentsServer struct {
+	grpc.ServerStream
+}
+
+func (x *segmentServiceBatchGetUserSegmentsServer) Send(m *UserSegments) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _SegmentService_CreateReport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateReportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).CreateReport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_CreateReport_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).CreateReport(ctx, req.(*CreateReportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// SegmentService_ServiceDesc is the grpc.ServiceDesc for SegmentService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SegmentService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "segments.v1.SegmentService",
+	HandlerType: (*SegmentServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateSegment",
+			Handler:    _SegmentService_CreateSegment_Handler,
+		},
+		{
+			MethodName: "DeleteSegment",
+			Handler:    _SegmentService_DeleteSegment_Handler,
+		},
+		{
+			MethodName: "GetSegment",
+			Handler:    _SegmentService_GetSegment_Handler,
+		},
+		{
+			MethodName: "UpdateUserSegments",
+			Handler:    _SegmentService_UpdateUserSegments_Handler,
+		},
+		{
+			MethodName: "GetUserSegments",
+			Handler:    _SegmentService_GetUserSegments_Handler,
+		},
+		{
+			MethodName: "CreateReport",
+			Handler:    _SegmentService_CreateReport_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "BatchGetUserSegments",
+			Handler:       _SegmentService_BatchGetUserSegments_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "segments/v1/segments.proto",
+}